@@ -55,6 +55,7 @@ type InstanceOptions struct {
 	PublicName         string
 	Settings           string
 	SwiftLayout        int
+	ContentAddressed   bool
 	DiskQuota          int64
 	Apps               []string
 	Passphrase         string
@@ -150,6 +151,9 @@ func (c *Client) CreateInstance(opts *InstanceOptions) (*Instance, error) {
 	if opts.DomainAliases != nil {
 		q.Add("DomainAliases", strings.Join(opts.DomainAliases, ","))
 	}
+	if opts.ContentAddressed {
+		q.Add("ContentAddressed", "true")
+	}
 	res, err := c.Req(&request.Options{
 		Method:  "POST",
 		Path:    "/instances",
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/cozy/cozy-stack/client/request"
@@ -13,6 +14,17 @@ type jobOptions struct {
 	MaxExecCount int            `json:"max_exec_count,omitempty"`
 	MaxExecTime  *time.Duration `json:"max_exec_time,omitempty"`
 	Timeout      *time.Duration `json:"timeout,omitempty"`
+	Retry        *RetryPolicy   `json:"retry,omitempty"`
+}
+
+// RetryPolicy describes how a job is retried when it fails.
+type RetryPolicy struct {
+	Strategy   string   `json:"strategy,omitempty"`
+	MaxRetries int      `json:"max_retries"`
+	BaseDelay  string   `json:"base_delay,omitempty"`
+	MaxDelay   string   `json:"max_delay,omitempty"`
+	Jitter     float64  `json:"jitter,omitempty"`
+	RetryOn    []string `json:"retry_on,omitempty"`
 }
 
 // JobOptions is the options to run a job.
@@ -22,6 +34,7 @@ type JobOptions struct {
 	MaxExecCount int
 	MaxExecTime  *time.Duration
 	Timeout      *time.Duration
+	Retry        *RetryPolicy
 	Logs         chan *JobLog
 }
 
@@ -53,6 +66,14 @@ type Job struct {
 		StartedAt time.Time   `json:"started_at"`
 		State     string      `json:"state"`
 		Worker    string      `json:"worker"`
+		Progress  *struct {
+			Done    int64  `json:"done"`
+			Total   int64  `json:"total"`
+			Message string `json:"message"`
+		} `json:"progress,omitempty"`
+		Result       json.RawMessage `json:"result,omitempty"`
+		ResultInFile bool            `json:"result_in_file,omitempty"`
+		Retries      int             `json:"retries,omitempty"`
 	} `json:"attributes"`
 }
 
@@ -66,12 +87,20 @@ type Trigger struct {
 		WorkerType string          `json:"worker"`
 		Arguments  string          `json:"arguments"`
 		Debounce   string          `json:"debounce"`
+		TimeZone   string          `json:"time_zone,omitempty"`
+		Selector   json.RawMessage `json:"selector,omitempty"`
 		Message    json.RawMessage `json:"message"`
 		Options    *struct {
 			MaxExecCount int           `json:"max_exec_count"`
 			MaxExecTime  time.Duration `json:"max_exec_time"`
 			Timeout      time.Duration `json:"timeout"`
+			Retry        *RetryPolicy  `json:"retry,omitempty"`
 		} `json:"options"`
+		Outgoing *struct {
+			Secret     string     `json:"secret"`
+			Failures   int        `json:"failures,omitempty"`
+			DisabledAt *time.Time `json:"disabled_at,omitempty"`
+		} `json:"outgoing_webhook,omitempty"`
 	} `json:"attributes"`
 }
 
@@ -98,6 +127,7 @@ func (c *Client) JobPush(r *JobOptions) (*Job, error) {
 	if r.Timeout != nil {
 		opt.Timeout = r.Timeout
 	}
+	opt.Retry = r.Retry
 
 	withLogs := r.Logs != nil
 	var channel *RealtimeChannel
@@ -162,7 +192,7 @@ func (c *Client) JobPush(r *JobOptions) (*Job, error) {
 				if err = json.Unmarshal(evt.Payload.Doc, &j.Attrs); err != nil {
 					return nil, err
 				}
-				if j.Attrs.State == "done" || j.Attrs.State == "errored" {
+				if j.Attrs.State == "done" || j.Attrs.State == "errored" || j.Attrs.State == "cancelled" {
 					return j, nil
 				}
 			case "io.cozy.jobs.logs":
@@ -178,6 +208,22 @@ func (c *Client) JobPush(r *JobOptions) (*Job, error) {
 	return j, nil
 }
 
+// JobCancel cancels the job with the specified ID.
+func (c *Client) JobCancel(jobID string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "DELETE",
+		Path:   "/jobs/" + url.PathEscape(jobID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var j *Job
+	if err := readJSONAPI(res.Body, &j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
 // GetTrigger return the trigger with the specified ID.
 func (c *Client) GetTrigger(triggerID string) (*Trigger, error) {
 	res, err := c.Req(&request.Options{
@@ -242,3 +288,152 @@ func (c *Client) ListTriggers() ([]*Trigger, error) {
 	}
 	return list, nil
 }
+
+// DeadLetter is a struct representing a job that has failed after all its
+// retries.
+type DeadLetter struct {
+	ID    string `json:"id"`
+	Rev   string `json:"rev"`
+	Attrs struct {
+		Domain     string          `json:"domain"`
+		WorkerType string          `json:"worker"`
+		JobID      string          `json:"job_id"`
+		TriggerID  string          `json:"trigger_id"`
+		Message    json.RawMessage `json:"message"`
+		Event      json.RawMessage `json:"event,omitempty"`
+		Options    *jobOptions     `json:"options"`
+		Error      string          `json:"error"`
+		FailedAt   time.Time       `json:"failed_at"`
+	} `json:"attributes"`
+}
+
+// DeadLetterFilter is used to select the dead letters by worker type, domain
+// and error.
+type DeadLetterFilter struct {
+	Worker string
+	Domain string
+	Error  string
+	Limit  int
+}
+
+func (f *DeadLetterFilter) queries() url.Values {
+	q := url.Values{}
+	if f.Worker != "" {
+		q.Add("Worker", f.Worker)
+	}
+	if f.Domain != "" {
+		q.Add("Domain", f.Domain)
+	}
+	if f.Error != "" {
+		q.Add("Error", f.Error)
+	}
+	if f.Limit > 0 {
+		q.Add("Limit", strconv.Itoa(f.Limit))
+	}
+	return q
+}
+
+// ListDeadLetters returns the dead letters that match the filter.
+func (c *Client) ListDeadLetters(filter *DeadLetterFilter) ([]*DeadLetter, error) {
+	res, err := c.Req(&request.Options{
+		Method:  "GET",
+		Path:    "/jobs/dead-letters",
+		Queries: filter.queries(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []*DeadLetter
+	if err := readJSONAPI(res.Body, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetDeadLetter returns the dead letter with the specified ID.
+func (c *Client) GetDeadLetter(id string) (*DeadLetter, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/jobs/dead-letters/" + url.PathEscape(id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var d *DeadLetter
+	if err := readJSONAPI(res.Body, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// UpdateDeadLetterMessage changes the message of the job of a dead letter.
+func (c *Client) UpdateDeadLetterMessage(id string, msg json.RawMessage) (*DeadLetter, error) {
+	body, err := writeJSONAPI(map[string]interface{}{
+		"attributes": map[string]interface{}{"message": msg},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Req(&request.Options{
+		Method: "PATCH",
+		Path:   "/jobs/dead-letters/" + url.PathEscape(id),
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var d *DeadLetter
+	if err := readJSONAPI(res.Body, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DeleteDeadLetter removes a dead letter, without replaying its job.
+func (c *Client) DeleteDeadLetter(id string) error {
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       "/jobs/dead-letters/" + url.PathEscape(id),
+		NoResponse: true,
+	})
+	return err
+}
+
+// ReplayDeadLetter pushes again the job of a dead letter.
+func (c *Client) ReplayDeadLetter(id string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/jobs/dead-letters/" + url.PathEscape(id) + "/replay",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var j *Job
+	if err := readJSONAPI(res.Body, &j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// ReplayDeadLetters pushes again the jobs of all the dead letters that match
+// the filter. It returns the number of replayed jobs, and the errors for the
+// dead letters that could not be replayed.
+func (c *Client) ReplayDeadLetters(filter *DeadLetterFilter) (int, []string, error) {
+	res, err := c.Req(&request.Options{
+		Method:  "POST",
+		Path:    "/jobs/dead-letters/replay",
+		Queries: filter.queries(),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Replayed int      `json:"replayed"`
+		Errors   []string `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, nil, err
+	}
+	return result.Replayed, result.Errors, nil
+}
@@ -144,6 +144,41 @@ keyfiles written in:
 	},
 }
 
+var genFsKeyCmd = &cobra.Command{
+	Use:   "gen-fs-key <filepath>",
+	Short: "Generate a key for the encryption of the files",
+	Long: `
+cozy-stack config gen-fs-key generate a key and save it in the specified path.
+
+This key is used to protect the keys that encrypt the content of the files of
+the instances on the local file system. It should be referenced in the
+vault.fs_encryption_key parameter of the configuration file.
+
+The file permissions are 0400.`,
+
+	Example: `$ cozy-stack config gen-fs-key ~/fs-key
+keyfile written in:
+	~/fs-key
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+
+		filename := filepath.Join(utils.AbsPath(args[0]))
+		marshaledKey, err := keymgmt.GenerateEncodedSecretKey()
+		if err != nil {
+			return err
+		}
+
+		if err = writeFile(filename, marshaledKey, 0400); err != nil {
+			return err
+		}
+		errPrintfln("keyfile written in:\n  %s", filename)
+		return nil
+	},
+}
+
 var encryptCredentialsDataCmd = &cobra.Command{
 	Use:   "encrypt-data <encoding keyfile> <text>",
 	Short: "Encrypt data with the specified encryption keyfile.",
@@ -362,6 +397,7 @@ var listContextsCmd = &cobra.Command{
 func init() {
 	configCmdGroup.AddCommand(adminPasswdCmd)
 	configCmdGroup.AddCommand(genKeysCmd)
+	configCmdGroup.AddCommand(genFsKeyCmd)
 	configCmdGroup.AddCommand(encryptCredentialsDataCmd)
 	configCmdGroup.AddCommand(decryptCredentialsDataCmd)
 	configCmdGroup.AddCommand(encryptCredentialsCmd)
@@ -45,6 +45,7 @@ var flagIncreaseQuota bool
 var flagForceRegistry bool
 var flagOnlyRegistry bool
 var flagSwiftLayout int
+var flagContentAddressed bool
 var flagUUID string
 var flagTOSSigned string
 var flagTOS string
@@ -57,6 +58,8 @@ var flagAllowLoginScope bool
 var flagFsckIndexIntegrity bool
 var flagFsckFilesConsistensy bool
 var flagFsckFailFast bool
+var flagFsckRepair bool
+var flagFsckNoDryRun bool
 var flagAvailableFields bool
 var flagOnboardingSecret string
 var flagOnboardingApp string
@@ -172,20 +175,21 @@ be used as the error message.
 		domain := args[0]
 		c := newAdminClient()
 		in, err := c.CreateInstance(&client.InstanceOptions{
-			Domain:        domain,
-			DomainAliases: flagDomainAliases,
-			Locale:        flagLocale,
-			UUID:          flagUUID,
-			TOSSigned:     flagTOSSigned,
-			Timezone:      flagTimezone,
-			ContextName:   flagContextName,
-			Email:         flagEmail,
-			PublicName:    flagPublicName,
-			Settings:      flagSettings,
-			SwiftLayout:   flagSwiftLayout,
-			DiskQuota:     diskQuota,
-			Apps:          flagApps,
-			Passphrase:    flagPassphrase,
+			Domain:           domain,
+			DomainAliases:    flagDomainAliases,
+			Locale:           flagLocale,
+			UUID:             flagUUID,
+			TOSSigned:        flagTOSSigned,
+			Timezone:         flagTimezone,
+			ContextName:      flagContextName,
+			Email:            flagEmail,
+			PublicName:       flagPublicName,
+			Settings:         flagSettings,
+			SwiftLayout:      flagSwiftLayout,
+			ContentAddressed: flagContentAddressed,
+			DiskQuota:        diskQuota,
+			Apps:             flagApps,
+			Passphrase:       flagPassphrase,
 		})
 		if err != nil {
 			errPrintfln(
@@ -628,6 +632,12 @@ There are 2 steps:
 
 By default, both operations are done, but you can choose one or the other via
 the flags.
+
+With the --repair flag, a safe fix is applied for the inconsistencies that can
+be repaired: the orphan files and directories are moved to /Lost+found, the
+missing documents in the index are recreated from the storage, and the wrong
+sizes and checksums are fixed. It is a dry-run by default, and the
+--no-dry-run flag must be used to really apply the fixes.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
@@ -635,6 +645,10 @@ the flags.
 		}
 		domain := args[0]
 
+		if flagFsckRepair {
+			return fsckRepair(domain)
+		}
+
 		if flagFsckFilesConsistensy && flagFsckIndexIntegrity {
 			flagFsckIndexIntegrity = false
 			flagFsckFilesConsistensy = false
@@ -670,6 +684,35 @@ the flags.
 	},
 }
 
+func fsckRepair(domain string) error {
+	buf := new(bytes.Buffer)
+	body := struct {
+		DryRun bool `json:"dry_run"`
+	}{
+		DryRun: !flagFsckNoDryRun,
+	}
+	if err := json.NewEncoder(buf).Encode(body); err != nil {
+		return err
+	}
+
+	c := newAdminClient()
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + url.PathEscape(domain) + "/fsck/repair",
+		Body:   bytes.NewReader(buf.Bytes()),
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		fmt.Println(string(scanner.Bytes()))
+	}
+	return scanner.Err()
+}
+
 func appOrKonnectorTokenInstance(cmd *cobra.Command, args []string, appType string) error {
 	if len(args) < 2 {
 		return cmd.Usage()
@@ -1078,7 +1121,8 @@ func init() {
 	addInstanceCmd.Flags().StringVar(&flagEmail, "email", "", "The email of the owner")
 	addInstanceCmd.Flags().StringVar(&flagPublicName, "public-name", "", "The public name of the owner")
 	addInstanceCmd.Flags().StringVar(&flagSettings, "settings", "", "A list of settings (eg context:foo,offer:premium)")
-	addInstanceCmd.Flags().IntVar(&flagSwiftLayout, "swift-layout", -1, "Specify the layout to use for Swift (from 0 for layout V1 to 2 for layout V3, -1 means the default)")
+	addInstanceCmd.Flags().IntVar(&flagSwiftLayout, "swift-layout", -1, "Specify the layout to use for Swift (from 0 for layout V1 to 3 for layout V4, -1 means the default)")
+	addInstanceCmd.Flags().BoolVar(&flagContentAddressed, "content-addressed", false, "Use the content-addressed layout for the local file system")
 	addInstanceCmd.Flags().StringVar(&flagDiskQuota, "disk-quota", "", "The quota allowed to the instance's VFS")
 	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled")
 	addInstanceCmd.Flags().BoolVar(&flagDev, "dev", false, "To create a development instance (deprecated)")
@@ -1103,6 +1147,8 @@ func init() {
 	fsckInstanceCmd.Flags().BoolVar(&flagFsckIndexIntegrity, "index-integrity", false, "Check the index integrity only")
 	fsckInstanceCmd.Flags().BoolVar(&flagFsckFilesConsistensy, "files-consistency", false, "Check the files consistency only (between CouchDB and Swift)")
 	fsckInstanceCmd.Flags().BoolVar(&flagFsckFailFast, "fail-fast", false, "Stop the FSCK on the first error")
+	fsckInstanceCmd.Flags().BoolVar(&flagFsckRepair, "repair", false, "Repair the inconsistencies that can be safely fixed")
+	fsckInstanceCmd.Flags().BoolVar(&flagFsckNoDryRun, "no-dry-run", false, "Apply the fixes of the repair (it is a dry-run by default)")
 	fsckInstanceCmd.Flags().BoolVar(&flagJSON, "json", false, "Output more informations in JSON format")
 	oauthClientInstanceCmd.Flags().BoolVar(&flagJSON, "json", false, "Output more informations in JSON format")
 	oauthClientInstanceCmd.Flags().BoolVar(&flagAllowLoginScope, "allow-login-scope", false, "Allow login scope")
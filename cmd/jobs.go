@@ -20,6 +20,10 @@ var flagJobPrintLogs bool
 var flagJobPrintLogsVerbose bool
 var flagJobWorkers []string
 var flagJobsPurgeDuration string
+var flagDeadLettersWorker string
+var flagDeadLettersError string
+var flagDeadLettersLimit int
+var flagDeadLettersAll bool
 
 var jobsCmdGroup = &cobra.Command{
 	Use:   "jobs <command>",
@@ -73,6 +77,31 @@ var jobsRunCmd = &cobra.Command{
 	},
 }
 
+var jobsCancelCmd = &cobra.Command{
+	Use:     "cancel <job-id>",
+	Short:   `Cancel a queued or running job`,
+	Example: `$ cozy-stack jobs cancel --domain example.mycozy.cloud 0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		if flagDomain == "" {
+			return errMissingDomain
+		}
+		c := newClient(flagDomain, "io.cozy.jobs:DELETE")
+		j, err := c.JobCancel(args[0])
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(j, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
 var jobsPurgeCmd = &cobra.Command{
 	Use:     "purge-old-jobs <domain>",
 	Short:   `Purge old jobs from an instance`,
@@ -113,6 +142,137 @@ var jobsPurgeCmd = &cobra.Command{
 	},
 }
 
+var jobsDeadLettersCmdGroup = &cobra.Command{
+	Use:   "dead-letters <command>",
+	Short: "Manage the jobs that have failed after all their retries",
+	Long: `
+The jobs of some workers (sendmail, push, share-replicate) that have failed
+after all their retries are kept as dead letters. These commands can be used to
+list them, fix their message, and execute them again.
+
+The --domain flag is used to filter the dead letters of an instance only when it
+is explicitly given.
+`,
+}
+
+var jobsDeadLettersLsCmd = &cobra.Command{
+	Use:     "ls",
+	Short:   `List the dead letters`,
+	Example: `$ cozy-stack jobs dead-letters ls --worker sendmail --error timeout`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		list, err := c.ListDeadLetters(deadLetterFilter(cmd))
+		if err != nil {
+			return err
+		}
+		for _, d := range list {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", d.ID, d.Attrs.FailedAt.Format(time.RFC3339),
+				d.Attrs.Domain, d.Attrs.WorkerType, d.Attrs.Error)
+		}
+		return nil
+	},
+}
+
+var jobsDeadLettersShowCmd = &cobra.Command{
+	Use:     "show <id>",
+	Short:   `Show a dead letter`,
+	Example: `$ cozy-stack jobs dead-letters show 0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		d, err := c.GetDeadLetter(args[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(d)
+	},
+}
+
+var jobsDeadLettersEditCmd = &cobra.Command{
+	Use:     "edit <id>",
+	Short:   `Change the message of the job of a dead letter`,
+	Example: `$ cozy-stack jobs dead-letters edit 0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d --json '{"mode": "noreply", "template_name": "archiver"}'`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		if flagJobJSONArg == "" {
+			return errors.New("The JSON argument is missing")
+		}
+		c := newAdminClient()
+		d, err := c.UpdateDeadLetterMessage(args[0], json.RawMessage(flagJobJSONArg))
+		if err != nil {
+			return err
+		}
+		return printJSON(d)
+	},
+}
+
+var jobsDeadLettersReplayCmd = &cobra.Command{
+	Use:   "replay [id]",
+	Short: `Execute again the jobs of dead letters`,
+	Example: `$ cozy-stack jobs dead-letters replay 0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d
+$ cozy-stack jobs dead-letters replay --all --worker push`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		if len(args) == 1 {
+			j, err := c.ReplayDeadLetter(args[0])
+			if err != nil {
+				return err
+			}
+			return printJSON(j)
+		}
+		if len(args) != 0 || !flagDeadLettersAll {
+			return cmd.Help()
+		}
+		replayed, errs, err := c.ReplayDeadLetters(deadLetterFilter(cmd))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d job(s) replayed\n", replayed)
+		for _, e := range errs {
+			errPrintfln("%s", e)
+		}
+		return nil
+	},
+}
+
+var jobsDeadLettersRmCmd = &cobra.Command{
+	Use:     "rm <id>",
+	Short:   `Remove a dead letter without executing its job again`,
+	Example: `$ cozy-stack jobs dead-letters rm 0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		return c.DeleteDeadLetter(args[0])
+	},
+}
+
+func deadLetterFilter(cmd *cobra.Command) *client.DeadLetterFilter {
+	filter := &client.DeadLetterFilter{
+		Worker: flagDeadLettersWorker,
+		Error:  flagDeadLettersError,
+		Limit:  flagDeadLettersLimit,
+	}
+	if cmd.Flags().Changed("domain") {
+		filter.Domain = flagDomain
+	}
+	return filter
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
 func init() {
 	jobsCmdGroup.PersistentFlags().StringVar(&flagDomain, "domain", cozyDomain(), "specify the domain name of the instance")
 
@@ -123,7 +283,22 @@ func init() {
 	jobsPurgeCmd.Flags().StringSliceVar(&flagJobWorkers, "workers", nil, "worker types to iterate over (all workers by default)")
 	jobsPurgeCmd.Flags().StringVar(&flagJobsPurgeDuration, "duration", "", "duration to look for (ie. 3D, 2M)")
 
+	for _, cmd := range []*cobra.Command{jobsDeadLettersLsCmd, jobsDeadLettersReplayCmd} {
+		cmd.Flags().StringVar(&flagDeadLettersWorker, "worker", "", "filter the dead letters by worker type")
+		cmd.Flags().StringVar(&flagDeadLettersError, "error", "", "filter the dead letters by error text")
+	}
+	jobsDeadLettersLsCmd.Flags().IntVar(&flagDeadLettersLimit, "limit", 100, "maximal number of dead letters")
+	jobsDeadLettersEditCmd.Flags().StringVar(&flagJobJSONArg, "json", "", "specify the new message as raw JSON")
+	jobsDeadLettersReplayCmd.Flags().BoolVar(&flagDeadLettersAll, "all", false, "replay all the dead letters that match the filters")
+	jobsDeadLettersCmdGroup.AddCommand(jobsDeadLettersLsCmd)
+	jobsDeadLettersCmdGroup.AddCommand(jobsDeadLettersShowCmd)
+	jobsDeadLettersCmdGroup.AddCommand(jobsDeadLettersEditCmd)
+	jobsDeadLettersCmdGroup.AddCommand(jobsDeadLettersReplayCmd)
+	jobsDeadLettersCmdGroup.AddCommand(jobsDeadLettersRmCmd)
+
 	jobsCmdGroup.AddCommand(jobsRunCmd)
+	jobsCmdGroup.AddCommand(jobsCancelCmd)
 	jobsCmdGroup.AddCommand(jobsPurgeCmd)
+	jobsCmdGroup.AddCommand(jobsDeadLettersCmdGroup)
 	RootCmd.AddCommand(jobsCmdGroup)
 }
@@ -174,8 +174,11 @@ func cleanAndWaitSingle(inst *instance.Instance, entry CleanEntry) error {
 		if err != nil {
 			return err
 		}
-		err = j.WaitUntilDone(inst)
-		if err != nil {
+		_, err = j.WaitUntilDone(inst)
+		if err == job.ErrWaitTimeout {
+			inst.Logger().WithField("nspace", "accounts").
+				Warnf("The deletion of account %s is not finished", acc.ID())
+		} else if err != nil {
 			return err
 		}
 	}
@@ -144,6 +144,8 @@ func Copier(appsType consts.AppType, inst *instance.Instance) appfs.Copier {
 		return appfs.NewAferoCopier(baseFS)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return appfs.NewSwiftCopier(config.GetSwiftConnection(), appsType)
+	case config.SchemeS3, config.SchemeS3Secure:
+		return appfs.NewS3Copier(config.GetS3Client(), config.GetS3Bucket(), appsType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -163,6 +165,8 @@ func AppsFileServer(i *instance.Instance) appfs.FileServer {
 		return appfs.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return appfs.NewSwiftFileServer(config.GetSwiftConnection(), consts.WebappType)
+	case config.SchemeS3, config.SchemeS3Secure:
+		return appfs.NewS3FileServer(config.GetS3Client(), config.GetS3Bucket(), consts.WebappType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -182,6 +186,8 @@ func KonnectorsFileServer(i *instance.Instance) appfs.FileServer {
 		return appfs.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return appfs.NewSwiftFileServer(config.GetSwiftConnection(), consts.KonnectorType)
+	case config.SchemeS3, config.SchemeS3Secure:
+		return appfs.NewS3FileServer(config.GetS3Client(), config.GetS3Bucket(), consts.KonnectorType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
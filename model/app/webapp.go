@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"strings"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/appfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/metadata"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/spf13/afero"
@@ -41,11 +43,12 @@ type Routes map[string]Route
 type Service struct {
 	name string
 
-	Type           string `json:"type"`
-	File           string `json:"file"`
-	Debounce       string `json:"debounce"`
-	TriggerOptions string `json:"trigger"`
-	TriggerID      string `json:"trigger_id"`
+	Type           string    `json:"type"`
+	File           string    `json:"file"`
+	Debounce       string    `json:"debounce"`
+	TriggerOptions string    `json:"trigger"`
+	Selector       mango.Map `json:"selector,omitempty"`
+	TriggerID      string    `json:"trigger_id"`
 }
 
 // Services is a map to define services assciated with an application.
@@ -369,7 +372,8 @@ func diffServices(db prefixer.Prefixer, slug string, oldServices, newServices Se
 		if newService.File != oldService.File ||
 			newService.Type != oldService.Type ||
 			newService.TriggerOptions != oldService.TriggerOptions ||
-			newService.Debounce != oldService.Debounce {
+			newService.Debounce != oldService.Debounce ||
+			!reflect.DeepEqual(newService.Selector, oldService.Selector) {
 			deleted = append(deleted, oldService)
 			created = append(created, newService)
 		} else {
@@ -412,6 +416,7 @@ func diffServices(db prefixer.Prefixer, slug string, oldServices, newServices Se
 			WorkerType: "service",
 			Debounce:   service.Debounce,
 			Arguments:  triggerArgs,
+			Selector:   service.Selector,
 			Metadata:   md,
 		}, msg)
 		if err != nil {
@@ -20,6 +20,7 @@ const (
 	PasswordResetTokenLen = 16
 	SessionSecretLen      = 64
 	OauthSecretLen        = 128
+	FsKeyLen              = 32
 )
 
 var twoFactorTOTPOptions = totp.ValidateOpts{
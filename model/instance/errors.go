@@ -31,4 +31,7 @@ var (
 	ErrInvalidSwiftLayout = errors.New("Invalid Swift layout")
 	// ErrDeletionAlreadyRequested is returned when a deletion has already been requested.
 	ErrDeletionAlreadyRequested = errors.New("The deletion has already been requested")
+	// ErrMissingFsEncryptionKey is returned when the files of an instance are
+	// encrypted, but the master key is not configured in the vault.
+	ErrMissingFsEncryptionKey = errors.New("Missing encryption key for the files")
 )
@@ -10,6 +10,7 @@ import (
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
@@ -60,10 +61,16 @@ type Instance struct {
 	// - 0 for layout v1
 	// - 1 for layout v2
 	// - 2 for layout v3
+	// - 3 for layout v4 (content-addressed)
 	// It is called swift_cluster in CouchDB and indexed from 0 for legacy reasons.
 	// See model/vfs/vfsswift for more details.
 	SwiftLayout int `json:"swift_cluster,omitempty"`
 
+	// ContentAddressed is true when the files are stored with the
+	// content-addressed layout on the local file system (the equivalent of
+	// the Swift layout v4).
+	ContentAddressed bool `json:"content_addressed,omitempty"`
+
 	// PassphraseHash is a hash of a hash of the user's passphrase: the
 	// passphrase is first hashed in client-side to avoid sending it to the
 	// server as it also used for encryption on client-side, and after that,
@@ -85,6 +92,11 @@ type Instance struct {
 	OAuthSecret []byte `json:"oauth_secret,omitempty"`
 	// CLISecret is used to authenticate request from the CLI
 	CLISecret []byte `json:"cli_secret,omitempty"`
+	// FsKeys are the keys used to encrypt the content of the files on the
+	// local file system, wrapped with the master key of the vault. The first
+	// key is used to encrypt, the other ones are only kept to decrypt the
+	// files during a key rotation.
+	FsKeys [][]byte `json:"fs_keys,omitempty"`
 
 	// FeatureFlags is the feature flags that are specific to this instance
 	FeatureFlags map[string]interface{} `json:"feature_flags,omitempty"`
@@ -139,6 +151,14 @@ func (i *Instance) Clone() couchdb.Doc {
 
 	cloned.CLISecret = make([]byte, len(i.CLISecret))
 	copy(cloned.CLISecret, i.CLISecret)
+
+	if i.FsKeys != nil {
+		cloned.FsKeys = make([][]byte, len(i.FsKeys))
+		for k, key := range i.FsKeys {
+			cloned.FsKeys[k] = make([]byte, len(key))
+			copy(cloned.FsKeys[k], key)
+		}
+	}
 	return &cloned
 }
 
@@ -203,7 +223,17 @@ func (i *Instance) MakeVFS() error {
 	var err error
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
+		if i.ContentAddressed {
+			i.vfs, err = vfsafero.NewContentAddressed(i, index, disk, mutex, fsURL, i.DirName())
+		} else {
+			i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
+		}
+		if err == nil && len(i.FsKeys) > 0 {
+			var keys [][]byte
+			if keys, err = i.FsDataKeys(); err == nil {
+				i.vfs, err = vfsafero.WithEncryption(i.vfs, keys)
+			}
+		}
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		switch i.SwiftLayout {
 		case 0:
@@ -212,15 +242,40 @@ func (i *Instance) MakeVFS() error {
 			i.vfs, err = vfsswift.NewV2(i, index, disk, mutex)
 		case 2:
 			i.vfs, err = vfsswift.NewV3(i, index, disk, mutex)
+		case 3:
+			i.vfs, err = vfsswift.NewV4(i, index, disk, mutex)
 		default:
 			err = ErrInvalidSwiftLayout
 		}
+	case config.SchemeS3, config.SchemeS3Secure:
+		i.vfs, err = vfss3.New(i, index, disk, mutex)
 	default:
 		err = fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 	}
 	return err
 }
 
+// FsDataKeys returns the keys used to encrypt the content of the files, after
+// unwrapping them with the master key of the vault.
+func (i *Instance) FsDataKeys() ([][]byte, error) {
+	if len(i.FsKeys) == 0 {
+		return nil, nil
+	}
+	master := config.GetVault().FsEncryptionKey()
+	if master == nil {
+		return nil, ErrMissingFsEncryptionKey
+	}
+	keys := make([][]byte, len(i.FsKeys))
+	for k, wrapped := range i.FsKeys {
+		key, err := master.Open(wrapped)
+		if err != nil {
+			return nil, err
+		}
+		keys[k] = key
+	}
+	return keys, nil
+}
+
 // NotesLock returns a mutex for the notes on this instance.
 func (i *Instance) NotesLock() lock.ErrorRWLocker {
 	return lock.ReadWrite(i, "notes")
@@ -353,6 +408,34 @@ func (i *Instance) DiskQuota() int64 {
 	return i.BytesDiskQuota
 }
 
+// TrashRetention returns how long the files and directories are kept in the
+// trash before being destroyed. It can be set in the context with the
+// trash_retention_days parameter, and overridden in the settings of the
+// instance. A zero duration means that the trash is never cleaned
+// automatically.
+func (i *Instance) TrashRetention() time.Duration {
+	if settings, err := i.SettingsDocument(); err == nil {
+		if days, ok := settings.M["trash_retention_days"].(float64); ok && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+	}
+	ctxSettings, ok := i.SettingsContext()
+	if !ok {
+		return 0
+	}
+	switch days := ctxSettings["trash_retention_days"].(type) {
+	case int:
+		if days > 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+	case float64:
+		if days > 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return 0
+}
+
 // WithContextualDomain the current instance context with the given hostname.
 func (i *Instance) WithContextualDomain(domain string) *Instance {
 	if i.HasDomain(domain) {
@@ -20,30 +20,31 @@ import (
 
 // Options holds the parameters to create a new instance.
 type Options struct {
-	Domain         string
-	DomainAliases  []string
-	Locale         string
-	UUID           string
-	TOSSigned      string
-	TOSLatest      string
-	Timezone       string
-	ContextName    string
-	Email          string
-	PublicName     string
-	Settings       string
-	SettingsObj    *couchdb.JSONDoc
-	AuthMode       string
-	Passphrase     string
-	Key            string
-	KdfIterations  int
-	SwiftLayout    int
-	DiskQuota      int64
-	Apps           []string
-	AutoUpdate     *bool
-	Debug          *bool
-	Deleting       *bool
-	Blocked        *bool
-	BlockingReason string
+	Domain           string
+	DomainAliases    []string
+	Locale           string
+	UUID             string
+	TOSSigned        string
+	TOSLatest        string
+	Timezone         string
+	ContextName      string
+	Email            string
+	PublicName       string
+	Settings         string
+	SettingsObj      *couchdb.JSONDoc
+	AuthMode         string
+	Passphrase       string
+	Key              string
+	KdfIterations    int
+	SwiftLayout      int
+	ContentAddressed bool
+	DiskQuota        int64
+	Apps             []string
+	AutoUpdate       *bool
+	Debug            *bool
+	Deleting         *bool
+	Blocked          *bool
+	BlockingReason   string
 
 	OnboardingFinished *bool
 }
@@ -97,13 +98,15 @@ func CreateWithoutHooks(opts *Options) (*instance.Instance, error) {
 	i.TOSLatest = opts.TOSLatest
 	i.ContextName = opts.ContextName
 	i.BytesDiskQuota = opts.DiskQuota
+	i.ContentAddressed = opts.ContentAddressed
 	i.IndexViewsVersion = couchdb.IndexViewsVersion
 	i.RegisterToken = crypto.GenerateRandomBytes(instance.RegisterTokenLen)
 	i.SessSecret = crypto.GenerateRandomBytes(instance.SessionSecretLen)
 	i.OAuthSecret = crypto.GenerateRandomBytes(instance.OauthSecretLen)
 	i.CLISecret = crypto.GenerateRandomBytes(instance.OauthSecretLen)
+	i.FsKeys = newFsKeys()
 
-	if 0 <= opts.SwiftLayout && opts.SwiftLayout <= 2 {
+	if 0 <= opts.SwiftLayout && opts.SwiftLayout <= 3 {
 		i.SwiftLayout = opts.SwiftLayout
 	} else {
 		i.SwiftLayout = config.GetConfig().Fs.DefaultLayout
@@ -277,8 +280,8 @@ func buildSettings(opts *Options) *couchdb.JSONDoc {
 
 // Triggers returns the list of the triggers to add when an instance is created
 func Triggers(db prefixer.Prefixer) []job.TriggerInfos {
-	// Create/update/remove thumbnails when an image is created/updated/removed
 	return []job.TriggerInfos{
+		// Create/update/remove thumbnails when an image is created/updated/removed
 		{
 			Domain:     db.DomainName(),
 			Prefix:     db.DBPrefix(),
@@ -286,5 +289,47 @@ func Triggers(db prefixer.Prefixer) []job.TriggerInfos {
 			WorkerType: "thumbnail",
 			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
 		},
+		// Keep the search index up-to-date when a file or directory changes
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "search-index",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED",
+		},
+		// Destroy the files that have been in the trash for too long
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@cron",
+			WorkerType: "trash-expiration",
+			Arguments:  trashExpirationCron(db.DomainName()),
+		},
 	}
 }
+
+// newFsKeys returns the wrapped key for encrypting the content of the files
+// of a new instance, if the encryption is enabled (a master key is set in the
+// vault and the files are stored on the local file system).
+func newFsKeys() [][]byte {
+	master := config.GetVault().FsEncryptionKey()
+	if master == nil {
+		return nil
+	}
+	switch config.FsURL().Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		key := crypto.GenerateRandomBytes(instance.FsKeyLen)
+		return [][]byte{master.Seal(key)}
+	}
+	return nil
+}
+
+// trashExpirationCron returns the cron spec for the daily job that cleans the
+// trash. The time is derived from the domain to spread the jobs of the
+// instances during the night.
+func trashExpirationCron(domain string) string {
+	sum := sha256.Sum256([]byte(domain))
+	minute := int(sum[0]) % 60
+	hour := int(sum[1]) % 6
+	return "0 " + strconv.Itoa(minute) + " " + strconv.Itoa(hour) + " * * *"
+}
@@ -69,6 +69,10 @@ func destroyWithoutHooks(domain string) error {
 		}
 	}
 
+	if _, err = job.DeleteDeadLettersOfDomain(inst.Domain); err != nil {
+		logger.WithDomain(domain).Errorf("Failed to remove the dead letters: %s", err)
+	}
+
 	if err = couchdb.DeleteAllDBs(inst); err != nil {
 		inst.Logger().Errorf("Could not delete all CouchDB databases: %s", err.Error())
 		return err
@@ -7,6 +7,7 @@ import (
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/spf13/afero"
@@ -20,10 +21,10 @@ func ThumbsFS(i *instance.Instance) vfs.Thumbser {
 	case config.SchemeFile:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), vfs.ThumbsDirName))
-		return vfsafero.NewThumbsFs(baseFS)
+		return vfsafero.NewThumbsFs(encryptedThumbsFS(i, baseFS))
 	case config.SchemeMem:
 		baseFS := vfsafero.GetMemFS(i.DomainName() + "-thumbs")
-		return vfsafero.NewThumbsFs(baseFS)
+		return vfsafero.NewThumbsFs(encryptedThumbsFS(i, baseFS))
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		switch i.SwiftLayout {
 		case 0:
@@ -32,10 +33,31 @@ func ThumbsFS(i *instance.Instance) vfs.Thumbser {
 			return vfsswift.NewThumbsFsV2(config.GetSwiftConnection(), i)
 		case 2:
 			return vfsswift.NewThumbsFsV3(config.GetSwiftConnection(), i)
+		case 3:
+			return vfsswift.NewThumbsFsV4(config.GetSwiftConnection(), i)
 		default:
 			panic(instance.ErrInvalidSwiftLayout)
 		}
+	case config.SchemeS3, config.SchemeS3Secure:
+		return vfss3.NewThumbsFs(config.GetS3Client(), config.GetS3Bucket(), i)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
 }
+
+// encryptedThumbsFS returns the file system for the thumbnails, with the
+// encryption of their content if it is enabled for the files of the instance.
+func encryptedThumbsFS(i *instance.Instance, baseFS afero.Fs) afero.Fs {
+	keys, err := i.FsDataKeys()
+	if err != nil {
+		panic(err)
+	}
+	if len(keys) == 0 {
+		return baseFS
+	}
+	fs, err := vfsafero.NewEncryptedFs(baseFS, keys)
+	if err != nil {
+		panic(err)
+	}
+	return fs
+}
@@ -3,7 +3,6 @@ package job
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"sort"
 	"time"
 
@@ -26,15 +25,18 @@ const (
 	Done State = "done"
 	// Errored state
 	Errored State = "errored"
+	// Cancelled state
+	Cancelled State = "cancelled"
 )
 
 // defaultMaxLimits defines the maximum limit of how much jobs will be returned
 // for each job state
 var defaultMaxLimits map[State]int = map[State]int{
-	Queued:  50,
-	Running: 50,
-	Done:    50,
-	Errored: 50,
+	Queued:    50,
+	Running:   50,
+	Done:      50,
+	Errored:   50,
+	Cancelled: 50,
 }
 
 const (
@@ -54,9 +56,21 @@ type (
 		// This method is asynchronous.
 		PushJob(db prefixer.Prefixer, request *JobRequest) (*Job, error)
 
+		// CancelJob cancels the job with the given ID. A queued job is removed
+		// from the queue, and a running job has its context cancelled.
+		CancelJob(db prefixer.Prefixer, jobID string) (*Job, error)
+
+		// RetryJob pushes again in its queue a job that has failed, after the
+		// given delay. It is used for the jobs with a retry policy, so that
+		// they don't wait in a worker slot.
+		RetryJob(job *Job, delay time.Duration) error
+
 		// WorkerQueueLen returns the total element in the queue of the specified
 		// worker type.
 		WorkerQueueLen(workerType string) (int, error)
+		// WorkerQueueLenByDomain returns the number of elements in the queue
+		// of the specified worker type for each instance.
+		WorkerQueueLenByDomain(workerType string) (map[string]int, error)
 		// WorkerIsReserved returns true if the given worker type is reserved
 		// (ie clients should not push jobs to it, only the stack).
 		WorkerIsReserved(workerType string) (bool, error)
@@ -73,6 +87,16 @@ type (
 	// Event is a json encoded value of a realtime.Event
 	Event json.RawMessage
 
+	// JobProgress is the progress of a running job, as reported by its
+	// worker. Total is 0 when the worker does not know how many items it has
+	// to process.
+	JobProgress struct {
+		Done      int64     `json:"done"`
+		Total     int64     `json:"total,omitempty"`
+		Message   string    `json:"message,omitempty"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
 	// Job contains all the metadata informations of a Job. It can be
 	// marshalled in JSON.
 	Job struct {
@@ -86,6 +110,7 @@ type (
 		Event       Event       `json:"event"`
 		Manual      bool        `json:"manual_execution,omitempty"`
 		Debounced   bool        `json:"debounced,omitempty"`
+		Webhook     bool        `json:"webhook,omitempty"`
 		Options     *JobOptions `json:"options,omitempty"`
 		State       State       `json:"state"`
 		QueuedAt    time.Time   `json:"queued_at"`
@@ -93,6 +118,29 @@ type (
 		FinishedAt  time.Time   `json:"finished_at"`
 		Error       string      `json:"error,omitempty"`
 		ForwardLogs bool        `json:"forward_logs,omitempty"`
+
+		// Progress is the last progress reported by the worker with
+		// WorkerContext.ReportProgress.
+		Progress *JobProgress `json:"progress,omitempty"`
+		// Result is the result of the job, set by the worker with
+		// WorkerContext.SetResult, when it is small enough to be kept in the
+		// job document. Else, it is saved as a file in the VFS, and
+		// ResultInFile is true.
+		Result       Message `json:"result,omitempty"`
+		ResultInFile bool    `json:"result_in_file,omitempty"`
+		// Retries is the number of times the job has been scheduled again
+		// with its retry policy.
+		Retries int `json:"retries,omitempty"`
+
+		WorkflowID   string `json:"workflow_id,omitempty"`
+		WorkflowStep int    `json:"workflow_step,omitempty"`
+
+		// result is the full result of the job, given to the next job of a
+		// workflow.
+		result Message
+		// releaseSlot is set by the broker when the job counts for the
+		// concurrency limit of its instance (see InstanceConcurrency).
+		releaseSlot func()
 	}
 
 	// JobRequest struct is used to represent a new job request.
@@ -104,8 +152,16 @@ type (
 		Event       Event
 		Manual      bool
 		Debounced   bool
+		Webhook     bool
 		ForwardLogs bool
 		Options     *JobOptions
+
+		// OnSuccess and OnFailure are the follow-up jobs to execute after
+		// the job (see Workflow).
+		OnSuccess    []*WorkflowStep
+		OnFailure    []*WorkflowStep
+		WorkflowID   string
+		WorkflowStep int
 	}
 
 	// JobOptions struct contains the execution properties of the jobs.
@@ -113,6 +169,7 @@ type (
 		MaxExecCount int           `json:"max_exec_count"`
 		MaxExecTime  time.Duration `json:"max_exec_time"`
 		Timeout      time.Duration `json:"timeout"`
+		Retry        *RetryPolicy  `json:"retry,omitempty"`
 	}
 )
 
@@ -142,8 +199,20 @@ func (j *Job) Clone() couchdb.Doc {
 	cloned := *j
 	if j.Options != nil {
 		tmp := *j.Options
+		if j.Options.Retry != nil {
+			retry := *j.Options.Retry
+			tmp.Retry = &retry
+		}
 		cloned.Options = &tmp
 	}
+	if j.Progress != nil {
+		tmp := *j.Progress
+		cloned.Progress = &tmp
+	}
+	if j.Result != nil {
+		cloned.Result = make(Message, len(j.Result))
+		copy(cloned.Result, j.Result)
+	}
 	if j.Message != nil {
 		tmp := j.Message
 		j.Message = make([]byte, len(tmp))
@@ -225,6 +294,20 @@ func (j *Job) Nack(err error) error {
 	return j.Update()
 }
 
+// Cancel sets the job infos state to Cancelled.
+func (j *Job) Cancel() error {
+	j.Logger().Debugf("cancel %s ", j.ID())
+	j.FinishedAt = time.Now()
+	j.State = Cancelled
+	j.Event = nil
+	return j.Update()
+}
+
+// IsFinished returns true if the job is done, errored or cancelled.
+func (j *Job) IsFinished() bool {
+	return j.State == Done || j.State == Errored || j.State == Cancelled
+}
+
 // Update updates the job in couchdb
 func (j *Job) Update() error {
 	return couchdb.UpdateDoc(j, j)
@@ -235,15 +318,24 @@ func (j *Job) Create() error {
 	return couchdb.CreateDoc(j, j)
 }
 
-// WaitUntilDone will wait until the job is done. It will return an error if
-// the job has failed. And there is a timeout (10 minutes).
-func (j *Job) WaitUntilDone(db prefixer.Prefixer) error {
+// waitTimeout is the maximal duration for WaitUntilDone.
+const waitTimeout = 10 * time.Minute
+
+// WaitUntilDone will wait until the job is done, and returns its result (nil
+// if the job has no result). It will return an error if the job has failed or
+// has been cancelled, and ErrWaitTimeout if the job is not finished after 10
+// minutes.
+func (j *Job) WaitUntilDone(db prefixer.Prefixer) (Message, error) {
 	sub := realtime.GetHub().Subscriber(db)
 	defer sub.Close()
 	if err := sub.Watch(j.DocType(), j.ID()); err != nil {
-		return err
+		return nil, err
+	}
+	// The job may have finished before the subscription
+	if current, err := Get(db, j.ID()); err == nil && current.IsFinished() {
+		return current.finishedResult(db)
 	}
-	timeout := time.After(10 * time.Minute)
+	timeout := time.After(waitTimeout)
 	for {
 		select {
 		case e := <-sub.Channel:
@@ -259,16 +351,37 @@ func (j *Job) WaitUntilDone(db prefixer.Prefixer) error {
 			}
 			switch state {
 			case Done:
-				return nil
+				done, err := Get(db, j.ID())
+				if err != nil {
+					return nil, err
+				}
+				return done.finishedResult(db)
 			case Errored:
-				return errors.New("The konnector failed on account deletion")
+				return nil, ErrJobFailed
+			case Cancelled:
+				return nil, ErrJobCancelled
 			}
 		case <-timeout:
-			return nil
+			return nil, ErrWaitTimeout
 		}
 	}
 }
 
+// finishedResult returns the result of a finished job for WaitUntilDone.
+func (j *Job) finishedResult(db prefixer.Prefixer) (Message, error) {
+	switch j.State {
+	case Errored:
+		return nil, ErrJobFailed
+	case Cancelled:
+		return nil, ErrJobCancelled
+	}
+	result, err := j.GetResult(db)
+	if err == ErrNoResult {
+		err = nil
+	}
+	return result, err
+}
+
 // UnmarshalJSON implements json.Unmarshaler on Message. It should be retro-
 // compatible with the old Message representation { Data, Type }.
 func (m *Message) UnmarshalJSON(data []byte) error {
@@ -309,11 +422,15 @@ func NewJob(db prefixer.Prefixer, req *JobRequest) *Job {
 		Manual:      req.Manual,
 		Message:     req.Message,
 		Debounced:   req.Debounced,
+		Webhook:     req.Webhook,
 		Event:       req.Event,
 		Options:     req.Options,
 		ForwardLogs: req.ForwardLogs,
 		State:       Queued,
 		QueuedAt:    time.Now(),
+
+		WorkflowID:   req.WorkflowID,
+		WorkflowStep: req.WorkflowStep,
 	}
 }
 
@@ -430,7 +547,7 @@ func GetLastsJobs(jobs []*Job, workerType string) ([]*Job, error) {
 	// Ordering by QueuedAt before filtering jobs
 	sort.Slice(jobs, func(i, j int) bool { return jobs[i].QueuedAt.Before(jobs[j].QueuedAt) })
 
-	for _, state := range []State{Queued, Running, Done, Errored} {
+	for _, state := range []State{Queued, Running, Done, Errored, Cancelled} {
 		limit := defaultMaxLimits[state]
 
 		filtered := FilterByWorkerAndState(jobs, workerType, state, limit)
@@ -449,9 +566,17 @@ func NewMessage(data interface{}) (Message, error) {
 	return Message(b), nil
 }
 
-// NewEvent return a json encoded realtime.Event
+// NewEvent return a json encoded realtime.Event. The doctype of the document
+// is added, as it is not always in the JSON of the document.
 func NewEvent(data *realtime.Event) (Event, error) {
-	b, err := json.Marshal(data)
+	var doctype string
+	if data.Doc != nil {
+		doctype = data.Doc.DocType()
+	}
+	b, err := json.Marshal(struct {
+		*realtime.Event
+		DocType string `json:"doctype,omitempty"`
+	}{data, doctype})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,356 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// DeadLettersRetention is the duration after which the dead letters are
+	// removed.
+	DeadLettersRetention = 30 * 24 * time.Hour
+
+	deadLettersPageSize      = 100
+	deadLettersSweepInterval = 1 * time.Hour
+)
+
+// DeadLetter is a document for a job that has failed after all its retries,
+// for a worker that keeps them (see WorkerConfig.NoDeadLetters). It has all the
+// informations needed to push the job again, and the dead letters of all the
+// instances are stored in the global database.
+type DeadLetter struct {
+	DID        string      `json:"_id,omitempty"`
+	DRev       string      `json:"_rev,omitempty"`
+	Domain     string      `json:"domain"`
+	Prefix     string      `json:"prefix,omitempty"`
+	WorkerType string      `json:"worker"`
+	JobID      string      `json:"job_id"`
+	TriggerID  string      `json:"trigger_id,omitempty"`
+	Message    Message     `json:"message"`
+	Event      Event       `json:"event,omitempty"`
+	Options    *JobOptions `json:"options,omitempty"`
+	Error      string      `json:"error"`
+	FailedAt   time.Time   `json:"failed_at"`
+}
+
+// DeadLetterFilter is used to select some dead letters. The empty fields are
+// ignored, and the error is matched as a case-insensitive substring.
+type DeadLetterFilter struct {
+	WorkerType string
+	Domain     string
+	Error      string
+	Limit      int
+}
+
+// ID implements the couchdb.Doc interface
+func (d *DeadLetter) ID() string { return d.DID }
+
+// Rev implements the couchdb.Doc interface
+func (d *DeadLetter) Rev() string { return d.DRev }
+
+// DocType implements the couchdb.Doc interface
+func (d *DeadLetter) DocType() string { return consts.JobsDeadLetters }
+
+// SetID implements the couchdb.Doc interface
+func (d *DeadLetter) SetID(id string) { d.DID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (d *DeadLetter) SetRev(rev string) { d.DRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (d *DeadLetter) Clone() couchdb.Doc {
+	cloned := *d
+	if d.Options != nil {
+		tmp := *d.Options
+		cloned.Options = &tmp
+	}
+	return &cloned
+}
+
+// JobRequest returns a job request for executing again the job of the dead
+// letter.
+func (d *DeadLetter) JobRequest() *JobRequest {
+	return &JobRequest{
+		WorkerType: d.WorkerType,
+		TriggerID:  d.TriggerID,
+		Message:    d.Message,
+		Event:      d.Event,
+		Options:    d.Options,
+	}
+}
+
+func (d *DeadLetter) prefixer() prefixer.Prefixer {
+	prefix := d.Prefix
+	if prefix == "" {
+		prefix = d.Domain
+	}
+	return prefixer.NewPrefixer(d.Domain, prefix)
+}
+
+// viewKey returns the first two items of the keys of DeadLettersView for the
+// filter.
+func (f *DeadLetterFilter) viewKey() (string, string) {
+	switch {
+	case f.Domain != "" && f.WorkerType != "":
+		return "domain-worker", f.Domain + "/" + f.WorkerType
+	case f.Domain != "":
+		return "domain", f.Domain
+	case f.WorkerType != "":
+		return "worker", f.WorkerType
+	}
+	return "all", ""
+}
+
+func (f *DeadLetterFilter) match(d *DeadLetter) bool {
+	if f.WorkerType != "" && f.WorkerType != d.WorkerType {
+		return false
+	}
+	if f.Domain != "" && f.Domain != d.Domain {
+		return false
+	}
+	if f.Error != "" && !strings.Contains(strings.ToLower(d.Error), strings.ToLower(f.Error)) {
+		return false
+	}
+	return true
+}
+
+// addDeadLetter keeps the job that has failed with the given error in the
+// dead letters.
+func addDeadLetter(job *Job, errRun error) error {
+	d := &DeadLetter{
+		Domain:     job.Domain,
+		Prefix:     job.Prefix,
+		WorkerType: job.WorkerType,
+		JobID:      job.ID(),
+		TriggerID:  job.TriggerID,
+		Message:    job.Message,
+		Event:      job.Event,
+		Options:    job.Options,
+		Error:      errRun.Error(),
+		FailedAt:   time.Now().UTC(),
+	}
+	return couchdb.CreateDoc(couchdb.GlobalDB, d)
+}
+
+// GetDeadLetter returns the dead letter with the given identifier.
+func GetDeadLetter(id string) (*DeadLetter, error) {
+	var d DeadLetter
+	if err := couchdb.GetDoc(couchdb.GlobalDB, consts.JobsDeadLetters, id, &d); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrNotFoundDeadLetter
+		}
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ListDeadLetters returns the dead letters that match the filter, from the
+// most recent to the oldest.
+func ListDeadLetters(filter *DeadLetterFilter) ([]*DeadLetter, error) {
+	var list []*DeadLetter
+	err := forEachDeadLetter(filter, time.Time{}, func(d *DeadLetter) bool {
+		if filter.match(d) {
+			list = append(list, d)
+		}
+		return filter.Limit <= 0 || len(list) < filter.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// forEachDeadLetter calls fn for the dead letters of the domain and worker of
+// the filter, from the most recent to the oldest, until fn returns false. If
+// before is not zero, only the dead letters that have failed before this date
+// are used.
+func forEachDeadLetter(filter *DeadLetterFilter, before time.Time, fn func(d *DeadLetter) bool) error {
+	kind, value := filter.viewKey()
+	var startKey interface{} = []interface{}{kind, value, map[string]interface{}{}}
+	if !before.IsZero() {
+		startKey = []interface{}{kind, value, before.UTC()}
+	}
+	startDocID := ""
+	skip := 0
+	for {
+		req := &couchdb.ViewRequest{
+			StartKey:      startKey,
+			StartKeyDocID: startDocID,
+			EndKey:        []interface{}{kind, value},
+			Descending:    true,
+			IncludeDocs:   true,
+			Limit:         deadLettersPageSize,
+			Skip:          skip,
+		}
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(couchdb.GlobalDB, couchdb.DeadLettersView, req, &res)
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		if couchdb.IsNotFoundError(err) {
+			views := []*couchdb.View{couchdb.DeadLettersView}
+			if err = couchdb.DefineViews(couchdb.GlobalDB, views); err != nil {
+				return err
+			}
+			err = couchdb.ExecView(couchdb.GlobalDB, couchdb.DeadLettersView, req, &res)
+		}
+		if err != nil {
+			return err
+		}
+		for _, row := range res.Rows {
+			var d DeadLetter
+			if err := json.Unmarshal(row.Doc, &d); err != nil {
+				return err
+			}
+			if !fn(&d) {
+				return nil
+			}
+		}
+		if len(res.Rows) < deadLettersPageSize {
+			return nil
+		}
+		// The next page starts after the last row
+		last := res.Rows[len(res.Rows)-1]
+		startKey = last.Key
+		startDocID = last.ID
+		skip = 1
+	}
+}
+
+// PurgeDeadLetters removes the dead letters that have failed before the given
+// date. It returns the number of removed dead letters.
+func PurgeDeadLetters(before time.Time) (int, error) {
+	return deleteDeadLetters(&DeadLetterFilter{}, before)
+}
+
+// DeleteDeadLettersOfDomain removes all the dead letters of an instance, when
+// it is destroyed.
+func DeleteDeadLettersOfDomain(domain string) (int, error) {
+	return deleteDeadLetters(&DeadLetterFilter{Domain: domain}, time.Time{})
+}
+
+func deleteDeadLetters(filter *DeadLetterFilter, before time.Time) (int, error) {
+	var list []couchdb.Doc
+	err := forEachDeadLetter(filter, before, func(d *DeadLetter) bool {
+		list = append(list, d)
+		return true
+	})
+	if err != nil || len(list) == 0 {
+		return 0, err
+	}
+	if err = couchdb.BulkDeleteDocs(couchdb.GlobalDB, consts.JobsDeadLetters, list); err != nil {
+		return 0, err
+	}
+	return len(list), nil
+}
+
+// SweepDeadLetters starts a loop that removes the dead letters older than
+// DeadLettersRetention.
+func SweepDeadLetters() utils.Shutdowner {
+	closed := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(deadLettersSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				n, err := PurgeDeadLetters(now.Add(-DeadLettersRetention))
+				if err != nil {
+					logger.WithNamespace("jobs").
+						Errorf("Could not purge the dead letters: %s", err)
+				} else if n > 0 {
+					logger.WithNamespace("jobs").
+						Infof("%d dead letters have been purged", n)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &deadLettersSweeper{closed}
+}
+
+type deadLettersSweeper struct {
+	closed chan struct{}
+}
+
+func (s *deadLettersSweeper) Shutdown(ctx context.Context) error {
+	select {
+	case s.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// UpdateDeadLetterMessage changes the message of the job of a dead letter,
+// before replaying it.
+func UpdateDeadLetterMessage(id string, msg Message) (*DeadLetter, error) {
+	d, err := GetDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err = json.Unmarshal(msg, &v); err != nil {
+		return nil, ErrMessageUnmarshal
+	}
+	d.Message = msg
+	if err = couchdb.UpdateDoc(couchdb.GlobalDB, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DeleteDeadLetter removes a dead letter without executing its job again.
+func DeleteDeadLetter(id string) error {
+	d, err := GetDeadLetter(id)
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(couchdb.GlobalDB, d)
+}
+
+// Replay pushes again the job of the dead letter, and removes the dead letter.
+// If the new job fails, it will be added again to the dead letters.
+func (d *DeadLetter) Replay() (*Job, error) {
+	j, err := System().PushJob(d.prefixer(), d.JobRequest())
+	if err != nil {
+		return nil, err
+	}
+	if err = couchdb.DeleteDoc(couchdb.GlobalDB, d); err != nil {
+		return j, err
+	}
+	return j, nil
+}
+
+// ReplayDeadLetters replays the jobs of all the dead letters that match the
+// filter. It returns the new jobs, and the errors for the dead letters that
+// could not be replayed.
+func ReplayDeadLetters(filter *DeadLetterFilter) ([]*Job, error) {
+	list, err := ListDeadLetters(filter)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	var errm error
+	for _, d := range list {
+		j, err := d.Replay()
+		if j != nil {
+			jobs = append(jobs, j)
+		}
+		if err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	return jobs, errm
+}
+
+var _ couchdb.Doc = &DeadLetter{}
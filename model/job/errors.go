@@ -20,6 +20,27 @@ var (
 	ErrMessageNil = errors.New("jobs: message is nil")
 	// ErrMessageUnmarshal is used when unmarshalling a message causes an error
 	ErrMessageUnmarshal = errors.New("jobs: message unmarshal")
+	// ErrJobFinished is used when trying to cancel a job that is already
+	// finished
+	ErrJobFinished = errors.New("jobs: the job is already finished")
+	// ErrJobCancelled is used when the job has been cancelled during its
+	// execution
+	ErrJobCancelled = errors.New("jobs: the job has been cancelled")
+	// ErrJobFailed is used when waiting for a job that has failed
+	ErrJobFailed = errors.New("jobs: the job has failed")
+	// ErrWaitTimeout is used when a job is not finished after the maximal
+	// duration for waiting it
+	ErrWaitTimeout = errors.New("jobs: timeout while waiting for the job")
+	// ErrNotFoundDeadLetter is used when the dead letter could not be found
+	ErrNotFoundDeadLetter = errors.New("jobs: dead letter not found")
+	// ErrNoResult is used when the job has no result
+	ErrNoResult = errors.New("jobs: the job has no result")
+	// ErrResultTooLarge is used when the result of a job exceeds the maximal
+	// size
+	ErrResultTooLarge = errors.New("jobs: the result is too large")
+	// ErrInvalidRetryPolicy is used when the retry policy of a job cannot be
+	// used
+	ErrInvalidRetryPolicy = errors.New("jobs: invalid retry policy")
 	// ErrAbort can be used to abort the execution of the job without causing
 	// errors.
 	ErrAbort = errors.New("jobs: abort")
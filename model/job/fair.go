@@ -0,0 +1,179 @@
+package job
+
+import (
+	"container/list"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// instanceWeight returns the weight of an instance for the fair scheduling of
+// the jobs: it is the number of jobs of this instance that can be executed
+// each time it is its turn. It is configured by context, and defaults to 1.
+func instanceWeight(db prefixer.Prefixer) int {
+	weights := config.GetConfig().Jobs.Weights
+	if len(weights) == 0 || db.DomainName() == prefixer.GlobalPrefixer.DomainName() {
+		return 1
+	}
+	contextName := config.DefaultInstanceContext
+	inst, ok := db.(*instance.Instance)
+	if !ok {
+		var err error
+		inst, err = instance.GetFromCouch(db.DomainName())
+		if err != nil {
+			inst = nil
+		}
+	}
+	if inst != nil && inst.ContextName != "" {
+		contextName = inst.ContextName
+	}
+	if weight, ok := weights[contextName]; ok {
+		return weight
+	}
+	if weight, ok := weights[config.DefaultInstanceContext]; ok {
+		return weight
+	}
+	return 1
+}
+
+// release is called by the worker when it has finished with the job.
+func (j *Job) release() {
+	if j.releaseSlot != nil {
+		j.releaseSlot()
+	}
+}
+
+// fairQueue is a queue of jobs with a list for each instance. The instances
+// are served in a weighted round-robin order, and the instances that have
+// reached their concurrency limit are skipped. It is not safe for concurrent
+// use.
+type fairQueue struct {
+	maxPerInstance int
+	size           int
+	ring           []string // the prefixes of the instances with queued jobs
+	lists          map[string]*list.List
+	domains        map[string]string
+	weights        map[string]int
+	credits        map[string]int
+	running        map[string]int
+}
+
+func newFairQueue(maxPerInstance int) *fairQueue {
+	return &fairQueue{
+		maxPerInstance: maxPerInstance,
+		lists:          make(map[string]*list.List),
+		domains:        make(map[string]string),
+		weights:        make(map[string]int),
+		credits:        make(map[string]int),
+		running:        make(map[string]int),
+	}
+}
+
+// push adds a job at the end of the list of its instance.
+func (q *fairQueue) push(job *Job, weight int) {
+	prefix := job.DBPrefix()
+	l, ok := q.lists[prefix]
+	if !ok {
+		l = list.New()
+		q.lists[prefix] = l
+		q.ring = append(q.ring, prefix)
+		q.domains[prefix] = job.Domain
+	}
+	q.weights[prefix] = weight
+	l.PushBack(job)
+	q.size++
+}
+
+// pop returns the next job to execute, or nil if there is no job that can be
+// executed now.
+func (q *fairQueue) pop() *Job {
+	for i := 0; i < len(q.ring); i++ {
+		prefix := q.ring[0]
+		if q.maxPerInstance > 0 && q.running[prefix] >= q.maxPerInstance {
+			q.rotate()
+			continue
+		}
+		l := q.lists[prefix]
+		job := l.Remove(l.Front()).(*Job)
+		q.size--
+		if q.maxPerInstance > 0 {
+			q.running[prefix]++
+		}
+		if l.Len() == 0 {
+			q.drop(prefix)
+		} else if q.credits[prefix]++; q.credits[prefix] >= q.weights[prefix] {
+			delete(q.credits, prefix)
+			q.rotate()
+		}
+		return job
+	}
+	return nil
+}
+
+// done is called when a job returned by pop has been executed.
+func (q *fairQueue) done(prefix string) {
+	if q.running[prefix] <= 1 {
+		delete(q.running, prefix)
+	} else {
+		q.running[prefix]--
+	}
+}
+
+// remove removes the job with the given identifier from the queue, and
+// returns true if it was found.
+func (q *fairQueue) remove(prefix, jobID string) bool {
+	l, ok := q.lists[prefix]
+	if !ok {
+		return false
+	}
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Job).ID() == jobID {
+			l.Remove(e)
+			q.size--
+			if l.Len() == 0 {
+				q.drop(prefix)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// limited returns true if the jobs count for the concurrency limit of their
+// instance.
+func (q *fairQueue) limited() bool {
+	return q.maxPerInstance > 0
+}
+
+func (q *fairQueue) len() int {
+	return q.size
+}
+
+// lenByDomain returns the number of queued jobs for each instance.
+func (q *fairQueue) lenByDomain() map[string]int {
+	lens := make(map[string]int, len(q.lists))
+	for prefix, l := range q.lists {
+		lens[q.domains[prefix]] += l.Len()
+	}
+	return lens
+}
+
+func (q *fairQueue) rotate() {
+	if len(q.ring) > 1 {
+		q.ring = append(q.ring[1:], q.ring[0])
+	}
+}
+
+func (q *fairQueue) drop(prefix string) {
+	for i, p := range q.ring {
+		if p == prefix {
+			q.ring = append(q.ring[:i], q.ring[i+1:]...)
+			break
+		}
+	}
+	delete(q.lists, prefix)
+	delete(q.domains, prefix)
+	delete(q.weights, prefix)
+	delete(q.credits, prefix)
+}
@@ -1,13 +1,14 @@
 package job
 
 import (
-	"container/list"
 	"context"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	multierror "github.com/hashicorp/go-multierror"
@@ -16,14 +17,17 @@ import (
 
 type (
 	// memQueue is a queue in-memory implementation of the Queue interface.
+	// The jobs of the different instances are scheduled fairly (see
+	// fairQueue).
 	memQueue struct {
 		MaxCapacity int
 		Jobs        chan *Job
 		closed      chan struct{}
 
-		list *list.List
-		run  bool
-		jmu  sync.RWMutex
+		fair    *fairQueue
+		run     bool
+		closing bool
+		jmu     sync.RWMutex
 	}
 
 	// memBroker is an in-memory broker implementation of the Broker interface.
@@ -36,48 +40,78 @@ type (
 )
 
 // newMemQueue creates and a new in-memory queue.
-func newMemQueue(workerType string) *memQueue {
+func newMemQueue(conf *WorkerConfig) *memQueue {
 	return &memQueue{
-		list:   list.New(),
+		fair:   newFairQueue(conf.InstanceConcurrency),
 		Jobs:   make(chan *Job),
 		closed: make(chan struct{}),
 	}
 }
 
 // Enqueue into the queue
-func (q *memQueue) Enqueue(job *Job) error {
+func (q *memQueue) Enqueue(job *Job, weight int) error {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
-	q.list.PushBack(job.Clone())
-	if !q.run {
+	q.fair.push(job.Clone().(*Job), weight)
+	q.start()
+	return nil
+}
+
+// start launches the goroutine that sends the jobs to the workers, if it is
+// not already running. It must be called with the lock.
+func (q *memQueue) start() {
+	if !q.run && !q.closing && q.fair.len() > 0 {
 		q.run = true
 		go q.send()
 	}
-	return nil
 }
 
 func (q *memQueue) send() {
 	for {
 		q.jmu.Lock()
-		e := q.list.Front()
-		if e == nil || !q.run {
+		var job *Job
+		if q.run {
+			job = q.fair.pop()
+		}
+		if job == nil {
 			q.run = false
 			q.jmu.Unlock()
 			return
 		}
-		q.list.Remove(e)
+		if q.fair.limited() {
+			prefix := job.DBPrefix()
+			job.releaseSlot = func() { q.release(prefix) }
+		}
 		q.jmu.Unlock()
 		select {
 		case <-q.closed:
 			return
-		case q.Jobs <- e.Value.(*Job):
+		case q.Jobs <- job:
 		}
 	}
 }
 
+// release is called when a job of the given instance has been executed, to
+// free its slot for the concurrency limit of the instance.
+func (q *memQueue) release(prefix string) {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	q.fair.done(prefix)
+	q.start()
+}
+
+// Remove removes the job with the given identifier from the queue, and
+// returns true if it was found.
+func (q *memQueue) Remove(db prefixer.Prefixer, jobID string) bool {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	return q.fair.remove(db.DBPrefix(), jobID)
+}
+
 func (q *memQueue) close() {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
+	q.closing = true
 	if !q.run {
 		return
 	}
@@ -89,7 +123,14 @@ func (q *memQueue) close() {
 func (q *memQueue) Len() int {
 	q.jmu.RLock()
 	defer q.jmu.RUnlock()
-	return q.list.Len()
+	return q.fair.len()
+}
+
+// LenByDomain returns the number of jobs in the queue for each instance.
+func (q *memQueue) LenByDomain() map[string]int {
+	q.jmu.RLock()
+	defer q.jmu.RUnlock()
+	return q.fair.lenByDomain()
 }
 
 // NewMemBroker creates a new in-memory broker system.
@@ -112,8 +153,9 @@ func (b *memBroker) StartWorkers(ws WorkersList) error {
 		if conf.Concurrency <= 0 {
 			continue
 		}
-		q := newMemQueue(conf.WorkerType)
+		q := newMemQueue(conf)
 		w := NewWorker(conf)
+		w.broker = b
 		b.queues[conf.WorkerType] = q
 		b.workers = append(b.workers, w)
 		if err := w.Start(q.Jobs); err != nil {
@@ -214,17 +256,71 @@ func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error)
 		}
 	}
 
-	if err := job.Create(); err != nil {
+	if err := createJob(job, req); err != nil {
 		return nil, err
 	}
 
 	q := b.queues[workerType]
-	if err := q.Enqueue(job); err != nil {
+	if err := q.Enqueue(job, instanceWeight(db)); err != nil {
 		return nil, err
 	}
 	return job, nil
 }
 
+// RetryJob pushes again the job in its queue after the delay. If the job is
+// cancelled in the meantime, the worker will skip it when acking it, as its
+// revision will have changed.
+func (b *memBroker) RetryJob(job *Job, delay time.Duration) error {
+	q, ok := b.queues[job.WorkerType]
+	if !ok {
+		return ErrUnknownWorker
+	}
+	cloned := job.Clone().(*Job)
+	cloned.releaseSlot = nil
+	weight := instanceWeight(job)
+	time.AfterFunc(delay, func() {
+		if atomic.LoadUint32(&b.running) == 0 {
+			return
+		}
+		_ = q.Enqueue(cloned, weight)
+	})
+	return nil
+}
+
+// CancelJob removes the job from its queue if it is still queued, or cancels
+// its execution if it is running.
+func (b *memBroker) CancelJob(db prefixer.Prefixer, jobID string) (*Job, error) {
+	job, err := Get(db, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job.IsFinished() {
+		return nil, ErrJobFinished
+	}
+	if cancelRunningJob(db, jobID) {
+		return job, nil
+	}
+	if q, ok := b.queues[job.WorkerType]; ok {
+		q.Remove(db, jobID)
+	}
+	// If the job was not in the queue, it is being sent to a worker, and the
+	// worker will skip it when acking it, as its revision will have changed.
+	if err := job.Cancel(); err != nil {
+		if !couchdb.IsConflictError(err) {
+			return nil, err
+		}
+		// The worker has started the job in the meantime
+		cancelRunningJob(db, jobID)
+		return Get(db, jobID)
+	}
+	if job.WorkflowID != "" {
+		if err := continueWorkflow(job, nil); err != nil {
+			job.Logger().Warnf("Cannot update the workflow %s: %s", job.WorkflowID, err)
+		}
+	}
+	return job, nil
+}
+
 // WorkerQueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *memBroker) WorkerQueueLen(workerType string) (int, error) {
@@ -235,6 +331,16 @@ func (b *memBroker) WorkerQueueLen(workerType string) (int, error) {
 	return q.Len(), nil
 }
 
+// WorkerQueueLenByDomain returns the number of elements in queue of the
+// specified worker type for each instance.
+func (b *memBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	q, ok := b.queues[workerType]
+	if !ok {
+		return nil, ErrUnknownWorker
+	}
+	return q.LenByDomain(), nil
+}
+
 func (b *memBroker) WorkerIsReserved(workerType string) (bool, error) {
 	for _, w := range b.workers {
 		if w.Type == workerType {
@@ -2,9 +2,11 @@ package job_test
 
 import (
 	"encoding/json"
+	"errors"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -235,6 +237,429 @@ func TestRetry(t *testing.T) {
 	w.Wait()
 }
 
+func TestCancelJob(t *testing.T) {
+	var w sync.WaitGroup
+	started := make(chan struct{})
+	committed := make(chan error, 1)
+
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "cancel",
+			Concurrency:  1,
+			MaxExecCount: 3,
+			Timeout:      10 * time.Second,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				w.Done()
+				return ctx.Err()
+			},
+			WorkerCommit: func(ctx *jobs.WorkerContext, errjob error) error {
+				committed <- errjob
+				return nil
+			},
+		},
+	}))
+
+	w.Add(1)
+	running, err := broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "cancel",
+		Message:    nil,
+	})
+	assert.NoError(t, err)
+	queued, err := broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "cancel",
+		Message:    nil,
+	})
+	assert.NoError(t, err)
+	<-started
+
+	// The second job is still in the queue
+	j, err := broker.CancelJob(testInstance, queued.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Cancelled, j.State)
+	_, err = broker.CancelJob(testInstance, queued.ID())
+	assert.Equal(t, jobs.ErrJobFinished, err)
+
+	_, err = queued.WaitUntilDone(testInstance)
+	assert.Equal(t, jobs.ErrJobCancelled, err)
+
+	// The first job is running
+	waited := make(chan error, 1)
+	go func() {
+		_, err := running.WaitUntilDone(testInstance)
+		waited <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	j, err = broker.CancelJob(testInstance, running.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Running, j.State)
+	w.Wait()
+	assert.Equal(t, jobs.ErrJobCancelled, <-committed)
+	select {
+	case err = <-waited:
+		assert.Equal(t, jobs.ErrJobCancelled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitUntilDone has not returned for the cancelled job")
+	}
+
+	for i := 0; i < 10; i++ {
+		if j, err = jobs.Get(testInstance, running.ID()); err == nil && j.State == jobs.Cancelled {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, jobs.Cancelled, j.State)
+	n, err := broker.WorkerQueueLen("cancel")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestDeadLetters(t *testing.T) {
+	var w sync.WaitGroup
+
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "dead-letters",
+			Concurrency:  1,
+			MaxExecCount: 2,
+			RetryDelay:   1 * time.Millisecond,
+			Timeout:      1 * time.Second,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				w.Done()
+				return errors.New("Connection Refused")
+			},
+		},
+	}))
+
+	w.Add(2)
+	msg, _ := jobs.NewMessage("foo")
+	j, err := broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "dead-letters",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+	w.Wait()
+
+	filter := &jobs.DeadLetterFilter{
+		WorkerType: "dead-letters",
+		Domain:     testInstance.Domain,
+		Error:      "connection refused",
+	}
+	var list []*jobs.DeadLetter
+	for i := 0; i < 50; i++ {
+		list, err = jobs.ListDeadLetters(filter)
+		if err == nil && len(list) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		d := list[0]
+		assert.Equal(t, j.ID(), d.JobID)
+		assert.Equal(t, "Connection Refused", d.Error)
+		assert.JSONEq(t, `"foo"`, string(d.Message))
+
+		d, err = jobs.UpdateDeadLetterMessage(d.ID(), jobs.Message(`"bar"`))
+		assert.NoError(t, err)
+		assert.JSONEq(t, `"bar"`, string(d.Message))
+		_, err = jobs.UpdateDeadLetterMessage(d.ID(), jobs.Message(`{`))
+		assert.Equal(t, jobs.ErrMessageUnmarshal, err)
+
+		assert.NoError(t, jobs.DeleteDeadLetter(d.ID()))
+		_, err = jobs.GetDeadLetter(d.ID())
+		assert.Equal(t, jobs.ErrNotFoundDeadLetter, err)
+	}
+
+	filter.Error = "timeout"
+	list, err = jobs.ListDeadLetters(filter)
+	assert.NoError(t, err)
+	assert.Len(t, list, 0)
+
+	w.Add(2)
+	_, err = broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "dead-letters",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+	w.Wait()
+	filter.Error = ""
+	for i := 0; i < 50; i++ {
+		list, err = jobs.ListDeadLetters(filter)
+		if err == nil && len(list) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	// The recent dead letters are not purged
+	_, err = jobs.PurgeDeadLetters(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	list, err = jobs.ListDeadLetters(filter)
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	n, err := jobs.DeleteDeadLettersOfDomain(testInstance.Domain)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	list, err = jobs.ListDeadLetters(filter)
+	assert.NoError(t, err)
+	assert.Len(t, list, 0)
+}
+
+func TestMemBrokerFairness(t *testing.T) {
+	var w sync.WaitGroup
+	var mu sync.Mutex
+	var domains []string
+	running := make(map[string]int)
+	maxRunning := make(map[string]int)
+	gate := make(chan struct{})
+	started := make(chan struct{}, 10)
+
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:          "fair",
+			Concurrency:         2,
+			InstanceConcurrency: 1,
+			MaxExecCount:        1,
+			Timeout:             10 * time.Second,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				var domain string
+				if err := ctx.UnmarshalMessage(&domain); err != nil {
+					return err
+				}
+				mu.Lock()
+				domains = append(domains, domain)
+				running[domain]++
+				if running[domain] > maxRunning[domain] {
+					maxRunning[domain] = running[domain]
+				}
+				mu.Unlock()
+				started <- struct{}{}
+				<-gate
+				mu.Lock()
+				running[domain]--
+				mu.Unlock()
+				w.Done()
+				return nil
+			},
+		},
+	}))
+
+	n := 5
+	w.Add(n + 1)
+	for i := 0; i < n; i++ {
+		msg, _ := jobs.NewMessage(testInstance.Domain)
+		_, err := broker.PushJob(testInstance, &jobs.JobRequest{
+			WorkerType: "fair",
+			Message:    msg,
+		})
+		assert.NoError(t, err)
+	}
+	msg, _ := jobs.NewMessage(prefixer.GlobalPrefixer.DomainName())
+	_, err := broker.PushJob(prefixer.GlobalPrefixer, &jobs.JobRequest{
+		WorkerType: "fair",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+
+	// Only one job of the instance can be executed at the same time
+	<-started
+	<-started
+	lens, err := broker.WorkerQueueLenByDomain("fair")
+	assert.NoError(t, err)
+	assert.Equal(t, n-1, lens[testInstance.Domain])
+
+	close(gate)
+	w.Wait()
+
+	// The job of the other instance is executed before most of the jobs of
+	// the instance that has pushed a lot of jobs
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, domains, n+1) {
+		idx := -1
+		for i, domain := range domains {
+			if domain == prefixer.GlobalPrefixer.DomainName() {
+				idx = i
+			}
+		}
+		assert.True(t, idx >= 0 && idx <= 2)
+	}
+	assert.Equal(t, 1, maxRunning[testInstance.Domain])
+}
+
+func TestReportProgress(t *testing.T) {
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "progress",
+			Concurrency:  1,
+			MaxExecCount: 1,
+			Timeout:      1 * time.Second,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				for i := int64(1); i <= 5; i++ {
+					ctx.ReportProgress(i, 5, "step "+strconv.FormatInt(i, 10))
+				}
+				return nil
+			},
+		},
+	}))
+
+	msg, _ := jobs.NewMessage("foo")
+	j, err := broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "progress",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		if j, err = jobs.Get(testInstance, j.ID()); err == nil && j.State == jobs.Done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Done, j.State)
+	if assert.NotNil(t, j.Progress) {
+		assert.EqualValues(t, 5, j.Progress.Done)
+		assert.EqualValues(t, 5, j.Progress.Total)
+		assert.Equal(t, "step 5", j.Progress.Message)
+	}
+	// created, running, first progress, last progress, done: the progress
+	// between them has been throttled
+	assert.True(t, strings.HasPrefix(j.Rev(), "5-"))
+}
+
+func TestJobResult(t *testing.T) {
+	gate := make(chan struct{})
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "result",
+			Concurrency:  1,
+			MaxExecCount: 1,
+			Timeout:      5 * time.Second,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				<-gate
+				var size int
+				if err := ctx.UnmarshalMessage(&size); err != nil {
+					return err
+				}
+				return ctx.SetResult(map[string]string{"data": strings.Repeat("a", size)})
+			},
+		},
+	}))
+
+	// The second result is too large to be kept in the job document
+	for _, size := range []int{10, 64 * 1024} {
+		msg, _ := jobs.NewMessage(size)
+		j, err := broker.PushJob(testInstance, &jobs.JobRequest{
+			WorkerType: "result",
+			Message:    msg,
+		})
+		assert.NoError(t, err)
+		time.AfterFunc(10*time.Millisecond, func() { gate <- struct{}{} })
+		result, err := j.WaitUntilDone(testInstance)
+		assert.NoError(t, err)
+		var res map[string]string
+		assert.NoError(t, json.Unmarshal(result, &res))
+		assert.Len(t, res["data"], size)
+
+		j, err = jobs.Get(testInstance, j.ID())
+		assert.NoError(t, err)
+		if size < 1024 {
+			assert.NotEmpty(t, j.Result)
+			assert.False(t, j.ResultInFile)
+		} else {
+			assert.Empty(t, j.Result)
+			assert.True(t, j.ResultInFile)
+		}
+		assert.NoError(t, j.DeleteResult(testInstance))
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var count, commits int32
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "retry",
+			Concurrency:  1,
+			MaxExecCount: 1,
+			Timeout:      5 * time.Second,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				var msg string
+				if err := ctx.UnmarshalMessage(&msg); err != nil {
+					return err
+				}
+				if msg == "login" {
+					return errors.New("LOGIN_FAILED")
+				}
+				if atomic.AddInt32(&count, 1) <= 2 {
+					return errors.New("VENDOR_DOWN")
+				}
+				return nil
+			},
+			WorkerCommit: func(ctx *jobs.WorkerContext, errjob error) error {
+				atomic.AddInt32(&commits, 1)
+				return nil
+			},
+		},
+	}))
+
+	policy := &jobs.RetryPolicy{
+		Strategy:   jobs.RetryExponential,
+		MaxRetries: 3,
+		BaseDelay:  "10ms",
+		RetryOn:    []string{"VENDOR_DOWN"},
+	}
+	msg, _ := jobs.NewMessage("vendor")
+	j, err := broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "retry",
+		Message:    msg,
+		Options:    &jobs.JobOptions{Retry: policy},
+	})
+	assert.NoError(t, err)
+	_, err = j.WaitUntilDone(testInstance)
+	assert.NoError(t, err)
+	j, err = jobs.Get(testInstance, j.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Done, j.State)
+	assert.Equal(t, 2, j.Retries)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&count))
+	// The commit is not called for the attempts that are retried
+	assert.EqualValues(t, 1, atomic.LoadInt32(&commits))
+
+	// The other errors are not retried
+	msg, _ = jobs.NewMessage("login")
+	j, err = broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "retry",
+		Message:    msg,
+		Options:    &jobs.JobOptions{Retry: policy},
+	})
+	assert.NoError(t, err)
+	_, err = j.WaitUntilDone(testInstance)
+	assert.Error(t, err)
+	j, err = jobs.Get(testInstance, j.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Errored, j.State)
+	assert.Equal(t, 0, j.Retries)
+
+	// An invalid policy is rejected
+	_, err = broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "retry",
+		Message:    msg,
+		Options:    &jobs.JobOptions{Retry: &jobs.RetryPolicy{Strategy: "fibonacci"}},
+	})
+	assert.Equal(t, jobs.ErrInvalidRetryPolicy, err)
+}
+
 func TestPanicRetried(t *testing.T) {
 	var w sync.WaitGroup
 
@@ -0,0 +1,164 @@
+package job
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// WebhookWorkerType is the type of the worker that sends the events of an
+	// @event trigger to an outgoing webhook.
+	WebhookWorkerType = "webhook"
+
+	// maxWebhookFailures is the number of consecutive failed deliveries after
+	// which an outgoing webhook is disabled.
+	maxWebhookFailures = 20
+	// maxWebhookDeliveries is the number of deliveries kept in the log of an
+	// outgoing webhook.
+	maxWebhookDeliveries = 20
+)
+
+// ErrInvalidWebhookURL is used when the URL of an outgoing webhook is missing,
+// is not an HTTP(S) URL, or is for a loopback or private address.
+var ErrInvalidWebhookURL = errors.New("jobs: invalid webhook URL")
+
+// defaultWebhookRetry is the retry policy used for the outgoing webhooks when
+// the trigger has none.
+var defaultWebhookRetry = RetryPolicy{
+	Strategy:   RetryExponential,
+	MaxRetries: 5,
+	BaseDelay:  "1m",
+	MaxDelay:   "1h",
+	Jitter:     0.2,
+}
+
+// WebhookMessage is the message of a trigger for an outgoing webhook.
+type WebhookMessage struct {
+	URL string `json:"url"`
+}
+
+// OutgoingWebhook contains the informations specific to an @event trigger
+// that sends the events to an external URL: the key used to sign the
+// requests, and the state of the deliveries.
+type OutgoingWebhook struct {
+	Secret     string             `json:"secret"`
+	Failures   int                `json:"failures,omitempty"`
+	DisabledAt *time.Time         `json:"disabled_at,omitempty"`
+	Deliveries []*WebhookDelivery `json:"deliveries,omitempty"`
+}
+
+// WebhookDelivery is an entry in the log of the deliveries of an outgoing
+// webhook.
+type WebhookDelivery struct {
+	JobID      string    `json:"job_id"`
+	EventID    string    `json:"event_id,omitempty"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Duration   int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// newOutgoingWebhook checks the URL of a new trigger for an outgoing webhook,
+// and generates the secret used to sign its requests. The default retry
+// policy is also set if the trigger has none.
+func newOutgoingWebhook(infos *TriggerInfos) (*OutgoingWebhook, error) {
+	if infos.Type != "@event" {
+		return nil, ErrMalformedTrigger
+	}
+	var msg WebhookMessage
+	if err := infos.Message.Unmarshal(&msg); err != nil {
+		return nil, ErrInvalidWebhookURL
+	}
+	u, err := url.Parse(msg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+	if !config.GetConfig().Jobs.AllowPrivateWebhooks && !isPublicHost(u.Hostname()) {
+		return nil, ErrInvalidWebhookURL
+	}
+	if infos.Options == nil {
+		infos.Options = &JobOptions{}
+	}
+	if infos.Options.Retry == nil {
+		retry := defaultWebhookRetry
+		infos.Options.Retry = &retry
+	}
+	return &OutgoingWebhook{Secret: utils.RandomString(webhookSecretLen)}, nil
+}
+
+// isPublicHost returns false for the hosts that are obviously not on internet.
+// The domains are resolved only when the webhook is called, and the HTTP
+// client of the webhook worker rejects the private addresses at this time.
+func isPublicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return utils.IsPublicIP(ip)
+	}
+	return true
+}
+
+// Disabled returns true if the trigger is for an outgoing webhook that has
+// been disabled.
+func (t *TriggerInfos) Disabled() bool {
+	return t.Outgoing != nil && t.Outgoing.DisabledAt != nil
+}
+
+// addDelivery adds the delivery to the log, and updates the count of
+// consecutive failures. The webhook is disabled when there are too many
+// failures, or if disable is true.
+func (w *OutgoingWebhook) addDelivery(delivery *WebhookDelivery, disable bool) {
+	w.Deliveries = append(w.Deliveries, delivery)
+	if len(w.Deliveries) > maxWebhookDeliveries {
+		w.Deliveries = w.Deliveries[len(w.Deliveries)-maxWebhookDeliveries:]
+	}
+	if delivery.Error == "" {
+		w.Failures = 0
+		return
+	}
+	w.Failures++
+	if w.DisabledAt == nil && (disable || w.Failures >= maxWebhookFailures) {
+		at := delivery.At
+		w.DisabledAt = &at
+	}
+}
+
+// RecordWebhookDelivery saves a delivery in the log of the outgoing webhook of
+// the given trigger. It returns true if the webhook is disabled.
+func RecordWebhookDelivery(db prefixer.Prefixer, triggerID string, delivery *WebhookDelivery, disable bool) (bool, error) {
+	var err error
+	// The trigger can be updated by several jobs at the same time
+	for i := 0; i < 3; i++ {
+		var infos TriggerInfos
+		if err = couchdb.GetDoc(db, consts.Triggers, triggerID, &infos); err != nil {
+			if couchdb.IsNotFoundError(err) {
+				return false, ErrNotFoundTrigger
+			}
+			return false, err
+		}
+		if infos.Outgoing == nil {
+			return false, ErrMalformedTrigger
+		}
+		infos.Outgoing.addDelivery(delivery, disable)
+		err = couchdb.UpdateDoc(db, &infos)
+		if err == nil {
+			return infos.Disabled(), nil
+		}
+		if !couchdb.IsConflictError(err) {
+			return false, err
+		}
+	}
+	return false, err
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/go-redis/redis/v7"
@@ -21,8 +23,115 @@ const (
 	redisPrefix = "j/"
 	// redisHighPrioritySuffix suffix is the suffix used for prioritized queue.
 	redisHighPrioritySuffix = "/p0"
+	// redisCancelChannel is the pub/sub channel used to ask the stacks to
+	// cancel a running job.
+	redisCancelChannel = "jobs/cancel"
+	// minSlotTTL is the minimal TTL in seconds of the counter of the running
+	// jobs of an instance.
+	minSlotTTL = 60
 )
 
+// The jobs of a worker type are queued in a list per instance, and the
+// instances that have queued jobs are in a ring. A stack takes the instance
+// at the end of the ring, pops a job from its list, and moves it to the start
+// of the ring when the instance has used its weight (the number of jobs taken
+// in a row). An instance that has reached its concurrency limit is skipped.
+// These scripts are used to keep the lists, the ring, and the counters
+// consistent.
+
+// luaFairPush pushes a job in the list of its instance, adds the instance to
+// the ring if needed, and wakes up a stack waiting for jobs (the wake list is
+// trimmed to 10 tokens).
+//
+// KEYS: list, ring, domains, weights, wake
+// ARGV: prefix, job, domain, weight
+const luaFairPush = `
+if redis.call("LPUSH", KEYS[1], ARGV[2]) == 1 then
+  redis.call("LPUSH", KEYS[2], ARGV[1])
+  redis.call("HSET", KEYS[3], ARGV[1], ARGV[3])
+end
+redis.call("HSET", KEYS[4], ARGV[1], ARGV[4])
+redis.call("LPUSH", KEYS[5], 1)
+redis.call("LTRIM", KEYS[5], 0, 9)
+return 1`
+
+// luaFairPop pops a job from the list of the instance at the end of the
+// ring, or returns nil if no job of this instance can be executed now. The
+// instance is read from the ring before calling the script, as all the keys
+// must be given to the script (they share the same hash tag, so that they are
+// in the same slot with Redis Cluster): nil is also returned if another stack
+// has changed the end of the ring in the meantime.
+//
+// KEYS: ring, domains, weights, credits, list, counter
+// ARGV: prefix, concurrency limit, TTL
+const luaFairPop = `
+if redis.call("LINDEX", KEYS[1], -1) ~= ARGV[1] then
+  return false
+end
+local max = tonumber(ARGV[2])
+if max > 0 and tonumber(redis.call("GET", KEYS[6]) or "0") >= max then
+  redis.call("RPOPLPUSH", KEYS[1], KEYS[1])
+  return false
+end
+local val = redis.call("RPOP", KEYS[5])
+if val and max > 0 then
+  redis.call("INCR", KEYS[6])
+  redis.call("EXPIRE", KEYS[6], ARGV[3])
+end
+if redis.call("LLEN", KEYS[5]) == 0 then
+  redis.call("LREM", KEYS[1], 0, ARGV[1])
+  redis.call("HDEL", KEYS[2], ARGV[1])
+  redis.call("HDEL", KEYS[3], ARGV[1])
+  redis.call("HDEL", KEYS[4], ARGV[1])
+elseif redis.call("HINCRBY", KEYS[4], ARGV[1], 1) >= tonumber(redis.call("HGET", KEYS[3], ARGV[1]) or "1") then
+  redis.call("HDEL", KEYS[4], ARGV[1])
+  redis.call("RPOPLPUSH", KEYS[1], KEYS[1])
+end
+return val`
+
+// luaFairRelease decrements the counter of running jobs of an instance, and
+// wakes up a stack, as a job of this instance can now be executed.
+//
+// KEYS: counter, wake
+const luaFairRelease = `
+if redis.call("DECR", KEYS[1]) <= 0 then
+  redis.call("DEL", KEYS[1])
+end
+redis.call("LPUSH", KEYS[2], 1)
+redis.call("LTRIM", KEYS[2], 0, 9)
+return 1`
+
+// redisQueueKeys are the keys used in redis for the queue of a worker type.
+type redisQueueKeys struct {
+	main     string // the queue of the jobs pushed before the fair scheduling
+	priority string
+	ring     string
+	domains  string
+	weights  string
+	credits  string
+	wake     string
+	lists    string
+	running  string
+}
+
+func newRedisQueueKeys(workerType string) redisQueueKeys {
+	key := redisPrefix + workerType
+	// The {} is a hash tag for Redis Cluster: the keys used by the lua
+	// scripts for the fair scheduling are in the same slot.
+	fair := redisPrefix + "{" + workerType + "}"
+	return redisQueueKeys{
+		main:     key,
+		priority: key + redisHighPrioritySuffix,
+		ring:     fair + "/ring",
+		domains:  fair + "/domains",
+		weights:  fair + "/weights",
+		credits:  fair + "/credits",
+		wake:     fair + "/wake",
+		lists:    fair + "/i/",
+		running:  fair + "/running/",
+	}
+}
+
 type redisBroker struct {
 	client         redis.UniversalClient
 	workers        []*Worker
@@ -30,6 +139,7 @@ type redisBroker struct {
 	workersTypes   []string
 	running        uint32
 	closed         chan struct{}
+	cancels        *redis.PubSub
 }
 
 // NewRedisBroker creates a new broker that will use redis to distribute
@@ -50,6 +160,7 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 	for _, conf := range ws {
 		b.workersTypes = append(b.workersTypes, conf.WorkerType)
 		w := NewWorker(conf)
+		w.broker = b
 		b.workers = append(b.workers, w)
 		if conf.Concurrency <= 0 {
 			continue
@@ -59,10 +170,12 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 		if err := w.Start(ch); err != nil {
 			return err
 		}
-		go b.pollLoop(redisPrefix+conf.WorkerType, ch)
+		go b.pollLoop(w, ch)
 	}
 
 	if len(b.workersRunning) > 0 {
+		b.cancels = b.client.Subscribe(redisCancelChannel)
+		go b.cancelLoop(b.cancels.Channel())
 		joblog.Infof("Started redis broker for %d workers type", len(b.workersRunning))
 	}
 
@@ -90,6 +203,9 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 
 	fmt.Print("  shutting down redis broker...")
 	defer b.client.Close()
+	if b.cancels != nil {
+		_ = b.cancels.Close()
+	}
 
 	for i := 0; i < len(b.workersRunning); i++ {
 		select {
@@ -122,39 +238,59 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 
 var redisBRPopTimeout = 10 * time.Second
 
-func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
+func (b *redisBroker) pollLoop(w *Worker, ch chan<- *Job) {
 	defer func() {
 		b.closed <- struct{}{}
 	}()
 
+	keys := newRedisQueueKeys(w.Type)
+	conf := w.defaultedConf(nil)
+	// The TTL of the counters of running jobs is refreshed while the jobs are
+	// running (see keepSlot).
+	ttl := int64((conf.Timeout * time.Duration(conf.MaxExecCount+1)).Seconds())
+	if ttl < minSlotTTL {
+		ttl = minSlotTTL
+	}
+	limited := conf.InstanceConcurrency > 0
+
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for {
 		if atomic.LoadUint32(&b.running) == 0 {
 			return
 		}
 
-		// The brpop redis command will always take elements in priority from the
-		// first key containing elements at the call. By always priorizing the
-		// manual queue, this would cause a starvation for our main queue if too
-		// many "manual" jobs are pushed. By randomizing the order we make sure we
-		// avoid such starvation. For one in three call, the main queue is
-		// selected.
-		keyP0 := key + redisHighPrioritySuffix
-		keyP1 := key
+		// By always priorizing the manual queue, this would cause a starvation
+		// for the other jobs if too many "manual" jobs are pushed. By
+		// randomizing the order we make sure we avoid such starvation. For one
+		// in three call, the instances queues are selected first.
+		var val string
+		var fair bool
 		if rng.Intn(3) == 0 {
-			keyP1, keyP0 = keyP0, keyP1
-		}
-		results, err := b.client.BRPop(redisBRPopTimeout, keyP0, keyP1).Result()
-		if err != nil || len(results) < 2 {
-			time.Sleep(100 * time.Millisecond)
-			continue
+			val, fair = b.popFair(keys, conf.InstanceConcurrency, ttl), true
+			if val == "" {
+				val, fair = b.popPriority(keys), false
+			}
+		} else {
+			val, fair = b.popPriority(keys), false
+			if val == "" {
+				val, fair = b.popFair(keys, conf.InstanceConcurrency, ttl), true
+			}
 		}
 
-		key := results[0]
-		val := results[1]
-		if len(key) < len(redisPrefix) {
-			joblog.Warnf("Invalid key %s", key)
-			continue
+		// When there is no job, we wait for a job in the manual queue or in
+		// the old queue, or for a token in the wake list, that is pushed when
+		// a job is added to the queue of an instance.
+		if val == "" {
+			fair = false
+			results, err := b.client.BRPop(redisBRPopTimeout, keys.priority, keys.main, keys.wake).Result()
+			if err != nil || len(results) < 2 {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if results[0] == keys.wake {
+				continue
+			}
+			val = results[1]
 		}
 
 		parts := strings.SplitN(val, "/", 2)
@@ -164,16 +300,110 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 		}
 
 		prefix, jobID := parts[0], parts[1]
+		var release func()
+		if fair && limited {
+			counter := keys.running + prefix
+			stop := make(chan struct{})
+			go b.keepSlot(counter, ttl, stop)
+			var once sync.Once
+			release = func() {
+				once.Do(func() {
+					close(stop)
+					err := b.client.Eval(luaFairRelease, []string{counter, keys.wake}).Err()
+					if err != nil {
+						joblog.Warnf("Cannot release slot for %s: %s", prefix, err)
+					}
+				})
+			}
+		}
 		job, err := Get(prefixer.NewPrefixer("", prefix), jobID)
 		if err != nil {
 			joblog.Warnf("Cannot find job %s on domain %s: %s", parts[1], parts[0], err)
+			if release != nil {
+				release()
+			}
 			continue
 		}
+		job.releaseSlot = release
 
 		ch <- job
 	}
 }
 
+// keepSlot refreshes the TTL of the counter of the running jobs of an
+// instance while a job is running, so that the counter doesn't expire for a
+// job that runs longer than expected (the TTL is only here to not keep a slot
+// forever if the stack crashes).
+func (b *redisBroker) keepSlot(counter string, ttl int64, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(ttl) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.client.Expire(counter, time.Duration(ttl)*time.Second).Err(); err != nil {
+				joblog.Warnf("Cannot refresh the slot counter %s: %s", counter, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// popFair returns the next job from the queues of the instances, or an empty
+// string if there is no job that can be executed now.
+func (b *redisBroker) popFair(keys redisQueueKeys, maxPerInstance int, ttl int64) string {
+	// Each instance of the ring is tried at most once
+	n, err := b.client.LLen(keys.ring).Result()
+	if err != nil {
+		joblog.Warnf("Cannot pop job from %s: %s", keys.ring, err)
+		return ""
+	}
+	for i := int64(0); i < n; i++ {
+		prefix, err := b.client.LIndex(keys.ring, -1).Result()
+		if err != nil {
+			if err != redis.Nil {
+				joblog.Warnf("Cannot pop job from %s: %s", keys.ring, err)
+			}
+			return ""
+		}
+		val, err := b.client.Eval(luaFairPop,
+			[]string{keys.ring, keys.domains, keys.weights, keys.credits,
+				keys.lists + prefix, keys.running + prefix},
+			prefix, maxPerInstance, ttl).Text()
+		if err != nil && err != redis.Nil {
+			joblog.Warnf("Cannot pop job from %s: %s", keys.ring, err)
+			return ""
+		}
+		if val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// popPriority returns the next job from the queue of the manual jobs, or an
+// empty string if this queue is empty.
+func (b *redisBroker) popPriority(keys redisQueueKeys) string {
+	val, err := b.client.RPop(keys.priority).Result()
+	if err != nil && err != redis.Nil {
+		joblog.Warnf("Cannot pop job from %s: %s", keys.priority, err)
+	}
+	return val
+}
+
+// cancelLoop cancels the running jobs for which a message has been published
+// on the cancel channel by one of the stacks.
+func (b *redisBroker) cancelLoop(ch <-chan *redis.Message) {
+	for msg := range ch {
+		parts := strings.SplitN(msg.Payload, "/", 2)
+		if len(parts) != 2 {
+			joblog.Warnf("Invalid cancel message %s", msg.Payload)
+			continue
+		}
+		cancelRunningJob(prefixer.NewPrefixer("", parts[0]), parts[1])
+	}
+}
+
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error) {
@@ -219,39 +449,163 @@ func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, erro
 		}
 	}
 
-	if err := job.Create(); err != nil {
+	if err := createJob(job, req); err != nil {
 		return nil, err
 	}
 
-	key := redisPrefix + job.WorkerType
+	if err := pushJobToRedis(b.client, job, instanceWeight(db)); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// pushJobToRedis adds the job to its queue in redis.
+func pushJobToRedis(client redis.UniversalClient, job *Job, weight int) error {
+	keys := newRedisQueueKeys(job.WorkerType)
 	val := job.DBPrefix() + "/" + job.JobID
 
 	// When the job is manual, it is being pushed in a specific prioritized
 	// queue.
 	if job.Manual {
-		key += redisHighPrioritySuffix
+		return client.LPush(keys.priority, val).Err()
 	}
 
-	if err := b.client.LPush(key, val).Err(); err != nil {
+	return client.Eval(luaFairPush,
+		[]string{keys.lists + job.DBPrefix(), keys.ring, keys.domains, keys.weights, keys.wake},
+		job.DBPrefix(), val, job.Domain, weight).Err()
+}
+
+// RetryJob adds the job to a sorted set in redis, where the scheduler will
+// take it when its delay has expired to push it again in its queue.
+func (b *redisBroker) RetryJob(job *Job, delay time.Duration) error {
+	at := time.Now().Add(delay).UTC().Unix()
+	val := job.DBPrefix() + "/" + job.JobID
+	return b.client.ZAdd(RetriesKey, &redis.Z{Score: float64(at), Member: val}).Err()
+}
+
+// CancelJob removes the job from its queue if it is still queued, or asks the
+// stack that executes it to cancel it if it is running.
+func (b *redisBroker) CancelJob(db prefixer.Prefixer, jobID string) (*Job, error) {
+	job, err := Get(db, jobID)
+	if err != nil {
 		return nil, err
 	}
+	if job.IsFinished() {
+		return nil, ErrJobFinished
+	}
 
+	keys := newRedisQueueKeys(job.WorkerType)
+	val := job.DBPrefix() + "/" + job.JobID
+	if job.State == Queued {
+		// If the job has already been taken by a worker, but is not running
+		// yet, the worker will skip it when acking it, as its revision will
+		// have changed.
+		pipe := b.client.Pipeline()
+		pipe.LRem(keys.lists+job.DBPrefix(), 0, val)
+		pipe.LRem(keys.main, 0, val)
+		pipe.LRem(keys.priority, 0, val)
+		if _, err := pipe.Exec(); err != nil {
+			return nil, err
+		}
+		err := job.Cancel()
+		if err == nil {
+			if job.WorkflowID != "" {
+				if err := continueWorkflow(job, nil); err != nil {
+					job.Logger().Warnf("Cannot update the workflow %s: %s", job.WorkflowID, err)
+				}
+			}
+			return job, nil
+		}
+		if !couchdb.IsConflictError(err) {
+			return nil, err
+		}
+		// The worker has started the job in the meantime
+		if job, err = Get(db, jobID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.client.Publish(redisCancelChannel, val).Err(); err != nil {
+		return nil, err
+	}
 	return job, nil
 }
 
-// QueueLen returns the size of the number of elements in queue of the
+// WorkerQueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
-	key := redisPrefix + workerType
-	l1, err := b.client.LLen(key).Result()
+	keys := newRedisQueueKeys(workerType)
+	prefixes, err := b.client.LRange(keys.ring, 0, -1).Result()
 	if err != nil {
 		return 0, err
 	}
-	l2, err := b.client.LLen(key + redisHighPrioritySuffix).Result()
+	listKeys := []string{keys.main, keys.priority}
+	seen := make(map[string]bool)
+	for _, prefix := range prefixes {
+		if !seen[prefix] {
+			seen[prefix] = true
+			listKeys = append(listKeys, keys.lists+prefix)
+		}
+	}
+	total := 0
+	for _, key := range listKeys {
+		l, err := b.client.LLen(key).Result()
+		if err != nil {
+			return 0, err
+		}
+		total += int(l)
+	}
+	return total, nil
+}
+
+// WorkerQueueLenByDomain returns the number of elements in queue of the
+// specified worker type for each instance.
+func (b *redisBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	keys := newRedisQueueKeys(workerType)
+	domains, err := b.client.HGetAll(keys.domains).Result()
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	domainOf := func(prefix string) string {
+		if domain, ok := domains[prefix]; ok && domain != "" {
+			return domain
+		}
+		return prefix
+	}
+
+	lens := make(map[string]int)
+	prefixes, err := b.client.LRange(keys.ring, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, prefix := range prefixes {
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		l, err := b.client.LLen(keys.lists + prefix).Result()
+		if err != nil {
+			return nil, err
+		}
+		if l > 0 {
+			lens[domainOf(prefix)] += int(l)
+		}
+	}
+
+	// The manual jobs, and the jobs pushed before the fair scheduling, are in
+	// the queues shared by all the instances.
+	for _, key := range []string{keys.main, keys.priority} {
+		vals, err := b.client.LRange(key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			prefix := strings.SplitN(val, "/", 2)[0]
+			lens[domainOf(prefix)]++
+		}
 	}
-	return int(l1 + l2), nil
+	return lens, nil
 }
 
 func (b *redisBroker) WorkerIsReserved(workerType string) (bool, error) {
@@ -17,6 +17,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/go-redis/redis/v7"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,6 +29,11 @@ const TriggersKey = "triggers"
 // currently being executed
 const SchedKey = "scheduling"
 
+// RetriesKey is the key of the sorted set in redis used for the jobs that
+// have failed and will be pushed again in their queue (see RetryPolicy). The
+// score is the time of the next execution.
+const RetriesKey = "jobs-retries"
+
 // pollInterval is the time interval between 2 redis polling
 const pollInterval = 1 * time.Second
 
@@ -52,6 +58,15 @@ if #t > 0 then
 end
 return t`
 
+// luaPollRetries returns the lua script used for taking the jobs to retry
+// that are due.
+const luaPollRetries = `
+local r = redis.call("ZRANGEBYSCORE", "` + RetriesKey + `", 0, KEYS[1], "LIMIT", 0, 100)
+if #r > 0 then
+  redis.call("ZREM", "` + RetriesKey + `", unpack(r))
+end
+return r`
+
 // redisScheduler is a centralized scheduler of many triggers. It starts all of
 // them and schedules jobs accordingly.
 type redisScheduler struct {
@@ -103,6 +118,9 @@ func (s *redisScheduler) pollLoop() {
 			if err := s.PollScheduler(now); err != nil {
 				s.log.Warnf("Failed to poll redis: %s", err)
 			}
+			if err := s.pollRetries(now); err != nil {
+				s.log.Warnf("Failed to poll the retries: %s", err)
+			}
 		}
 	}
 }
@@ -162,6 +180,9 @@ func (s *redisScheduler) eventLoop(eventsCh <-chan *realtime.Event) {
 				continue
 			}
 			et := t.(*EventTrigger)
+			if et.Infos().Disabled() || !et.matchSelector(event) {
+				continue
+			}
 			if et.Infos().Debounce != "" {
 				var d time.Duration
 				if d, err = time.ParseDuration(et.Infos().Debounce); err == nil {
@@ -287,6 +308,60 @@ func (s *redisScheduler) PollScheduler(now int64) error {
 	}
 }
 
+// pollRetries pushes again in their queues the jobs that have failed and
+// whose retry delay has expired. The jobs are removed from the sorted set by
+// the lua script, so that two stacks can't push the same job, and they are
+// added back to it if they can't be pushed, to not lose them.
+func (s *redisScheduler) pollRetries(now int64) error {
+	res, err := s.client.Eval(luaPollRetries, []string{strconv.FormatInt(now, 10)}).Result()
+	if err != nil || res == nil {
+		return err
+	}
+	results, ok := res.([]interface{})
+	if !ok {
+		return errors.New("Unexpected response from redis")
+	}
+	var errm error
+	for _, result := range results {
+		val, _ := result.(string)
+		parts := strings.SplitN(val, "/", 2)
+		if len(parts) != 2 {
+			s.log.Warnf("Invalid retry %s", val)
+			continue
+		}
+		job, err := Get(prefixer.NewPrefixer("", parts[0]), parts[1])
+		if err != nil {
+			if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+				s.log.Infof("Job %s on %s has been deleted before its retry", parts[1], parts[0])
+				continue
+			}
+			s.log.Warnf("Cannot find job %s on domain %s: %s", parts[1], parts[0], err)
+			if err = s.delayRetry(val, now); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+			continue
+		}
+		// The job may have been cancelled while waiting for its retry
+		if job.State != Queued {
+			continue
+		}
+		if err := pushJobToRedis(s.client, job, instanceWeight(job)); err != nil {
+			s.log.Warnf("Cannot push job %s on domain %s: %s", parts[1], parts[0], err)
+			if err = s.delayRetry(val, now); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+	}
+	return errm
+}
+
+// delayRetry adds back a job in the sorted set of the retries, for the next
+// poll.
+func (s *redisScheduler) delayRetry(val string, now int64) error {
+	at := now + int64(pollInterval/time.Second)
+	return s.client.ZAdd(RetriesKey, &redis.Z{Score: float64(at), Member: val}).Err()
+}
+
 // AddTrigger a trigger to the system, by persisting it and using redis for
 // scheduling its jobs
 func (s *redisScheduler) AddTrigger(t Trigger) error {
@@ -303,6 +378,9 @@ func (s *redisScheduler) addToRedis(t Trigger, prev time.Time) error {
 	case *EventTrigger:
 		hKey := eventsKey(t)
 		return s.client.HSet(hKey, t.ID(), t.Infos().Arguments).Err()
+	case *WebhookTrigger:
+		// The jobs are pushed when the webhook is called
+		return nil
 	case *AtTrigger:
 		timestamp = t.at
 	case *CronTrigger:
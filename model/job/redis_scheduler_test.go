@@ -52,6 +52,14 @@ func (b *mockBroker) PushJob(db prefixer.Prefixer, request *jobs.JobRequest) (*j
 	return nil, nil
 }
 
+func (b *mockBroker) CancelJob(db prefixer.Prefixer, jobID string) (*jobs.Job, error) {
+	return nil, jobs.ErrNotFoundJob
+}
+
+func (b *mockBroker) RetryJob(job *jobs.Job, delay time.Duration) error {
+	return nil
+}
+
 func (b *mockBroker) WorkerQueueLen(workerType string) (int, error) {
 	count := 0
 	for _, job := range b.jobs {
@@ -62,6 +70,10 @@ func (b *mockBroker) WorkerQueueLen(workerType string) (int, error) {
 	return count, nil
 }
 
+func (b *mockBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	return nil, nil
+}
+
 func (b *mockBroker) WorkerIsReserved(workerType string) (bool, error) {
 	return false, nil
 }
@@ -0,0 +1,90 @@
+package job
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// maxInlineResultSize is the maximal size of a result kept in the job
+	// document. A larger result is saved as a file in the VFS of the
+	// instance.
+	maxInlineResultSize = 32 * 1024
+	// MaxResultSize is the maximal size of the result of a job.
+	MaxResultSize = 10 * 1024 * 1024
+)
+
+// saveResult saves the result set by the worker in the job (it is not
+// persisted in CouchDB before the next update of the job). If the result is
+// too large for the job document, it is saved as a file in the VFS, outside
+// of the files tree: it doesn't count in the disk quota and it can't be
+// modified by the user.
+func (j *Job) saveResult(inst *instance.Instance) error {
+	if len(j.result) == 0 {
+		return nil
+	}
+	if len(j.result) <= maxInlineResultSize {
+		j.Result = j.result
+		return nil
+	}
+	if inst == nil {
+		return ErrResultTooLarge
+	}
+
+	file, err := inst.VFS().CreateJobResult(j.ID())
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(j.result); err != nil {
+		_ = file.Abort()
+		return err
+	}
+	if err = file.Commit(); err != nil {
+		return err
+	}
+	j.ResultInFile = true
+	return nil
+}
+
+// GetResult returns the result of the job, or ErrNoResult if the job has no
+// result.
+func (j *Job) GetResult(db prefixer.Prefixer) (Message, error) {
+	if !j.ResultInFile {
+		if len(j.Result) == 0 {
+			return nil, ErrNoResult
+		}
+		return j.Result, nil
+	}
+	inst, ok := db.(*instance.Instance)
+	if !ok {
+		var err error
+		if inst, err = instance.GetFromCouch(db.DomainName()); err != nil {
+			return nil, err
+		}
+	}
+	file, err := inst.VFS().OpenJobResult(j.ID())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoResult
+		}
+		return nil, err
+	}
+	defer file.Close()
+	result, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return Message(result), nil
+}
+
+// DeleteResult removes the file where the result of the job is saved, if
+// any. It can be called when the job is purged.
+func (j *Job) DeleteResult(inst *instance.Instance) error {
+	if !j.ResultInFile {
+		return nil
+	}
+	return inst.VFS().DeleteJobResult(j.ID())
+}
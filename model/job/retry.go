@@ -0,0 +1,181 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// RetryConstant is the strategy where all the retries wait for the same
+	// delay.
+	RetryConstant = "constant"
+	// RetryLinear is the strategy where the delay grows linearly with the
+	// number of retries.
+	RetryLinear = "linear"
+	// RetryExponential is the strategy where the delay is doubled for each
+	// retry. It is the default strategy.
+	RetryExponential = "exponential"
+
+	// RetryOnNetwork is the class of the network errors.
+	RetryOnNetwork = "network"
+	// RetryOnTimeout is the class of the errors for an execution that has
+	// taken too long.
+	RetryOnTimeout = "timeout"
+
+	// maxRetries is the maximal number of retries for a retry policy.
+	maxRetries = 20
+	// maxRetryDelay is the maximal delay between two executions of a job.
+	maxRetryDelay = 24 * time.Hour
+)
+
+// RetryPolicy describes how a job is retried when it fails. When a job has a
+// retry policy, the retries are pushed in the queue after the delay, instead
+// of waiting in the worker.
+type RetryPolicy struct {
+	// Strategy is how the delay is computed: constant, linear or exponential
+	Strategy string `json:"strategy,omitempty"`
+	// MaxRetries is the number of retries after the first execution
+	MaxRetries int `json:"max_retries"`
+	// BaseDelay is the delay before the first retry, like "30s" (defaults
+	// to the retry delay of the worker)
+	BaseDelay string `json:"base_delay,omitempty"`
+	// MaxDelay is the maximal delay between two executions, like "1h"
+	MaxDelay string `json:"max_delay,omitempty"`
+	// Jitter is the fraction of the delay that is randomized, between 0 and 1
+	Jitter float64 `json:"jitter,omitempty"`
+	// RetryOn is the list of the errors that can be retried. It can be an
+	// error class (network or timeout), or else a string that is looked for
+	// in the error message. All the errors are retried when it is empty.
+	RetryOn []string `json:"retry_on,omitempty"`
+}
+
+// Validate checks that the retry policy can be used.
+func (p *RetryPolicy) Validate() error {
+	switch p.Strategy {
+	case "", RetryConstant, RetryLinear, RetryExponential:
+	default:
+		return ErrInvalidRetryPolicy
+	}
+	if p.MaxRetries < 0 || p.MaxRetries > maxRetries {
+		return ErrInvalidRetryPolicy
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return ErrInvalidRetryPolicy
+	}
+	base, err := parseRetryDelay(p.BaseDelay)
+	if err != nil {
+		return err
+	}
+	max, err := parseRetryDelay(p.MaxDelay)
+	if err != nil {
+		return err
+	}
+	if base > 0 && max > 0 && max < base {
+		return ErrInvalidRetryPolicy
+	}
+	for _, class := range p.RetryOn {
+		if class == "" {
+			return ErrInvalidRetryPolicy
+		}
+	}
+	return nil
+}
+
+// validate checks the options of a job, and can be called on nil.
+func (o *JobOptions) validate() error {
+	if o == nil || o.Retry == nil {
+		return nil
+	}
+	return o.Retry.Validate()
+}
+
+func parseRetryDelay(delay string) (time.Duration, error) {
+	if delay == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(delay)
+	if err != nil || d < 0 || d > maxRetryDelay {
+		return 0, ErrInvalidRetryPolicy
+	}
+	return d, nil
+}
+
+// Retryable returns true if the error is in the classes of errors that can be
+// retried.
+func (p *RetryPolicy) Retryable(err error) bool {
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	msg := err.Error()
+	for _, class := range p.RetryOn {
+		switch class {
+		case RetryOnNetwork:
+			// context.DeadlineExceeded implements net.Error, but it is the
+			// timeout of the job, not a network error
+			var netErr net.Error
+			if errors.As(err, &netErr) && !errors.Is(err, context.DeadlineExceeded) {
+				return true
+			}
+		case RetryOnTimeout:
+			if errors.Is(err, context.DeadlineExceeded) {
+				return true
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return true
+			}
+		default:
+			if strings.Contains(msg, class) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Delay returns the delay before the given retry (starting at 1). The
+// defaultDelay is used when the policy has no base delay.
+func (p *RetryPolicy) Delay(retry int, defaultDelay time.Duration) time.Duration {
+	base, _ := parseRetryDelay(p.BaseDelay)
+	if base == 0 {
+		base = defaultDelay
+	}
+	max, _ := parseRetryDelay(p.MaxDelay)
+	if max == 0 {
+		max = maxRetryDelay
+	}
+	if retry < 1 {
+		retry = 1
+	}
+
+	var delay time.Duration
+	switch p.Strategy {
+	case RetryConstant:
+		delay = base
+	case RetryLinear:
+		delay = base * time.Duration(retry)
+	default:
+		delay = base
+		for i := 1; i < retry && delay < max; i++ {
+			delay *= 2
+		}
+	}
+	if delay > max || delay < 0 {
+		delay = max
+	}
+
+	if p.Jitter > 0 {
+		fuzz := int64(p.Jitter * float64(delay))
+		if fuzz > 0 {
+			delay += time.Duration(rand.Int63n(2*fuzz+1) - fuzz)
+		}
+		if delay > max {
+			delay = max
+		}
+	}
+	return delay
+}
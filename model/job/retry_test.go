@@ -0,0 +1,58 @@
+package job_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	jobs "github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &jobs.RetryPolicy{Strategy: jobs.RetryConstant, BaseDelay: "10s"}
+	assert.Equal(t, 10*time.Second, p.Delay(1, time.Minute))
+	assert.Equal(t, 10*time.Second, p.Delay(5, time.Minute))
+
+	p = &jobs.RetryPolicy{Strategy: jobs.RetryLinear, BaseDelay: "10s"}
+	assert.Equal(t, 10*time.Second, p.Delay(1, time.Minute))
+	assert.Equal(t, 30*time.Second, p.Delay(3, time.Minute))
+
+	p = &jobs.RetryPolicy{MaxDelay: "5m"}
+	assert.Equal(t, time.Minute, p.Delay(1, time.Minute))
+	assert.Equal(t, 4*time.Minute, p.Delay(3, time.Minute))
+	assert.Equal(t, 5*time.Minute, p.Delay(4, time.Minute))
+	assert.Equal(t, 5*time.Minute, p.Delay(20, time.Minute))
+
+	p = &jobs.RetryPolicy{BaseDelay: "1m", Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := p.Delay(2, time.Second)
+		assert.True(t, d >= time.Minute && d <= 3*time.Minute, d)
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	p := &jobs.RetryPolicy{}
+	assert.True(t, p.Retryable(errors.New("LOGIN_FAILED")))
+
+	p = &jobs.RetryPolicy{RetryOn: []string{jobs.RetryOnNetwork, "VENDOR_DOWN"}}
+	assert.True(t, p.Retryable(&net.OpError{Op: "dial", Err: errors.New("refused")}))
+	assert.True(t, p.Retryable(errors.New("VENDOR_DOWN")))
+	assert.False(t, p.Retryable(errors.New("LOGIN_FAILED")))
+	assert.False(t, p.Retryable(context.DeadlineExceeded))
+
+	p = &jobs.RetryPolicy{RetryOn: []string{jobs.RetryOnTimeout}}
+	assert.True(t, p.Retryable(context.DeadlineExceeded))
+	assert.False(t, p.Retryable(errors.New("VENDOR_DOWN")))
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	assert.NoError(t, (&jobs.RetryPolicy{MaxRetries: 5, BaseDelay: "1m", MaxDelay: "1h", Jitter: 0.2}).Validate())
+	assert.Error(t, (&jobs.RetryPolicy{Strategy: "fibonacci"}).Validate())
+	assert.Error(t, (&jobs.RetryPolicy{MaxRetries: 100}).Validate())
+	assert.Error(t, (&jobs.RetryPolicy{BaseDelay: "soon"}).Validate())
+	assert.Error(t, (&jobs.RetryPolicy{BaseDelay: "1h", MaxDelay: "1m"}).Validate())
+	assert.Error(t, (&jobs.RetryPolicy{Jitter: 2}).Validate())
+}
@@ -56,8 +56,14 @@ type (
 		WorkerType   string                 `json:"worker"`
 		Arguments    string                 `json:"arguments"`
 		Debounce     string                 `json:"debounce"`
+		TimeZone     string                 `json:"time_zone,omitempty"`
+		Selector     mango.Map              `json:"selector,omitempty"`
 		Options      *JobOptions            `json:"options"`
 		Message      Message                `json:"message"`
+		OnSuccess    []*WorkflowStep        `json:"on_success,omitempty"`
+		OnFailure    []*WorkflowStep        `json:"on_failure,omitempty"`
+		Webhook      *WebhookInfos          `json:"webhook,omitempty"`
+		Outgoing     *OutgoingWebhook       `json:"outgoing_webhook,omitempty"`
 		CurrentState *TriggerState          `json:"current_state,omitempty"`
 		Metadata     *metadata.CozyMetadata `json:"cozyMetadata,omitempty"`
 	}
@@ -75,6 +81,8 @@ type (
 		LastError           string     `json:"last_error,omitempty"`
 		LastManualExecution *time.Time `json:"last_manual_execution,omitempty"`
 		LastManualJobID     string     `json:"last_manual_job_id,omitempty"`
+		LastWebhookCall     *time.Time `json:"last_webhook_call,omitempty"`
+		LastWebhookJobID    string     `json:"last_webhook_job_id,omitempty"`
 	}
 )
 
@@ -115,6 +123,24 @@ func NewTrigger(db prefixer.Prefixer, infos TriggerInfos, data interface{}) (Tri
 		infos.Metadata.EnsureCreatedFields(md)
 	}
 
+	if infos.WorkerType == WebhookWorkerType {
+		infos.Outgoing, err = newOutgoingWebhook(&infos)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := infos.Options.validate(); err != nil {
+		return nil, err
+	}
+
+	if infos.Type == "@webhook" {
+		infos.Webhook, err = newWebhookInfos(infos.Arguments)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return fromTriggerInfos(&infos)
 }
 
@@ -130,6 +156,8 @@ func fromTriggerInfos(infos *TriggerInfos) (Trigger, error) {
 		return NewEveryTrigger(infos)
 	case "@event":
 		return NewEventTrigger(infos)
+	case "@webhook":
+		return NewWebhookTrigger(infos)
 	default:
 		return nil, ErrUnknownTrigger
 	}
@@ -156,6 +184,16 @@ func (t *TriggerInfos) Clone() couchdb.Doc {
 		t.Message = make([]byte, len(tmp))
 		copy(t.Message[:], tmp)
 	}
+	if t.Webhook != nil {
+		tmp := *t.Webhook
+		cloned.Webhook = &tmp
+	}
+	if t.Outgoing != nil {
+		tmp := *t.Outgoing
+		tmp.Deliveries = make([]*WebhookDelivery, len(t.Outgoing.Deliveries))
+		copy(tmp.Deliveries, t.Outgoing.Deliveries)
+		cloned.Outgoing = &tmp
+	}
 	if t.CurrentState != nil {
 		tmp := *t.CurrentState
 		cloned.CurrentState = &tmp
@@ -175,6 +213,8 @@ func (t *TriggerInfos) JobRequest() *JobRequest {
 		Trigger:    trigger,
 		Message:    t.Message,
 		Options:    t.Options,
+		OnSuccess:  t.OnSuccess,
+		OnFailure:  t.OnFailure,
 	}
 }
 
@@ -254,6 +294,11 @@ func GetTriggerState(db prefixer.Prefixer, triggerID string) (*TriggerState, err
 			state.LastManualJobID = j.ID()
 		}
 
+		if j.Webhook {
+			state.LastWebhookCall = &j.QueuedAt
+			state.LastWebhookJobID = j.ID()
+		}
+
 		switch j.State {
 		case Errored:
 			state.LastFailure = startedAt
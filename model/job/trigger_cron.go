@@ -1,8 +1,14 @@
 package job
 
 import (
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/robfig/cron/v3"
 )
 
@@ -11,20 +17,41 @@ import (
 type CronTrigger struct {
 	*TriggerInfos
 	sched cron.Schedule
+	loc   *time.Location // nil when the time zone of the instance is used
 	done  chan struct{}
 }
 
+// anchoredSchedule is used for the @every triggers with an anchor, like
+// "@every 6h from 08:00": the executions are at the anchor time plus a
+// multiple of the duration, computed on the wall clock of the time zone, so
+// that they don't shift with the daylight saving time changes.
+type anchoredSchedule struct {
+	every  time.Duration
+	anchor time.Duration // since midnight
+}
+
 var parser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
 
 // NewCronTrigger returns a new instance of CronTrigger given the specified options.
 func NewCronTrigger(infos *TriggerInfos) (*CronTrigger, error) {
+	loc, err := triggerLocation(infos)
+	if err != nil {
+		return nil, err
+	}
 	schedule, err := parser.Parse(infos.Arguments)
 	if err != nil {
 		return nil, ErrMalformedTrigger
 	}
+	if strings.HasPrefix(infos.Arguments, "TZ=") || strings.HasPrefix(infos.Arguments, "CRON_TZ=") {
+		// The time zone is given in the spec
+		if spec, ok := schedule.(*cron.SpecSchedule); ok {
+			loc = spec.Location
+		}
+	}
 	return &CronTrigger{
 		TriggerInfos: infos,
 		sched:        schedule,
+		loc:          loc,
 		done:         make(chan struct{}),
 	}, nil
 }
@@ -32,25 +59,183 @@ func NewCronTrigger(infos *TriggerInfos) (*CronTrigger, error) {
 // NewEveryTrigger returns an new instance of CronTrigger given the specified
 // options as @every.
 func NewEveryTrigger(infos *TriggerInfos) (*CronTrigger, error) {
-	schedule, err := parser.Parse("@every " + infos.Arguments)
+	loc, err := triggerLocation(infos)
+	if err != nil {
+		return nil, err
+	}
+	var schedule cron.Schedule
+	if parts := strings.SplitN(infos.Arguments, " from ", 2); len(parts) == 2 {
+		schedule, err = parseAnchoredSchedule(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	} else {
+		schedule, err = parser.Parse("@every " + infos.Arguments)
+	}
 	if err != nil {
 		return nil, ErrMalformedTrigger
 	}
 	return &CronTrigger{
 		TriggerInfos: infos,
 		sched:        schedule,
+		loc:          loc,
 		done:         make(chan struct{}),
 	}, nil
 }
 
+func parseAnchoredSchedule(every, anchor string) (*anchoredSchedule, error) {
+	d, err := time.ParseDuration(every)
+	if err != nil {
+		return nil, err
+	}
+	if d < time.Second {
+		return nil, ErrMalformedTrigger
+	}
+	var at time.Time
+	if at, err = time.Parse("15:04:05", anchor); err != nil {
+		if at, err = time.Parse("15:04", anchor); err != nil {
+			return nil, err
+		}
+	}
+	return &anchoredSchedule{
+		every:  d.Truncate(time.Second),
+		anchor: time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute + time.Duration(at.Second())*time.Second,
+	}, nil
+}
+
+// triggerLocation returns the time zone of the trigger, or nil if the trigger
+// uses the time zone of the instance.
+func triggerLocation(infos *TriggerInfos) (*time.Location, error) {
+	if infos.TimeZone == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(infos.TimeZone)
+	if err != nil {
+		return nil, ErrMalformedTrigger
+	}
+	return loc, nil
+}
+
+// locationTTL is the duration during which the time zone of an instance is
+// kept in cache. The cache entry is removed earlier when the settings are
+// updated on this stack, and the TTL is for the updates made on other stacks.
+const locationTTL = 10 * time.Minute
+
+type cachedLocation struct {
+	loc       *time.Location
+	expiresAt time.Time
+}
+
+var (
+	locationsMu    sync.Mutex
+	locations      = make(map[string]cachedLocation)
+	locationsWatch sync.Once
+)
+
+// instanceLocation returns the time zone configured in the settings of the
+// instance, or the local time zone of the server if there is none. It is
+// called for each execution of the cron triggers, so the time zone is cached.
+func instanceLocation(db prefixer.Prefixer) *time.Location {
+	locationsWatch.Do(watchSettings)
+	key := db.DBPrefix()
+	now := time.Now()
+	locationsMu.Lock()
+	cached, ok := locations[key]
+	locationsMu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.loc
+	}
+
+	loc := loadInstanceLocation(db)
+	locationsMu.Lock()
+	locations[key] = cachedLocation{loc: loc, expiresAt: now.Add(locationTTL)}
+	locationsMu.Unlock()
+	return loc
+}
+
+func loadInstanceLocation(db prefixer.Prefixer) *time.Location {
+	var doc couchdb.JSONDoc
+	if err := couchdb.GetDoc(db, consts.Settings, consts.InstanceSettingsID, &doc); err != nil {
+		return time.Local
+	}
+	tz, _ := doc.M["tz"].(string)
+	if tz == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// watchSettings removes the time zone of an instance from the cache when its
+// settings are updated.
+func watchSettings() {
+	sub := realtime.GetHub().SubscribeLocalAll()
+	go func() {
+		for e := range sub.Channel {
+			if e.Doc == nil || e.Doc.DocType() != consts.Settings || e.Doc.ID() != consts.InstanceSettingsID {
+				continue
+			}
+			locationsMu.Lock()
+			delete(locations, e.DBPrefix())
+			locationsMu.Unlock()
+		}
+	}()
+}
+
+// Next implements the cron.Schedule interface, in the local time zone.
+func (s *anchoredSchedule) Next(last time.Time) time.Time {
+	return s.next(last, time.Local)
+}
+
+func (s *anchoredSchedule) next(last time.Time, loc *time.Location) time.Time {
+	// Compute on the wall clock, as if the time zone was UTC
+	l := last.In(loc)
+	wall := time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), 0, time.UTC)
+	first := time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC).Add(s.anchor)
+	k := int64(wall.Sub(first) / s.every)
+	for {
+		k++
+		w := first.Add(time.Duration(k) * s.every)
+		next := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, loc)
+		// An hour can be skipped or repeated when the DST changes
+		if next.After(last) {
+			return next
+		}
+	}
+}
+
+// Location returns the time zone used to compute the next executions.
+func (c *CronTrigger) Location() *time.Location {
+	if c.loc != nil {
+		return c.loc
+	}
+	return instanceLocation(c.TriggerInfos)
+}
+
 // Type implements the Type method of the Trigger interface.
 func (c *CronTrigger) Type() string {
 	return c.TriggerInfos.Type
 }
 
-// NextExecution returns the next time when a job should be fired for this trigger
+// NextExecution returns the next time when a job should be fired for this
+// trigger. It is computed in the time zone of the trigger.
 func (c *CronTrigger) NextExecution(last time.Time) time.Time {
-	return c.sched.Next(last)
+	var next time.Time
+	switch s := c.sched.(type) {
+	case *cron.SpecSchedule:
+		spec := *s
+		spec.Location = c.Location()
+		next = spec.Next(last)
+	case *anchoredSchedule:
+		next = s.next(last, c.Location())
+	default:
+		return c.sched.Next(last)
+	}
+	if !next.IsZero() && !next.After(last) {
+		// It can happen when the clock is set back for DST
+		return c.NextExecution(last.Add(time.Second))
+	}
+	return next
 }
 
 // Schedule implements the Schedule method of the Trigger interface.
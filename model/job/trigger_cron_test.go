@@ -0,0 +1,67 @@
+package job_test
+
+import (
+	"testing"
+	"time"
+
+	jobs "github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronTriggerTimeZone(t *testing.T) {
+	_, err := jobs.NewCronTrigger(&jobs.TriggerInfos{
+		Type:      "@cron",
+		Arguments: "0 0 8 * * *",
+		TimeZone:  "Mars/Olympus_Mons",
+	})
+	assert.Equal(t, jobs.ErrMalformedTrigger, err)
+
+	cron, err := jobs.NewCronTrigger(&jobs.TriggerInfos{
+		Type:      "@cron",
+		Arguments: "0 0 8 * * *",
+		TimeZone:  "Europe/Paris",
+	})
+	assert.NoError(t, err)
+	// The daylight saving time starts on 2020-03-29 in Paris
+	last := time.Date(2020, time.March, 28, 7, 0, 0, 0, time.UTC)
+	next := cron.NextExecution(last)
+	assert.Equal(t, time.Date(2020, time.March, 29, 6, 0, 0, 0, time.UTC), next.UTC())
+	next = cron.NextExecution(next)
+	assert.Equal(t, time.Date(2020, time.March, 30, 6, 0, 0, 0, time.UTC), next.UTC())
+
+	_, err = jobs.NewEveryTrigger(&jobs.TriggerInfos{
+		Type:      "@every",
+		Arguments: "6h from 25:00",
+		TimeZone:  "Europe/Paris",
+	})
+	assert.Equal(t, jobs.ErrMalformedTrigger, err)
+
+	every, err := jobs.NewEveryTrigger(&jobs.TriggerInfos{
+		Type:      "@every",
+		Arguments: "12h from 08:30",
+		TimeZone:  "Europe/Paris",
+	})
+	assert.NoError(t, err)
+	next = every.NextExecution(last)
+	assert.Equal(t, time.Date(2020, time.March, 28, 7, 30, 0, 0, time.UTC), next.UTC())
+	next = every.NextExecution(next)
+	assert.Equal(t, time.Date(2020, time.March, 28, 19, 30, 0, 0, time.UTC), next.UTC())
+	next = every.NextExecution(next)
+	assert.Equal(t, time.Date(2020, time.March, 29, 6, 30, 0, 0, time.UTC), next.UTC())
+
+	// The daylight saving time ends on 2020-10-25 in Paris, and 02:30 happens
+	// twice that night, but the job is executed only once at this time
+	paris, _ := time.LoadLocation("Europe/Paris")
+	hourly, err := jobs.NewEveryTrigger(&jobs.TriggerInfos{
+		Type:      "@every",
+		Arguments: "1h from 00:30",
+		TimeZone:  "Europe/Paris",
+	})
+	assert.NoError(t, err)
+	last = time.Date(2020, time.October, 24, 23, 30, 0, 0, time.UTC) // 01:30 CEST
+	next = hourly.NextExecution(last)
+	assert.True(t, next.After(last))
+	assert.Equal(t, 2, next.In(paris).Hour())
+	next = hourly.NextExecution(next)
+	assert.Equal(t, time.Date(2020, time.October, 25, 2, 30, 0, 0, time.UTC), next.UTC())
+}
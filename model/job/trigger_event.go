@@ -1,6 +1,7 @@
 package job
 
 import (
+	"encoding/json"
 	"errors"
 	"strings"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 )
@@ -17,6 +19,7 @@ type EventTrigger struct {
 	*TriggerInfos
 	unscheduled chan struct{}
 	mask        []permission.Rule
+	selector    *mango.Selector
 }
 
 // NewEventTrigger returns a new instance of EventTrigger given the specified
@@ -31,10 +34,18 @@ func NewEventTrigger(infos *TriggerInfos) (*EventTrigger, error) {
 		}
 		rules[i] = rule
 	}
+	var selector *mango.Selector
+	if infos.Selector != nil {
+		var err error
+		if selector, err = mango.NewSelector(infos.Selector); err != nil {
+			return nil, ErrMalformedTrigger
+		}
+	}
 	return &EventTrigger{
 		TriggerInfos: infos,
 		unscheduled:  make(chan struct{}),
 		mask:         rules,
+		selector:     selector,
 	}, nil
 }
 
@@ -65,7 +76,7 @@ func (t *EventTrigger) Schedule() <-chan *JobRequest {
 						break
 					}
 				}
-				if found {
+				if found && t.matchSelector(e) {
 					if evt, err := t.Infos().JobRequestWithEvent(e); err == nil {
 						ch <- evt
 					}
@@ -88,6 +99,41 @@ func (t *EventTrigger) Infos() *TriggerInfos {
 	return t.TriggerInfos
 }
 
+// matchSelector returns true if the trigger has no selector, or if the
+// document of the event matches it. The old version of the document is used
+// for the $changed operator.
+func (t *EventTrigger) matchSelector(e *realtime.Event) bool {
+	if t.selector == nil {
+		return true
+	}
+	doc, ok := eventDocToMap(e.Doc)
+	if !ok {
+		return false
+	}
+	var old map[string]interface{}
+	if e.OldDoc != nil {
+		if old, ok = eventDocToMap(e.OldDoc); !ok {
+			return false
+		}
+	}
+	return t.selector.Match(doc, old)
+}
+
+func eventDocToMap(doc realtime.Doc) (map[string]interface{}, bool) {
+	if d, ok := doc.(*couchdb.JSONDoc); ok {
+		return d.M, true
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, false
+	}
+	return m, true
+}
+
 func eventMatchRule(e *realtime.Event, rule *permission.Rule) bool {
 	if e.Doc.DocType() != rule.Type {
 		return false
@@ -8,6 +8,7 @@ import (
 
 	jobs "github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/stretchr/testify/assert"
 )
@@ -93,6 +94,20 @@ func TestTriggerEvent(t *testing.T) {
 			WorkerType: "worker_event",
 			Message:    makeMessage(t, "message-wholetype"),
 		},
+		{
+			Type:       "@event",
+			Arguments:  "io.cozy.testeventobject:CREATED",
+			Selector:   mango.Map{"test": mango.Map{"$in": []interface{}{"foo", "bar"}}},
+			WorkerType: "worker_event",
+			Message:    makeMessage(t, "message-selector-bad-value"),
+		},
+		{
+			Type:       "@event",
+			Arguments:  "io.cozy.testeventobject:UPDATED",
+			Selector:   mango.Map{"test": mango.Map{"$changed": true}},
+			WorkerType: "worker_event",
+			Message:    makeMessage(t, "message-selector-changed"),
+		},
 	}
 
 	sch := jobs.NewMemScheduler()
@@ -132,6 +147,7 @@ func TestTriggerEvent(t *testing.T) {
 	assert.False(t, called["message-bad-verb"])
 	assert.False(t, called["message-correct-verb-bad-value"])
 	assert.False(t, called["message-change"])
+	assert.False(t, called["message-selector-bad-value"])
 
 	delete(called, "message-correct-verb")
 	delete(called, "message-correct-verb-correct-value")
@@ -168,10 +184,11 @@ func TestTriggerEvent(t *testing.T) {
 	assert.False(t, called["message-bad-verb"])
 	assert.False(t, called["message-correct-verb-bad-value"])
 	assert.False(t, called["message-change"])
+	assert.False(t, called["message-selector-changed"])
 
 	delete(called, "message-wholetype")
 
-	wg.Add(2)
+	wg.Add(3)
 
 	time.AfterFunc(1*time.Millisecond, func() {
 		doc := couchdb.JSONDoc{
@@ -201,6 +218,7 @@ func TestTriggerEvent(t *testing.T) {
 	assert.False(t, called["message-correct-verb-bad-value"])
 	assert.True(t, called["message-change"])
 	assert.True(t, called["message-wholetype"])
+	assert.True(t, called["message-selector-changed"])
 
 	for _, trigger := range triggers {
 		err := sch.DeleteTrigger(testInstance, trigger.ID())
@@ -0,0 +1,226 @@
+package job
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// WebhookSignatureHeader is the HTTP header used to send the signature of
+	// the body of a call to a @webhook trigger.
+	WebhookSignatureHeader = "X-Cozy-Signature"
+	// WebhookHMACSHA256 is the argument of a @webhook trigger that requires
+	// the calls to be signed with HMAC-SHA256.
+	WebhookHMACSHA256 = "hmac-sha256"
+
+	webhookTokenLen  = 32
+	webhookSecretLen = 32
+)
+
+// ErrInvalidWebhookSignature is used when the signature of a call to a
+// @webhook trigger is missing or invalid.
+var ErrInvalidWebhookSignature = errors.New("jobs: invalid webhook signature")
+
+// WebhookInfos contains the informations specific to a @webhook trigger: the
+// token used in its secret URL, and the key used to check the signatures of
+// the calls (if they are required).
+type WebhookInfos struct {
+	Token  string `json:"token"`
+	URL    string `json:"url,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// newWebhookInfos generates the token and, if needed, the secret for a new
+// @webhook trigger with the given arguments.
+func newWebhookInfos(arguments string) (*WebhookInfos, error) {
+	infos := &WebhookInfos{Token: utils.RandomString(webhookTokenLen)}
+	switch arguments {
+	case "":
+	case WebhookHMACSHA256:
+		infos.Secret = utils.RandomString(webhookSecretLen)
+	default:
+		return nil, ErrMalformedTrigger
+	}
+	return infos, nil
+}
+
+// WebhookTrigger implements the @webhook trigger type. It launches a job
+// when an external service makes an HTTP request on its secret URL.
+type WebhookTrigger struct {
+	*TriggerInfos
+	done chan struct{}
+}
+
+// NewWebhookTrigger returns a new instance of WebhookTrigger given the
+// specified options.
+func NewWebhookTrigger(infos *TriggerInfos) (*WebhookTrigger, error) {
+	if infos.Webhook == nil || infos.Webhook.Token == "" {
+		return nil, ErrMalformedTrigger
+	}
+	if infos.Arguments != "" && infos.Arguments != WebhookHMACSHA256 {
+		return nil, ErrMalformedTrigger
+	}
+	// The body of the requests is added to the message, so it must be an
+	// object
+	if len(infos.Message) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(infos.Message, &fields); err != nil {
+			return nil, ErrMalformedTrigger
+		}
+	}
+	return &WebhookTrigger{
+		TriggerInfos: infos,
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// GetWebhookTrigger returns the @webhook trigger of the instance with the
+// given token. The token is looked up in a CouchDB view.
+func GetWebhookTrigger(db prefixer.Prefixer, token string) (*WebhookTrigger, error) {
+	if token == "" {
+		return nil, ErrNotFoundTrigger
+	}
+	var res couchdb.ViewResponse
+	req := &couchdb.ViewRequest{Key: token, Limit: 1}
+	err := couchdb.ExecView(db, couchdb.TriggersByWebhookTokenView, req, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, ErrNotFoundTrigger
+	}
+	if couchdb.IsNotFoundError(err) {
+		views := []*couchdb.View{couchdb.TriggersByWebhookTokenView}
+		if err = couchdb.DefineViews(db, views); err != nil {
+			return nil, err
+		}
+		req = &couchdb.ViewRequest{Key: token, Limit: 1}
+		err = couchdb.ExecView(db, couchdb.TriggersByWebhookTokenView, req, &res)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Rows) == 0 {
+		return nil, ErrNotFoundTrigger
+	}
+	t, err := System().GetTrigger(db, res.Rows[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	w, ok := t.(*WebhookTrigger)
+	if !ok || subtle.ConstantTimeCompare([]byte(w.Webhook.Token), []byte(token)) != 1 {
+		return nil, ErrNotFoundTrigger
+	}
+	return w, nil
+}
+
+// Type implements the Type method of the Trigger interface.
+func (w *WebhookTrigger) Type() string {
+	return w.TriggerInfos.Type
+}
+
+// Schedule implements the Schedule method of the Trigger interface. The jobs
+// of a webhook are pushed when the requests are received, not by the
+// scheduler, so the channel is only closed when the trigger is unscheduled.
+func (w *WebhookTrigger) Schedule() <-chan *JobRequest {
+	ch := make(chan *JobRequest)
+	go func() {
+		<-w.done
+		close(ch)
+	}()
+	return ch
+}
+
+// Unschedule implements the Unschedule method of the Trigger interface.
+func (w *WebhookTrigger) Unschedule() {
+	close(w.done)
+}
+
+// Infos implements the Infos method of the Trigger interface.
+func (w *WebhookTrigger) Infos() *TriggerInfos {
+	return w.TriggerInfos
+}
+
+// CheckSignature returns an error if the trigger requires the calls to be
+// signed, and the given signature is not valid for the body. The signature
+// has the form `sha256=<hex encoded HMAC-SHA256 of the body>`.
+func (w *WebhookTrigger) CheckSignature(body []byte, signature string) error {
+	if w.Webhook.Secret == "" {
+		return nil
+	}
+	if !strings.HasPrefix(signature, "sha256=") {
+		return ErrInvalidWebhookSignature
+	}
+	given, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return ErrInvalidWebhookSignature
+	}
+	if !hmac.Equal(given, webhookMAC(w.Webhook.Secret, body)) {
+		return ErrInvalidWebhookSignature
+	}
+	return nil
+}
+
+// SignWebhookPayload returns the signature of a body for the
+// X-Cozy-Signature header, with the same format as for the @webhook triggers.
+// It is used for the requests of the outgoing webhooks.
+func SignWebhookPayload(secret string, body []byte) string {
+	return "sha256=" + hex.EncodeToString(webhookMAC(secret, body))
+}
+
+func webhookMAC(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// JobRequestWithPayload returns a job request for a call to the webhook. The
+// message of the job is the message of the trigger, with a `webhook` field
+// for the body of the request: it is kept as is for JSON, and sent as a
+// string for the other content types.
+func (w *WebhookTrigger) JobRequestWithPayload(contentType string, body []byte) (*JobRequest, error) {
+	var fields map[string]json.RawMessage
+	if len(w.Message) > 0 {
+		if err := json.Unmarshal(w.Message, &fields); err != nil {
+			return nil, ErrMessageUnmarshal
+		}
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+
+	payload := json.RawMessage(body)
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/json" || !json.Valid(body) {
+		str, err := json.Marshal(string(body))
+		if err != nil {
+			return nil, err
+		}
+		payload = str
+	}
+	webhook, err := json.Marshal(map[string]interface{}{
+		"content_type": contentType,
+		"body":         payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields["webhook"] = webhook
+
+	msg, err := NewMessage(fields)
+	if err != nil {
+		return nil, err
+	}
+	req := w.TriggerInfos.JobRequest()
+	req.Message = msg
+	req.Webhook = true
+	return req, nil
+}
+
+var _ Trigger = &WebhookTrigger{}
@@ -0,0 +1,108 @@
+package job_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	jobs "github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookTrigger(t *testing.T) {
+	webhook := &jobs.WebhookInfos{Token: "token", Secret: "secret"}
+	_, err := jobs.NewWebhookTrigger(&jobs.TriggerInfos{
+		Type:      "@webhook",
+		Arguments: "garbage",
+		Webhook:   webhook,
+	})
+	assert.Equal(t, jobs.ErrMalformedTrigger, err)
+
+	_, err = jobs.NewWebhookTrigger(&jobs.TriggerInfos{
+		Type:      "@webhook",
+		Arguments: jobs.WebhookHMACSHA256,
+		Message:   jobs.Message(`"foo"`),
+		Webhook:   webhook,
+	})
+	assert.Equal(t, jobs.ErrMalformedTrigger, err)
+
+	w, err := jobs.NewWebhookTrigger(&jobs.TriggerInfos{
+		TID:        "trigger-id",
+		Type:       "@webhook",
+		WorkerType: "konnector",
+		Arguments:  jobs.WebhookHMACSHA256,
+		Message:    jobs.Message(`{"konnector":"foo"}`),
+		Webhook:    webhook,
+	})
+	assert.NoError(t, err)
+
+	body := []byte(`{"amount":42}`)
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	assert.NoError(t, w.CheckSignature(body, signature))
+	assert.Equal(t, jobs.ErrInvalidWebhookSignature, w.CheckSignature(body, ""))
+	assert.Equal(t, jobs.ErrInvalidWebhookSignature, w.CheckSignature(body, "sha256=zz"))
+	assert.Equal(t, jobs.ErrInvalidWebhookSignature, w.CheckSignature([]byte(`{}`), signature))
+
+	req, err := w.JobRequestWithPayload("application/json; charset=utf-8", body)
+	assert.NoError(t, err)
+	assert.True(t, req.Webhook)
+	assert.Equal(t, "trigger-id", req.TriggerID)
+	assert.Equal(t, "konnector", req.WorkerType)
+	var msg map[string]json.RawMessage
+	assert.NoError(t, json.Unmarshal(req.Message, &msg))
+	assert.JSONEq(t, `"foo"`, string(msg["konnector"]))
+	assert.JSONEq(t, `{"content_type":"application/json; charset=utf-8","body":{"amount":42}}`, string(msg["webhook"]))
+
+	req, err = w.JobRequestWithPayload("text/plain", []byte("amount=42"))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(req.Message, &msg))
+	assert.JSONEq(t, `{"content_type":"text/plain","body":"amount=42"}`, string(msg["webhook"]))
+}
+
+func TestOutgoingWebhook(t *testing.T) {
+	db := prefixer.NewPrefixer("cozy.example.net", "cozy-example-net")
+	infos := jobs.TriggerInfos{
+		Type:       "@event",
+		WorkerType: jobs.WebhookWorkerType,
+		Arguments:  "io.cozy.files:CREATED",
+	}
+	_, err := jobs.NewTrigger(db, infos, map[string]string{"url": "ftp://example.org/"})
+	assert.Equal(t, jobs.ErrInvalidWebhookURL, err)
+	_, err = jobs.NewTrigger(db, infos, nil)
+	assert.Equal(t, jobs.ErrInvalidWebhookURL, err)
+	for _, u := range []string{"http://localhost:8080/", "http://127.0.0.1/", "http://[::1]/", "http://169.254.169.254/latest/", "https://192.168.0.1/"} {
+		_, err = jobs.NewTrigger(db, infos, map[string]string{"url": u})
+		assert.Equal(t, jobs.ErrInvalidWebhookURL, err, u)
+	}
+
+	infos.Type = "@cron"
+	infos.Arguments = "0 0 0 * * *"
+	_, err = jobs.NewTrigger(db, infos, map[string]string{"url": "https://example.org/"})
+	assert.Equal(t, jobs.ErrMalformedTrigger, err)
+
+	infos.Type = "@event"
+	infos.Arguments = "io.cozy.files:CREATED"
+	trigger, err := jobs.NewTrigger(db, infos, map[string]string{"url": "https://example.org/"})
+	assert.NoError(t, err)
+	outgoing := trigger.Infos().Outgoing
+	if assert.NotNil(t, outgoing) {
+		assert.NotEmpty(t, outgoing.Secret)
+	}
+	assert.False(t, trigger.Infos().Disabled())
+	if assert.NotNil(t, trigger.Infos().Options) && assert.NotNil(t, trigger.Infos().Options.Retry) {
+		assert.Equal(t, 5, trigger.Infos().Options.Retry.MaxRetries)
+	}
+
+	body := []byte(`{"verb":"CREATED"}`)
+	signature := jobs.SignWebhookPayload(outgoing.Secret, body)
+	w := &jobs.WebhookTrigger{TriggerInfos: &jobs.TriggerInfos{
+		Webhook: &jobs.WebhookInfos{Token: "token", Secret: outgoing.Secret},
+	}}
+	assert.NoError(t, w.CheckSignature(body, signature))
+	assert.Error(t, w.CheckSignature([]byte(`{}`), signature))
+}
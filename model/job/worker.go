@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"runtime"
 	"runtime/debug"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,6 +27,10 @@ var (
 	defaultMaxExecCount = 1
 	defaultRetryDelay   = 60 * time.Millisecond
 	defaultTimeout      = 10 * time.Second
+
+	// progressInterval is the minimal duration between two updates of the
+	// job document for the progress reported by a worker.
+	progressInterval = 1 * time.Second
 )
 
 type (
@@ -41,8 +46,9 @@ type (
 	// WorkerFunc represent the work function that a worker should implement.
 	WorkerFunc func(ctx *WorkerContext) error
 
-	// WorkerCommit is an optional method that is always called once after the
-	// execution of the WorkerFunc.
+	// WorkerCommit is an optional method that is called once after the
+	// execution of the WorkerFunc, when the job is finished: it is not called
+	// when the job is scheduled again with its retry policy.
 	WorkerCommit func(ctx *WorkerContext, errjob error) error
 
 	// WorkerBeforeHook is an optional method that is always called before the
@@ -59,18 +65,23 @@ type (
 	// system. It contains parameters of the worker along with the worker main
 	// function that perform the work against a job's message.
 	WorkerConfig struct {
-		WorkerInit   WorkerInitFunc
-		WorkerStart  WorkerStartFunc
-		WorkerFunc   WorkerFunc
-		WorkerCommit WorkerCommit
-		WorkerType   string
-		BeforeHook   WorkerBeforeHook
-		ErrorHook    JobErrorCheckerHook
-		Concurrency  int
-		MaxExecCount int
-		Reserved     bool // true when the clients must not push jobs for this worker
-		Timeout      time.Duration
-		RetryDelay   time.Duration
+		WorkerInit    WorkerInitFunc
+		WorkerStart   WorkerStartFunc
+		WorkerFunc    WorkerFunc
+		WorkerCommit  WorkerCommit
+		WorkerType    string
+		BeforeHook    WorkerBeforeHook
+		ErrorHook     JobErrorCheckerHook
+		Concurrency   int
+		MaxExecCount  int
+		Reserved      bool // true when the clients must not push jobs for this worker
+		NoDeadLetters bool // true when the failed jobs are not kept as dead letters
+		Timeout       time.Duration
+		RetryDelay    time.Duration
+
+		// InstanceConcurrency is the maximal number of jobs of a single
+		// instance executed in parallel by the stacks (0 for no limit).
+		InstanceConcurrency int
 	}
 
 	// Worker is a unit of work that will consume from a queue and execute the do
@@ -81,6 +92,7 @@ type (
 		jobs    chan *Job
 		running uint32
 		closed  chan struct{}
+		broker  Broker // used to schedule the retries of the jobs
 	}
 
 	// WorkerContext is a context.Context passed to the worker for each job
@@ -93,11 +105,55 @@ type (
 		id       string
 		cookie   interface{}
 		noRetry  bool
+		progress *progressThrottle
+	}
+
+	// progressThrottle is shared by the clones of a worker context to limit
+	// the number of updates of the job document for the progress.
+	progressThrottle struct {
+		sync.Mutex
+		lastUpdate time.Time
 	}
 )
 
 var slots chan struct{}
 
+// runningJobs contains the cancel functions of the contexts of the jobs that
+// are executed by the workers of this process, indexed by their prefix and
+// identifier.
+var runningJobs = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: make(map[string]context.CancelFunc)}
+
+func runningJobKey(db prefixer.Prefixer, jobID string) string {
+	return db.DBPrefix() + "/" + jobID
+}
+
+func registerRunningJob(job *Job, cancel context.CancelFunc) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	runningJobs.cancels[runningJobKey(job, job.ID())] = cancel
+}
+
+func unregisterRunningJob(job *Job) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	delete(runningJobs.cancels, runningJobKey(job, job.ID()))
+}
+
+// cancelRunningJob cancels the context of the given job if it is executed
+// by a worker of this process, and returns true in this case.
+func cancelRunningJob(db prefixer.Prefixer, jobID string) bool {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	cancel, ok := runningJobs.cancels[runningJobKey(db, jobID)]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
 func setNbSlots(nb int) {
 	slots = make(chan struct{}, nb)
 	for i := 0; i < nb; i++ {
@@ -135,6 +191,7 @@ func NewWorkerContext(workerID string, job *Job, inst *instance.Instance) *Worke
 		job:      job,
 		log:      log,
 		id:       id,
+		progress: &progressThrottle{},
 	}
 }
 
@@ -171,6 +228,7 @@ func (c *WorkerContext) clone() *WorkerContext {
 		log:      c.log,
 		id:       c.id,
 		cookie:   c.cookie,
+		progress: c.progress,
 	}
 }
 
@@ -204,6 +262,46 @@ func (c *WorkerContext) TriggerID() (string, bool) {
 	return triggerID, triggerID != ""
 }
 
+// SetResult sets the result of the job. It is saved with the job when it
+// succeeds, and can be read via the API. For a job in a workflow, the result
+// is also used as the message of the next jobs.
+func (c *WorkerContext) SetResult(v interface{}) error {
+	result, err := NewMessage(v)
+	if err != nil {
+		return err
+	}
+	if len(result) > MaxResultSize {
+		return ErrResultTooLarge
+	}
+	c.job.result = result
+	return nil
+}
+
+// ReportProgress sets the progress of the job: done is the number of items
+// already processed, out of total (or 0 if it is not known). The job
+// document, and so the realtime event for io.cozy.jobs, is updated at most
+// once per second, and when the last item has been processed. An error while
+// saving the progress is only logged, as the job can continue without it.
+func (c *WorkerContext) ReportProgress(done, total int64, message string) {
+	c.progress.Lock()
+	defer c.progress.Unlock()
+	now := time.Now()
+	c.job.Progress = &JobProgress{
+		Done:      done,
+		Total:     total,
+		Message:   message,
+		UpdatedAt: now,
+	}
+	finished := total > 0 && done >= total
+	if !finished && now.Sub(c.progress.lastUpdate) < progressInterval {
+		return
+	}
+	c.progress.lastUpdate = now
+	if err := c.job.Update(); err != nil {
+		c.log.Warnf("Cannot save the progress of the job: %s", err)
+	}
+}
+
 // Cookie returns the cookie associated with the worker context.
 func (c *WorkerContext) Cookie() interface{} {
 	return c.cookie
@@ -222,6 +320,17 @@ func (c *WorkerContext) Manual() bool {
 	return c.job.Manual
 }
 
+// JobID returns the identifier of the job executed by the worker.
+func (c *WorkerContext) JobID() string {
+	return c.job.ID()
+}
+
+// Retries returns the number of times the job has been retried with its
+// retry policy.
+func (c *WorkerContext) Retries() int {
+	return c.job.Retries
+}
+
 // Start is used to start the worker consumption of messages from its queue.
 func (w *Worker) Start(jobs chan *Job) error {
 	if !atomic.CompareAndSwapUint32(&w.running, 0, 1) {
@@ -260,90 +369,138 @@ func (w *Worker) Shutdown(ctx context.Context) error {
 
 func (w *Worker) work(workerID string, closed chan<- struct{}) {
 	for job := range w.jobs {
-		domain := job.Domain
-		if domain == "" {
-			joblog.Errorf("%s: missing domain from job request", workerID)
-			continue
+		w.runJob(workerID, job)
+		job.release()
+	}
+	joblog.Debugf("%s: worker shut down", workerID)
+	closed <- struct{}{}
+}
+
+// runJob executes a job received from the broker.
+func (w *Worker) runJob(workerID string, job *Job) {
+	domain := job.Domain
+	if domain == "" {
+		joblog.Errorf("%s: missing domain from job request", workerID)
+		return
+	}
+	if job.State == Cancelled {
+		return
+	}
+	var inst *instance.Instance
+	if domain != prefixer.GlobalPrefixer.DomainName() {
+		var err error
+		inst, err = instance.GetFromCouch(job.Domain)
+		if err != nil {
+			joblog.Errorf("Instance not found for %s: %s", job.Domain, err)
+			return
 		}
-		var inst *instance.Instance
-		if domain != prefixer.GlobalPrefixer.DomainName() {
-			var err error
-			inst, err = instance.GetFromCouch(job.Domain)
-			if err != nil {
-				joblog.Errorf("Instance not found for %s: %s", job.Domain, err)
-				continue
+		// Do not execute jobs for instances with blocking not signed TOS,
+		// except for:
+		// - mails because the user may needs a mail to login and accept
+		//   the new TOS (2FA, password reset, etc.)
+		// - migrations because the old version may be no longer supported
+		//   when the user will sign the TOS
+		if w.Type != "sendmail" && w.Type != "migrations" {
+			notSigned, deadline := inst.CheckTOSNotSignedAndDeadline()
+			if notSigned && deadline == instance.TOSBlocked {
+				return
 			}
-			// Do not execute jobs for instances with blocking not signed TOS,
-			// except for:
-			// - mails because the user may needs a mail to login and accept
-			//   the new TOS (2FA, password reset, etc.)
-			// - migrations because the old version may be no longer supported
-			//   when the user will sign the TOS
-			if w.Type != "sendmail" && w.Type != "migrations" {
-				notSigned, deadline := inst.CheckTOSNotSignedAndDeadline()
-				if notSigned && deadline == instance.TOSBlocked {
-					continue
-				}
+		}
+	}
+	parentCtx := NewWorkerContext(workerID, job, inst)
+	var cancel context.CancelFunc
+	parentCtx.Context, cancel = context.WithCancel(parentCtx.Context)
+	registerRunningJob(job, cancel)
+	if err := job.AckConsumed(); err != nil {
+		parentCtx.Logger().Errorf("error acking consume job: %s",
+			err.Error())
+		unregisterRunningJob(job)
+		cancel()
+		return
+	}
+	t := &task{
+		w:    w,
+		ctx:  parentCtx,
+		job:  job,
+		conf: w.defaultedConf(job.Options),
+	}
+	var runResultLabel string
+	var errAck error
+	var retried bool
+	errRun := t.run()
+	unregisterRunningJob(job)
+	// The WorkerCommit function is called with the context of the job, before
+	// its state is updated, and only when the job won't be retried.
+	defer cancel()
+	errCommit := errRun
+	if errRun == ErrAbort {
+		errRun = nil
+	}
+	if errRun == ErrJobCancelled {
+		parentCtx.Logger().Infof("job cancelled")
+		runResultLabel = metrics.WorkerExecResultErrored
+		t.commit(errCommit)
+		errAck = job.Cancel()
+	} else if delay, ok := t.retryLater(errRun); ok {
+		parentCtx.Logger().Warnf("error while performing job: %s (retry in %s)",
+			errRun.Error(), delay)
+		runResultLabel = metrics.WorkerExecResultErrored
+		retried = true
+		errAck = w.retryJob(job, errRun, delay)
+	} else if errRun != nil {
+		parentCtx.Logger().Errorf("error while performing job: %s",
+			errRun.Error())
+		runResultLabel = metrics.WorkerExecResultErrored
+		if !w.Conf.NoDeadLetters {
+			if err := addDeadLetter(job, errRun); err != nil {
+				parentCtx.Logger().Errorf("error while adding dead letter: %s",
+					err.Error())
 			}
 		}
-		parentCtx := NewWorkerContext(workerID, job, inst)
-		if err := job.AckConsumed(); err != nil {
-			parentCtx.Logger().Errorf("error acking consume job: %s",
+		t.commit(errCommit)
+		errAck = job.Nack(errRun)
+	} else {
+		runResultLabel = metrics.WorkerExecResultSuccess
+		if err := job.saveResult(inst); err != nil {
+			parentCtx.Logger().Errorf("error while saving the result: %s",
 				err.Error())
-			continue
-		}
-		t := &task{
-			w:    w,
-			ctx:  parentCtx,
-			job:  job,
-			conf: w.defaultedConf(job.Options),
-		}
-		var runResultLabel string
-		var errAck error
-		errRun := t.run()
-		if errRun == ErrAbort {
-			errRun = nil
-		}
-		if errRun != nil {
-			parentCtx.Logger().Errorf("error while performing job: %s",
-				errRun.Error())
-			runResultLabel = metrics.WorkerExecResultErrored
-			errAck = job.Nack(errRun)
-		} else {
-			runResultLabel = metrics.WorkerExecResultSuccess
-			errAck = job.Ack()
 		}
+		t.commit(errCommit)
+		errAck = job.Ack()
+	}
 
-		// Distinguish classic job execution and konnector/account deletion
-		msg := struct {
-			Account        string `json:"account"`
-			AccountRev     string `json:"account_rev"`
-			Konnector      string `json:"konnector"`
-			AccountDeleted bool   `json:"account_deleted"`
-		}{}
-		err := json.Unmarshal(job.Message, &msg)
-
-		if err == nil && w.Type == "konnector" && msg.AccountDeleted {
-			metrics.WorkerKonnectorExecDeleteCounter.WithLabelValues(w.Type, runResultLabel).Inc()
-		} else {
-			metrics.WorkerExecCounter.WithLabelValues(w.Type, runResultLabel).Inc()
-		}
+	// Distinguish classic job execution and konnector/account deletion
+	msg := struct {
+		Account        string `json:"account"`
+		AccountRev     string `json:"account_rev"`
+		Konnector      string `json:"konnector"`
+		AccountDeleted bool   `json:"account_deleted"`
+	}{}
+	err := json.Unmarshal(job.Message, &msg)
+
+	if err == nil && w.Type == "konnector" && msg.AccountDeleted {
+		metrics.WorkerKonnectorExecDeleteCounter.WithLabelValues(w.Type, runResultLabel).Inc()
+	} else {
+		metrics.WorkerExecCounter.WithLabelValues(w.Type, runResultLabel).Inc()
+	}
 
-		if errAck != nil {
-			parentCtx.Logger().Errorf("error while acking job done: %s",
-				errAck.Error())
+	if errAck != nil {
+		parentCtx.Logger().Errorf("error while acking job done: %s",
+			errAck.Error())
+	} else if job.WorkflowID != "" && !retried {
+		if err := continueWorkflow(job, errRun); err != nil {
+			parentCtx.Logger().Errorf("error while continuing workflow %s: %s",
+				job.WorkflowID, err.Error())
 		}
+	}
 
-		// Delete the trigger associated with the job (if any) when we receive a
-		// ErrBadTrigger.
-		if job.TriggerID != "" && globalJobSystem != nil {
-			if _, ok := errRun.(ErrBadTrigger); ok {
-				_ = globalJobSystem.DeleteTrigger(job, job.TriggerID)
-			}
+	// Delete the trigger associated with the job (if any) when we receive a
+	// ErrBadTrigger.
+	if job.TriggerID != "" && globalJobSystem != nil {
+		if _, ok := errRun.(ErrBadTrigger); ok {
+			_ = globalJobSystem.DeleteTrigger(job, job.TriggerID)
 		}
 	}
-	joblog.Debugf("%s: worker shut down", workerID)
-	closed <- struct{}{}
 }
 
 func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
@@ -381,6 +538,22 @@ type task struct {
 	startTime time.Time
 	endTime   time.Time
 	execCount int
+	noRetry   bool
+	started   bool
+}
+
+// commit calls the optional WorkerCommit function of the worker, if the
+// WorkerStart function has succeeded. It must not be called when the job is
+// scheduled again with its retry policy.
+func (t *task) commit(err error) {
+	if t.conf.WorkerCommit == nil || !t.started {
+		return
+	}
+	t.ctx.log = t.ctx.Logger().WithField("exec_time", t.endTime.Sub(t.startTime))
+	if errc := t.conf.WorkerCommit(t.ctx, err); errc != nil {
+		t.ctx.Logger().Warnf("Error while committing job: %s",
+			errc.Error())
+	}
 }
 
 func (t *task) run() (err error) {
@@ -393,15 +566,7 @@ func (t *task) run() (err error) {
 			return err
 		}
 	}
-	defer func() {
-		if t.conf.WorkerCommit != nil {
-			t.ctx.log = t.ctx.Logger().WithField("exec_time", t.endTime.Sub(t.startTime))
-			if errc := t.conf.WorkerCommit(t.ctx, err); errc != nil {
-				t.ctx.Logger().Warnf("Error while committing job: %s",
-					errc.Error())
-			}
-		}
-	}()
+	t.started = true
 	for {
 		retry, delay, timeout := t.nextDelay(err)
 
@@ -419,7 +584,14 @@ func (t *task) run() (err error) {
 		}
 
 		if delay > 0 {
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-t.ctx.Done():
+			}
+		}
+		if t.ctx.Err() != nil {
+			err = ErrJobCancelled
+			break
 		}
 
 		t.ctx.Logger().Debugf("Executing job (%d) (timeout set to %s)",
@@ -432,6 +604,10 @@ func (t *task) run() (err error) {
 
 		ctx, cancel := t.ctx.WithTimeout(timeout)
 		err = t.exec(ctx)
+		if err != nil && t.ctx.Err() != nil {
+			// The job has been cancelled during its execution
+			err = ErrJobCancelled
+		}
 		if err == nil {
 			execResultLabel = metrics.WorkerExecResultSuccess
 			timer.ObserveDuration()
@@ -474,6 +650,7 @@ func (t *task) run() (err error) {
 		t.execCount++
 
 		if ctx.NoRetry() {
+			t.noRetry = true
 			break
 		}
 	}
@@ -504,16 +681,8 @@ func (t *task) exec(ctx *WorkerContext) (err error) {
 }
 
 func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
-	// for certain kinds of errors, we do not have a retry since these error
-	// cannot be recovered from
-	{
-		if _, ok := prevError.(ErrBadTrigger); ok {
-			return false, 0, 0
-		}
-		switch prevError {
-		case ErrAbort, ErrMessageUnmarshal, ErrMessageNil:
-			return false, 0, 0
-		}
+	if isPermanentError(prevError) {
+		return false, 0, 0
 	}
 
 	c := t.conf
@@ -522,6 +691,12 @@ func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
 		return false, 0, 0
 	}
 
+	// with a retry policy, the retries are not made in this loop, but are
+	// pushed again in the queue (see retryLater)
+	if t.execCount > 0 && t.retryPolicy() != nil {
+		return false, 0, 0
+	}
+
 	// the worker timeout should take into account the maximum execution time
 	// allowed to the task
 	timeout := c.Timeout
@@ -540,3 +715,56 @@ func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
 
 	return true, nextDelay, timeout
 }
+
+// isPermanentError returns true for certain kinds of errors that cannot be
+// recovered from: there is no retry for them.
+func isPermanentError(err error) bool {
+	if _, ok := err.(ErrBadTrigger); ok {
+		return true
+	}
+	switch err {
+	case ErrAbort, ErrJobCancelled, ErrMessageUnmarshal, ErrMessageNil:
+		return true
+	}
+	return false
+}
+
+func (t *task) retryPolicy() *RetryPolicy {
+	if t.job.Options == nil {
+		return nil
+	}
+	return t.job.Options.Retry
+}
+
+// retryLater returns the delay before the next execution of a job with a retry
+// policy, and false if the job must not be retried.
+func (t *task) retryLater(err error) (time.Duration, bool) {
+	policy := t.retryPolicy()
+	if policy == nil || err == nil || t.noRetry || isPermanentError(err) {
+		return 0, false
+	}
+	if t.job.Retries >= policy.MaxRetries || !policy.Retryable(err) {
+		return 0, false
+	}
+	if t.conf.ErrorHook != nil && !t.conf.ErrorHook(err) {
+		return 0, false
+	}
+	return policy.Delay(t.job.Retries+1, t.conf.RetryDelay), true
+}
+
+// retryJob puts the job back in the queued state, and asks the broker to push
+// it again in the queue after the delay.
+func (w *Worker) retryJob(job *Job, errRun error, delay time.Duration) error {
+	if w.broker == nil {
+		return job.Nack(errRun)
+	}
+	job.Retries++
+	job.State = Queued
+	job.Error = errRun.Error()
+	job.Progress = nil
+	job.result = nil
+	if err := job.Update(); err != nil {
+		return err
+	}
+	return w.broker.RetryJob(job, delay)
+}
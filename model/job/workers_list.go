@@ -75,6 +75,9 @@ func applyWorkerConfig(w *WorkerConfig, c config.Worker) *WorkerConfig {
 	if c.Concurrency != nil {
 		w.Concurrency = *c.Concurrency
 	}
+	if c.InstanceConcurrency != nil {
+		w.InstanceConcurrency = *c.InstanceConcurrency
+	}
 	if c.MaxExecCount != nil {
 		w.MaxExecCount = *c.MaxExecCount
 	}
@@ -0,0 +1,371 @@
+package job
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// Pending state is used for the steps of a workflow that have not been
+	// reached yet.
+	Pending State = "pending"
+	// Skipped state is used for the steps of a workflow that will not be
+	// executed, as the previous step has not ended with the expected result.
+	Skipped State = "skipped"
+
+	// OnSuccess is the condition for a step executed after the success of
+	// its parent.
+	OnSuccess = "on_success"
+	// OnFailure is the condition for a step executed after the failure of its
+	// parent.
+	OnFailure = "on_failure"
+
+	// maxWorkflowSteps is the maximal number of steps in a workflow.
+	maxWorkflowSteps = 20
+	// maxWorkflowUpdateRetries is the number of times a workflow is updated
+	// when there are conflicts with the updates for other steps.
+	maxWorkflowUpdateRetries = 10
+)
+
+// ErrInvalidWorkflow is used when the follow-up jobs of a job request are
+// not valid.
+var ErrInvalidWorkflow = errors.New("jobs: invalid workflow")
+
+type (
+	// WorkflowStep is a follow-up job, declared in a job request or a
+	// trigger, that is executed after the success or the failure of the
+	// previous job. If the step has no message, it receives the result of the
+	// previous job (or its message if there is no result).
+	WorkflowStep struct {
+		WorkerType string          `json:"worker"`
+		Message    Message         `json:"message,omitempty"`
+		Options    *JobOptions     `json:"options,omitempty"`
+		OnSuccess  []*WorkflowStep `json:"on_success,omitempty"`
+		OnFailure  []*WorkflowStep `json:"on_failure,omitempty"`
+	}
+
+	// WorkflowStepState is the state of a step of a workflow.
+	WorkflowStepState struct {
+		WorkerType string      `json:"worker"`
+		Message    Message     `json:"message,omitempty"`
+		Options    *JobOptions `json:"options,omitempty"`
+		Parent     int         `json:"parent"`
+		Condition  string      `json:"condition,omitempty"`
+		State      State       `json:"state"`
+		JobID      string      `json:"job_id,omitempty"`
+		Error      string      `json:"error,omitempty"`
+	}
+
+	// Workflow is a document that follows the execution of a job and of its
+	// follow-up jobs. The first step is the initial job, and the other steps
+	// have the index of their parent step.
+	Workflow struct {
+		WID       string               `json:"_id,omitempty"`
+		WRev      string               `json:"_rev,omitempty"`
+		Domain    string               `json:"domain"`
+		Prefix    string               `json:"prefix,omitempty"`
+		TriggerID string               `json:"trigger_id,omitempty"`
+		State     State                `json:"state"`
+		Steps     []*WorkflowStepState `json:"steps"`
+		CreatedAt time.Time            `json:"created_at"`
+		UpdatedAt time.Time            `json:"updated_at"`
+	}
+)
+
+// ID implements the couchdb.Doc interface
+func (w *Workflow) ID() string { return w.WID }
+
+// Rev implements the couchdb.Doc interface
+func (w *Workflow) Rev() string { return w.WRev }
+
+// DocType implements the couchdb.Doc interface
+func (w *Workflow) DocType() string { return consts.JobsWorkflows }
+
+// SetID implements the couchdb.Doc interface
+func (w *Workflow) SetID(id string) { w.WID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (w *Workflow) SetRev(rev string) { w.WRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (w *Workflow) Clone() couchdb.Doc {
+	cloned := *w
+	cloned.Steps = make([]*WorkflowStepState, len(w.Steps))
+	for i, step := range w.Steps {
+		tmp := *step
+		cloned.Steps[i] = &tmp
+	}
+	return &cloned
+}
+
+// DBPrefix implements the prefixer.Prefixer interface.
+func (w *Workflow) DBPrefix() string {
+	if w.Prefix != "" {
+		return w.Prefix
+	}
+	return w.Domain
+}
+
+// DomainName implements the prefixer.Prefixer interface.
+func (w *Workflow) DomainName() string {
+	return w.Domain
+}
+
+// GetWorkflow returns the workflow with the given identifier.
+func GetWorkflow(db prefixer.Prefixer, workflowID string) (*Workflow, error) {
+	var wf Workflow
+	if err := couchdb.GetDoc(db, consts.JobsWorkflows, workflowID, &wf); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrNotFoundJob
+		}
+		return nil, err
+	}
+	return &wf, nil
+}
+
+// HasFollowUps returns true if the job request declares some jobs to execute
+// after it.
+func (jr *JobRequest) HasFollowUps() bool {
+	return len(jr.OnSuccess) > 0 || len(jr.OnFailure) > 0
+}
+
+// FollowUpsWorkerTypes returns the worker types of all the follow-up jobs of
+// the job request.
+func (jr *JobRequest) FollowUpsWorkerTypes() []string {
+	var types []string
+	var walk func(steps []*WorkflowStep)
+	walk = func(steps []*WorkflowStep) {
+		for _, step := range steps {
+			types = append(types, step.WorkerType)
+			walk(step.OnSuccess)
+			walk(step.OnFailure)
+		}
+	}
+	walk(jr.OnSuccess)
+	walk(jr.OnFailure)
+	return types
+}
+
+// newWorkflow returns a workflow for the job and the follow-ups of the job
+// request, with the steps flattened.
+func newWorkflow(job *Job, req *JobRequest) (*Workflow, error) {
+	now := time.Now()
+	wf := &Workflow{
+		Domain:    job.Domain,
+		Prefix:    job.Prefix,
+		TriggerID: job.TriggerID,
+		State:     Queued,
+		Steps: []*WorkflowStepState{{
+			WorkerType: job.WorkerType,
+			Options:    job.Options,
+			Parent:     -1,
+			State:      Queued,
+		}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := wf.addSteps(0, OnSuccess, req.OnSuccess); err != nil {
+		return nil, err
+	}
+	if err := wf.addSteps(0, OnFailure, req.OnFailure); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+func (w *Workflow) addSteps(parent int, condition string, steps []*WorkflowStep) error {
+	for _, step := range steps {
+		if step == nil || step.WorkerType == "" {
+			return ErrInvalidWorkflow
+		}
+		if len(w.Steps) >= maxWorkflowSteps {
+			return ErrInvalidWorkflow
+		}
+		w.Steps = append(w.Steps, &WorkflowStepState{
+			WorkerType: step.WorkerType,
+			Message:    step.Message,
+			Options:    step.Options,
+			Parent:     parent,
+			Condition:  condition,
+			State:      Pending,
+		})
+		idx := len(w.Steps) - 1
+		if err := w.addSteps(idx, OnSuccess, step.OnSuccess); err != nil {
+			return err
+		}
+		if err := w.addSteps(idx, OnFailure, step.OnFailure); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createJob persists the job in CouchDB. If the job request has some
+// follow-ups, a workflow is also created, and the job is its first step.
+func createJob(job *Job, req *JobRequest) error {
+	if err := req.Options.validate(); err != nil {
+		return err
+	}
+	if job.WorkflowID != "" || !req.HasFollowUps() {
+		return job.Create()
+	}
+	wf, err := newWorkflow(job, req)
+	if err != nil {
+		return err
+	}
+	if err = couchdb.CreateDoc(job, wf); err != nil {
+		return err
+	}
+	job.WorkflowID = wf.ID()
+	job.WorkflowStep = 0
+	if err = job.Create(); err != nil {
+		return err
+	}
+	return updateWorkflow(job, wf.ID(), func(wf *Workflow) {
+		wf.Steps[0].JobID = job.ID()
+	})
+}
+
+// updateWorkflow applies the given function on the workflow, and saves it.
+// The function can be called several times if there are conflicts.
+func updateWorkflow(db prefixer.Prefixer, workflowID string, fn func(wf *Workflow)) error {
+	var err error
+	for i := 0; i < maxWorkflowUpdateRetries; i++ {
+		var wf *Workflow
+		wf, err = GetWorkflow(db, workflowID)
+		if err != nil {
+			return err
+		}
+		fn(wf)
+		wf.State = wf.computeState()
+		wf.UpdatedAt = time.Now()
+		err = couchdb.UpdateDoc(db, wf)
+		if err == nil || !couchdb.IsConflictError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// computeState returns the state of the workflow: queued or running while
+// some steps are not finished, and then done or errored.
+func (w *Workflow) computeState() State {
+	finished := true
+	failed := false
+	for i, step := range w.Steps {
+		switch step.State {
+		case Pending, Queued, Running:
+			finished = false
+		case Errored, Cancelled:
+			failed = true
+		}
+		if i == 0 && step.State == Queued {
+			return Queued
+		}
+	}
+	if !finished {
+		return Running
+	}
+	if failed {
+		return Errored
+	}
+	return Done
+}
+
+// skipStep marks the step and its pending descendants as skipped.
+func (w *Workflow) skipStep(idx int) {
+	w.Steps[idx].State = Skipped
+	for i, step := range w.Steps {
+		if step.Parent == idx && step.State == Pending {
+			w.skipStep(i)
+		}
+	}
+}
+
+// continueWorkflow is called when a job of a workflow is finished. It
+// updates the state of its step, and pushes the follow-up jobs that match
+// the result of the job.
+func continueWorkflow(job *Job, errRun error) error {
+	var next []int
+	err := updateWorkflow(job, job.WorkflowID, func(wf *Workflow) {
+		next = next[:0]
+		idx := job.WorkflowStep
+		if idx < 0 || idx >= len(wf.Steps) {
+			return
+		}
+		wf.Steps[idx].JobID = job.ID()
+		wf.Steps[idx].State = job.State
+		if errRun != nil {
+			wf.Steps[idx].Error = errRun.Error()
+		}
+		for i, step := range wf.Steps {
+			if step.Parent != idx || step.State != Pending {
+				continue
+			}
+			if (job.State == Done && step.Condition == OnSuccess) ||
+				(job.State == Errored && step.Condition == OnFailure) {
+				step.State = Queued
+				next = append(next, i)
+			} else {
+				wf.skipStep(i)
+			}
+		}
+	})
+	if err != nil || len(next) == 0 {
+		return err
+	}
+
+	wf, err := GetWorkflow(job, job.WorkflowID)
+	if err != nil {
+		return err
+	}
+	jobIDs := make(map[int]string)
+	failures := make(map[int]error)
+	for _, idx := range next {
+		step := wf.Steps[idx]
+		msg := step.Message
+		if len(msg) == 0 {
+			msg = job.result
+		}
+		if len(msg) == 0 {
+			msg = job.Message
+		}
+		req := &JobRequest{
+			WorkerType:   step.WorkerType,
+			TriggerID:    job.TriggerID,
+			Message:      msg,
+			Options:      step.Options,
+			WorkflowID:   wf.ID(),
+			WorkflowStep: idx,
+		}
+		j, err := System().PushJob(job, req)
+		if err != nil {
+			failures[idx] = err
+		} else {
+			// The job ID is empty if the job has been skipped by the
+			// BeforeHook of the worker
+			jobIDs[idx] = j.ID()
+		}
+	}
+
+	return updateWorkflow(job, job.WorkflowID, func(wf *Workflow) {
+		for idx, id := range jobIDs {
+			if id == "" {
+				wf.skipStep(idx)
+			} else if wf.Steps[idx].JobID == "" {
+				wf.Steps[idx].JobID = id
+			}
+		}
+		for idx, err := range failures {
+			wf.skipStep(idx)
+			wf.Steps[idx].State = Errored
+			wf.Steps[idx].Error = err.Error()
+		}
+	})
+}
+
+var _ couchdb.Doc = &Workflow{}
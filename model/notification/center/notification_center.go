@@ -25,6 +25,12 @@ const (
 	// NotificationDiskQuota category for sending alert when reaching 90% of disk
 	// usage quota.
 	NotificationDiskQuota = "disk-quota"
+	// NotificationTrashExpiration category for warning the user that some
+	// files in the trash will be destroyed soon.
+	NotificationTrashExpiration = "trash-expiration"
+	// NotificationFileDrop category for telling the user that a file has been
+	// uploaded in one of their file drops.
+	NotificationFileDrop = "file-drop"
 )
 
 var (
@@ -36,6 +42,14 @@ var (
 			MailTemplate: "notifications_diskquota",
 			MinInterval:  7 * 24 * time.Hour,
 		},
+		NotificationTrashExpiration: {
+			Description:  "Warn about the files in the trash that will be destroyed soon",
+			MailTemplate: "notifications_trash_expiration",
+		},
+		NotificationFileDrop: {
+			Description:  "Tell about the files uploaded in a file drop",
+			MailTemplate: "notifications_file_drop",
+		},
 	}
 )
 
@@ -61,6 +75,36 @@ func init() {
 	})
 }
 
+// PushTrashExpiration sends a notification to the user to warn that some
+// files and directories will be removed from the trash in a few days.
+func PushTrashExpiration(inst *instance.Instance, count, days int) error {
+	trashLink := inst.SubDomain(consts.DriveSlug)
+	trashLink.Fragment = "/trash"
+	n := &notification.Notification{
+		Data: map[string]interface{}{
+			"Count":     count,
+			"Days":      days,
+			"TrashLink": trashLink.String(),
+		},
+	}
+	return pushStack(inst.Domain, NotificationTrashExpiration, n)
+}
+
+// PushFileDrop sends a notification to the user to tell that a file has been
+// uploaded in the given directory via a file drop.
+func PushFileDrop(inst *instance.Instance, dir *vfs.DirDoc, file *vfs.FileDoc) error {
+	folderLink := inst.SubDomain(consts.DriveSlug)
+	folderLink.Fragment = "/folder/" + dir.ID()
+	n := &notification.Notification{
+		Data: map[string]interface{}{
+			"FileName":   file.DocName,
+			"FolderName": dir.DocName,
+			"FolderLink": folderLink.String(),
+		},
+	}
+	return pushStack(inst.Domain, NotificationFileDrop, n)
+}
+
 func pushStack(domain string, category string, n *notification.Notification) error {
 	inst, err := lifecycle.GetInstance(domain)
 	if err != nil {
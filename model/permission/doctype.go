@@ -23,6 +23,8 @@ var blackList = map[string]bool{
 	consts.Archives:         none,
 	consts.Sharings:         none,
 	consts.Shared:           none,
+	consts.FilesBlobs:       none,
+	consts.FilesSearchIndex: none,
 
 	// TODO: uncomment to restric jobs permissions (make these none instead of
 	// readable).
@@ -0,0 +1,161 @@
+package permission
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// maxDropUpdateRetries is the number of times the counters of a file drop are
+// updated when there are conflicts with concurrent uploads.
+const maxDropUpdateRetries = 20
+
+// DropOptions are the options of a file drop: the limits on the files that
+// can be uploaded, and the counters of what has already been received. A
+// zero limit means that there is no limit.
+type DropOptions struct {
+	MaxSize    int64 `json:"max_size,omitempty"`
+	MaxFiles   int   `json:"max_files,omitempty"`
+	BytesCount int64 `json:"bytes_count"`
+	FilesCount int   `json:"files_count"`
+}
+
+// DropDirID returns the identifier of the directory where the files of a
+// file drop are uploaded.
+func (p *Permission) DropDirID() string {
+	if p.Type != TypeShareDrop || len(p.Permissions) != 1 {
+		return ""
+	}
+	if len(p.Permissions[0].Values) != 1 {
+		return ""
+	}
+	return p.Permissions[0].Values[0]
+}
+
+// CheckDrop returns an error if a file of the given size cannot be uploaded
+// in the file drop. A negative size means that the size is unknown.
+func (p *Permission) CheckDrop(size int64) error {
+	if p.Drop == nil {
+		return nil
+	}
+	if p.Drop.MaxFiles > 0 && p.Drop.FilesCount >= p.Drop.MaxFiles {
+		return ErrDropLimitReached
+	}
+	if p.Drop.MaxSize > 0 {
+		if size < 0 || p.Drop.BytesCount+size > p.Drop.MaxSize {
+			return ErrDropLimitReached
+		}
+	}
+	return nil
+}
+
+// CreateShareDropSet creates a Permission doc for a file drop. The set must
+// have a single rule, for uploading files (POST) in a directory.
+func CreateShareDropSet(db prefixer.Prefixer, parent *Permission, sourceID string, codes, shortcodes map[string]string, subdoc Permission, expiresAt *time.Time) (*Permission, error) {
+	set := subdoc.Permissions
+	if parent.Type != TypeWebapp && parent.Type != TypeKonnector && parent.Type != TypeOauth {
+		return nil, ErrOnlyAppCanCreateSubSet
+	}
+
+	if len(set) != 1 {
+		return nil, ErrInvalidDrop
+	}
+	rule := set[0]
+	if rule.Type != consts.Files || rule.Selector != "" || len(rule.Values) != 1 ||
+		len(rule.Verbs) != 1 || !rule.Verbs.Contains(POST) {
+		return nil, ErrInvalidDrop
+	}
+
+	if !set.IsSubSetOf(parent.Permissions) {
+		return nil, ErrNotSubset
+	}
+
+	drop := &DropOptions{}
+	if subdoc.Drop != nil {
+		drop.MaxSize = subdoc.Drop.MaxSize
+		drop.MaxFiles = subdoc.Drop.MaxFiles
+	}
+
+	doc := &Permission{
+		Type:        TypeShareDrop,
+		SourceID:    sourceID,
+		Permissions: set,
+		Codes:       codes,
+		ShortCodes:  shortcodes,
+		ExpiresAt:   expiresAt,
+		Drop:        drop,
+		Metadata:    subdoc.Metadata,
+	}
+
+	err := couchdb.CreateDoc(db, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// ReserveDrop checks the limits of a file drop and counts a file of the given
+// size in its counters, in a single update of the permission document. The
+// update is retried when there are conflicts with concurrent uploads, so that
+// the limits can't be exceeded. A negative size means that the size is
+// unknown: the file is counted with a zero size, and AdjustDrop can be called
+// when the upload is finished.
+func ReserveDrop(db prefixer.Prefixer, permID string, size int64) (*Permission, error) {
+	return updateDrop(db, permID, func(doc *Permission) error {
+		if err := doc.CheckDrop(size); err != nil {
+			return err
+		}
+		if size < 0 {
+			size = 0
+		}
+		doc.Drop.FilesCount++
+		doc.Drop.BytesCount += size
+		return nil
+	})
+}
+
+// AdjustDrop updates the counters of a file drop with the given deltas, for
+// example when an upload has failed after its reservation.
+func AdjustDrop(db prefixer.Prefixer, permID string, files int, bytes int64) (*Permission, error) {
+	return updateDrop(db, permID, func(doc *Permission) error {
+		doc.Drop.FilesCount += files
+		doc.Drop.BytesCount += bytes
+		if doc.Drop.FilesCount < 0 {
+			doc.Drop.FilesCount = 0
+		}
+		if doc.Drop.BytesCount < 0 {
+			doc.Drop.BytesCount = 0
+		}
+		return nil
+	})
+}
+
+func updateDrop(db prefixer.Prefixer, permID string, fn func(doc *Permission) error) (*Permission, error) {
+	var err error
+	for i := 0; i < maxDropUpdateRetries; i++ {
+		doc := &Permission{}
+		if err = couchdb.GetDoc(db, consts.Permissions, permID, doc); err != nil {
+			return nil, err
+		}
+		if doc.Type != TypeShareDrop {
+			return nil, ErrInvalidDrop
+		}
+		if doc.Drop == nil {
+			doc.Drop = &DropOptions{}
+		}
+		if err = fn(doc); err != nil {
+			return nil, err
+		}
+		err = couchdb.UpdateDoc(db, doc)
+		if err == nil {
+			return doc, nil
+		}
+		if !couchdb.IsConflictError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
@@ -38,4 +38,14 @@ var (
 	// ErrNotParent is used when the permissions should have a specific parent.
 	ErrNotParent = echo.NewHTTPError(http.StatusForbidden,
 		"Permissions can be updated only by its parent")
+
+	// ErrInvalidDrop is used when the permissions of a file drop are not a
+	// single rule for uploading files in a directory.
+	ErrInvalidDrop = echo.NewHTTPError(http.StatusBadRequest,
+		"A file drop must have a single rule for POST on a directory")
+
+	// ErrDropLimitReached is used when a file cannot be uploaded in a file
+	// drop as it would exceed the limits set by its owner.
+	ErrDropLimitReached = echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+		"The limits of this file drop have been reached")
 )
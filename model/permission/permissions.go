@@ -30,6 +30,7 @@ type Permission struct {
 	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
 	Codes       map[string]string `json:"codes,omitempty"`
 	ShortCodes  map[string]string `json:"shortcodes,omitempty"`
+	Drop        *DropOptions      `json:"drop,omitempty"`
 
 	Client   interface{}            `json:"-"` // Contains the *oauth.Client client pointer for Oauth permission type
 	Metadata *metadata.CozyMetadata `json:"cozyMetadata,omitempty"`
@@ -62,6 +63,10 @@ const (
 	// TypeShareInteract is the value of Permission.Type for reading and
 	// writing a note in a shared folder.
 	TypeShareInteract = "share-interact"
+
+	// TypeShareDrop is the value of Permission.Type for a file drop: the link
+	// holder can upload files in a directory, but cannot see its content.
+	TypeShareDrop = "share-drop"
 )
 
 // ID implements jsonapi.Doc
@@ -81,6 +86,10 @@ func (p *Permission) Clone() couchdb.Doc {
 	if p.Metadata != nil {
 		cloned.Metadata = p.Metadata.Clone()
 	}
+	if p.Drop != nil {
+		drop := *p.Drop
+		cloned.Drop = &drop
+	}
 	for k, v := range p.Codes {
 		cloned.Codes[k] = v
 	}
@@ -155,7 +164,8 @@ func (p *Permission) Revoke(db prefixer.Prefixer) error {
 // ParentOf check if child has been created by p
 func (p *Permission) ParentOf(child *Permission) bool {
 	canBeParent := p.Type == TypeWebapp || p.Type == TypeOauth
-	return child.Type == TypeShareByLink && canBeParent &&
+	isShare := child.Type == TypeShareByLink || child.Type == TypeShareDrop
+	return isShare && canBeParent &&
 		child.SourceID == p.SourceID
 }
 
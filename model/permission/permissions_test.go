@@ -402,3 +402,21 @@ func (t *validableFile) Fetch(field string) []string {
 	}
 	return prefixes
 }
+
+func TestCheckDrop(t *testing.T) {
+	p := &Permission{Type: TypeShareDrop}
+	assert.NoError(t, p.CheckDrop(-1))
+
+	p.Drop = &DropOptions{MaxSize: 100, MaxFiles: 2}
+	assert.NoError(t, p.CheckDrop(60))
+	assert.Error(t, p.CheckDrop(-1))
+	assert.Error(t, p.CheckDrop(101))
+
+	p.Drop.BytesCount = 60
+	p.Drop.FilesCount = 1
+	assert.NoError(t, p.CheckDrop(40))
+	assert.Error(t, p.CheckDrop(41))
+
+	p.Drop.FilesCount = 2
+	assert.Error(t, p.CheckDrop(1))
+}
@@ -0,0 +1,71 @@
+package search
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+const (
+	// maxTextSize is the maximal size of a text file for its content to be
+	// indexed. For bigger files, only the beginning is indexed.
+	maxTextSize = 2 << 20
+	// maxPDFSize is the maximal size of a PDF file for its content to be
+	// indexed.
+	maxPDFSize = 20 << 20
+)
+
+// isText returns true if the content of the file is some text that can be
+// indexed as is (plain text, markdown, notes).
+func isText(doc *vfs.FileDoc) bool {
+	switch doc.Mime {
+	case consts.NoteMimeType, "text/plain", "text/markdown", "text/x-markdown", "text/csv":
+		return true
+	}
+	return strings.HasPrefix(doc.Mime, "text/") && doc.Class == "text"
+}
+
+// isPDF returns true if the file is a PDF.
+func isPDF(doc *vfs.FileDoc) bool {
+	return doc.Mime == "application/pdf"
+}
+
+// extractContent returns the text content of a file, or an empty string if
+// the type of the file is not supported. For the notes, the file contains
+// the markdown of the note.
+func extractContent(fs vfs.VFS, doc *vfs.FileDoc) (string, error) {
+	switch {
+	case isText(doc):
+		buf, err := readFile(fs, doc, maxTextSize)
+		if err != nil {
+			return "", err
+		}
+		if !utf8.Valid(buf) {
+			buf = []byte(strings.ToValidUTF8(string(buf), " "))
+		}
+		return string(buf), nil
+	case isPDF(doc):
+		if doc.ByteSize > maxPDFSize {
+			return "", nil
+		}
+		buf, err := readFile(fs, doc, maxPDFSize)
+		if err != nil {
+			return "", err
+		}
+		return extractPDFText(buf), nil
+	}
+	return "", nil
+}
+
+func readFile(fs vfs.VFS, doc *vfs.FileDoc, limit int64) ([]byte, error) {
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(io.LimitReader(f, limit))
+}
@@ -0,0 +1,263 @@
+// Package search is a full-text search engine for the files. The index is an
+// inverted index, made of a CouchDB document per file with the terms found in
+// the name, the path, the tags and the content of the file, and a view that
+// emits these terms.
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// The weights used to compute the relevance of a term for a file.
+const (
+	nameWeight    = 10
+	tagWeight     = 5
+	pathWeight    = 2
+	contentWeight = 1
+	// maxContentScore is the maximal score that a term can have from the
+	// content: a term that is repeated many times in a long document should
+	// not be more relevant than a term in the name of a file.
+	maxContentScore = 5
+	// maxContentTerms is the maximal number of distinct terms kept for the
+	// content of a file.
+	maxContentTerms = 10000
+)
+
+// Entry is the document of the search index for a file. Its identifier is
+// the same as the file.
+type Entry struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	Name    string         `json:"name"`
+	DirID   string         `json:"dir_id"`
+	Path    string         `json:"path"`
+	Tags    []string       `json:"tags,omitempty"`
+	MD5Sum  []byte         `json:"md5sum,omitempty"`
+	Content map[string]int `json:"content,omitempty"`
+
+	// Terms is the map of the terms for this file with their weights
+	Terms map[string]int `json:"terms"`
+}
+
+// ID returns the entry qualified identifier
+func (e *Entry) ID() string { return e.DocID }
+
+// Rev returns the entry revision
+func (e *Entry) Rev() string { return e.DocRev }
+
+// DocType returns the entry document type
+func (e *Entry) DocType() string { return consts.FilesSearchIndex }
+
+// Clone implements couchdb.Doc
+func (e *Entry) Clone() couchdb.Doc {
+	cloned := *e
+	cloned.Tags = make([]string, len(e.Tags))
+	copy(cloned.Tags, e.Tags)
+	cloned.MD5Sum = make([]byte, len(e.MD5Sum))
+	copy(cloned.MD5Sum, e.MD5Sum)
+	cloned.Content = make(map[string]int, len(e.Content))
+	for k, v := range e.Content {
+		cloned.Content[k] = v
+	}
+	cloned.Terms = make(map[string]int, len(e.Terms))
+	for k, v := range e.Terms {
+		cloned.Terms[k] = v
+	}
+	return &cloned
+}
+
+// SetID changes the entry qualified identifier
+func (e *Entry) SetID(id string) { e.DocID = id }
+
+// SetRev changes the entry revision
+func (e *Entry) SetRev(rev string) { e.DocRev = rev }
+
+// computeTerms fills the terms from the name, path, tags and content.
+func (e *Entry) computeTerms() {
+	terms := make(map[string]int)
+	add := func(text string, weight int) {
+		for _, term := range Tokenize(text) {
+			terms[term] += weight
+		}
+	}
+	add(e.Name, nameWeight)
+	add(e.Path, pathWeight)
+	for _, tag := range e.Tags {
+		add(tag, tagWeight)
+	}
+	for term, count := range e.Content {
+		score := count * contentWeight
+		if score > maxContentScore {
+			score = maxContentScore
+		}
+		terms[term] += score
+	}
+	e.Terms = terms
+}
+
+// countTerms returns the number of occurrences of each term of the text.
+func countTerms(text string) map[string]int {
+	counts := make(map[string]int)
+	for _, term := range Tokenize(text) {
+		if _, ok := counts[term]; !ok && len(counts) >= maxContentTerms {
+			continue
+		}
+		counts[term]++
+	}
+	return counts
+}
+
+func getEntry(inst *instance.Instance, fileID string) (*Entry, error) {
+	entry := &Entry{}
+	err := couchdb.GetDoc(inst, consts.FilesSearchIndex, fileID, entry)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func saveEntry(inst *instance.Instance, old, entry *Entry) error {
+	if old == nil {
+		return couchdb.CreateNamedDocWithDB(inst, entry)
+	}
+	if old.Name == entry.Name && old.Path == entry.Path &&
+		bytes.Equal(old.MD5Sum, entry.MD5Sum) &&
+		reflect.DeepEqual(old.Terms, entry.Terms) {
+		return nil
+	}
+	entry.SetRev(old.Rev())
+	return couchdb.UpdateDoc(inst, entry)
+}
+
+// IndexFile adds the file to the search index, or updates its entry in the
+// index. The content is extracted only if it has changed since the last time
+// the file was indexed. A file in the trash is removed from the index.
+func IndexFile(inst *instance.Instance, doc *vfs.FileDoc) error {
+	fs := inst.VFS()
+	fullpath, err := doc.Path(fs)
+	if err != nil {
+		return err
+	}
+	if doc.Trashed || strings.HasPrefix(fullpath, vfs.TrashDirName+"/") {
+		return RemoveFile(inst, doc.ID())
+	}
+
+	old, err := getEntry(inst, doc.ID())
+	if err != nil {
+		return err
+	}
+	entry := &Entry{
+		DocID:  doc.ID(),
+		Name:   doc.DocName,
+		DirID:  doc.DirID,
+		Path:   path.Dir(fullpath),
+		Tags:   doc.Tags,
+		MD5Sum: doc.MD5Sum,
+	}
+	if old != nil && bytes.Equal(old.MD5Sum, doc.MD5Sum) {
+		entry.Content = old.Content
+	} else {
+		text, err := extractContent(fs, doc)
+		if err != nil {
+			inst.Logger().WithField("nspace", "search").
+				Infof("Cannot extract the content of %s: %s", doc.ID(), err)
+		}
+		if text != "" {
+			entry.Content = countTerms(text)
+		}
+	}
+	entry.computeTerms()
+	return saveEntry(inst, old, entry)
+}
+
+// RemoveFile removes the entry of a file from the search index.
+func RemoveFile(inst *instance.Instance, fileID string) error {
+	entry, err := getEntry(inst, fileID)
+	if err != nil || entry == nil {
+		return err
+	}
+	return couchdb.DeleteDoc(inst, entry)
+}
+
+// UpdateDirectory must be called when a directory has been moved or renamed:
+// the path of the files inside it has changed.
+func UpdateDirectory(inst *instance.Instance, dir *vfs.DirDoc) error {
+	fs := inst.VFS()
+	trashed := strings.HasPrefix(dir.Fullpath, vfs.TrashDirName)
+	return vfs.Walk(fs, dir.Fullpath, func(name string, d *vfs.DirDoc, f *vfs.FileDoc, err error) error {
+		if err != nil || f == nil {
+			return err
+		}
+		if trashed {
+			return RemoveFile(inst, f.ID())
+		}
+		old, err := getEntry(inst, f.ID())
+		if err != nil || old == nil {
+			return err
+		}
+		entry := old.Clone().(*Entry)
+		entry.Path = path.Dir(name)
+		entry.computeTerms()
+		return saveEntry(inst, old, entry)
+	})
+}
+
+// Reindex builds the search index for all the files of the instance, and
+// removes the entries of the files that no longer exist.
+func Reindex(inst *instance.Instance) error {
+	fs := inst.VFS()
+	log := inst.Logger().WithField("nspace", "search")
+	seen := make(map[string]struct{})
+	err := vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			if dir.ID() == consts.TrashDirID {
+				return vfs.ErrSkipDir
+			}
+			return nil
+		}
+		seen[file.ID()] = struct{}{}
+		if err := IndexFile(inst, file); err != nil {
+			log.Warnf("Cannot index %s: %s", file.ID(), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var toRemove []couchdb.Doc
+	err = couchdb.ForeachDocs(inst, consts.FilesSearchIndex, func(id string, raw json.RawMessage) error {
+		if _, ok := seen[id]; ok {
+			return nil
+		}
+		entry := &Entry{}
+		if err := json.Unmarshal(raw, entry); err != nil {
+			return err
+		}
+		toRemove = append(toRemove, entry)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	if len(toRemove) == 0 {
+		return nil
+	}
+	return couchdb.BulkDeleteDocs(inst, consts.FilesSearchIndex, toRemove)
+}
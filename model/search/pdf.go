@@ -0,0 +1,303 @@
+package search
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// maxStreamSize is the maximal size of an inflated stream of a PDF.
+const maxStreamSize = 10 << 20
+
+var (
+	streamKeyword    = []byte("stream")
+	endstreamKeyword = []byte("endstream")
+	type0Keyword     = []byte("/Type0")
+)
+
+// extractPDFText returns the text that can be found in the content streams of
+// a PDF file. It is not a full PDF parser: it only looks at the streams that
+// are not compressed or compressed with FlateDecode, and at the strings shown
+// by the text operators (Tj, TJ, ' and "). It is enough for the PDF generated
+// by most office suites and for the bills, but not for the scanned documents.
+//
+// The fonts are not resolved, and the strings are decoded as Latin-1 or
+// UTF-16. With a composite font (Type0), the strings are glyph identifiers
+// that can only be decoded with the ToUnicode CMap of the font: an empty
+// string is returned for such a PDF, instead of some garbage. The font
+// dictionaries can be in a compressed object stream, so these streams are
+// inflated to look for them.
+func extractPDFText(data []byte) string {
+	if bytes.Contains(data, type0Keyword) {
+		return ""
+	}
+	var sb strings.Builder
+	pos := 0
+	for {
+		idx := bytes.Index(data[pos:], streamKeyword)
+		if idx < 0 {
+			break
+		}
+		start := pos + idx
+		pos = start + len(streamKeyword)
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+		dict := streamDictionary(data[:start])
+		if pos < len(data) && data[pos] == '\r' {
+			pos++
+		}
+		if pos < len(data) && data[pos] == '\n' {
+			pos++
+		}
+		end := bytes.Index(data[pos:], endstreamKeyword)
+		if end < 0 {
+			break
+		}
+		stream := data[pos : pos+end]
+		pos += end + len(endstreamKeyword)
+		if strings.Contains(dict, "/ObjStm") {
+			if objects, ok := inflate(dict, stream); ok && bytes.Contains(objects, type0Keyword) {
+				return ""
+			}
+			continue
+		}
+		if content, ok := decodeStream(dict, stream); ok {
+			extractTextOperators(content, &sb)
+		}
+	}
+	return sb.String()
+}
+
+// streamDictionary returns the dictionary just before the stream keyword.
+func streamDictionary(data []byte) string {
+	end := bytes.LastIndex(data, []byte(">>"))
+	if end < 0 {
+		return ""
+	}
+	start := end - 2048
+	if start < 0 {
+		start = 0
+	}
+	idx := bytes.LastIndex(data[start:end], []byte("obj"))
+	if idx >= 0 {
+		start += idx
+	}
+	return string(data[start:end])
+}
+
+// decodeStream returns the decoded content of a stream, or false if the
+// stream is not a content stream that can be decoded.
+func decodeStream(dict string, stream []byte) ([]byte, bool) {
+	for _, skip := range []string{"/Image", "/XObject", "/Length1", "/FontFile", "/ObjStm", "/XRef", "/Metadata"} {
+		if strings.Contains(dict, skip) {
+			return nil, false
+		}
+	}
+	return inflate(dict, stream)
+}
+
+// inflate returns the content of a stream that is not compressed or
+// compressed with FlateDecode, or false for the other filters.
+func inflate(dict string, stream []byte) ([]byte, bool) {
+	if !strings.Contains(dict, "/Filter") {
+		return stream, true
+	}
+	if !strings.Contains(dict, "/FlateDecode") {
+		return nil, false
+	}
+	for _, other := range []string{"/DCTDecode", "/LZWDecode", "/ASCII85Decode", "/ASCIIHexDecode", "/JBIG2Decode", "/CCITTFaxDecode", "/JPXDecode"} {
+		if strings.Contains(dict, other) {
+			return nil, false
+		}
+	}
+	r, err := zlib.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	// The content may have been truncated, so we keep what has been inflated
+	// even if there is an error
+	content, _ := ioutil.ReadAll(io.LimitReader(r, maxStreamSize))
+	return content, len(content) > 0
+}
+
+// extractTextOperators looks for the text operators in a content stream, and
+// writes the strings that they show.
+func extractTextOperators(content []byte, sb *strings.Builder) {
+	var operands []string
+	inArray := false
+	var array strings.Builder
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			var s string
+			s, i = readLiteralString(content, i)
+			if inArray {
+				array.WriteString(s)
+			} else {
+				operands = append(operands, s)
+			}
+		case c == '<' && i+1 < len(content) && content[i+1] == '<':
+			i++
+		case c == '<':
+			var s string
+			s, i = readHexString(content, i)
+			if inArray {
+				array.WriteString(s)
+			} else {
+				operands = append(operands, s)
+			}
+		case c == '[':
+			inArray = true
+			array.Reset()
+		case c == ']':
+			inArray = false
+			operands = append(operands, array.String())
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			start := i
+			for i+1 < len(content) && (content[i+1] == '.' || (content[i+1] >= '0' && content[i+1] <= '9')) {
+				i++
+			}
+			// In a TJ array, a big negative number is used for the space
+			// between two words
+			if inArray && c == '-' && i-start >= 3 {
+				array.WriteByte(' ')
+			}
+		case c == '/':
+			for i+1 < len(content) && !isDelimiter(content[i+1]) {
+				i++
+			}
+		case isRegular(c):
+			start := i
+			for i+1 < len(content) && isRegular(content[i+1]) {
+				i++
+			}
+			switch string(content[start : i+1]) {
+			case "Tj", "TJ", "'", "\"":
+				if len(operands) > 0 {
+					sb.WriteString(operands[len(operands)-1])
+				}
+			case "Td", "TD", "T*", "Tm", "ET":
+				sb.WriteByte(' ')
+			}
+			operands = operands[:0]
+		}
+	}
+}
+
+func isDelimiter(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '\f', 0, '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func isRegular(c byte) bool {
+	return !isDelimiter(c) && c != '-' && c != '.' && (c < '0' || c > '9')
+}
+
+// readLiteralString reads a string like (Hello world) starting at the given
+// position, and returns the string and the position of the closing
+// parenthesis.
+func readLiteralString(content []byte, i int) (string, int) {
+	var buf []byte
+	depth := 0
+	for i++; i < len(content); i++ {
+		c := content[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(content) {
+				break
+			}
+			switch e := content[i]; e {
+			case 'n', 'r', 't', 'f':
+				buf = append(buf, ' ')
+			case 'b':
+			case '\r', '\n':
+				// line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					n := 0
+					for j := 0; j < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; j++ {
+						n = n*8 + int(content[i]-'0')
+						i++
+					}
+					i--
+					buf = append(buf, byte(n))
+				} else {
+					buf = append(buf, e)
+				}
+			}
+		case '(':
+			depth++
+			buf = append(buf, c)
+		case ')':
+			if depth == 0 {
+				return decodePDFString(buf), i
+			}
+			depth--
+			buf = append(buf, c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return decodePDFString(buf), i
+}
+
+// readHexString reads a string like <48656C6C6F> starting at the given
+// position, and returns the string and the position of the closing bracket.
+func readHexString(content []byte, i int) (string, int) {
+	var digits []byte
+	for i++; i < len(content) && content[i] != '>'; i++ {
+		if c := content[i]; (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	buf, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return "", i
+	}
+	return decodePDFString(buf), i
+}
+
+// decodePDFString converts a PDF string to UTF-8. The strings that start
+// with a BOM are encoded in UTF-16BE, and the other strings are considered
+// to be encoded in Latin-1 (which is close enough to the PDFDocEncoding and
+// WinAnsiEncoding for the letters). The non-printable characters are removed.
+func decodePDFString(buf []byte) string {
+	var sb strings.Builder
+	if len(buf) >= 2 && buf[0] == 0xfe && buf[1] == 0xff {
+		u16 := make([]uint16, 0, len(buf)/2)
+		for i := 2; i+1 < len(buf); i += 2 {
+			u16 = append(u16, uint16(buf[i])<<8|uint16(buf[i+1]))
+		}
+		for _, r := range utf16.Decode(u16) {
+			if unicode.IsPrint(r) {
+				sb.WriteRune(r)
+			}
+		}
+		return sb.String()
+	}
+	for _, b := range buf {
+		if r := rune(b); unicode.IsPrint(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,65 @@
+package search
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makePDF(content string, compress bool) []byte {
+	stream := []byte(content)
+	filter := ""
+	if compress {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		_, _ = w.Write(stream)
+		_ = w.Close()
+		stream = buf.Bytes()
+		filter = " /Filter /FlateDecode"
+	}
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	pdf.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	pdf.WriteString("3 0 obj\n<< /Length 8 /Subtype /Image >>\nstream\n(Hidden)\nendstream\nendobj\n")
+	fmt.Fprintf(&pdf, "4 0 obj\n<< /Length %d%s >>\nstream\n", len(stream), filter)
+	pdf.Write(stream)
+	pdf.WriteString("\nendstream\nendobj\n%%EOF\n")
+	return pdf.Bytes()
+}
+
+func TestExtractPDFText(t *testing.T) {
+	content := `BT /F1 12 Tf 72 712 Td (Facture n\2601 \(avril\)) Tj ET
+BT 72 690 Td [(Mont)20(ant)-300(total)] TJ T* <FEFF00E9006C00E9> Tj ET`
+	for _, compress := range []bool{false, true} {
+		text := extractPDFText(makePDF(content, compress))
+		assert.Contains(t, text, "Facture n°1 (avril)")
+		assert.Contains(t, text, "Montant total")
+		assert.Contains(t, text, "élé")
+		assert.NotContains(t, text, "Hidden")
+		assert.Equal(t, []string{"facture", "avril", "montant", "total", "ele"}, Tokenize(text))
+	}
+
+	assert.Equal(t, "", extractPDFText([]byte("not a pdf")))
+}
+
+func TestExtractPDFTextWithCompositeFont(t *testing.T) {
+	content := `BT /F1 12 Tf 72 712 Td <0026004C0051> Tj ET`
+	font := "<< /Type /Font /Subtype /Type0 /Encoding /Identity-H >>"
+	pdf := makePDF(content, true)
+	pdf = append(pdf, "5 0 obj\n"+font+"\nendobj\n"...)
+	assert.Equal(t, "", extractPDFText(pdf))
+
+	// The font dictionary is in a compressed object stream
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	_, _ = w.Write([]byte("5 0 " + font))
+	_ = w.Close()
+	pdf = makePDF(content, true)
+	pdf = append(pdf, fmt.Sprintf("6 0 obj\n<< /Type /ObjStm /N 1 /First 4 /Length %d /Filter /FlateDecode >>\nstream\n", buf.Len())...)
+	pdf = append(pdf, buf.Bytes()...)
+	pdf = append(pdf, "\nendstream\nendobj\n"...)
+	assert.Equal(t, "", extractPDFText(pdf))
+}
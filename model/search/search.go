@@ -0,0 +1,182 @@
+package search
+
+import (
+	"sort"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+const (
+	// maxQueryTerms is the maximal number of terms used from a query.
+	maxQueryTerms = 10
+	// maxRowsPerTerm is the maximal number of entries fetched from the index
+	// for a term of the query.
+	maxRowsPerTerm = 10000
+	// batchSize is the number of files that are fetched at once for checking
+	// the permissions.
+	batchSize = 100
+	// exactMatchBonus is the multiplier applied to the weight of a term when
+	// it is an exact match (and not just a prefix) of a term of the query.
+	exactMatchBonus = 2
+)
+
+// Result is a file that matches a query, with its relevance score.
+type Result struct {
+	File  *vfs.FileDoc
+	Score int
+}
+
+type candidate struct {
+	id    string
+	score int
+}
+
+// Search returns the files that match all the terms of the query, sorted by
+// relevance. The last term of the query can be a prefix, to allow searching
+// while the user is typing. Only the files that can be read with the given
+// permission set are returned. The boolean is true when the index has too
+// many entries for a term of the query: some matching files may be missing
+// from the results.
+func Search(inst *instance.Instance, pset permission.Set, query string, limit int) ([]*Result, bool, error) {
+	terms := uniqueTerms(Tokenize(query))
+	if len(terms) == 0 {
+		return []*Result{}, false, nil
+	}
+
+	var scores map[string]int
+	truncated := false
+	for _, term := range terms {
+		matches, full, err := matchTerm(inst, term)
+		if err != nil {
+			return nil, false, err
+		}
+		if full {
+			truncated = true
+		}
+		if scores == nil {
+			scores = matches
+		} else {
+			for id, score := range scores {
+				if s, ok := matches[id]; ok {
+					scores[id] = score + s
+				} else {
+					delete(scores, id)
+				}
+			}
+		}
+		if len(scores) == 0 {
+			return []*Result{}, truncated, nil
+		}
+	}
+
+	candidates := make([]candidate, 0, len(scores))
+	for id, score := range scores {
+		candidates = append(candidates, candidate{id, score})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].id < candidates[j].id
+	})
+
+	// The permissions are checked while iterating on the candidates, so that
+	// the files that can't be read don't hide the other matches.
+	fs := inst.VFS()
+	results := []*Result{}
+	for start := 0; start < len(candidates) && len(results) < limit; start += batchSize {
+		end := start + batchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		files, err := fetchFiles(inst, candidates[start:end])
+		if err != nil {
+			return nil, false, err
+		}
+		for _, c := range candidates[start:end] {
+			file, ok := files[c.id]
+			if !ok || file.Trashed {
+				continue
+			}
+			if err := vfs.Allows(fs, pset, permission.GET, file); err != nil {
+				continue
+			}
+			results = append(results, &Result{File: file, Score: c.score})
+			if len(results) >= limit {
+				break
+			}
+		}
+	}
+	return results, truncated, nil
+}
+
+// fetchFiles loads the files of the candidates in one request to CouchDB.
+func fetchFiles(inst *instance.Instance, candidates []candidate) (map[string]*vfs.FileDoc, error) {
+	ids := make([]string, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.id
+	}
+	var docs []*vfs.FileDoc
+	req := &couchdb.AllDocsRequest{Keys: ids}
+	if err := couchdb.GetAllDocs(inst, consts.Files, req, &docs); err != nil {
+		return nil, err
+	}
+	files := make(map[string]*vfs.FileDoc, len(docs))
+	for _, doc := range docs {
+		// The rows for the deleted documents have a null doc
+		if doc != nil && doc.Type == consts.FileType {
+			files[doc.ID()] = doc
+		}
+	}
+	return files, nil
+}
+
+// matchTerm returns the identifiers of the files that have a term starting
+// with the given term, with their score. The boolean is true if the limit of
+// rows has been reached.
+func matchTerm(inst *instance.Instance, term string) (map[string]int, bool, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(inst, couchdb.FilesSearchByTermView, &couchdb.ViewRequest{
+		StartKey: term,
+		EndKey:   term + "\uffff",
+		Limit:    maxRowsPerTerm,
+	}, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return map[string]int{}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	matches := make(map[string]int, len(res.Rows))
+	for _, row := range res.Rows {
+		weight, _ := row.Value.(float64)
+		score := int(weight)
+		if key, _ := row.Key.(string); key == term {
+			score *= exactMatchBonus
+		}
+		if score > matches[row.ID] {
+			matches[row.ID] = score
+		}
+	}
+	return matches, len(res.Rows) >= maxRowsPerTerm, nil
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]struct{}, len(terms))
+	unique := terms[:0]
+	for _, term := range terms {
+		if _, ok := seen[term]; ok {
+			continue
+		}
+		seen[term] = struct{}{}
+		unique = append(unique, term)
+		if len(unique) >= maxQueryTerms {
+			break
+		}
+	}
+	return unique
+}
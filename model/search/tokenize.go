@@ -0,0 +1,45 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// minTermLength is the minimal number of characters for a term to be
+	// indexed.
+	minTermLength = 2
+	// maxTermLength is the maximal number of characters for a term to be
+	// indexed. Longer words are usually not real words (hashes, base64, etc.)
+	maxTermLength = 40
+)
+
+// Tokenize splits a text in terms. The terms are lowercased, and the
+// diacritics are removed, so that a search for "ecole" can find "École".
+func Tokenize(text string) []string {
+	folded, _, err := transform.String(folder(), text)
+	if err != nil {
+		folded = text
+	}
+	words := strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, word := range words {
+		n := len([]rune(word))
+		if n < minTermLength || n > maxTermLength {
+			continue
+		}
+		terms = append(terms, strings.ToLower(word))
+	}
+	return terms
+}
+
+// folder returns a transformer that removes the diacritics.
+func folder() transform.Transformer {
+	return transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+}
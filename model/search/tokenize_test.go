@@ -0,0 +1,15 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Empty(t, Tokenize(""))
+	assert.Equal(t, []string{"hello", "world"}, Tokenize("Hello, world!"))
+	assert.Equal(t, []string{"ecole", "ete", "2020"}, Tokenize("L'École d'été 2020"))
+	assert.Equal(t, []string{"facture", "edf", "pdf"}, Tokenize("facture_EDF.pdf"))
+	assert.Equal(t, []string{"ab"}, Tokenize("a ab 0123456789012345678901234567890123456789x"))
+}
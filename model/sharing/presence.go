@@ -0,0 +1,148 @@
+package sharing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/client/request"
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/presence"
+)
+
+// PresenceMessage is sent to another member of a sharing when a session joins
+// or leaves a shared document.
+type PresenceMessage struct {
+	*presence.Session
+	Left bool `json:"left,omitempty"`
+}
+
+// RelayPresence sends a change of presence on a document to the other members
+// of the sharings of this document. A recipient sends the changes to the
+// owner, and the owner relays them to the other recipients. fromSharingID and
+// fromInstance are used when the change comes from another member, to not send
+// it back to this member.
+func RelayPresence(inst *instance.Instance, p *presence.Session, left bool, fromSharingID, fromInstance string) {
+	ref := &SharedRef{}
+	if err := couchdb.GetDoc(inst, consts.Shared, p.ID(), ref); err != nil {
+		if !couchdb.IsNotFoundError(err) && !couchdb.IsNoDatabaseError(err) {
+			inst.Logger().WithField("nspace", "presence").
+				Warnf("Cannot get the io.cozy.shared for %s: %s", p.ID(), err)
+		}
+		return
+	}
+	for sharingID, info := range ref.Infos {
+		if info.Removed {
+			continue
+		}
+		s, err := FindSharing(inst, sharingID)
+		if err != nil || !s.Active {
+			continue
+		}
+		if !s.Owner {
+			if fromSharingID != "" {
+				continue
+			}
+			if err := s.sendPresence(inst, &s.Members[0], &s.Credentials[0], p, left); err != nil {
+				inst.Logger().WithField("nspace", "presence").
+					Infof("Cannot send the presence to the owner of %s: %s", s.SID, err)
+			}
+			continue
+		}
+		for i := 1; i < len(s.Members) && i <= len(s.Credentials); i++ {
+			m := &s.Members[i]
+			if m.Status != MemberStatusReady || m.Instance == "" {
+				continue
+			}
+			if sharingID == fromSharingID && m.Instance == fromInstance {
+				continue
+			}
+			if err := s.sendPresence(inst, m, &s.Credentials[i-1], p, left); err != nil {
+				inst.Logger().WithField("nspace", "presence").
+					Infof("Cannot send the presence to %s for %s: %s", m.Instance, s.SID, err)
+			}
+		}
+	}
+}
+
+func (s *Sharing) sendPresence(inst *instance.Instance, m *Member, creds *Credentials, p *presence.Session, left bool) error {
+	if creds.AccessToken == nil {
+		return ErrInvalidSharing
+	}
+	u, err := url.Parse(m.Instance)
+	if m.Instance == "" || err != nil {
+		return ErrInvalidSharing
+	}
+	session := *p
+	if session.Type == consts.Files && len(creds.XorKey) > 0 {
+		session.DocID = XorID(session.DocID, creds.XorKey)
+	}
+	body, err := json.Marshal(PresenceMessage{Session: &session, Left: left})
+	if err != nil {
+		return err
+	}
+	opts := &request.Options{
+		Method: http.MethodPost,
+		Scheme: u.Scheme,
+		Domain: u.Host,
+		Path:   "/sharings/" + s.SID + "/presence",
+		Headers: request.Headers{
+			"Accept":        "application/json",
+			"Content-Type":  "application/json",
+			"Authorization": "Bearer " + creds.AccessToken.AccessToken,
+		},
+		Body: bytes.NewReader(body),
+	}
+	res, err := request.Req(opts)
+	if res != nil && res.StatusCode/100 == 4 {
+		res, err = RefreshToken(inst, s, m, creds, opts, body)
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// ReceivePresence saves a change of presence sent by another member of the
+// sharing, and relays it to the other members if this instance is the owner.
+func (s *Sharing) ReceivePresence(inst *instance.Instance, m *Member, msg *PresenceMessage) error {
+	if msg.Session == nil {
+		return presence.ErrInvalidSession
+	}
+	p := msg.Session
+	ref := &SharedRef{}
+	if err := couchdb.GetDoc(inst, consts.Shared, p.ID(), ref); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return ErrSafety
+		}
+		return err
+	}
+	if info, ok := ref.Infos[s.SID]; !ok || info.Removed {
+		return ErrSafety
+	}
+	// The owner knows the instance of the recipients, but a recipient
+	// receives the sessions of all the members from the owner
+	if s.Owner || p.Instance == "" {
+		p.Instance = m.Instance
+	}
+
+	// The sessions of another member are bound to its instance
+	var changed bool
+	var err error
+	if msg.Left {
+		changed, err = presence.Leave(inst, p.Type, p.DocID, p.SessionID, m.Instance)
+	} else {
+		changed, err = presence.Join(inst, p, m.Instance)
+	}
+	if err != nil {
+		return err
+	}
+	if s.Owner && changed {
+		go RelayPresence(inst, p, msg.Left, s.SID, m.Instance)
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/presence"
 	"github.com/cozy/cozy-stack/pkg/utils"
 
 	"github.com/google/gops/agent"
@@ -74,6 +75,11 @@ security features. Please do not use this binary as your production server.
 		return
 	}
 
+	// Init the global client for the S3 storage
+	if err = config.InitDefaultS3Client(); err != nil {
+		return
+	}
+
 	workersList, err := job.GetWorkersList()
 	if err != nil {
 		return
@@ -94,18 +100,22 @@ security features. Please do not use this binary as your production server.
 		return
 	}
 
-	// Initialize the dynamic assets FS. Can be OsFs, MemFs or Swift
+	// Initialize the dynamic assets FS. Can be OsFs, MemFs, Swift or S3
 	err = dynamic.InitDynamicAssetFS()
 	if err != nil {
 		return nil, err
 	}
 
 	sessionSweeper := session.SweepLoginRegistrations()
+	presenceSweeper := presence.SweepExpiredSessions()
+	deadLettersSweeper := job.SweepDeadLetters()
 
 	// Global shutdowner that composes all the running processes of the stack
 	processes = utils.NewGroupShutdown(
 		job.System(),
 		sessionSweeper,
+		presenceSweeper,
+		deadLettersSweeper,
 		gopAgent{},
 	)
 	return
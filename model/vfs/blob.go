@@ -0,0 +1,345 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// Blob is used to count the references to a content stored with a
+// content-addressed layout (the Swift layout v4, or the afero one). With such
+// a layout, the contents are stored by their checksum, and a content is shared
+// by all the files and versions that have the same md5sum. The content can be
+// removed from the storage only when the last reference has been removed.
+//
+// The identifier of a blob is the hex-encoded md5sum of its content.
+type Blob struct {
+	DocID    string `json:"_id,omitempty"`
+	DocRev   string `json:"_rev,omitempty"`
+	ByteSize int64  `json:"size,string"`
+	Refs     int    `json:"refs"`
+}
+
+// ID returns the blob qualified identifier
+func (b *Blob) ID() string { return b.DocID }
+
+// Rev returns the blob revision
+func (b *Blob) Rev() string { return b.DocRev }
+
+// DocType returns the blob document type
+func (b *Blob) DocType() string { return consts.FilesBlobs }
+
+// Clone implements couchdb.Doc
+func (b *Blob) Clone() couchdb.Doc {
+	cloned := *b
+	return &cloned
+}
+
+// SetID changes the blob qualified identifier
+func (b *Blob) SetID(id string) { b.DocID = id }
+
+// SetRev changes the blob revision
+func (b *Blob) SetRev(rev string) { b.DocRev = rev }
+
+// BlobID returns the identifier of the blob for the given checksum.
+func BlobID(md5sum []byte) string {
+	return hex.EncodeToString(md5sum)
+}
+
+// RefBlob adds a reference to the blob with the given checksum. It returns
+// true if the blob was not known before, ie its content has to be stored.
+//
+// The reference counting is not safe for concurrent calls: the caller must
+// hold the lock of the VFS.
+func RefBlob(db prefixer.Prefixer, md5sum []byte, size int64) (bool, error) {
+	blob := &Blob{}
+	err := couchdb.GetDoc(db, consts.FilesBlobs, BlobID(md5sum), blob)
+	if couchdb.IsNotFoundError(err) {
+		blob = &Blob{
+			DocID:    BlobID(md5sum),
+			ByteSize: size,
+			Refs:     1,
+		}
+		return true, couchdb.CreateNamedDocWithDB(db, blob)
+	}
+	if err != nil {
+		return false, err
+	}
+	if blob.ByteSize != size {
+		return false, ErrBlobCollision
+	}
+	blob.Refs++
+	return false, couchdb.UpdateDoc(db, blob)
+}
+
+// UnrefBlobs removes a reference for each of the given checksums (a checksum
+// can be given several times). It returns the identifiers of the blobs that
+// are no longer referenced, and whose contents can be removed.
+//
+// The reference counting is not safe for concurrent calls: the caller must
+// hold the lock of the VFS.
+func UnrefBlobs(db prefixer.Prefixer, md5sums [][]byte) ([]string, error) {
+	counts := make(map[string]int)
+	for _, md5sum := range md5sums {
+		counts[BlobID(md5sum)]++
+	}
+	var removed []string
+	var errm error
+	for id, count := range counts {
+		blob := &Blob{}
+		err := couchdb.GetDoc(db, consts.FilesBlobs, id, blob)
+		if couchdb.IsNotFoundError(err) {
+			// Without its blob document, we can't know if the content is
+			// still used, so we keep it. The fsck will tell.
+			continue
+		}
+		if err == nil {
+			blob.Refs -= count
+			if blob.Refs > 0 {
+				err = couchdb.UpdateDoc(db, blob)
+			} else if err = couchdb.DeleteDoc(db, blob); err == nil {
+				removed = append(removed, id)
+			}
+		}
+		if err != nil && errm == nil {
+			errm = err
+		}
+	}
+	return removed, errm
+}
+
+// BlobsUsage returns the number of bytes used by the contents of the files
+// and versions stored with a content-addressed layout, ie counting only once
+// the contents that are shared.
+func BlobsUsage(db prefixer.Prefixer) (int64, error) {
+	var doc couchdb.ViewResponse
+	req := &couchdb.ViewRequest{Reduce: true}
+	err := couchdb.ExecView(db, couchdb.BlobsDiskUsageView, req, &doc)
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	if couchdb.IsNotFoundError(err) {
+		views := []*couchdb.View{couchdb.BlobsDiskUsageView}
+		if err = couchdb.DefineViews(db, views); err != nil {
+			return 0, err
+		}
+		req = &couchdb.ViewRequest{Reduce: true}
+		err = couchdb.ExecView(db, couchdb.BlobsDiskUsageView, req, &doc)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	// Reduce of _sum should give us a number value
+	used, ok := doc.Rows[0].Value.(float64)
+	if !ok {
+		return 0, ErrWrongCouchdbState
+	}
+	return int64(used), nil
+}
+
+// PhysicalUsager is implemented by the file systems that deduplicate the
+// contents of the files, and where the space used on the storage can be
+// lower than the DiskUsage.
+type PhysicalUsager interface {
+	// PhysicalUsage returns the number of bytes really used on the storage.
+	PhysicalUsage() (int64, error)
+}
+
+// PhysicalUsage returns the number of bytes used on the storage by the given
+// VFS. The DiskUsage is the logical size, that is used for the quota, when
+// the PhysicalUsage is the space really used after deduplication.
+func PhysicalUsage(fs VFS) (int64, error) {
+	if p, ok := fs.(PhysicalUsager); ok {
+		return p.PhysicalUsage()
+	}
+	return fs.DiskUsage()
+}
+
+// BlobObject describes a content, as listed by the storage of a
+// content-addressed layout.
+type BlobObject struct {
+	// Name is the key of the blob, ie the hex-encoded checksum of the
+	// content when it was stored.
+	Name        string
+	MD5Sum      []byte
+	ByteSize    int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// CheckBlobs is used by the file system check of the content-addressed
+// layouts. It compares the files and the versions of the index with the
+// blobs listed by the walk function.
+func CheckBlobs(
+	db prefixer.Prefixer,
+	entries []*TreeFile,
+	walk func(fn func(obj *BlobObject) error) error,
+	accumulate func(log *FsckLog),
+	failFast bool,
+) error {
+	files := make(map[string][]*TreeFile, len(entries))
+	for _, f := range entries {
+		id := BlobID(f.MD5Sum)
+		files[id] = append(files[id], f)
+	}
+	versions := make(map[string][]*Version, 1024)
+	err := couchdb.ForeachDocs(db, consts.FilesVersions, func(_ string, data json.RawMessage) error {
+		v := &Version{}
+		if erru := json.Unmarshal(data, v); erru != nil {
+			return erru
+		}
+		id := BlobID(v.MD5Sum)
+		versions[id] = append(versions[id], v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = walk(func(obj *BlobObject) error {
+		fs, vs := files[obj.Name], versions[obj.Name]
+		delete(files, obj.Name)
+		delete(versions, obj.Name)
+		if len(fs) == 0 && len(vs) == 0 {
+			accumulate(&FsckLog{
+				Type:    IndexMissing,
+				IsFile:  true,
+				FileDoc: blobToFileDoc(obj),
+			})
+			if failFast {
+				return ErrFsckFailFail
+			}
+			return nil
+		}
+		for _, f := range fs {
+			if !bytes.Equal(obj.MD5Sum, f.MD5Sum) || obj.ByteSize != f.ByteSize {
+				accumulate(&FsckLog{
+					Type:    ContentMismatch,
+					IsFile:  true,
+					FileDoc: f,
+					ContentMismatch: &FsckContentMismatch{
+						SizeFile:    obj.ByteSize,
+						SizeIndex:   f.ByteSize,
+						MD5SumFile:  obj.MD5Sum,
+						MD5SumIndex: f.MD5Sum,
+					},
+				})
+				if failFast {
+					return ErrFsckFailFail
+				}
+			}
+		}
+		for _, v := range vs {
+			if !bytes.Equal(obj.MD5Sum, v.MD5Sum) || obj.ByteSize != v.ByteSize {
+				accumulate(&FsckLog{
+					Type:       ContentMismatch,
+					IsVersion:  true,
+					VersionDoc: v,
+					ContentMismatch: &FsckContentMismatch{
+						SizeFile:    obj.ByteSize,
+						SizeIndex:   v.ByteSize,
+						MD5SumFile:  obj.MD5Sum,
+						MD5SumIndex: v.MD5Sum,
+					},
+				})
+				if failFast {
+					return ErrFsckFailFail
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if err == ErrFsckFailFail {
+			return nil
+		}
+		return err
+	}
+
+	// files and versions should contain only the documents that have no
+	// content in the storage.
+	for _, fs := range files {
+		for _, f := range fs {
+			accumulate(&FsckLog{
+				Type:    FSMissing,
+				IsFile:  true,
+				FileDoc: f,
+			})
+			if failFast {
+				return nil
+			}
+		}
+	}
+	for _, vs := range versions {
+		for _, v := range vs {
+			accumulate(&FsckLog{
+				Type:       FSMissing,
+				IsVersion:  true,
+				VersionDoc: v,
+			})
+			if failFast {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func blobToFileDoc(obj *BlobObject) *TreeFile {
+	name := "unknown"
+	mime, class := ExtractMimeAndClass(obj.ContentType)
+	return &TreeFile{
+		DirOrFileDoc: DirOrFileDoc{
+			DirDoc: &DirDoc{
+				Type:      consts.FileType,
+				DocName:   name,
+				DirID:     "",
+				CreatedAt: obj.ModTime,
+				UpdatedAt: obj.ModTime,
+				Fullpath:  path.Join(OrphansDirName, name),
+			},
+			ByteSize: obj.ByteSize,
+			Mime:     mime,
+			Class:    class,
+			MD5Sum:   obj.MD5Sum,
+		},
+	}
+}
+
+// maxBlobsPerBulk is the maximal number of blob documents that are created in
+// a single bulk request.
+const maxBlobsPerBulk = 1000
+
+// CreateBlobs creates the documents for the given blobs, in bulk. It is used
+// by the migrations to a content-addressed layout, when the references have
+// been counted for all the files and versions.
+func CreateBlobs(db prefixer.Prefixer, blobs []*Blob) error {
+	if err := couchdb.CreateDB(db, consts.FilesBlobs); err != nil && !couchdb.IsFileExists(err) {
+		return err
+	}
+	for len(blobs) > 0 {
+		n := len(blobs)
+		if n > maxBlobsPerBulk {
+			n = maxBlobsPerBulk
+		}
+		docs := make([]interface{}, n)
+		for i := range docs {
+			docs[i] = blobs[i]
+		}
+		olddocs := make([]interface{}, n)
+		if err := couchdb.BulkUpdateDocs(db, consts.FilesBlobs, docs, olddocs); err != nil {
+			return err
+		}
+		blobs = blobs[n:]
+	}
+	return nil
+}
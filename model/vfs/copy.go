@@ -0,0 +1,217 @@
+package vfs
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// CopyOptions is used to choose which fields of a file or directory are
+// copied with it. The content, the mime-type, the class and the executable
+// flag are always copied.
+type CopyOptions struct {
+	Metadata     bool `json:"metadata,omitempty"`
+	Tags         bool `json:"tags,omitempty"`
+	ReferencedBy bool `json:"referenced_by,omitempty"`
+	// CozyMetadata is used as a model for the cozyMetadata of the copies
+	CozyMetadata *FilesCozyMetadata `json:"cozy_metadata,omitempty"`
+}
+
+// CopyDirMessage is the message of the job used to copy the content of a
+// directory.
+type CopyDirMessage struct {
+	SourceID string      `json:"source_id"`
+	DirID    string      `json:"dir_id"`
+	Options  CopyOptions `json:"options"`
+}
+
+// NewFileDocForCopy returns the document for a copy of the given file, with
+// the given name in the given directory. The document is not persisted: the
+// CopyFile method of the VFS must be called with it.
+func NewFileDocForCopy(src *FileDoc, dirID, name string, opts *CopyOptions) (*FileDoc, error) {
+	var tags []string
+	if opts.Tags {
+		tags = src.Tags
+	}
+	doc, err := NewFileDoc(name, dirID, src.ByteSize, src.MD5Sum, src.Mime,
+		src.Class, time.Now(), src.Executable, false, tags)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Metadata && len(src.Metadata) > 0 {
+		doc.Metadata = make(Metadata, len(src.Metadata))
+		for k, v := range src.Metadata {
+			doc.Metadata[k] = v
+		}
+	}
+	if opts.ReferencedBy && len(src.ReferencedBy) > 0 {
+		doc.ReferencedBy = make([]couchdb.DocReference, len(src.ReferencedBy))
+		copy(doc.ReferencedBy, src.ReferencedBy)
+	}
+	if opts.CozyMetadata != nil {
+		doc.CozyMetadata = newCozyMetadataForCopy(opts.CozyMetadata, doc.CreatedAt)
+		uploadedAt := doc.CreatedAt
+		doc.CozyMetadata.UploadedAt = &uploadedAt
+	}
+	return doc, nil
+}
+
+// NewDirDocForCopy returns the document for a copy of the given directory,
+// with the given name in the given parent directory. Only the directory is
+// copied, not its content.
+func NewDirDocForCopy(src *DirDoc, parent *DirDoc, name string, opts *CopyOptions) (*DirDoc, error) {
+	var tags []string
+	if opts.Tags {
+		tags = src.Tags
+	}
+	doc, err := NewDirDocWithParent(name, parent, tags)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ReferencedBy && len(src.ReferencedBy) > 0 {
+		doc.ReferencedBy = make([]couchdb.DocReference, len(src.ReferencedBy))
+		copy(doc.ReferencedBy, src.ReferencedBy)
+	}
+	if opts.CozyMetadata != nil {
+		doc.CozyMetadata = newCozyMetadataForCopy(opts.CozyMetadata, doc.CreatedAt)
+		doc.CozyMetadata.UploadedAt = nil
+		doc.CozyMetadata.UploadedBy = nil
+		doc.CozyMetadata.UploadedOn = ""
+	}
+	return doc, nil
+}
+
+func newCozyMetadataForCopy(model *FilesCozyMetadata, now time.Time) *FilesCozyMetadata {
+	fcm := model.Clone()
+	fcm.CreatedAt = now
+	fcm.UpdatedAt = now
+	return fcm
+}
+
+// CheckCopy checks that a file of the given size can be copied to the
+// location of newdoc: the quota must not be exceeded, the parent directory
+// must not be in the trash, and no file or directory must already have the
+// same name. It returns the number of bytes that can be written before the
+// quota alert. It is a helper for the implementations of the CopyFile method,
+// and the caller must hold the VFS lock.
+func CheckCopy(fs VFS, newdoc *FileDoc, size int64) (capsize int64, err error) {
+	if diskQuota := fs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := fs.DiskUsage()
+		if err != nil {
+			return 0, err
+		}
+		if size > diskQuota-diskUsage {
+			return 0, ErrFileTooBig
+		}
+		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
+			capsize = quotaBytes - diskUsage
+		}
+	}
+
+	newpath, err := fs.FilePath(newdoc)
+	if err != nil {
+		return 0, err
+	}
+	if strings.HasPrefix(newpath, TrashDirName+"/") {
+		return 0, ErrParentInTrash
+	}
+
+	exists, err := fs.DirChildExists(newdoc.DirID, newdoc.DocName)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, os.ErrExist
+	}
+	return capsize, nil
+}
+
+// CheckQuotaForCopy checks that there is enough space available on the disk
+// for copying the given number of bytes. It can be used before copying a
+// directory to fail early.
+func CheckQuotaForCopy(fs VFS, size int64) error {
+	diskQuota := fs.DiskQuota()
+	if diskQuota <= 0 {
+		return nil
+	}
+	diskUsage, err := fs.DiskUsage()
+	if err != nil {
+		return err
+	}
+	if size > diskQuota-diskUsage {
+		return ErrFileTooBig
+	}
+	return nil
+}
+
+// DirSize returns the number of files and the total size of the files inside
+// the given directory and its sub-directories.
+func DirSize(fs Indexer, dir *DirDoc) (count int, size int64, err error) {
+	err = walk(fs, dir.Fullpath, dir, nil, func(_ string, _ *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			count++
+			size += file.ByteSize
+		}
+		return nil
+	}, 0)
+	return
+}
+
+// CopyDirContent copies the files and sub-directories of src inside dst,
+// that must already exist. The progress function, if not nil, is called
+// after each copied file with the number of files and bytes copied so far.
+func CopyDirContent(fs VFS, src, dst *DirDoc, opts *CopyOptions, progress func(count int, size int64)) error {
+	if dst.ID() == src.ID() || strings.HasPrefix(dst.Fullpath, src.Fullpath+"/") {
+		return ErrForbiddenDocMove
+	}
+
+	parents := map[string]*DirDoc{src.ID(): dst}
+	var count int
+	var size int64
+	return walk(fs, src.Fullpath, src, nil, func(_ string, dir *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			if dir.ID() == src.ID() {
+				return nil
+			}
+			parent, ok := parents[dir.DirID]
+			if !ok {
+				return ErrParentDoesNotExist
+			}
+			newdir, err := NewDirDocForCopy(dir, parent, dir.DocName, opts)
+			if err != nil {
+				return err
+			}
+			if err = fs.CreateDir(newdir); err != nil {
+				return err
+			}
+			parents[dir.ID()] = newdir
+			return nil
+		}
+
+		parent, ok := parents[file.DirID]
+		if !ok {
+			return ErrParentDoesNotExist
+		}
+		newdoc, err := NewFileDocForCopy(file, parent.ID(), file.DocName, opts)
+		if err != nil {
+			return err
+		}
+		if err = fs.CopyFile(file, newdoc); err != nil {
+			return err
+		}
+		count++
+		size += file.ByteSize
+		if progress != nil {
+			progress(count, size)
+		}
+		return nil
+	}, 0)
+}
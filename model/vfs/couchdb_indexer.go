@@ -55,7 +55,8 @@ func (c *couchdbIndexer) InitIndex() error {
 	return nil
 }
 
-// DiskUsage returns the total size of the files (current + old versions).
+// DiskUsage returns the total size of the files (current + old versions),
+// including the content already received for the resumable uploads.
 func (c *couchdbIndexer) DiskUsage() (int64, error) {
 	used, err := c.FilesUsage()
 	if err != nil {
@@ -66,6 +67,10 @@ func (c *couchdbIndexer) DiskUsage() (int64, error) {
 		used += versions
 	}
 
+	if uploads, err := UploadsUsage(c.db); err == nil {
+		used += uploads
+	}
+
 	return used, nil
 }
 
@@ -27,9 +27,10 @@ type DirDoc struct {
 	DirID       string `json:"dir_id"`
 	RestorePath string `json:"restore_path,omitempty"`
 
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Tags      []string  `json:"tags"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
+	Tags      []string   `json:"tags"`
 
 	// Directory path on VFS.
 	// Fullpath should always be present. It is marked "omitempty" because
@@ -60,6 +61,10 @@ func (d *DirDoc) Clone() couchdb.Doc {
 	if d.CozyMetadata != nil {
 		cloned.CozyMetadata = d.CozyMetadata.Clone()
 	}
+	if d.TrashedAt != nil {
+		trashedAt := *d.TrashedAt
+		cloned.TrashedAt = &trashedAt
+	}
 	return &cloned
 }
 
@@ -252,12 +257,14 @@ func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	trashedAt := time.Now()
 
 	var newdoc *DirDoc
 	err = tryOrUseSuffix(olddoc.DocName, conflictFormat, func(name string) error {
 		newdoc = olddoc.Clone().(*DirDoc)
 		newdoc.DirID = trashDirID
 		newdoc.RestorePath = restorePath
+		newdoc.TrashedAt = &trashedAt
 		newdoc.DocName = name
 		newdoc.Fullpath = path.Join(TrashDirName, name)
 		newdoc.CozyMetadata = olddoc.CozyMetadata
@@ -288,6 +295,7 @@ func RestoreDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 		newdoc = olddoc.Clone().(*DirDoc)
 		newdoc.DirID = restoreDir.DocID
 		newdoc.RestorePath = ""
+		newdoc.TrashedAt = nil
 		newdoc.DocName = name
 		newdoc.Fullpath = path.Join(restoreDir.Fullpath, name)
 		newdoc.CozyMetadata = olddoc.CozyMetadata
@@ -44,4 +44,15 @@ var (
 	ErrFsckFailFail = errors.New("FSCK has been stopped on first failure")
 	// ErrWrongToken is used when a key is not found on the store
 	ErrWrongToken = errors.New("Wrong download token")
+	// ErrInvalidUploadOffset is used when a chunk of a resumable upload is sent
+	// for another offset than the current one of the upload
+	ErrInvalidUploadOffset = errors.New("The offset does not match the current offset of the upload")
+	// ErrUploadIncomplete is used when trying to finish a resumable upload
+	// before all the content has been sent
+	ErrUploadIncomplete = errors.New("The upload is not complete")
+	// ErrUploadExpired is used when the resumable upload has expired
+	ErrUploadExpired = errors.New("The upload has expired")
+	// ErrBlobCollision is used when two contents have the same checksum but
+	// not the same size in a content-addressed layout
+	ErrBlobCollision = errors.New("Two contents have the same checksum but a different size")
 )
@@ -29,8 +29,9 @@ type FileDoc struct {
 	DirID       string `json:"dir_id,omitempty"`
 	RestorePath string `json:"restore_path,omitempty"`
 
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
 
 	ByteSize   int64    `json:"size,string"` // Serialized in JSON as a string, because JS has some issues with big numbers
 	MD5Sum     []byte   `json:"md5sum"`
@@ -83,6 +84,10 @@ func (f *FileDoc) Clone() couchdb.Doc {
 	if f.CozyMetadata != nil {
 		cloned.CozyMetadata = f.CozyMetadata.Clone()
 	}
+	if f.TrashedAt != nil {
+		trashedAt := *f.TrashedAt
+		cloned.TrashedAt = &trashedAt
+	}
 	return &cloned
 }
 
@@ -325,12 +330,14 @@ func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	trashedAt := time.Now()
 
 	var newdoc *FileDoc
 	err = tryOrUseSuffix(olddoc.DocName, conflictFormat, func(name string) error {
 		newdoc = olddoc.Clone().(*FileDoc)
 		newdoc.DirID = trashDirID
 		newdoc.RestorePath = restorePath
+		newdoc.TrashedAt = &trashedAt
 		newdoc.DocName = name
 		newdoc.Trashed = true
 		newdoc.fullpath = path.Join(TrashDirName, name)
@@ -360,6 +367,7 @@ func RestoreFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 		newdoc = olddoc.Clone().(*FileDoc)
 		newdoc.DirID = restoreDir.DocID
 		newdoc.RestorePath = ""
+		newdoc.TrashedAt = nil
 		newdoc.DocName = name
 		newdoc.Trashed = false
 		newdoc.fullpath = path.Join(restoreDir.Fullpath, name)
@@ -0,0 +1,458 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// LostAndFoundDirName is the path of the directory where the files and
+// directories detached from the tree are moved by the repair of a fsck.
+const LostAndFoundDirName = "/Lost+found"
+
+// FsckRepairAction is the action made to repair a FsckLog
+type FsckRepairAction string
+
+const (
+	// RepairNone is used when there is no safe repair for a FsckLog
+	RepairNone FsckRepairAction = "none"
+	// RepairCreateRoot is used to recreate the root directory in the index
+	RepairCreateRoot FsckRepairAction = "create_root"
+	// RepairCreateTrash is used to recreate the trash directory in the index
+	RepairCreateTrash FsckRepairAction = "create_trash"
+	// RepairMoveToLostAndFound is used to move an orphan file or directory to
+	// the Lost+found directory.
+	RepairMoveToLostAndFound FsckRepairAction = "move_to_lost_found"
+	// RepairCreateIndex is used to recreate the document of a file or
+	// directory in the index from what is in the storage.
+	RepairCreateIndex FsckRepairAction = "create_index"
+	// RepairUpdateContent is used to fix the size and md5sum of a file in the
+	// index to match its content in the storage.
+	RepairUpdateContent FsckRepairAction = "update_content"
+	// RepairRemovePath is used to remove the path field of a file document.
+	RepairRemovePath FsckRepairAction = "remove_path"
+)
+
+// FsckRepairState is the state of a repair in the journal
+type FsckRepairState string
+
+const (
+	// RepairDryRun is the state of a repair that has not been applied, as it
+	// was asked for a dry-run.
+	RepairDryRun FsckRepairState = "dry_run"
+	// RepairSkipped is the state of a FsckLog that cannot be safely repaired.
+	RepairSkipped FsckRepairState = "skipped"
+	// RepairPending is the state of a repair that is being applied.
+	RepairPending FsckRepairState = "pending"
+	// RepairDone is the state of a repair that has been applied.
+	RepairDone FsckRepairState = "done"
+	// RepairFailed is the state of a repair that has failed.
+	RepairFailed FsckRepairState = "failed"
+)
+
+// FsckRepair is an entry of the journal of the repairs made from the logs of
+// a fsck. The entries are persisted in CouchDB, before and after the repair,
+// to keep a trace of what has been modified.
+type FsckRepair struct {
+	DocID           string               `json:"_id,omitempty"`
+	DocRev          string               `json:"_rev,omitempty"`
+	LogType         FsckLogType          `json:"log_type"`
+	Action          FsckRepairAction     `json:"action"`
+	State           FsckRepairState      `json:"state"`
+	FileID          string               `json:"file_id,omitempty"`
+	IsDir           bool                 `json:"is_dir"`
+	OldPath         string               `json:"old_path,omitempty"`
+	NewPath         string               `json:"new_path,omitempty"`
+	ContentMismatch *FsckContentMismatch `json:"content_mismatch,omitempty"`
+	Reason          string               `json:"reason,omitempty"`
+	Error           string               `json:"error,omitempty"`
+	CreatedAt       time.Time            `json:"created_at"`
+	UpdatedAt       time.Time            `json:"updated_at"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (r *FsckRepair) ID() string { return r.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (r *FsckRepair) Rev() string { return r.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (r *FsckRepair) DocType() string { return consts.FilesRepairs }
+
+// SetID is used to implement the couchdb.Doc interface
+func (r *FsckRepair) SetID(id string) { r.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (r *FsckRepair) SetRev(rev string) { r.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (r *FsckRepair) Clone() couchdb.Doc {
+	cloned := *r
+	if r.ContentMismatch != nil {
+		mismatch := *r.ContentMismatch
+		cloned.ContentMismatch = &mismatch
+	}
+	return &cloned
+}
+
+// repairOrder is used to sort the logs: the root and trash directories must
+// be recreated before moving the orphans, and the parent directories must be
+// in the index before recreating the documents of the files.
+var repairOrder = map[FsckLogType]int{
+	IndexMissingRoot:  0,
+	IndexMissingTrash: 1,
+	IndexOrphanTree:   2,
+	IndexMissing:      3,
+	IndexFileWithPath: 4,
+	ContentMismatch:   5,
+}
+
+// RepairFsck applies a safe repair for each of the given logs, and calls
+// accumulate with the journal entry of each repair. The logs without a safe
+// repair are skipped. When dryRun is true, nothing is modified and the entries
+// describe what would be done.
+func RepairFsck(fs VFS, db prefixer.Prefixer, logs []*FsckLog, dryRun bool, accumulate func(*FsckRepair)) error {
+	sorted := make([]*FsckLog, len(logs))
+	copy(sorted, logs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		oi, ok := repairOrder[sorted[i].Type]
+		if !ok {
+			oi = len(repairOrder)
+		}
+		oj, ok := repairOrder[sorted[j].Type]
+		if !ok {
+			oj = len(repairOrder)
+		}
+		return oi < oj
+	})
+
+	r := &fsckRepairer{
+		fs:       fs,
+		db:       db,
+		dryRun:   dryRun,
+		reserved: make(map[string]struct{}),
+	}
+	for _, log := range sorted {
+		entry := r.plan(log)
+		if entry.State == RepairSkipped || dryRun {
+			accumulate(entry)
+			continue
+		}
+		if err := couchdb.CreateDoc(db, entry); err != nil {
+			return err
+		}
+		if err := r.apply(log, entry); err != nil {
+			entry.State = RepairFailed
+			entry.Error = err.Error()
+		} else {
+			entry.State = RepairDone
+		}
+		entry.UpdatedAt = time.Now()
+		if err := couchdb.UpdateDoc(db, entry); err != nil {
+			return err
+		}
+		accumulate(entry)
+	}
+	return nil
+}
+
+type fsckRepairer struct {
+	fs           VFS
+	db           prefixer.Prefixer
+	dryRun       bool
+	lostAndFound *DirDoc
+	reserved     map[string]struct{}
+	moved        []string
+}
+
+// plan returns the journal entry for the repair of the given log, without
+// modifying anything.
+func (r *fsckRepairer) plan(log *FsckLog) *FsckRepair {
+	now := time.Now()
+	entry := &FsckRepair{
+		LogType:   log.Type,
+		Action:    RepairNone,
+		State:     RepairPending,
+		IsDir:     !log.IsFile && !log.IsVersion,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if r.dryRun {
+		entry.State = RepairDryRun
+	}
+	skip := func(reason string) *FsckRepair {
+		entry.Action = RepairNone
+		entry.State = RepairSkipped
+		entry.Reason = reason
+		return entry
+	}
+
+	switch log.Type {
+	case IndexMissingRoot:
+		entry.Action = RepairCreateRoot
+		entry.FileID = consts.RootDirID
+		entry.NewPath = "/"
+
+	case IndexMissingTrash:
+		entry.Action = RepairCreateTrash
+		entry.FileID = consts.TrashDirID
+		entry.NewPath = TrashDirName
+
+	case IndexOrphanTree:
+		doc := log.FileDoc
+		if !log.IsFile {
+			doc = log.DirDoc
+			entry.OldPath = doc.Fullpath
+		}
+		entry.Action = RepairMoveToLostAndFound
+		entry.FileID = doc.ID()
+		entry.NewPath = path.Join(LostAndFoundDirName, r.reserveName(doc.DocName))
+
+	case IndexMissing:
+		if log.IsVersion {
+			return skip("the versions are not recreated in the index")
+		}
+		doc := log.FileDoc
+		if !log.IsFile {
+			doc = log.DirDoc
+		}
+		if doc == nil {
+			return skip("the document is missing from the log")
+		}
+		entry.Action = RepairCreateIndex
+		entry.FileID = doc.DocID
+		switch {
+		case doc.DocID != "":
+			// The content is stored by identifier: the file is recreated in
+			// the Lost+found directory.
+			entry.NewPath = path.Join(LostAndFoundDirName, r.reserveName(doc.DocID))
+		case strings.HasPrefix(doc.Fullpath, OrphansDirName+"/"):
+			return skip("the content is not referenced by any file")
+		case r.isMoved(doc.Fullpath):
+			return skip("the content has been moved with its orphan directory")
+		default:
+			// The content is stored by path: the document is recreated at
+			// the same place.
+			entry.NewPath = doc.Fullpath
+		}
+
+	case IndexFileWithPath:
+		entry.Action = RepairRemovePath
+		entry.FileID = log.FileDoc.ID()
+		entry.OldPath = log.FileDoc.Fullpath
+
+	case ContentMismatch:
+		if log.IsVersion {
+			return skip("the versions are not updated")
+		}
+		if _, ok := r.fs.(PhysicalUsager); ok {
+			return skip("the content of a deduplicated file cannot be fixed from the index")
+		}
+		if log.ContentMismatch == nil || len(log.ContentMismatch.MD5SumFile) == 0 {
+			return skip("the checksum of the content is unknown")
+		}
+		entry.Action = RepairUpdateContent
+		entry.FileID = log.FileDoc.ID()
+		entry.ContentMismatch = log.ContentMismatch
+
+	default:
+		return skip("there is no safe repair for this inconsistency")
+	}
+
+	if log.Type == IndexOrphanTree && entry.OldPath != "" {
+		r.moved = append(r.moved, entry.OldPath)
+	}
+	return entry
+}
+
+// apply makes the repair described by the entry.
+func (r *fsckRepairer) apply(log *FsckLog, entry *FsckRepair) error {
+	switch entry.Action {
+	case RepairCreateRoot:
+		now := time.Now()
+		return r.fs.CreateNamedDirDoc(&DirDoc{
+			DocName:   "",
+			Type:      consts.DirType,
+			DocID:     consts.RootDirID,
+			Fullpath:  "/",
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+
+	case RepairCreateTrash:
+		now := time.Now()
+		return r.fs.CreateNamedDirDoc(&DirDoc{
+			DocName:   path.Base(TrashDirName),
+			Type:      consts.DirType,
+			DocID:     consts.TrashDirID,
+			Fullpath:  TrashDirName,
+			DirID:     consts.RootDirID,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+
+	case RepairMoveToLostAndFound:
+		parent, err := r.lostAndFoundDir()
+		if err != nil {
+			return err
+		}
+		name := path.Base(entry.NewPath)
+		if log.IsFile {
+			olddoc, err := r.fs.FileByID(entry.FileID)
+			if err != nil {
+				return err
+			}
+			newdoc := olddoc.Clone().(*FileDoc)
+			newdoc.DirID = parent.ID()
+			newdoc.DocName = name
+			newdoc.Trashed = false
+			newdoc.RestorePath = ""
+			newdoc.ResetFullpath()
+			return r.fs.UpdateFileDoc(olddoc, newdoc)
+		}
+		olddoc, err := r.fs.DirByID(entry.FileID)
+		if err != nil {
+			return err
+		}
+		newdoc := olddoc.Clone().(*DirDoc)
+		newdoc.DirID = parent.ID()
+		newdoc.DocName = name
+		newdoc.Fullpath = entry.NewPath
+		newdoc.RestorePath = ""
+		return r.fs.UpdateDirDoc(olddoc, newdoc)
+
+	case RepairCreateIndex:
+		if log.FileDoc != nil && log.FileDoc.DocID != "" {
+			return r.createFileInLostAndFound(log.FileDoc, path.Base(entry.NewPath))
+		}
+		return r.createIndexAtPath(log)
+
+	case RepairRemovePath:
+		// The path field is not serialized for the files, so updating the
+		// document is enough to remove it.
+		olddoc, err := r.fs.FileByID(entry.FileID)
+		if err != nil {
+			return err
+		}
+		newdoc := olddoc.Clone().(*FileDoc)
+		return r.fs.UpdateFileDoc(olddoc, newdoc)
+
+	case RepairUpdateContent:
+		olddoc, err := r.fs.FileByID(entry.FileID)
+		if err != nil {
+			return err
+		}
+		newdoc := olddoc.Clone().(*FileDoc)
+		newdoc.ByteSize = entry.ContentMismatch.SizeFile
+		newdoc.MD5Sum = entry.ContentMismatch.MD5SumFile
+		return r.fs.UpdateFileDoc(olddoc, newdoc)
+	}
+	return fmt.Errorf("vfs: unknown repair action %s", entry.Action)
+}
+
+// createFileInLostAndFound recreates in the index the document for a content
+// that is stored by identifier.
+func (r *fsckRepairer) createFileInLostAndFound(file *TreeFile, name string) error {
+	parent, err := r.lostAndFoundDir()
+	if err != nil {
+		return err
+	}
+	doc, err := NewFileDoc(name, parent.ID(), file.ByteSize, file.MD5Sum,
+		file.Mime, file.Class, file.CreatedAt, false, false, nil)
+	if err != nil {
+		return err
+	}
+	doc.DocID = file.DocID
+	doc.InternalID = file.InternalID
+	doc.CozyMetadata = NewCozyMetadata("")
+	return r.fs.CreateNamedFileDoc(doc)
+}
+
+// createIndexAtPath recreates in the index the document for a file or
+// directory that is stored by path. Only the document is created, as the
+// content is already in the storage.
+func (r *fsckRepairer) createIndexAtPath(log *FsckLog) error {
+	doc := log.FileDoc
+	if !log.IsFile {
+		doc = log.DirDoc
+	}
+	if _, _, err := r.fs.DirOrFileByPath(doc.Fullpath); err == nil {
+		return os.ErrExist
+	}
+	parent, err := r.fs.DirByPath(path.Dir(doc.Fullpath))
+	if err != nil {
+		return err
+	}
+	if !log.IsFile {
+		dir, err := NewDirDocWithParent(doc.DocName, parent, nil)
+		if err != nil {
+			return err
+		}
+		dir.CreatedAt = doc.CreatedAt
+		dir.UpdatedAt = doc.UpdatedAt
+		dir.CozyMetadata = NewCozyMetadata("")
+		return r.fs.CreateDirDoc(dir)
+	}
+	file, err := NewFileDoc(doc.DocName, parent.ID(), doc.ByteSize, doc.MD5Sum,
+		doc.Mime, doc.Class, doc.CreatedAt, doc.Executable, doc.Trashed, nil)
+	if err != nil {
+		return err
+	}
+	file.CozyMetadata = NewCozyMetadata("")
+	return r.fs.CreateFileDoc(file)
+}
+
+// lostAndFoundDir returns the Lost+found directory, and creates it if needed.
+func (r *fsckRepairer) lostAndFoundDir() (*DirDoc, error) {
+	if r.lostAndFound != nil {
+		return r.lostAndFound, nil
+	}
+	dir, err := MkdirAll(r.fs, LostAndFoundDirName)
+	if err != nil {
+		return nil, err
+	}
+	r.lostAndFound = dir
+	return dir, nil
+}
+
+// reserveName returns a name, derived from the given one, that is not used
+// in the Lost+found directory.
+func (r *fsckRepairer) reserveName(name string) string {
+	if name == "" {
+		name = "unknown"
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; ; i++ {
+		if _, ok := r.reserved[candidate]; !ok {
+			fullpath := path.Join(LostAndFoundDirName, candidate)
+			if _, _, err := r.fs.DirOrFileByPath(fullpath); err != nil {
+				break
+			}
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	r.reserved[candidate] = struct{}{}
+	return candidate
+}
+
+// isMoved returns true if the given path is inside an orphan directory that
+// is moved to the Lost+found directory.
+func (r *fsckRepairer) isMoved(fullpath string) bool {
+	for _, moved := range r.moved {
+		if fullpath == moved || strings.HasPrefix(fullpath, moved+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+var _ couchdb.Doc = &FsckRepair{}
@@ -1,5 +1,11 @@
 package vfs
 
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
 // TrashJournal is a list of files that have been deleted of CouchDB when the
 // trash was cleared, but removing them from Swift is slow and should be done
 // later via the trash-files worker.
@@ -7,3 +13,108 @@ type TrashJournal struct {
 	FileIDs     []string `json:"ids"`
 	ObjectNames []string `json:"objects"`
 }
+
+// TrashedAt returns the date when the file or directory has been put in the
+// trash. The boolean is false for the documents trashed before this date was
+// recorded: they are not expiring until SetMissingTrashedAt has been called.
+func TrashedAt(dir *DirDoc, file *FileDoc) (time.Time, bool) {
+	if dir != nil {
+		if dir.TrashedAt != nil {
+			return *dir.TrashedAt, true
+		}
+		return time.Time{}, false
+	}
+	if file.TrashedAt != nil {
+		return *file.TrashedAt, true
+	}
+	return time.Time{}, false
+}
+
+// SetMissingTrashedAt sets the trashed_at date to now for the files and
+// directories at the root of the trash that don't have one, so that the
+// retention period starts now for them. It returns the number of updated
+// documents.
+func SetMissingTrashedAt(fs VFS) (int, error) {
+	trash, err := fs.DirByID(consts.TrashDirID)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var dirs []*DirDoc
+	var files []*FileDoc
+	iter := fs.DirIterator(trash, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := TrashedAt(d, f); ok {
+			continue
+		}
+		if d != nil {
+			dirs = append(dirs, d)
+		} else {
+			files = append(files, f)
+		}
+	}
+
+	count := 0
+	for _, olddoc := range dirs {
+		newdoc := olddoc.Clone().(*DirDoc)
+		newdoc.TrashedAt = &now
+		if err := fs.UpdateDirDoc(olddoc, newdoc); err != nil {
+			return count, err
+		}
+		count++
+	}
+	for _, olddoc := range files {
+		newdoc := olddoc.Clone().(*FileDoc)
+		newdoc.TrashedAt = &now
+		if err := fs.UpdateFileDoc(olddoc, newdoc); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// TrashedBetween returns the files and directories at the root of the trash
+// that have been trashed in the [from, to) interval. A zero from means that
+// there is no lower bound.
+func TrashedBetween(fs VFS, from, to time.Time) ([]*DirDoc, []*FileDoc, error) {
+	trash, err := fs.DirByID(consts.TrashDirID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var dirs []*DirDoc
+	var files []*FileDoc
+	iter := fs.DirIterator(trash, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		at, ok := TrashedAt(d, f)
+		if !ok || at.Before(from) || !at.Before(to) {
+			continue
+		}
+		if d != nil {
+			dirs = append(dirs, d)
+		} else {
+			files = append(files, f)
+		}
+	}
+	return dirs, files, nil
+}
+
+// ExpiredTrash returns the files and directories of the trash that have been
+// trashed for longer than the given retention period.
+func ExpiredTrash(fs VFS, retention time.Duration) ([]*DirDoc, []*FileDoc, error) {
+	return TrashedBetween(fs, time.Time{}, time.Now().Add(-retention))
+}
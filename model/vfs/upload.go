@@ -0,0 +1,429 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// UploadSessionTTL is the duration after which a resumable upload that has
+// not been finished is considered as expired, and its chunks are removed.
+var UploadSessionTTL = 24 * time.Hour
+
+// UploadSession is used to keep the state of a resumable upload. The content
+// of the file is sent by chunks, that are kept by the VFS until the upload is
+// finished. The file is created only at the end, from the chunks, so that
+// clients never see a file with a partial content.
+type UploadSession struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	// The informations for the file that will be created
+	DirID        string             `json:"dir_id"`
+	Name         string             `json:"name"`
+	Size         int64              `json:"size,string"`
+	MD5Sum       []byte             `json:"md5sum,omitempty"`
+	Mime         string             `json:"mime"`
+	Class        string             `json:"class"`
+	Executable   bool               `json:"executable"`
+	Tags         []string           `json:"tags,omitempty"`
+	Metadata     Metadata           `json:"metadata,omitempty"`
+	CozyMetadata *FilesCozyMetadata `json:"cozyMetadata,omitempty"`
+	CreatedAt    time.Time          `json:"created_at"`
+
+	// Offset is the number of bytes that have already been received
+	Offset     int64     `json:"offset,string"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Finalizing bool      `json:"finalizing,omitempty"`
+}
+
+// ID returns the upload session qualified identifier
+func (u *UploadSession) ID() string { return u.DocID }
+
+// Rev returns the upload session revision
+func (u *UploadSession) Rev() string { return u.DocRev }
+
+// DocType returns the upload session document type
+func (u *UploadSession) DocType() string { return consts.FilesUploads }
+
+// Clone implements couchdb.Doc
+func (u *UploadSession) Clone() couchdb.Doc {
+	cloned := *u
+	cloned.MD5Sum = make([]byte, len(u.MD5Sum))
+	copy(cloned.MD5Sum, u.MD5Sum)
+	cloned.Tags = make([]string, len(u.Tags))
+	copy(cloned.Tags, u.Tags)
+	cloned.Metadata = make(Metadata, len(u.Metadata))
+	for k, v := range u.Metadata {
+		cloned.Metadata[k] = v
+	}
+	if u.CozyMetadata != nil {
+		cloned.CozyMetadata = u.CozyMetadata.Clone()
+	}
+	return &cloned
+}
+
+// SetID changes the upload session qualified identifier
+func (u *UploadSession) SetID(id string) { u.DocID = id }
+
+// SetRev changes the upload session revision
+func (u *UploadSession) SetRev(rev string) { u.DocRev = rev }
+
+// Expired returns true if the upload session has expired.
+func (u *UploadSession) Expired() bool {
+	return time.Now().After(u.ExpiresAt)
+}
+
+// FileDoc returns the document of the file that will be created when the
+// upload is finished.
+func (u *UploadSession) FileDoc() (*FileDoc, error) {
+	doc, err := NewFileDoc(u.Name, u.DirID, u.Size, u.MD5Sum, u.Mime, u.Class,
+		u.CreatedAt, u.Executable, false, u.Tags)
+	if err != nil {
+		return nil, err
+	}
+	doc.Metadata = u.Metadata
+	if u.CozyMetadata != nil {
+		doc.CozyMetadata = u.CozyMetadata.Clone()
+	}
+	return doc, nil
+}
+
+// CreateUploadSession starts a resumable upload for the given file document.
+// The size of the file must be known in advance, and it is checked against
+// the disk quota.
+func CreateUploadSession(fs VFS, doc *FileDoc) (*UploadSession, error) {
+	if doc.ByteSize < 0 {
+		return nil, ErrContentLengthMismatch
+	}
+	if err := checkFileName(doc.DocName); err != nil {
+		return nil, err
+	}
+
+	parent, err := doc.Parent(fs)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(parent.Fullpath, TrashDirName) {
+		return nil, ErrParentInTrash
+	}
+	exists, err := fs.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, os.ErrExist
+	}
+
+	if quota := fs.DiskQuota(); quota > 0 {
+		usage, err := fs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		if usage+doc.ByteSize > quota {
+			return nil, ErrFileTooBig
+		}
+	}
+
+	now := time.Now()
+	u := &UploadSession{
+		DirID:        doc.DirID,
+		Name:         doc.DocName,
+		Size:         doc.ByteSize,
+		MD5Sum:       doc.MD5Sum,
+		Mime:         doc.Mime,
+		Class:        doc.Class,
+		Executable:   doc.Executable,
+		Tags:         doc.Tags,
+		Metadata:     doc.Metadata,
+		CozyMetadata: doc.CozyMetadata,
+		CreatedAt:    doc.CreatedAt,
+		UpdatedAt:    now,
+		ExpiresAt:    now.Add(UploadSessionTTL),
+	}
+	if err := couchdb.CreateDoc(fs, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetUploadSession returns the upload session with the given identifier.
+func GetUploadSession(db prefixer.Prefixer, id string) (*UploadSession, error) {
+	u := &UploadSession{}
+	if err := couchdb.GetDoc(db, consts.FilesUploads, id, u); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// CleanUploadMessage is the message for the clean-upload worker, that removes
+// the chunks of an upload session when it has expired.
+type CleanUploadMessage struct {
+	UploadID string `json:"upload_id"`
+}
+
+// UploadsUsage returns the number of bytes received for the resumable uploads
+// that are not finished. These bytes count against the disk quota.
+func UploadsUsage(db prefixer.Prefixer) (int64, error) {
+	var sessions []*UploadSession
+	err := couchdb.GetAllDocs(db, consts.FilesUploads, nil, &sessions)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var used int64
+	for _, u := range sessions {
+		// When an upload is finalizing, the file has already been created
+		// and its size is counted in the files usage.
+		if !u.Finalizing {
+			used += u.Offset
+		}
+	}
+	return used, nil
+}
+
+func uploadLock(db prefixer.Prefixer, id string) lock.ErrorLocker {
+	return lock.LongOperation(db, "uploads/"+id)
+}
+
+// WriteUploadChunk stores a new chunk for a resumable upload. The offset must
+// be the current offset of the upload, and the chunk must not go further than
+// the size of the file.
+func WriteUploadChunk(fs VFS, id string, offset int64, r io.Reader) (*UploadSession, error) {
+	mu := uploadLock(fs, id)
+	if err := mu.Lock(); err != nil {
+		return nil, err
+	}
+	defer mu.Unlock()
+
+	u, err := GetUploadSession(fs, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Expired() {
+		return nil, ErrUploadExpired
+	}
+	if u.Finalizing {
+		return nil, ErrConflict
+	}
+	if offset != u.Offset {
+		return nil, ErrInvalidUploadOffset
+	}
+
+	maxsize := u.Size - u.Offset
+	errTooLong := ErrContentLengthMismatch
+	if quota := fs.DiskQuota(); quota > 0 {
+		usage, err := fs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		if left := quota - usage; left < maxsize {
+			maxsize = left
+			errTooLong = ErrFileTooBig
+		}
+	}
+
+	chunk, err := fs.CreateUploadChunk(u.ID(), u.Offset)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.CopyN(chunk, r, maxsize+1)
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil && n > maxsize {
+		err = errTooLong
+	}
+	if err == nil && n == 0 {
+		return u, chunk.Abort()
+	}
+	if err != nil {
+		if errAbort := chunk.Abort(); errAbort != nil {
+			logger.WithDomain(fs.DomainName()).WithField("nspace", "upload").
+				Warnf("Cannot abort chunk for %s: %s", u.ID(), errAbort)
+		}
+		return nil, err
+	}
+	if err = chunk.Commit(); err != nil {
+		return nil, err
+	}
+
+	u.Offset += n
+	u.UpdatedAt = time.Now()
+	if err = couchdb.UpdateDoc(fs, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// FinishUpload creates the file from the chunks of a resumable upload, once
+// all the content has been received. The upload session is then removed.
+func FinishUpload(fs VFS, id string) (*FileDoc, error) {
+	mu := uploadLock(fs, id)
+	if err := mu.Lock(); err != nil {
+		return nil, err
+	}
+	defer mu.Unlock()
+
+	u, err := GetUploadSession(fs, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Expired() {
+		return nil, ErrUploadExpired
+	}
+	if u.Offset != u.Size {
+		return nil, ErrUploadIncomplete
+	}
+	doc, err := u.FileDoc()
+	if err != nil {
+		return nil, err
+	}
+
+	u.Finalizing = true
+	if err = couchdb.UpdateDoc(fs, u); err != nil {
+		return nil, err
+	}
+	if err = createFileFromChunks(fs, u.ID(), doc); err != nil {
+		u.Finalizing = false
+		if errUpdate := couchdb.UpdateDoc(fs, u); errUpdate != nil {
+			logger.WithDomain(fs.DomainName()).WithField("nspace", "upload").
+				Warnf("Cannot update the upload session %s: %s", u.ID(), errUpdate)
+		}
+		return nil, err
+	}
+
+	if err = deleteUploadSession(fs, u); err != nil {
+		logger.WithDomain(fs.DomainName()).WithField("nspace", "upload").
+			Warnf("Cannot delete the upload session %s: %s", u.ID(), err)
+	}
+	return doc, nil
+}
+
+func createFileFromChunks(fs VFS, id string, doc *FileDoc) (err error) {
+	content, err := fs.OpenUploadChunks(id)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	file, err := fs.CreateFile(doc, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	_, err = io.Copy(file, content)
+	return err
+}
+
+// AbortUpload cancels a resumable upload: the chunks already received are
+// removed, and the session too.
+func AbortUpload(fs VFS, id string) error {
+	mu := uploadLock(fs, id)
+	if err := mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	u, err := GetUploadSession(fs, id)
+	if err != nil {
+		return err
+	}
+	if u.Finalizing && !u.Expired() {
+		return ErrConflict
+	}
+	return deleteUploadSession(fs, u)
+}
+
+func deleteUploadSession(fs VFS, u *UploadSession) error {
+	if err := fs.DeleteUploadChunks(u.ID()); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(fs, u)
+}
+
+// UploadChunkName returns the name used by the VFS for storing the chunk of a
+// resumable upload that starts at the given offset. The names can be sorted
+// in lexical order to have the chunks in the right order.
+func UploadChunkName(offset int64) string {
+	return fmt.Sprintf("%020d", offset)
+}
+
+// IsUploadChunkName returns true if the given name is the name of a chunk,
+// as returned by UploadChunkName.
+func IsUploadChunkName(name string) bool {
+	if len(name) != 20 {
+		return false
+	}
+	for _, c := range name {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewChunksReader returns a reader on the concatenation of the chunks with the
+// given names. The chunks are opened one by one, when they are needed.
+func NewChunksReader(names []string, open func(name string) (io.ReadCloser, error)) io.ReadCloser {
+	return &chunksReader{names: names, open: open}
+}
+
+type chunksReader struct {
+	names []string
+	open  func(name string) (io.ReadCloser, error)
+	cur   io.ReadCloser
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.names) == 0 {
+				return 0, io.EOF
+			}
+			f, err := r.open(r.names[0])
+			if err != nil {
+				return 0, err
+			}
+			r.names = r.names[1:]
+			r.cur = f
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			err = r.cur.Close()
+			r.cur = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunksReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
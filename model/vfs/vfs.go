@@ -39,6 +39,16 @@ const (
 	// VersionsDirName is the path of the directory where old versions of files
 	// are persisted.
 	VersionsDirName = "/.cozy_versions"
+	// UploadsDirName is the path of the directory where the chunks of the
+	// resumable uploads are kept until the upload is finished.
+	UploadsDirName = "/.cozy_uploads"
+	// BlobsDirName is the path of the directory where the contents of the
+	// files are stored by checksum, for the content-addressed layout of the
+	// local file system.
+	BlobsDirName = "/.cozy_blobs"
+	// JobResultsDirName is the path of the directory where the results of the
+	// jobs that are too large to be kept in the job documents are stored.
+	JobResultsDirName = "/.cozy_jobs_results"
 )
 
 const (
@@ -80,6 +90,11 @@ type Fs interface {
 	//
 	// Warning: you MUST call the Close() method and check for its error.
 	CreateFile(newdoc, olddoc *FileDoc) (File, error)
+	// CopyFile creates a new file with the same content as the first one. The
+	// content is copied inside the storage, without transiting by the stack
+	// when possible. The second argument is the document of the new file,
+	// that is typically created with NewFileDocForCopy.
+	CopyFile(olddoc, newdoc *FileDoc) error
 	// DestroyDirContent destroys all directories and files contained in a
 	// directory.
 	DestroyDirContent(doc *DirDoc, push func(TrashJournal) error) error
@@ -99,6 +114,23 @@ type Fs interface {
 	// ClearOldVersions deletes all the old versions of all files
 	ClearOldVersions() error
 
+	// CreateUploadChunk returns a writer for storing a chunk of a resumable
+	// upload, that starts at the given offset.
+	CreateUploadChunk(uploadID string, offset int64) (ChunkFiler, error)
+	// OpenUploadChunks returns a reader on the content of a resumable upload,
+	// ie the concatenation of all its chunks.
+	OpenUploadChunks(uploadID string) (io.ReadCloser, error)
+	// DeleteUploadChunks removes all the chunks of a resumable upload.
+	DeleteUploadChunks(uploadID string) error
+
+	// CreateJobResult returns a writer for storing the result of a job. The
+	// result is not a file of the tree, and doesn't count in the quota.
+	CreateJobResult(jobID string) (ChunkFiler, error)
+	// OpenJobResult returns a reader on the result of a job.
+	OpenJobResult(jobID string) (io.ReadCloser, error)
+	// DeleteJobResult removes the result of a job.
+	DeleteJobResult(jobID string) error
+
 	// Fsck return the list of inconsistencies in the VFS
 	Fsck(func(log *FsckLog), bool) (err error)
 	CheckFilesConsistency(func(*FsckLog), bool) error
@@ -130,7 +162,7 @@ type Indexer interface {
 	FilePather
 
 	// DiskUsage computes the total size of the files contained in the VFS,
-	// including versions.
+	// including versions and the pending resumable uploads.
 	DiskUsage() (int64, error)
 	// FilesUsage computes the total size of the files contained in the VFS,
 	// excluding versions.
@@ -238,6 +270,15 @@ type ThumbFiler interface {
 	Commit() error
 }
 
+// ChunkFiler defines an interface to handle the storage of a chunk of a
+// resumable upload. Like ThumbFiler, it is an io.Writer that can be aborted in
+// case of error, or committed in case of success.
+type ChunkFiler interface {
+	io.Writer
+	Abort() error
+	Commit() error
+}
+
 // VFS is composed of the Indexer and Fs interface. It is the common interface
 // used throughout the stack to access the VFS.
 type VFS interface {
@@ -317,6 +358,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			RestorePath:  fd.RestorePath,
 			CreatedAt:    fd.CreatedAt,
 			UpdatedAt:    fd.UpdatedAt,
+			TrashedAt:    fd.TrashedAt,
 			ByteSize:     fd.ByteSize,
 			MD5Sum:       fd.MD5Sum,
 			Mime:         fd.Mime,
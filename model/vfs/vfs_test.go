@@ -17,6 +17,7 @@ import (
 
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -24,6 +25,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/s3/s3test"
 	"github.com/ncw/swift/swifttest"
 	"github.com/stretchr/testify/assert"
 )
@@ -639,6 +641,238 @@ func TestArchive(t *testing.T) {
 	assert.NoError(t, fs.DestroyDirAndContent(dirdoc, fs.EnsureErased))
 }
 
+func TestTrashExpiration(t *testing.T) {
+	doc, err := vfs.NewFileDoc("trashed-file", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	trashed, err := vfs.TrashFile(fs, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotNil(t, trashed.TrashedAt)
+
+	dirs, files, err := vfs.ExpiredTrash(fs, time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, dirs, 0)
+	assert.Len(t, files, 0)
+
+	dirs, files, err = vfs.TrashedBetween(fs, time.Now().Add(-time.Hour), time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, dirs, 0)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, trashed.ID(), files[0].ID())
+	}
+
+	restored, err := vfs.RestoreFile(fs, trashed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, restored.TrashedAt)
+	assert.NoError(t, fs.DestroyFile(restored))
+}
+
+func TestLegacyTrashExpiration(t *testing.T) {
+	doc, err := vfs.NewFileDoc("legacy-trashed-file", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	trashed, err := vfs.TrashFile(fs, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Simulate a file trashed a long time ago, before trashed_at was recorded
+	legacy := trashed.Clone().(*vfs.FileDoc)
+	legacy.TrashedAt = nil
+	legacy.UpdatedAt = time.Now().Add(-365 * 24 * time.Hour)
+	if !assert.NoError(t, fs.UpdateFileDoc(trashed, legacy)) {
+		return
+	}
+	_, ok := vfs.TrashedAt(nil, legacy)
+	assert.False(t, ok)
+
+	dirs, files, err := vfs.ExpiredTrash(fs, time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, dirs, 0)
+	assert.Len(t, files, 0)
+
+	count, err := vfs.SetMissingTrashedAt(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	updated, err := fs.FileByID(legacy.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	at, ok := vfs.TrashedAt(nil, updated)
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), at, time.Minute)
+
+	dirs, files, err = vfs.ExpiredTrash(fs, time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, dirs, 0)
+	assert.Len(t, files, 0)
+	dirs, files, err = vfs.TrashedBetween(fs, time.Now().Add(-time.Hour), time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, dirs, 0)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, legacy.ID(), files[0].ID())
+	}
+	assert.NoError(t, fs.DestroyFile(updated))
+}
+
+func TestCopyFileAndDir(t *testing.T) {
+	origtree := H{
+		"copydir/": H{
+			"dirchild1/": H{
+				"food/": H{},
+				"bard/": H{},
+			},
+			"dirchild2/": H{
+				"foof": nil,
+			},
+			"filechild1": nil,
+		},
+	}
+	src, err := createTree(origtree, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	file, err := fs.FileByPath("/copydir/dirchild2/foof")
+	if !assert.NoError(t, err) {
+		return
+	}
+	opts := &vfs.CopyOptions{Tags: true}
+	newdoc, err := vfs.NewFileDocForCopy(file, src.ID(), "foof-copy", opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, fs.CopyFile(file, newdoc))
+	copied, err := fs.FileByPath("/copydir/foof-copy")
+	if assert.NoError(t, err) {
+		assert.Equal(t, file.MD5Sum, copied.MD5Sum)
+		assert.Equal(t, file.ByteSize, copied.ByteSize)
+		assert.NotEqual(t, file.ID(), copied.ID())
+	}
+
+	conflict, err := vfs.NewFileDocForCopy(file, src.ID(), "foof-copy", opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, os.ErrExist, fs.CopyFile(file, conflict))
+
+	root, err := fs.DirByID(consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dst, err := vfs.NewDirDocForCopy(src, root, "copydir2", opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateDir(dst)) {
+		return
+	}
+	assert.Equal(t, vfs.ErrForbiddenDocMove, vfs.CopyDirContent(fs, dst, dst, opts, nil))
+
+	var count int
+	err = vfs.CopyDirContent(fs, src, dst, opts, func(n int, _ int64) { count = n })
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	tree, err := fetchTree("/copydir2")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, H{
+			"copydir2/": H{
+				"dirchild1/": H{
+					"food/": H{},
+					"bard/": H{},
+				},
+				"dirchild2/": H{
+					"foof": nil,
+				},
+				"filechild1": nil,
+				"foof-copy":  nil,
+			},
+		}, tree)
+	}
+
+	assert.NoError(t, fs.DestroyDirAndContent(src, fs.EnsureErased))
+	assert.NoError(t, fs.DestroyDirAndContent(dst, fs.EnsureErased))
+}
+
+func TestFsckRepair(t *testing.T) {
+	orphan, err := vfs.MkdirAll(fs, "/ghost/orphan")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ghost, err := fs.DirByPath("/ghost")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.DeleteDirDoc(ghost)) {
+		return
+	}
+
+	var logs []*vfs.FsckLog
+	err = fs.CheckIndexIntegrity(func(log *vfs.FsckLog) {
+		if log.Type == vfs.IndexOrphanTree && log.DirDoc != nil && log.DirDoc.ID() == orphan.ID() {
+			logs = append(logs, log)
+		}
+	}, false)
+	assert.NoError(t, err)
+	if !assert.Len(t, logs, 1) {
+		return
+	}
+
+	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
+	var repairs []*vfs.FsckRepair
+	err = vfs.RepairFsck(fs, db, logs, true, func(r *vfs.FsckRepair) {
+		repairs = append(repairs, r)
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, repairs, 1) {
+		assert.Equal(t, vfs.RepairMoveToLostAndFound, repairs[0].Action)
+		assert.Equal(t, vfs.RepairDryRun, repairs[0].State)
+		assert.Equal(t, "/Lost+found/orphan", repairs[0].NewPath)
+	}
+	dir, err := fs.DirByID(orphan.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, "/ghost/orphan", dir.Fullpath)
+
+	repairs = nil
+	err = vfs.RepairFsck(fs, db, logs, false, func(r *vfs.FsckRepair) {
+		repairs = append(repairs, r)
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, repairs, 1) {
+		assert.Equal(t, vfs.RepairDone, repairs[0].State)
+		assert.NotEmpty(t, repairs[0].ID())
+	}
+	dir, err = fs.DirByID(orphan.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, "/Lost+found/orphan", dir.Fullpath)
+	lostAndFound, err := fs.DirByPath(vfs.LostAndFoundDirName)
+	if assert.NoError(t, err) {
+		assert.Equal(t, lostAndFound.ID(), dir.DirID)
+	}
+}
+
 func TestCreateFileTooBig(t *testing.T) {
 	diskQuota = 1 << (1 * 10) // 1KB
 	defer func() { diskQuota = 0 }()
@@ -790,7 +1024,39 @@ func TestMain(m *testing.M) {
 	res4 := m.Run()
 	rollback()
 
-	os.Exit(res1 + res2 + res3 + res4)
+	fs, rollback, err = makeSwiftFS(3)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res5 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeAferoCASFS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res6 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeS3FS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res7 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeEncryptedAferoFS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res8 := m.Run()
+	rollback()
+
+	os.Exit(res1 + res2 + res3 + res4 + res5 + res6 + res7 + res8)
 }
 
 func makeAferoFS() (vfs.VFS, func(), error) {
@@ -833,6 +1099,47 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 	}, nil
 }
 
+func makeAferoCASFS() (vfs.VFS, func(), error) {
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if err != nil {
+		return nil, nil, errors.New("could not create temporary directory")
+	}
+
+	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	mutex = lock.ReadWrite(db, "vfs-afero-cas-test")
+	aferoFs, err := vfsafero.NewContentAddressed(db, index, &diskImpl{}, mutex,
+		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, couchdb.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, couchdb.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	err = aferoFs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aferoFs, func() {
+		_ = os.RemoveAll(tempdir)
+		_ = couchdb.DeleteDB(db, consts.Files)
+		_ = couchdb.DeleteDB(db, consts.FilesBlobs)
+	}, nil
+}
+
 func makeSwiftFS(layout int) (vfs.VFS, func(), error) {
 	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
 	index := vfs.NewCouchdbIndexer(db)
@@ -863,6 +1170,9 @@ func makeSwiftFS(layout int) (vfs.VFS, func(), error) {
 	case 2:
 		mutex = lock.ReadWrite(db, "vfs-swiftv3-test")
 		swiftFs, err = vfsswift.NewV3(db, index, &diskImpl{}, mutex)
+	case 3:
+		mutex = lock.ReadWrite(db, "vfs-swiftv4-test")
+		swiftFs, err = vfsswift.NewV4(db, index, &diskImpl{}, mutex)
 	}
 	if err != nil {
 		return nil, nil, err
@@ -889,8 +1199,78 @@ func makeSwiftFS(layout int) (vfs.VFS, func(), error) {
 
 	return swiftFs, func() {
 		_ = couchdb.DeleteDB(db, consts.Files)
+		_ = couchdb.DeleteDB(db, consts.FilesBlobs)
 		if swiftSrv != nil {
 			swiftSrv.Close()
 		}
 	}, nil
 }
+
+func makeEncryptedAferoFS() (vfs.VFS, func(), error) {
+	aferoFs, rollback, err := makeAferoFS()
+	if err != nil {
+		return nil, nil, err
+	}
+	key := crypto.GenerateRandomBytes(32)
+	encryptedFs, err := vfsafero.WithEncryption(aferoFs, [][]byte{key})
+	if err != nil {
+		rollback()
+		return nil, nil, err
+	}
+	return encryptedFs, rollback, nil
+}
+
+func makeS3FS() (vfs.VFS, func(), error) {
+	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	s3Srv, err := s3test.NewServer("")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create s3 server %s", err)
+	}
+
+	u, err := url.Parse(s3Srv.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = config.InitS3Client(config.Fs{
+		URL: &url.URL{
+			Scheme:   config.SchemeS3,
+			Host:     u.Host,
+			Path:     "/cozy-test",
+			RawQuery: "AccessKey=" + s3test.AccessKey + "&SecretKey=" + s3test.SecretKey,
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mutex = lock.ReadWrite(db, "vfs-s3-test")
+	s3Fs, err := vfss3.New(db, index, &diskImpl{}, mutex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, couchdb.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, couchdb.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	err = s3Fs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s3Fs, func() {
+		_ = couchdb.DeleteDB(db, consts.Files)
+		s3Srv.Close()
+	}, nil
+}
@@ -0,0 +1,320 @@
+package vfsafero
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/spf13/afero"
+)
+
+// ErrUnknownEncryptionKey is used when a file has been encrypted with a key
+// that is not known by the VFS.
+var ErrUnknownEncryptionKey = errors.New("vfsafero: the file has been encrypted with an unknown key")
+
+// encryptedFs is an afero.Fs that encrypts the content of the files on the
+// underlying file system. The contents are encrypted in chunks (see
+// crypto.StreamWriter), which allows to read any part of a file without
+// decrypting what is before it. The files are always written with the first
+// key, and the other keys can be used to read the files during a key
+// rotation. The files that are not encrypted (written before the encryption
+// was enabled) are read as is.
+type encryptedFs struct {
+	afero.Fs
+	key  []byte
+	keys map[string][]byte
+}
+
+// NewEncryptedFs returns an afero.Fs that encrypts the content of the files
+// of fs with the first of the given keys.
+func NewEncryptedFs(fs afero.Fs, keys [][]byte) (afero.Fs, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("vfsafero: no encryption key")
+	}
+	efs := &encryptedFs{
+		Fs:   fs,
+		key:  keys[0],
+		keys: make(map[string][]byte, len(keys)),
+	}
+	for _, key := range keys {
+		efs.keys[string(crypto.StreamKeyID(key))] = key
+	}
+	return efs, nil
+}
+
+// WithEncryption returns a VFS that encrypts the content of the files, with
+// the first of the given keys.
+func WithEncryption(fs vfs.VFS, keys [][]byte) (vfs.VFS, error) {
+	var afs *aferoVFS
+	switch f := fs.(type) {
+	case *aferoVFS:
+		afs = f
+	case *aferoCAS:
+		afs = f.aferoVFS
+	default:
+		return nil, fmt.Errorf("vfsafero: cannot encrypt a %T", fs)
+	}
+	efs, err := NewEncryptedFs(afs.fs, keys)
+	if err != nil {
+		return nil, err
+	}
+	afs.fs = efs
+	return fs, nil
+}
+
+// Reencrypt encrypts again the content of all the files of the VFS with the
+// current key (the first one). It is used for key rotation, and to encrypt
+// the files written before the encryption was enabled.
+//
+// The caller must prevent any modification of the VFS during the operation.
+func Reencrypt(fs vfs.VFS) error {
+	var afs *aferoVFS
+	switch f := fs.(type) {
+	case *aferoVFS:
+		afs = f
+	case *aferoCAS:
+		afs = f.aferoVFS
+	default:
+		return fmt.Errorf("vfsafero: cannot encrypt a %T", fs)
+	}
+	efs, ok := afs.fs.(*encryptedFs)
+	if !ok {
+		return errors.New("vfsafero: the encryption is not enabled")
+	}
+
+	return afero.Walk(efs.Fs, "/", func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return efs.reencrypt(fullpath)
+	})
+}
+
+func (efs *encryptedFs) Name() string {
+	return "encryptedFs"
+}
+
+func (efs *encryptedFs) Create(name string) (afero.File, error) {
+	return efs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (efs *encryptedFs) Open(name string) (afero.File, error) {
+	return efs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (efs *encryptedFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&os.O_APPEND != 0 {
+		return nil, os.ErrInvalid
+	}
+	f, err := efs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		w, err := crypto.NewStreamWriter(f, efs.key)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &encryptedWriteFile{File: f, w: w}, nil
+	}
+	file, err := efs.openReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// openReader returns a file that decrypts the content of f, or f itself if
+// it is a directory or a file that is not encrypted.
+func (efs *encryptedFs) openReader(f afero.File) (afero.File, error) {
+	infos, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if infos.IsDir() {
+		return f, nil
+	}
+	keyID, err := crypto.ReadStreamKeyID(f)
+	if err != nil {
+		return nil, err
+	}
+	if keyID == nil {
+		return f, nil
+	}
+	key, ok := efs.keys[string(keyID)]
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+	r, err := crypto.NewStreamReader(f, infos.Size(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedReadFile{File: f, r: r}, nil
+}
+
+// Stat returns the infos of the file, with the size of its plaintext.
+func (efs *encryptedFs) Stat(name string) (os.FileInfo, error) {
+	infos, err := efs.Fs.Stat(name)
+	if err != nil || infos.IsDir() {
+		return infos, err
+	}
+	f, err := efs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keyID, err := crypto.ReadStreamKeyID(f)
+	if err != nil {
+		return nil, err
+	}
+	if keyID == nil {
+		return infos, nil
+	}
+	return &encryptedFileInfo{infos}, nil
+}
+
+// reencrypt encrypts again the file with the current key, if it is not
+// already the case.
+func (efs *encryptedFs) reencrypt(name string) error {
+	raw, err := efs.Fs.Open(name)
+	if err != nil {
+		return err
+	}
+	keyID, err := crypto.ReadStreamKeyID(raw)
+	if err != nil {
+		raw.Close()
+		return err
+	}
+	if bytes.Equal(keyID, crypto.StreamKeyID(efs.key)) {
+		return raw.Close()
+	}
+	in, err := efs.openReader(raw)
+	if err != nil {
+		raw.Close()
+		return err
+	}
+	defer in.Close()
+
+	out, err := afero.TempFile(efs, path.Dir(name), ".reencrypt")
+	if err != nil {
+		return err
+	}
+	tmppath := out.Name()
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		_ = efs.Fs.Remove(tmppath)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		_ = efs.Fs.Remove(tmppath)
+		return err
+	}
+	if err = efs.Fs.Rename(tmppath, name); err != nil {
+		_ = efs.Fs.Remove(tmppath)
+		return err
+	}
+	return nil
+}
+
+type encryptedFileInfo struct {
+	os.FileInfo
+}
+
+func (i *encryptedFileInfo) Size() int64 {
+	return crypto.StreamPlainSize(i.FileInfo.Size())
+}
+
+// encryptedReadFile is a file opened for reading, that decrypts its content.
+type encryptedReadFile struct {
+	afero.File
+	r *crypto.StreamReader
+}
+
+func (f *encryptedReadFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *encryptedReadFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.r.ReadAt(p, off)
+}
+
+func (f *encryptedReadFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+func (f *encryptedReadFile) Stat() (os.FileInfo, error) {
+	infos, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFileInfo{infos}, nil
+}
+
+func (f *encryptedReadFile) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *encryptedReadFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *encryptedReadFile) WriteString(s string) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *encryptedReadFile) Truncate(size int64) error {
+	return os.ErrInvalid
+}
+
+// encryptedWriteFile is a file opened for writing, that encrypts its content.
+// It can only be written sequentially.
+type encryptedWriteFile struct {
+	afero.File
+	w *crypto.StreamWriter
+}
+
+func (f *encryptedWriteFile) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+func (f *encryptedWriteFile) WriteString(s string) (int, error) {
+	return f.w.Write([]byte(s))
+}
+
+func (f *encryptedWriteFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *encryptedWriteFile) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *encryptedWriteFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *encryptedWriteFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *encryptedWriteFile) Truncate(size int64) error {
+	return os.ErrInvalid
+}
+
+func (f *encryptedWriteFile) Close() error {
+	err := f.w.Close()
+	if errc := f.File.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
@@ -75,7 +75,9 @@ func (afs *aferoVFS) checkFiles(
 
 		if fullpath == vfs.WebappsDirName ||
 			fullpath == vfs.KonnectorsDirName ||
-			fullpath == vfs.ThumbsDirName {
+			fullpath == vfs.ThumbsDirName ||
+			fullpath == vfs.UploadsDirName ||
+			fullpath == vfs.JobResultsDirName {
 			return filepath.SkipDir
 		}
 
@@ -97,11 +99,19 @@ func (afs *aferoVFS) checkFiles(
 
 		f, ok := entries[fullpath]
 		if !ok {
-			accumulate(&vfs.FsckLog{
-				Type:    vfs.IndexMissing,
-				IsFile:  true,
-				FileDoc: fileInfosToFileDoc(fullpath, info),
-			})
+			if info.IsDir() {
+				accumulate(&vfs.FsckLog{
+					Type:   vfs.IndexMissing,
+					IsFile: false,
+					DirDoc: fileInfosToDirDoc(fullpath, info),
+				})
+			} else {
+				accumulate(&vfs.FsckLog{
+					Type:    vfs.IndexMissing,
+					IsFile:  true,
+					FileDoc: fileInfosToFileDoc(fullpath, info),
+				})
+			}
 			if failFast {
 				return errFailFast
 			}
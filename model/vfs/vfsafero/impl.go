@@ -237,6 +237,64 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 	}, nil
 }
 
+// CopyFile copies the content in a temporary file on the local file system,
+// and then moves it to the path of the new file.
+func (afs *aferoVFS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+
+	capsize, err := vfs.CheckCopy(afs, newdoc, olddoc.ByteSize)
+	if err != nil {
+		return err
+	}
+	oldpath, err := afs.Indexer.FilePath(olddoc)
+	if err != nil {
+		return err
+	}
+	newpath, err := afs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+
+	in, err := afs.fs.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := afero.TempFile(afs.fs, "/", newdoc.DocName)
+	if err != nil {
+		return err
+	}
+	tmppath := path.Join("/", out.Name())
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = afs.fs.Remove(tmppath)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		_ = afs.fs.Remove(tmppath)
+		return err
+	}
+	if err = safeRenameFile(afs.fs, tmppath, newpath); err != nil {
+		_ = afs.fs.Remove(tmppath)
+		return err
+	}
+
+	newdoc.ByteSize = olddoc.ByteSize
+	newdoc.MD5Sum = olddoc.MD5Sum
+	if err = afs.Indexer.CreateFileDoc(newdoc); err != nil {
+		_ = afs.fs.Remove(newpath)
+		return err
+	}
+
+	if capsize > 0 && newdoc.ByteSize >= capsize {
+		vfs.PushDiskQuotaAlert(afs, true)
+	}
+	return nil
+}
+
 func (afs *aferoVFS) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
 	if lockerr := afs.mu.Lock(); lockerr != nil {
 		return lockerr
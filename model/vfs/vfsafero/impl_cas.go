@@ -0,0 +1,543 @@
+package vfsafero
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/filetype"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/spf13/afero"
+)
+
+// aferoCAS is the content-addressed layout for afero. The directories and the
+// paths of the files exist only in the index, and the contents of the files
+// and of their old versions are stored in the /.cozy_blobs directory, by
+// checksum. The files with the same content share the same blob, and the
+// io.cozy.files.blobs documents are used to count the references to a blob.
+//
+// It reuses the methods of aferoVFS for the uploads, the initialization and
+// the deletion of the file system.
+type aferoCAS struct {
+	*aferoVFS
+}
+
+// NewContentAddressed returns a vfs.VFS instance associated with the
+// specified indexer and storage url, that uses the content-addressed layout.
+// The supported schemes are the same as for New.
+func NewContentAddressed(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string) (vfs.VFS, error) {
+	fs, err := New(db, index, disk, mu, fsURL, pathSegment)
+	if err != nil {
+		return nil, err
+	}
+	return &aferoCAS{fs.(*aferoVFS)}, nil
+}
+
+// pathForBlob returns the path of the content with the given blob identifier.
+func pathForBlob(id string) string {
+	// Avoid too many files in the same directory by using some sub-directories
+	return path.Join(vfs.BlobsDirName, id[:2], id[2:])
+}
+
+func (afs *aferoCAS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
+	return &aferoCAS{afs.aferoVFS.UseSharingIndexer(index).(*aferoVFS)}
+}
+
+// PhysicalUsage returns the space used on the disk by this instance, ie each
+// content shared by several files or versions is counted only once.
+func (afs *aferoCAS) PhysicalUsage() (int64, error) {
+	used, err := vfs.BlobsUsage(afs)
+	if err != nil {
+		return 0, err
+	}
+	if uploads, err := vfs.UploadsUsage(afs); err == nil {
+		used += uploads
+	}
+	return used, nil
+}
+
+func (afs *aferoCAS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	exists, err := afs.Indexer.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	if doc.ID() == "" {
+		return afs.Indexer.CreateDirDoc(doc)
+	}
+	return afs.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (afs *aferoCAS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	f, err := afs.aferoVFS.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	return &aferoCASFileCreation{f.(*aferoFileCreation), afs}, nil
+}
+
+// CopyFile just adds a reference to the blob of the content: the copy shares
+// the content with the original file.
+func (afs *aferoCAS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+
+	capsize, err := vfs.CheckCopy(afs, newdoc, olddoc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if _, err = vfs.RefBlob(afs, olddoc.MD5Sum, olddoc.ByteSize); err != nil {
+		return err
+	}
+
+	newdoc.ByteSize = olddoc.ByteSize
+	newdoc.MD5Sum = olddoc.MD5Sum
+	if err = afs.Indexer.CreateFileDoc(newdoc); err != nil {
+		_ = afs.unrefBlobs([][]byte{olddoc.MD5Sum})
+		return err
+	}
+
+	if capsize > 0 && newdoc.ByteSize >= capsize {
+		vfs.PushDiskQuotaAlert(afs, true)
+	}
+	return nil
+}
+
+func (afs *aferoCAS) destroyDir(doc *vfs.DirDoc, onlyContent bool) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	diskUsage, _ := afs.DiskUsage()
+	files, destroyed, err := afs.Indexer.DeleteDirDocAndContent(doc, onlyContent)
+	if err != nil {
+		return err
+	}
+	md5sums := make([][]byte, 0, len(files))
+	var allVersions []*vfs.Version
+	for _, file := range files {
+		md5sums = append(md5sums, file.MD5Sum)
+		if versions, errv := vfs.VersionsFor(afs, file.DocID); errv == nil {
+			for _, v := range versions {
+				md5sums = append(md5sums, v.MD5Sum)
+				destroyed += v.ByteSize
+			}
+			allVersions = append(allVersions, versions...)
+		}
+	}
+	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
+	if err = afs.Indexer.BatchDeleteVersions(allVersions); err != nil {
+		return err
+	}
+	return afs.unrefBlobs(md5sums)
+}
+
+func (afs *aferoCAS) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return afs.destroyDir(doc, true)
+}
+
+func (afs *aferoCAS) DestroyDirAndContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return afs.destroyDir(doc, false)
+}
+
+func (afs *aferoCAS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	diskUsage, _ := afs.DiskUsage()
+	if err := afs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	versions, err := vfs.VersionsFor(afs, doc.DocID)
+	if err != nil {
+		return err
+	}
+	destroyed := doc.ByteSize
+	md5sums := [][]byte{doc.MD5Sum}
+	for _, v := range versions {
+		md5sums = append(md5sums, v.MD5Sum)
+		destroyed += v.ByteSize
+	}
+	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
+	if err = afs.Indexer.BatchDeleteVersions(versions); err != nil {
+		return err
+	}
+	return afs.unrefBlobs(md5sums)
+}
+
+func (afs *aferoCAS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.RUnlock()
+	f, err := afs.fs.Open(pathForBlob(vfs.BlobID(doc.MD5Sum)))
+	if err != nil {
+		return nil, err
+	}
+	return &aferoFileOpen{f}, nil
+}
+
+func (afs *aferoCAS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.RUnlock()
+	f, err := afs.fs.Open(pathForBlob(vfs.BlobID(version.MD5Sum)))
+	if err != nil {
+		return nil, err
+	}
+	return &aferoFileOpen{f}, nil
+}
+
+// RevertFileVersion swaps the current content and the version, but only in
+// the index: the reference of the current content is taken by the new
+// version, and the reference of the old version by the file.
+func (afs *aferoCAS) RevertFileVersion(doc *vfs.FileDoc, version *vfs.Version) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+
+	save := vfs.NewVersion(doc)
+	if err := afs.Indexer.CreateVersion(save); err != nil {
+		return err
+	}
+
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	vfs.SetMetaFromVersion(newdoc, version)
+	if err := afs.Indexer.UpdateFileDoc(doc, newdoc); err != nil {
+		_ = afs.Indexer.DeleteVersion(save)
+		return err
+	}
+
+	return afs.Indexer.DeleteVersion(version)
+}
+
+// UpdateFileDoc overrides the aferoVFS one, as the paths are only in the
+// index for this layout.
+//
+// @override Indexer.UpdateFileDoc
+func (afs *aferoCAS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := afs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UpdateDirDoc overrides the aferoVFS one, as the paths are only in the
+// index for this layout.
+//
+// @override Indexer.UpdateDirDoc
+func (afs *aferoCAS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		if strings.HasPrefix(newdoc.Fullpath, olddoc.Fullpath+"/") {
+			return vfs.ErrForbiddenDocMove
+		}
+		exists, err := afs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return afs.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+func (afs *aferoCAS) CleanOldVersion(fileID string, version *vfs.Version) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	if err := afs.Indexer.DeleteVersion(version); err != nil {
+		return err
+	}
+	return afs.unrefBlobs([][]byte{version.MD5Sum})
+}
+
+func (afs *aferoCAS) ClearOldVersions() error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	diskUsage, _ := afs.DiskUsage()
+	versions, err := afs.Indexer.AllVersions()
+	if err != nil {
+		return err
+	}
+	md5sums := make([][]byte, len(versions))
+	var destroyed int64
+	for i, v := range versions {
+		md5sums[i] = v.MD5Sum
+		destroyed += v.ByteSize
+	}
+	if err := afs.Indexer.BatchDeleteVersions(versions); err != nil {
+		return err
+	}
+	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
+	return afs.unrefBlobs(md5sums)
+}
+
+// unrefBlobs removes a reference to the blobs with the given checksums, and
+// deletes the contents that are no longer referenced. The caller must hold
+// the lock of the VFS.
+func (afs *aferoCAS) unrefBlobs(md5sums [][]byte) error {
+	removed, err := vfs.UnrefBlobs(afs, md5sums)
+	for _, id := range removed {
+		if errr := afs.fs.Remove(pathForBlob(id)); errr != nil && !os.IsNotExist(errr) && err == nil {
+			err = errr
+		}
+	}
+	return err
+}
+
+func (afs *aferoCAS) Fsck(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	var entries []*vfs.TreeFile
+	tree, err := afs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries = append(entries, f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err = afs.CheckTreeIntegrity(tree, accumulate, failFast); err != nil {
+		if err == vfs.ErrFsckFailFail {
+			return nil
+		}
+		return err
+	}
+	return vfs.CheckBlobs(afs, entries, afs.walkBlobs, accumulate, failFast)
+}
+
+func (afs *aferoCAS) CheckFilesConsistency(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	var entries []*vfs.TreeFile
+	_, err := afs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries = append(entries, f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return vfs.CheckBlobs(afs, entries, afs.walkBlobs, accumulate, failFast)
+}
+
+func (afs *aferoCAS) walkBlobs(fn func(obj *vfs.BlobObject) error) error {
+	err := afero.Walk(afs.fs, vfs.BlobsDirName, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := afs.fs.Open(fullpath)
+		if err != nil {
+			return err
+		}
+		contentType, r := filetype.FromReader(f)
+		h := md5.New()
+		if _, err = io.Copy(h, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		return fn(&vfs.BlobObject{
+			Name:        path.Base(path.Dir(fullpath)) + info.Name(),
+			MD5Sum:      h.Sum(nil),
+			ByteSize:    info.Size(),
+			ContentType: contentType,
+			ModTime:     info.ModTime(),
+		})
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// aferoCASFileCreation represents a file open for writing with the
+// content-addressed layout. The content is written in a temporary file, like
+// for aferoVFS, but this file is moved to its blob when the file is closed
+// (or just removed if the blob already exists).
+type aferoCASFileCreation struct {
+	*aferoFileCreation
+	afs *aferoCAS
+}
+
+func (f *aferoCASFileCreation) Close() (err error) {
+	defer func() {
+		if err != nil {
+			// remove the temporary file if an error occurred
+			_ = f.afs.fs.Remove(f.tmppath)
+			// If an error has occurred that is not due to the index update, we should
+			// delete the file from the index.
+			if f.olddoc == nil {
+				if _, isCouchErr := couchdb.IsCouchError(err); !isCouchErr {
+					_ = f.afs.Indexer.DeleteFileDoc(f.newdoc)
+				}
+			}
+		}
+	}()
+
+	if err = f.f.Close(); err != nil {
+		if f.meta != nil {
+			(*f.meta).Abort(err)
+		}
+		if f.err == nil {
+			f.err = err
+		}
+	}
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.w
+
+	if f.meta != nil {
+		if errc := (*f.meta).Close(); errc == nil {
+			vfs.MergeMetadata(newdoc, (*f.meta).Result())
+		}
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	md5sum := f.hash.Sum(nil)
+	if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = md5sum
+	}
+
+	if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		return vfs.ErrInvalidHash
+	}
+
+	if f.size < 0 {
+		newdoc.ByteSize = written
+	}
+
+	if newdoc.ByteSize != written {
+		return vfs.ErrContentLengthMismatch
+	}
+
+	lockerr := f.afs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.afs.mu.Unlock()
+
+	// Check again that a file with the same path does not exist. It can happen
+	// when the same file is uploaded twice in parallel.
+	if olddoc == nil {
+		exists, err := f.afs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	var newpath string
+	newpath, err = f.afs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	// Keep the temporary file as the blob if the content is new, or just
+	// remove it if the same content is already stored.
+	created, err := vfs.RefBlob(f.afs, newdoc.MD5Sum, newdoc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if created {
+		blobpath := pathForBlob(vfs.BlobID(newdoc.MD5Sum))
+		_ = f.afs.fs.MkdirAll(path.Dir(blobpath), 0755)
+		if err = f.afs.fs.Rename(f.tmppath, blobpath); err != nil {
+			_, _ = vfs.UnrefBlobs(f.afs, [][]byte{newdoc.MD5Sum})
+			return err
+		}
+	} else {
+		_ = f.afs.fs.Remove(f.tmppath)
+	}
+
+	var v *vfs.Version
+	if olddoc != nil {
+		v = vfs.NewVersion(olddoc)
+		err = f.afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	} else if newdoc.ID() == "" {
+		err = f.afs.Indexer.CreateFileDoc(newdoc)
+	} else {
+		err = f.afs.Indexer.CreateNamedFileDoc(newdoc)
+	}
+	if err != nil {
+		_ = f.afs.unrefBlobs([][]byte{newdoc.MD5Sum})
+		return err
+	}
+
+	// The reference of the old content is kept by the version, or removed if
+	// the version is not kept.
+	if v != nil {
+		var unused [][]byte
+		cleanV, toClean, _ := vfs.FindVersionsToClean(f.afs, newdoc.DocID, v)
+		if !cleanV {
+			if errv := f.afs.Indexer.CreateVersion(v); errv != nil {
+				cleanV = true
+			}
+		}
+		if cleanV {
+			unused = append(unused, v.MD5Sum)
+		}
+		for _, old := range toClean {
+			if errd := f.afs.Indexer.DeleteVersion(old); errd == nil {
+				unused = append(unused, old.MD5Sum)
+			}
+		}
+		_ = f.afs.unrefBlobs(unused)
+	}
+
+	if f.capsize > 0 && f.size >= f.capsize {
+		vfs.PushDiskQuotaAlert(f.afs, true)
+	}
+
+	return nil
+}
+
+var (
+	_ vfs.VFS            = &aferoCAS{}
+	_ vfs.PhysicalUsager = &aferoCAS{}
+	_ vfs.File           = &aferoCASFileCreation{}
+)
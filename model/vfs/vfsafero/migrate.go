@@ -0,0 +1,134 @@
+package vfsafero
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/spf13/afero"
+)
+
+// ErrNotPathLayout is used when trying to migrate a VFS that does not use
+// the layout by path.
+var ErrNotPathLayout = errors.New("vfsafero: the VFS does not use the layout by path")
+
+// MigrateToContentAddressed copies the contents of the files and of their old
+// versions from the layout by path of the given VFS to the blobs of the
+// content-addressed layout, and creates the io.cozy.files.blobs documents.
+//
+// The caller must prevent any modification of the VFS during the migration,
+// and is responsible for switching the instance to the new layout after that.
+// The old contents can then be removed with CleanPathLayout.
+func MigrateToContentAddressed(fs vfs.VFS) (err error) {
+	afs, ok := fs.(*aferoVFS)
+	if !ok {
+		return ErrNotPathLayout
+	}
+	if _, err = afs.fs.Stat(vfs.BlobsDirName); err == nil {
+		return os.ErrExist
+	}
+	root, err := afs.Indexer.DirByID(consts.RootDirID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = afs.fs.RemoveAll(vfs.BlobsDirName)
+		}
+	}()
+
+	blobs := make(map[string]*vfs.Blob)
+	addBlob := func(md5sum []byte, size int64, src string) error {
+		id := vfs.BlobID(md5sum)
+		if blob, ok := blobs[id]; ok {
+			blob.Refs++
+			return nil
+		}
+		if err := copyFile(afs.fs, src, pathForBlob(id)); err != nil {
+			return err
+		}
+		blobs[id] = &vfs.Blob{DocID: id, ByteSize: size, Refs: 1}
+		return nil
+	}
+
+	err = vfs.WalkAlreadyLocked(afs.Indexer, root, func(fullpath string, _ *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return nil
+		}
+		if err = addBlob(file.MD5Sum, file.ByteSize, fullpath); err != nil {
+			return err
+		}
+		versions, err := vfs.VersionsFor(afs, file.DocID)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+		for _, v := range versions {
+			if err = addBlob(v.MD5Sum, v.ByteSize, pathForVersion(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	list := make([]*vfs.Blob, 0, len(blobs))
+	for _, blob := range blobs {
+		list = append(list, blob)
+	}
+	return vfs.CreateBlobs(afs, list)
+}
+
+// CleanPathLayout removes the contents of the layout by path, after the
+// migration to the content-addressed layout. The directories that are not
+// managed by the VFS (thumbnails, applications, etc.) are kept.
+func CleanPathLayout(fs vfs.VFS) error {
+	afs, ok := fs.(*aferoVFS)
+	if !ok {
+		return ErrNotPathLayout
+	}
+	infos, err := afero.ReadDir(afs.fs, "/")
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		fullpath := path.Join("/", info.Name())
+		switch fullpath {
+		case vfs.BlobsDirName, vfs.UploadsDirName, vfs.ThumbsDirName,
+			vfs.WebappsDirName, vfs.KonnectorsDirName, vfs.JobResultsDirName:
+			continue
+		}
+		if err = afs.fs.RemoveAll(fullpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(fs afero.Fs, src, dst string) error {
+	if err := fs.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,43 @@
+package vfsafero
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/spf13/afero"
+)
+
+func (afs *aferoVFS) jobResultPath(jobID string) string {
+	return path.Join(vfs.JobResultsDirName, jobID+".json")
+}
+
+func (afs *aferoVFS) CreateJobResult(jobID string) (vfs.ChunkFiler, error) {
+	if err := afs.fs.MkdirAll(vfs.JobResultsDirName, 0755); err != nil {
+		return nil, err
+	}
+	f, err := afero.TempFile(afs.fs, vfs.JobResultsDirName, "cozy-result")
+	if err != nil {
+		return nil, err
+	}
+	// The results can be aborted and committed like the chunks of the uploads
+	return &uploadChunk{
+		File:    f,
+		fs:      afs.fs,
+		tmpname: f.Name(),
+		newname: afs.jobResultPath(jobID),
+	}, nil
+}
+
+func (afs *aferoVFS) OpenJobResult(jobID string) (io.ReadCloser, error) {
+	return afs.fs.Open(afs.jobResultPath(jobID))
+}
+
+func (afs *aferoVFS) DeleteJobResult(jobID string) error {
+	err := afs.fs.Remove(afs.jobResultPath(jobID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
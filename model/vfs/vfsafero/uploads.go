@@ -0,0 +1,75 @@
+package vfsafero
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/spf13/afero"
+)
+
+type uploadChunk struct {
+	afero.File
+	fs      afero.Fs
+	tmpname string
+	newname string
+}
+
+func (c *uploadChunk) Abort() error {
+	errc := c.File.Close()
+	errr := c.fs.Remove(c.tmpname)
+	if errc != nil {
+		return errc
+	}
+	return errr
+}
+
+func (c *uploadChunk) Commit() error {
+	if err := c.File.Close(); err != nil {
+		return err
+	}
+	return c.fs.Rename(c.tmpname, c.newname)
+}
+
+func (afs *aferoVFS) uploadDir(uploadID string) string {
+	return path.Join(vfs.UploadsDirName, uploadID)
+}
+
+func (afs *aferoVFS) CreateUploadChunk(uploadID string, offset int64) (vfs.ChunkFiler, error) {
+	dir := afs.uploadDir(uploadID)
+	if err := afs.fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := afero.TempFile(afs.fs, dir, "cozy-chunk")
+	if err != nil {
+		return nil, err
+	}
+	return &uploadChunk{
+		File:    f,
+		fs:      afs.fs,
+		tmpname: f.Name(),
+		newname: path.Join(dir, vfs.UploadChunkName(offset)),
+	}, nil
+}
+
+func (afs *aferoVFS) OpenUploadChunks(uploadID string) (io.ReadCloser, error) {
+	dir := afs.uploadDir(uploadID)
+	infos, err := afero.ReadDir(afs.fs, dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if vfs.IsUploadChunkName(info.Name()) {
+			names = append(names, path.Join(dir, info.Name()))
+		}
+	}
+	return vfs.NewChunksReader(names, func(name string) (io.ReadCloser, error) {
+		return afs.fs.Open(name)
+	}), nil
+}
+
+func (afs *aferoVFS) DeleteUploadChunks(uploadID string) error {
+	return afs.fs.RemoveAll(afs.uploadDir(uploadID))
+}
@@ -0,0 +1,195 @@
+package vfss3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+var errFailFast = errors.New("fail fast")
+
+func (sfs *s3VFS) Fsck(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	entries := make(map[string]*vfs.TreeFile, 1024)
+	tree, err := sfs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries[f.DocID+"/"+f.InternalID] = f
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err = sfs.CheckTreeIntegrity(tree, accumulate, failFast); err != nil {
+		if err == vfs.ErrFsckFailFail {
+			return nil
+		}
+		return err
+	}
+	return sfs.checkFiles(entries, accumulate, failFast)
+}
+
+func (sfs *s3VFS) CheckFilesConsistency(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	entries := make(map[string]*vfs.TreeFile, 1024)
+	_, err := sfs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries[f.DocID+"/"+f.InternalID] = f
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sfs.checkFiles(entries, accumulate, failFast)
+}
+
+// contentMismatch returns true if the object does not match the size and
+// md5sum of the index. The md5sum is known only for the objects that have not
+// been created with a multipart upload, so only the size can be checked for
+// the others.
+func contentMismatch(obj *s3.ObjectInfo, size int64, md5sum []byte) bool {
+	if obj.Size != size {
+		return true
+	}
+	if sum := obj.MD5Sum(); sum != nil && !bytes.Equal(sum, md5sum) {
+		return true
+	}
+	return false
+}
+
+func (sfs *s3VFS) checkFiles(
+	entries map[string]*vfs.TreeFile,
+	accumulate func(log *vfs.FsckLog),
+	failFast bool,
+) error {
+	versions := make(map[string]*vfs.Version, 1024)
+	err := couchdb.ForeachDocs(sfs, consts.FilesVersions, func(_ string, data json.RawMessage) error {
+		v := &vfs.Version{}
+		if erru := json.Unmarshal(data, v); erru != nil {
+			return erru
+		}
+		versions[v.DocID] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	prefix := sfs.instancePrefix() + filesPrefix
+	err = sfs.c.ListObjects(sfs.bucket, prefix, func(obj *s3.ObjectInfo) error {
+		docID := strings.TrimPrefix(obj.Key, prefix)
+		if v, ok := versions[docID]; ok {
+			if contentMismatch(obj, v.ByteSize, v.MD5Sum) {
+				accumulate(&vfs.FsckLog{
+					Type:       vfs.ContentMismatch,
+					IsVersion:  true,
+					VersionDoc: v,
+					ContentMismatch: &vfs.FsckContentMismatch{
+						SizeFile:    obj.Size,
+						SizeIndex:   v.ByteSize,
+						MD5SumFile:  obj.MD5Sum(),
+						MD5SumIndex: v.MD5Sum,
+					},
+				})
+				if failFast {
+					return errFailFast
+				}
+			}
+			delete(versions, docID)
+			return nil
+		}
+		f, ok := entries[docID]
+		if !ok {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.IndexMissing,
+				IsFile:  true,
+				FileDoc: objectToFileDoc(docID, obj),
+			})
+			if failFast {
+				return errFailFast
+			}
+			return nil
+		}
+		if contentMismatch(obj, f.ByteSize, f.MD5Sum) {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.ContentMismatch,
+				IsFile:  true,
+				FileDoc: f,
+				ContentMismatch: &vfs.FsckContentMismatch{
+					SizeFile:    obj.Size,
+					SizeIndex:   f.ByteSize,
+					MD5SumFile:  obj.MD5Sum(),
+					MD5SumIndex: f.MD5Sum,
+				},
+			})
+			if failFast {
+				return errFailFast
+			}
+		}
+		delete(entries, docID)
+		return nil
+	})
+	if err != nil {
+		if err == errFailFast {
+			return nil
+		}
+		return err
+	}
+
+	// entries should contain only data that does not contain an associated
+	// index.
+	for _, f := range entries {
+		accumulate(&vfs.FsckLog{
+			Type:    vfs.FSMissing,
+			IsFile:  true,
+			FileDoc: f,
+		})
+		if failFast {
+			return nil
+		}
+	}
+
+	for _, v := range versions {
+		accumulate(&vfs.FsckLog{
+			Type:       vfs.FSMissing,
+			IsVersion:  true,
+			VersionDoc: v,
+		})
+		if failFast {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func objectToFileDoc(docID string, obj *s3.ObjectInfo) *vfs.TreeFile {
+	name := "unknown"
+	mime, class := vfs.ExtractMimeAndClass(obj.ContentType)
+	fileID, internalID := docID, ""
+	if parts := strings.SplitN(docID, "/", 2); len(parts) > 1 {
+		fileID, internalID = parts[0], parts[1]
+	}
+	return &vfs.TreeFile{
+		DirOrFileDoc: vfs.DirOrFileDoc{
+			DirDoc: &vfs.DirDoc{
+				Type:      consts.FileType,
+				DocID:     fileID,
+				DocName:   name,
+				DirID:     "",
+				CreatedAt: obj.LastModified,
+				UpdatedAt: obj.LastModified,
+				Fullpath:  path.Join(vfs.OrphansDirName, name),
+			},
+			ByteSize:   obj.Size,
+			Mime:       mime,
+			Class:      class,
+			MD5Sum:     obj.MD5Sum(),
+			InternalID: internalID,
+		},
+	}
+}
@@ -0,0 +1,769 @@
+// Package vfss3 is the implementation of the VFS with an S3-compatible object
+// storage for the contents of the files.
+package vfss3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/s3"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// The objects of an instance are stored in the bucket with a prefix made of
+// the DB prefix of the instance, and then:
+//   - files/<docID>/<internalID> for the contents of the files and versions
+//   - thumbs/<docID>-<format> for the thumbnails
+//   - uploads/<uploadID>/<offset> for the chunks of the resumable uploads
+//   - jobs-results/<jobID> for the large results of the jobs.
+const (
+	filesPrefix      = "files/"
+	thumbsPrefix     = "thumbs/"
+	uploadsPrefix    = "uploads/"
+	jobResultsPrefix = "jobs-results/"
+)
+
+type s3VFS struct {
+	vfs.Indexer
+	vfs.DiskThresholder
+	c      *s3.Client
+	bucket string
+	domain string
+	prefix string
+	mu     lock.ErrorRWLocker
+	log    *logrus.Entry
+}
+
+// New returns a vfs.VFS instance associated with the specified indexer and
+// the S3 storage configured in fs.url.
+//
+// Like the V3 layout for Swift, the contents of a file and of its old
+// versions are stored in objects named with the file identifier and an
+// internal identifier, that changes each time the content is modified. It
+// allows to swap an old version with the current one without having to copy
+// the contents. All the instances share the same bucket, with a prefix for the
+// objects of each instance.
+func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		c:      config.GetS3Client(),
+		bucket: config.GetS3Bucket(),
+		domain: db.DomainName(),
+		prefix: db.DBPrefix(),
+		mu:     mu,
+		log:    logger.WithDomain(db.DomainName()).WithField("nspace", "vfss3"),
+	}, nil
+}
+
+// NewInternalID returns a random string that can be used as an internal_vfs_id.
+func NewInternalID() string {
+	return utils.RandomString(16)
+}
+
+// instancePrefix returns the prefix of the keys for all the objects of the
+// instance.
+func (sfs *s3VFS) instancePrefix() string {
+	return sfs.prefix + "/"
+}
+
+// makeKey returns the key of the object for the content of a file (or one of
+// its old versions).
+func (sfs *s3VFS) makeKey(docID, internalID string) string {
+	return sfs.instancePrefix() + filesPrefix + docID + "/" + internalID
+}
+
+// makeVersionKey returns the key of the object for an old version.
+func (sfs *s3VFS) makeVersionKey(fileID string, v *vfs.Version) string {
+	internalID := v.DocID
+	if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
+		internalID = parts[1]
+	}
+	return sfs.makeKey(fileID, internalID)
+}
+
+func (sfs *s3VFS) DBPrefix() string {
+	return sfs.prefix
+}
+
+func (sfs *s3VFS) DomainName() string {
+	return sfs.domain
+}
+
+func (sfs *s3VFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: sfs.DiskThresholder,
+		c:               sfs.c,
+		bucket:          sfs.bucket,
+		domain:          sfs.domain,
+		prefix:          sfs.prefix,
+		mu:              sfs.mu,
+		log:             sfs.log,
+	}
+}
+
+func (sfs *s3VFS) InitFs() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	// The bucket is shared by all the instances, and has been created when
+	// the S3 client has been initialized.
+	return sfs.Indexer.InitIndex()
+}
+
+func (sfs *s3VFS) Delete() error {
+	sfs.log.Infof("Deleting the objects with the prefix %q", sfs.instancePrefix())
+	return sfs.c.DeletePrefix(sfs.bucket, sfs.instancePrefix())
+}
+
+func (sfs *s3VFS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	exists, err := sfs.Indexer.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	if doc.ID() == "" {
+		return sfs.Indexer.CreateDirDoc(doc)
+	}
+	return sfs.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (sfs *s3VFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	diskQuota := sfs.DiskQuota()
+
+	var maxsize, newsize, capsize int64
+	maxsize = sfs.c.MaxObjectSize()
+	newsize = newdoc.ByteSize
+	if diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		if quotaSize := diskQuota - diskUsage; quotaSize < maxsize {
+			maxsize = quotaSize
+		}
+		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
+			capsize = quotaBytes - diskUsage
+		}
+	}
+	if newsize > maxsize {
+		return nil, vfs.ErrFileTooBig
+	}
+
+	if olddoc != nil {
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return nil, vfs.ErrParentInTrash
+	}
+
+	if olddoc == nil {
+		var exists bool
+		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+	}
+
+	if newdoc.DocID == "" {
+		if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+			return nil, err
+		}
+	}
+
+	newdoc.InternalID = NewInternalID()
+	key := sfs.makeKey(newdoc.DocID, newdoc.InternalID)
+	w := sfs.c.NewWriter(sfs.bucket, key, &s3.PutOptions{
+		ContentType: newdoc.Mime,
+		ContentMD5:  newdoc.MD5Sum,
+		Metadata: map[string]string{
+			"creation-name": newdoc.Name(),
+			"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
+			"exec":          strconv.FormatBool(newdoc.Executable),
+		},
+	})
+	extractor := vfs.NewMetaExtractor(newdoc)
+
+	return &s3FileCreation{
+		fs:      sfs,
+		w:       w,
+		newdoc:  newdoc,
+		olddoc:  olddoc,
+		key:     key,
+		size:    newsize,
+		maxsize: maxsize,
+		capsize: capsize,
+		hash:    md5.New(),
+		meta:    extractor,
+	}, nil
+}
+
+// CopyFile uses a server-side copy for the content. The objects that are too
+// large for that are copied by streaming them from the bucket to the bucket.
+func (sfs *s3VFS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	capsize, err := vfs.CheckCopy(sfs, newdoc, olddoc.ByteSize)
+	if err != nil {
+		return err
+	}
+
+	if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+		return err
+	}
+	newdoc.InternalID = NewInternalID()
+	srcKey := sfs.makeKey(olddoc.DocID, olddoc.InternalID)
+	dstKey := sfs.makeKey(newdoc.DocID, newdoc.InternalID)
+	if olddoc.ByteSize <= s3.MaxCopySize {
+		_, err = sfs.c.CopyObject(sfs.bucket, srcKey, dstKey)
+	} else {
+		err = sfs.streamCopy(srcKey, dstKey, newdoc)
+	}
+	if err != nil {
+		if err == s3.ErrNotFound {
+			err = os.ErrNotExist
+		}
+		return err
+	}
+
+	newdoc.ByteSize = olddoc.ByteSize
+	newdoc.MD5Sum = olddoc.MD5Sum
+	if err = sfs.Indexer.CreateNamedFileDoc(newdoc); err != nil {
+		_ = sfs.c.DeleteObject(sfs.bucket, dstKey)
+		return err
+	}
+
+	if capsize > 0 && newdoc.ByteSize >= capsize {
+		vfs.PushDiskQuotaAlert(sfs, true)
+	}
+	return nil
+}
+
+func (sfs *s3VFS) streamCopy(srcKey, dstKey string, newdoc *vfs.FileDoc) error {
+	obj, err := sfs.c.OpenObject(sfs.bucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	w := sfs.c.NewWriter(sfs.bucket, dstKey, &s3.PutOptions{
+		ContentType: newdoc.Mime,
+		Metadata: map[string]string{
+			"creation-name": newdoc.Name(),
+			"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
+			"exec":          strconv.FormatBool(newdoc.Executable),
+		},
+	})
+	if _, err = io.Copy(w, obj); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+func (sfs *s3VFS) destroyDir(doc *vfs.DirDoc, push func(vfs.TrashJournal) error, onlyContent bool) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	files, destroyed, err := sfs.Indexer.DeleteDirDocAndContent(doc, onlyContent)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	ids := make([]string, len(files))
+	keys := make([]string, len(files))
+	for i, file := range files {
+		ids[i] = file.DocID
+		keys[i] = sfs.makeKey(file.DocID, file.InternalID)
+	}
+	return push(vfs.TrashJournal{
+		FileIDs:     ids,
+		ObjectNames: keys,
+	})
+}
+
+func (sfs *s3VFS) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return sfs.destroyDir(doc, push, true)
+}
+
+func (sfs *s3VFS) DestroyDirAndContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return sfs.destroyDir(doc, push, false)
+}
+
+func (sfs *s3VFS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	keys := []string{sfs.makeKey(doc.DocID, doc.InternalID)}
+	if err := sfs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	destroyed := doc.ByteSize
+	if versions, errv := vfs.VersionsFor(sfs, doc.DocID); errv == nil {
+		for _, v := range versions {
+			keys = append(keys, sfs.makeVersionKey(doc.DocID, v))
+			destroyed += v.ByteSize
+		}
+		if err := sfs.Indexer.BatchDeleteVersions(versions); err != nil {
+			sfs.log.Warnf("DestroyFile failed on BatchDeleteVersions: %s", err)
+		}
+	}
+	err := sfs.c.DeleteObjects(sfs.bucket, keys)
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return err
+}
+
+func (sfs *s3VFS) EnsureErased(journal vfs.TrashJournal) error {
+	// No lock needed
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	keys := journal.ObjectNames
+	var destroyed int64
+	var allVersions []*vfs.Version
+	for _, fileID := range journal.FileIDs {
+		if versions, err := vfs.VersionsFor(sfs, fileID); err == nil {
+			for _, v := range versions {
+				keys = append(keys, sfs.makeVersionKey(fileID, v))
+				destroyed += v.ByteSize
+			}
+			allVersions = append(allVersions, versions...)
+		}
+	}
+	if err := sfs.Indexer.BatchDeleteVersions(allVersions); err != nil {
+		sfs.log.Warnf("EnsureErased failed on BatchDeleteVersions: %s", err)
+	}
+	err := sfs.c.DeleteObjects(sfs.bucket, keys)
+	if err != nil {
+		sfs.log.Infof("EnsureErased failed on DeleteObjects: %s", err)
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return err
+}
+
+func (sfs *s3VFS) openObject(key string) (vfs.File, error) {
+	obj, err := sfs.c.OpenObject(sfs.bucket, key)
+	if s3.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s3FileOpen{obj}, nil
+}
+
+func (sfs *s3VFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.openObject(sfs.makeKey(doc.DocID, doc.InternalID))
+}
+
+func (sfs *s3VFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.openObject(sfs.makeVersionKey(doc.DocID, version))
+}
+
+func (sfs *s3VFS) RevertFileVersion(doc *vfs.FileDoc, version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	save := vfs.NewVersion(doc)
+	if err := sfs.Indexer.CreateVersion(save); err != nil {
+		return err
+	}
+
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	if parts := strings.SplitN(version.DocID, "/", 2); len(parts) > 1 {
+		newdoc.InternalID = parts[1]
+	}
+	vfs.SetMetaFromVersion(newdoc, version)
+	if err := sfs.Indexer.UpdateFileDoc(doc, newdoc); err != nil {
+		_ = sfs.Indexer.DeleteVersion(save)
+		return err
+	}
+
+	return sfs.Indexer.DeleteVersion(version)
+}
+
+// UpdateFileDoc calls the indexer UpdateFileDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateFileDoc
+func (sfs *s3VFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UdpdateDirDoc calls the indexer UdpdateDirDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateDirDoc
+func (sfs *s3VFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+func (sfs *s3VFS) DirByID(fileID string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByID(fileID)
+}
+
+func (sfs *s3VFS) DirByPath(name string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByPath(name)
+}
+
+func (sfs *s3VFS) FileByID(fileID string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByID(fileID)
+}
+
+func (sfs *s3VFS) FileByPath(name string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByPath(name)
+}
+
+func (sfs *s3VFS) FilePath(doc *vfs.FileDoc) (string, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return "", lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FilePath(doc)
+}
+
+func (sfs *s3VFS) DirOrFileByID(fileID string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByID(fileID)
+}
+
+func (sfs *s3VFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByPath(name)
+}
+
+// s3FileCreation represents a file open for writing. It is used to create a
+// file or to modify the content of a file.
+//
+// s3FileCreation implements io.WriteCloser.
+type s3FileCreation struct {
+	fs      *s3VFS
+	w       *s3.Writer
+	newdoc  *vfs.FileDoc
+	olddoc  *vfs.FileDoc
+	key     string
+	written int64
+	size    int64
+	maxsize int64
+	capsize int64
+	hash    hash.Hash
+	meta    *vfs.MetaExtractor
+	err     error
+}
+
+func (f *s3FileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Write(p []byte) (int, error) {
+	if f.meta != nil {
+		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+	}
+
+	n, err := f.w.Write(p)
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+	_, _ = f.hash.Write(p[:n])
+
+	f.written += int64(n)
+	if f.maxsize >= 0 && f.written > f.maxsize {
+		f.err = vfs.ErrFileTooBig
+		return n, f.err
+	}
+
+	if f.size >= 0 && f.written > f.size {
+		f.err = vfs.ErrContentLengthMismatch
+		return n, f.err
+	}
+
+	return n, nil
+}
+
+func (f *s3FileCreation) Close() (err error) {
+	defer func() {
+		if err != nil {
+			// remove the object if an error occurred
+			_ = f.fs.c.DeleteObject(f.fs.bucket, f.key)
+			// If an error has occurred that is not due to the index update, we should
+			// delete the file from the index.
+			_, isCouchErr := couchdb.IsCouchError(err)
+			if !isCouchErr && f.olddoc == nil {
+				_ = f.fs.Indexer.DeleteFileDoc(f.newdoc)
+			}
+		}
+	}()
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.written
+
+	// The content length is checked before creating the object, to avoid
+	// sending an invalid content to S3.
+	if f.err == nil && f.size >= 0 && written != f.size {
+		f.err = vfs.ErrContentLengthMismatch
+	}
+
+	if f.err != nil {
+		_ = f.w.Abort()
+	} else if err = f.w.Close(); err != nil {
+		if e, ok := err.(*s3.Error); ok && e.Code == "BadDigest" {
+			err = vfs.ErrInvalidHash
+		}
+		f.err = err
+	}
+
+	if f.meta != nil {
+		if f.err != nil {
+			(*f.meta).Abort(f.err)
+		} else if errc := (*f.meta).Close(); errc == nil {
+			vfs.MergeMetadata(newdoc, (*f.meta).Result())
+		}
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	// The md5sum is checked by S3 only when the content is sent in a single
+	// request, so we check it here for the multipart uploads.
+	md5sum := f.hash.Sum(nil)
+	if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = md5sum
+	}
+	if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		return vfs.ErrInvalidHash
+	}
+
+	if f.size < 0 {
+		newdoc.ByteSize = written
+	}
+
+	if newdoc.ByteSize != written {
+		return vfs.ErrContentLengthMismatch
+	}
+
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+
+	// Check again that a file with the same path does not exist. It can happen
+	// when the same file is uploaded twice in parallel.
+	if olddoc == nil {
+		exists, err := f.fs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	var v *vfs.Version
+	if olddoc != nil {
+		v = vfs.NewVersion(olddoc)
+		err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	} else if newdoc.ID() == "" {
+		err = f.fs.Indexer.CreateFileDoc(newdoc)
+	} else {
+		err = f.fs.Indexer.CreateNamedFileDoc(newdoc)
+	}
+	if err != nil {
+		return err
+	}
+
+	if v != nil {
+		cleanV, toClean, _ := vfs.FindVersionsToClean(f.fs, newdoc.DocID, v)
+		if !cleanV {
+			if errv := f.fs.Indexer.CreateVersion(v); errv != nil {
+				cleanV = true
+			}
+		}
+		if cleanV {
+			_ = f.fs.c.DeleteObject(f.fs.bucket, f.fs.makeVersionKey(newdoc.DocID, v))
+		}
+		for _, old := range toClean {
+			_ = cleanOldVersion(f.fs, newdoc.DocID, old)
+		}
+	}
+
+	if f.capsize > 0 && f.size >= f.capsize {
+		vfs.PushDiskQuotaAlert(f.fs, true)
+	}
+
+	return nil
+}
+
+func (sfs *s3VFS) CleanOldVersion(fileID string, v *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return cleanOldVersion(sfs, fileID, v)
+}
+
+func cleanOldVersion(sfs *s3VFS, fileID string, v *vfs.Version) error {
+	if err := sfs.Indexer.DeleteVersion(v); err != nil {
+		return err
+	}
+	return sfs.c.DeleteObject(sfs.bucket, sfs.makeVersionKey(fileID, v))
+}
+
+func (sfs *s3VFS) ClearOldVersions() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	versions, err := sfs.Indexer.AllVersions()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	var destroyed int64
+	for _, v := range versions {
+		if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
+			keys = append(keys, sfs.makeKey(parts[0], parts[1]))
+		}
+		destroyed += v.ByteSize
+	}
+	if err := sfs.Indexer.BatchDeleteVersions(versions); err != nil {
+		return err
+	}
+	err = sfs.c.DeleteObjects(sfs.bucket, keys)
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return err
+}
+
+// s3FileOpen represents a file open for reading.
+type s3FileOpen struct {
+	*s3.Object
+}
+
+func (f *s3FileOpen) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+var (
+	_ vfs.VFS  = &s3VFS{}
+	_ vfs.File = &s3FileCreation{}
+	_ vfs.File = &s3FileOpen{}
+)
@@ -0,0 +1,39 @@
+package vfss3
+
+import (
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+func (sfs *s3VFS) jobResultKey(jobID string) string {
+	return sfs.instancePrefix() + jobResultsPrefix + jobID
+}
+
+func (sfs *s3VFS) CreateJobResult(jobID string) (vfs.ChunkFiler, error) {
+	w := sfs.c.NewWriter(sfs.bucket, sfs.jobResultKey(jobID), &s3.PutOptions{
+		ContentType: "application/json",
+	})
+	return &writer{w}, nil
+}
+
+func (sfs *s3VFS) OpenJobResult(jobID string) (io.ReadCloser, error) {
+	obj, err := sfs.c.OpenObject(sfs.bucket, sfs.jobResultKey(jobID))
+	if s3.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (sfs *s3VFS) DeleteJobResult(jobID string) error {
+	err := sfs.c.DeleteObject(sfs.bucket, sfs.jobResultKey(jobID))
+	if s3.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
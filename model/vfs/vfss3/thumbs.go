@@ -0,0 +1,102 @@
+package vfss3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+var unixEpochZero = time.Time{}
+
+// NewThumbsFs creates a new thumb filesystem base on S3.
+//
+// The thumbnails are stored in the same bucket as the files, with the
+// "thumbs/" prefix after the prefix of the instance.
+func NewThumbsFs(c *s3.Client, bucket string, db prefixer.Prefixer) vfs.Thumbser {
+	return &thumbs{c: c, bucket: bucket, prefix: db.DBPrefix() + "/" + thumbsPrefix}
+}
+
+type thumbs struct {
+	c      *s3.Client
+	bucket string
+	prefix string
+}
+
+// writer is used for the thumbnails and the chunks of the resumable uploads:
+// the object is created only on Commit.
+type writer struct {
+	*s3.Writer
+}
+
+func (w *writer) Abort() error {
+	return w.Writer.Abort()
+}
+
+func (w *writer) Commit() error {
+	return w.Writer.Close()
+}
+
+func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (vfs.ThumbFiler, error) {
+	w := t.c.NewWriter(t.bucket, t.makeName(img, format), &s3.PutOptions{
+		ContentType: img.Mime,
+		Metadata: map[string]string{
+			"file-md5": hex.EncodeToString(img.MD5Sum),
+		},
+	})
+	return &writer{w}, nil
+}
+
+func (t *thumbs) ThumbExists(img *vfs.FileDoc, format string) (bool, error) {
+	info, err := t.c.HeadObject(t.bucket, t.makeName(img, format))
+	if s3.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size == 0 {
+		return false, nil
+	}
+	if md5 := info.Metadata["file-md5"]; md5 != "" {
+		md5sum, err := hex.DecodeString(md5)
+		if err == nil && !bytes.Equal(md5sum, img.MD5Sum) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *thumbs) RemoveThumbs(img *vfs.FileDoc, formats []string) error {
+	keys := make([]string, len(formats))
+	for i, format := range formats {
+		keys[i] = t.makeName(img, format)
+	}
+	return t.c.DeleteObjects(t.bucket, keys)
+}
+
+func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *vfs.FileDoc, format string) error {
+	name := t.makeName(img, format)
+	obj, err := t.c.OpenObject(t.bucket, name)
+	if s3.IsNotFound(err) {
+		return os.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, obj.Info.ETag))
+	http.ServeContent(w, req, name, unixEpochZero, obj)
+	return nil
+}
+
+func (t *thumbs) makeName(img *vfs.FileDoc, format string) string {
+	return fmt.Sprintf("%s%s-%s", t.prefix, img.ID(), format)
+}
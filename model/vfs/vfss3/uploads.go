@@ -0,0 +1,43 @@
+package vfss3
+
+import (
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+func (sfs *s3VFS) uploadPrefix(uploadID string) string {
+	return sfs.instancePrefix() + uploadsPrefix + uploadID + "/"
+}
+
+func (sfs *s3VFS) CreateUploadChunk(uploadID string, offset int64) (vfs.ChunkFiler, error) {
+	key := sfs.uploadPrefix(uploadID) + vfs.UploadChunkName(offset)
+	w := sfs.c.NewWriter(sfs.bucket, key, &s3.PutOptions{
+		ContentType: "application/octet-stream",
+	})
+	// The chunks can be aborted and committed like the thumbnails
+	return &writer{w}, nil
+}
+
+func (sfs *s3VFS) OpenUploadChunks(uploadID string) (io.ReadCloser, error) {
+	keys, err := sfs.c.ListKeys(sfs.bucket, sfs.uploadPrefix(uploadID))
+	if err != nil {
+		return nil, err
+	}
+	return vfs.NewChunksReader(keys, func(key string) (io.ReadCloser, error) {
+		obj, err := sfs.c.OpenObject(sfs.bucket, key)
+		if s3.IsNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}), nil
+}
+
+func (sfs *s3VFS) DeleteUploadChunks(uploadID string) error {
+	return sfs.c.DeletePrefix(sfs.bucket, sfs.uploadPrefix(uploadID))
+}
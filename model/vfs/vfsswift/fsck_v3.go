@@ -69,7 +69,8 @@ func (sfs *swiftVFSV3) checkFiles(
 			return nil, err
 		}
 		for _, obj := range objs {
-			if strings.HasPrefix(obj.Name, "thumbs/") {
+			if strings.HasPrefix(obj.Name, "thumbs/") || strings.HasPrefix(obj.Name, uploadsPrefix) ||
+				strings.HasPrefix(obj.Name, jobResultsPrefix) {
 				continue
 			}
 			docID, internalID := makeDocIDV3(obj.Name)
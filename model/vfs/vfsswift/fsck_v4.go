@@ -0,0 +1,68 @@
+package vfsswift
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/ncw/swift"
+)
+
+func (sfs *swiftVFSV4) Fsck(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	var entries []*vfs.TreeFile
+	tree, err := sfs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries = append(entries, f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err = sfs.CheckTreeIntegrity(tree, accumulate, failFast); err != nil {
+		if err == vfs.ErrFsckFailFail {
+			return nil
+		}
+		return err
+	}
+	return vfs.CheckBlobs(sfs, entries, sfs.walkBlobs, accumulate, failFast)
+}
+
+func (sfs *swiftVFSV4) CheckFilesConsistency(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	var entries []*vfs.TreeFile
+	_, err := sfs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries = append(entries, f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return vfs.CheckBlobs(sfs, entries, sfs.walkBlobs, accumulate, failFast)
+}
+
+func (sfs *swiftVFSV4) walkBlobs(fn func(obj *vfs.BlobObject) error) error {
+	opts := &swift.ObjectsOpts{Prefix: blobsPrefix}
+	return sfs.c.ObjectsWalk(sfs.container, opts, func(opts *swift.ObjectsOpts) (interface{}, error) {
+		objs, err := sfs.c.Objects(sfs.container, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			md5sum, err := hex.DecodeString(obj.Hash)
+			if err != nil {
+				return nil, err
+			}
+			err = fn(&vfs.BlobObject{
+				Name:        strings.TrimPrefix(obj.Name, blobsPrefix),
+				MD5Sum:      md5sum,
+				ByteSize:    obj.Bytes,
+				ContentType: obj.ContentType,
+				ModTime:     obj.LastModified,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return objs, nil
+	})
+}
@@ -285,6 +285,37 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 	}, nil
 }
 
+// CopyFile uses a server-side copy of swift for the content.
+func (sfs *swiftVFS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	capsize, err := vfs.CheckCopy(sfs, newdoc, olddoc.ByteSize)
+	if err != nil {
+		return err
+	}
+
+	srcName := olddoc.DirID + "/" + olddoc.DocName
+	dstName := newdoc.DirID + "/" + newdoc.DocName
+	if _, err = sfs.c.ObjectCopy(sfs.container, srcName, sfs.container, dstName, nil); err != nil {
+		return err
+	}
+
+	newdoc.ByteSize = olddoc.ByteSize
+	newdoc.MD5Sum = olddoc.MD5Sum
+	if err = sfs.Indexer.CreateFileDoc(newdoc); err != nil {
+		_ = sfs.c.ObjectDelete(sfs.container, dstName)
+		return err
+	}
+
+	if capsize > 0 && newdoc.ByteSize >= capsize {
+		vfs.PushDiskQuotaAlert(sfs, true)
+	}
+	return nil
+}
+
 func (sfs *swiftVFS) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
 	if lockerr := sfs.mu.Lock(); lockerr != nil {
 		return lockerr
@@ -300,6 +300,45 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 	}, nil
 }
 
+// CopyFile uses a server-side copy of swift for the content.
+func (sfs *swiftVFSV2) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	capsize, err := vfs.CheckCopy(sfs, newdoc, olddoc.ByteSize)
+	if err != nil {
+		return err
+	}
+
+	if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+		return err
+	}
+	srcName := MakeObjectName(olddoc.DocID)
+	dstName := MakeObjectName(newdoc.DocID)
+	objMeta := swift.Metadata{
+		"creation-name": newdoc.Name(),
+		"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
+		"exec":          strconv.FormatBool(newdoc.Executable),
+	}
+	if _, err = sfs.c.ObjectCopy(sfs.container, srcName, sfs.container, dstName, objMeta.ObjectHeaders()); err != nil {
+		return err
+	}
+
+	newdoc.ByteSize = olddoc.ByteSize
+	newdoc.MD5Sum = olddoc.MD5Sum
+	if err = sfs.Indexer.CreateNamedFileDoc(newdoc); err != nil {
+		_ = sfs.c.ObjectDelete(sfs.container, dstName)
+		return err
+	}
+
+	if capsize > 0 && newdoc.ByteSize >= capsize {
+		vfs.PushDiskQuotaAlert(sfs, true)
+	}
+	return nil
+}
+
 func (sfs *swiftVFSV2) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
 	if lockerr := sfs.mu.Lock(); lockerr != nil {
 		return lockerr
@@ -0,0 +1,558 @@
+package vfsswift
+
+import (
+	"encoding/hex"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/ncw/swift"
+)
+
+// swiftVFSV4 works like the V3 layout, except for the storage of the
+// contents. So, it reuses the methods of the V3 layout for everything that
+// is only about the index (directories, moves, etc.).
+type swiftVFSV4 struct {
+	*swiftVFSV3
+}
+
+const (
+	swiftV4ContainerPrefix = "cozy-v4-"
+
+	// The contents of the files and versions are stored with the "blobs/"
+	// prefix, and the contents being uploaded with the "tmp/" prefix.
+	blobsPrefix = "blobs/"
+	tmpPrefix   = "tmp/"
+)
+
+// NewV4 returns a vfs.VFS instance associated with the specified indexer and
+// the swift storage url.
+//
+// The V4 layout is a content-addressed layout. Like the V3 layout, it uses a
+// single swift container per instance, but the contents of the files and of
+// their old versions are stored by their checksum. When several files have
+// the same content (a photo uploaded twice, a file copied by a sharing,
+// etc.), they share the same swift object. The io.cozy.files.blobs documents
+// are used to count the references to an object, and it is removed from
+// swift only when it is no longer referenced.
+func NewV4(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+	return &swiftVFSV4{&swiftVFSV3{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		c:         config.GetSwiftConnection(),
+		domain:    db.DomainName(),
+		prefix:    db.DBPrefix(),
+		container: swiftV4ContainerPrefix + db.DBPrefix(),
+		mu:        mu,
+		log:       logger.WithDomain(db.DomainName()).WithField("nspace", "vfsswift"),
+	}}, nil
+}
+
+// MakeBlobName returns the name of the swift object for the content with the
+// given checksum in the V4 layout.
+func MakeBlobName(md5sum []byte) string {
+	return blobsPrefix + vfs.BlobID(md5sum)
+}
+
+func (sfs *swiftVFSV4) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
+	v3 := sfs.swiftVFSV3.UseSharingIndexer(index).(*swiftVFSV3)
+	return &swiftVFSV4{v3}
+}
+
+// PhysicalUsage returns the space used in swift by this instance, ie each
+// content shared by several files or versions is counted only once.
+func (sfs *swiftVFSV4) PhysicalUsage() (int64, error) {
+	used, err := vfs.BlobsUsage(sfs)
+	if err != nil {
+		return 0, err
+	}
+	if uploads, err := vfs.UploadsUsage(sfs); err == nil {
+		used += uploads
+	}
+	return used, nil
+}
+
+func (sfs *swiftVFSV4) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	diskQuota := sfs.DiskQuota()
+
+	var maxsize, newsize, capsize int64
+	maxsize = maxFileSize
+	newsize = newdoc.ByteSize
+	if diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		maxsize = diskQuota - diskUsage
+		if maxsize > maxFileSize {
+			maxsize = maxFileSize
+		}
+		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
+			capsize = quotaBytes - diskUsage
+		}
+	}
+	if newsize > maxsize {
+		return nil, vfs.ErrFileTooBig
+	}
+
+	if olddoc != nil {
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return nil, vfs.ErrParentInTrash
+	}
+
+	if olddoc == nil {
+		var exists bool
+		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+	}
+
+	if newdoc.DocID == "" {
+		if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+			return nil, err
+		}
+	}
+
+	// The internal ID is not used for the name of the object, but it is
+	// still used for the identifiers of the versions.
+	newdoc.InternalID = NewInternalID()
+	objName := tmpPrefix + MakeObjectNameV3(newdoc.DocID, newdoc.InternalID)
+	objMeta := swift.Metadata{
+		"creation-name": newdoc.Name(),
+		"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
+	}
+
+	hash := hex.EncodeToString(newdoc.MD5Sum)
+	f, err := sfs.c.ObjectCreate(
+		sfs.container,
+		objName,
+		true,
+		hash,
+		newdoc.Mime,
+		objMeta.ObjectHeaders(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	extractor := vfs.NewMetaExtractor(newdoc)
+
+	return &swiftFileCreationV4{
+		swiftFileCreationV3: &swiftFileCreationV3{
+			fs:      sfs.swiftVFSV3,
+			f:       f,
+			newdoc:  newdoc,
+			olddoc:  olddoc,
+			name:    objName,
+			w:       0,
+			size:    newsize,
+			maxsize: maxsize,
+			capsize: capsize,
+			meta:    extractor,
+		},
+		fs: sfs,
+	}, nil
+}
+
+// CopyFile just adds a reference to the blob of the content: the copy shares
+// the swift object with the original file.
+func (sfs *swiftVFSV4) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	capsize, err := vfs.CheckCopy(sfs, newdoc, olddoc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if _, err = vfs.RefBlob(sfs, olddoc.MD5Sum, olddoc.ByteSize); err != nil {
+		return err
+	}
+
+	newdoc.ByteSize = olddoc.ByteSize
+	newdoc.MD5Sum = olddoc.MD5Sum
+	if err = sfs.Indexer.CreateFileDoc(newdoc); err != nil {
+		_ = sfs.unrefBlobs([][]byte{olddoc.MD5Sum})
+		return err
+	}
+
+	if capsize > 0 && newdoc.ByteSize >= capsize {
+		vfs.PushDiskQuotaAlert(sfs, true)
+	}
+	return nil
+}
+
+func (sfs *swiftVFSV4) destroyDir(doc *vfs.DirDoc, push func(vfs.TrashJournal) error, onlyContent bool) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	files, destroyed, err := sfs.Indexer.DeleteDirDocAndContent(doc, onlyContent)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	md5sums := make([][]byte, 0, len(files))
+	var allVersions []*vfs.Version
+	for _, file := range files {
+		md5sums = append(md5sums, file.MD5Sum)
+		if versions, errv := vfs.VersionsFor(sfs, file.DocID); errv == nil {
+			for _, v := range versions {
+				md5sums = append(md5sums, v.MD5Sum)
+				destroyed += v.ByteSize
+			}
+			allVersions = append(allVersions, versions...)
+		}
+	}
+	if err = sfs.Indexer.BatchDeleteVersions(allVersions); err != nil {
+		sfs.log.Warnf("destroyDir failed on BatchDeleteVersions: %s", err)
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+
+	// The references are removed now, and only the objects that are no longer
+	// referenced are deleted later by the trash-files worker. It means that
+	// the worker can safely be retried.
+	removed, err := vfs.UnrefBlobs(sfs, md5sums)
+	if len(removed) == 0 {
+		return err
+	}
+	objNames := make([]string, len(removed))
+	for i, id := range removed {
+		objNames[i] = blobsPrefix + id
+	}
+	if errp := push(vfs.TrashJournal{ObjectNames: objNames}); err == nil {
+		err = errp
+	}
+	return err
+}
+
+func (sfs *swiftVFSV4) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return sfs.destroyDir(doc, push, true)
+}
+
+func (sfs *swiftVFSV4) DestroyDirAndContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return sfs.destroyDir(doc, push, false)
+}
+
+func (sfs *swiftVFSV4) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	if err := sfs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	destroyed := doc.ByteSize
+	md5sums := [][]byte{doc.MD5Sum}
+	if versions, errv := vfs.VersionsFor(sfs, doc.DocID); errv == nil {
+		for _, v := range versions {
+			md5sums = append(md5sums, v.MD5Sum)
+			destroyed += v.ByteSize
+		}
+		if err := sfs.Indexer.BatchDeleteVersions(versions); err != nil {
+			sfs.log.Warnf("DestroyFile failed on BatchDeleteVersions: %s", err)
+		}
+	}
+	err := sfs.unrefBlobs(md5sums)
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return err
+}
+
+func (sfs *swiftVFSV4) EnsureErased(journal vfs.TrashJournal) error {
+	// The lock is needed to check that the blobs have not been referenced
+	// again since the journal was pushed.
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	var objNames []string
+	for _, objName := range journal.ObjectNames {
+		id := strings.TrimPrefix(objName, blobsPrefix)
+		err := couchdb.GetDoc(sfs, consts.FilesBlobs, id, &vfs.Blob{})
+		if couchdb.IsNotFoundError(err) {
+			objNames = append(objNames, objName)
+		}
+	}
+	return sfs.deleteObjects(objNames)
+}
+
+func (sfs *swiftVFSV4) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.openBlob(doc.MD5Sum)
+}
+
+func (sfs *swiftVFSV4) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.openBlob(version.MD5Sum)
+}
+
+func (sfs *swiftVFSV4) openBlob(md5sum []byte) (vfs.File, error) {
+	f, _, err := sfs.c.ObjectOpen(sfs.container, MakeBlobName(md5sum), false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &swiftFileOpenV3{f, nil}, nil
+}
+
+func (sfs *swiftVFSV4) CleanOldVersion(fileID string, v *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if err := sfs.Indexer.DeleteVersion(v); err != nil {
+		return err
+	}
+	return sfs.unrefBlobs([][]byte{v.MD5Sum})
+}
+
+func (sfs *swiftVFSV4) ClearOldVersions() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	versions, err := sfs.Indexer.AllVersions()
+	if err != nil {
+		return err
+	}
+	md5sums := make([][]byte, len(versions))
+	var destroyed int64
+	for i, v := range versions {
+		md5sums[i] = v.MD5Sum
+		destroyed += v.ByteSize
+	}
+	if err := sfs.Indexer.BatchDeleteVersions(versions); err != nil {
+		return err
+	}
+	err = sfs.unrefBlobs(md5sums)
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return err
+}
+
+// unrefBlobs removes a reference to the blobs with the given checksums, and
+// deletes the objects that are no longer referenced. The caller must hold
+// the lock of the VFS.
+func (sfs *swiftVFSV4) unrefBlobs(md5sums [][]byte) error {
+	removed, err := vfs.UnrefBlobs(sfs, md5sums)
+	objNames := make([]string, len(removed))
+	for i, id := range removed {
+		objNames[i] = blobsPrefix + id
+	}
+	if errd := sfs.deleteObjects(objNames); err == nil {
+		err = errd
+	}
+	return err
+}
+
+func (sfs *swiftVFSV4) deleteObjects(objNames []string) error {
+	if len(objNames) == 0 {
+		return nil
+	}
+	_, err := sfs.c.BulkDelete(sfs.container, objNames)
+	if err == swift.Forbidden {
+		sfs.log.Infof("deleteObjects failed on BulkDelete: %s", err)
+		err = nil
+		for _, objName := range objNames {
+			errd := sfs.c.ObjectDelete(sfs.container, objName)
+			if err == nil && errd != nil && errd != swift.ObjectNotFound {
+				sfs.log.Infof("deleteObjects failed on ObjectDelete: %s", errd)
+				err = errd
+			}
+		}
+	}
+	return err
+}
+
+// swiftFileCreationV4 represents a file open for writing. The content is
+// written in a temporary object, and moved to its blob when the file is
+// closed (or just removed if the blob already exists).
+type swiftFileCreationV4 struct {
+	*swiftFileCreationV3
+	fs *swiftVFSV4
+}
+
+func (f *swiftFileCreationV4) Close() (err error) {
+	defer func() {
+		if err != nil {
+			// remove the temporary object if an error occurred
+			_ = f.fs.c.ObjectDelete(f.fs.container, f.name)
+			// If an error has occurred that is not due to the index update, we should
+			// delete the file from the index.
+			_, isCouchErr := couchdb.IsCouchError(err)
+			if !isCouchErr && f.olddoc == nil {
+				_ = f.fs.Indexer.DeleteFileDoc(f.newdoc)
+			}
+		}
+	}()
+
+	if err = f.f.Close(); err != nil {
+		if err == swift.ObjectCorrupted {
+			err = vfs.ErrInvalidHash
+		}
+		if f.meta != nil {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+		if f.err == nil {
+			f.err = err
+		}
+	}
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.w
+
+	if f.meta != nil {
+		if errc := (*f.meta).Close(); errc == nil {
+			vfs.MergeMetadata(newdoc, (*f.meta).Result())
+		}
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	// The actual check of the optionally given md5 hash is handled by the swift
+	// library.
+	if newdoc.MD5Sum == nil {
+		var headers swift.Headers
+		var md5sum []byte
+		headers, err = f.f.Headers()
+		if err != nil {
+			return err
+		}
+		// Etags may be double-quoted
+		etag := strings.Trim(headers["Etag"], `"`)
+		md5sum, err = hex.DecodeString(etag)
+		if err != nil {
+			return err
+		}
+		newdoc.MD5Sum = md5sum
+	}
+
+	if f.size < 0 {
+		newdoc.ByteSize = written
+	}
+
+	if newdoc.ByteSize != written {
+		return vfs.ErrContentLengthMismatch
+	}
+
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+
+	// Check again that a file with the same path does not exist. It can happen
+	// when the same file is uploaded twice in parallel.
+	if olddoc == nil {
+		exists, err := f.fs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	// Keep the temporary object as the blob if the content is new, or just
+	// remove it if the same content is already stored.
+	created, err := vfs.RefBlob(f.fs, newdoc.MD5Sum, newdoc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if created {
+		err = f.fs.c.ObjectMove(f.fs.container, f.name, f.fs.container, MakeBlobName(newdoc.MD5Sum))
+		if err != nil {
+			_, _ = vfs.UnrefBlobs(f.fs, [][]byte{newdoc.MD5Sum})
+			return err
+		}
+	} else {
+		_ = f.fs.c.ObjectDelete(f.fs.container, f.name)
+	}
+
+	var v *vfs.Version
+	if olddoc != nil {
+		v = vfs.NewVersion(olddoc)
+		err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	} else if newdoc.ID() == "" {
+		err = f.fs.Indexer.CreateFileDoc(newdoc)
+	} else {
+		err = f.fs.Indexer.CreateNamedFileDoc(newdoc)
+	}
+	if err != nil {
+		_ = f.fs.unrefBlobs([][]byte{newdoc.MD5Sum})
+		return err
+	}
+
+	// The reference of the old content is kept by the version, or removed if
+	// the version is not kept.
+	if v != nil {
+		var unused [][]byte
+		cleanV, toClean, _ := vfs.FindVersionsToClean(f.fs, newdoc.DocID, v)
+		if !cleanV {
+			if errv := f.fs.Indexer.CreateVersion(v); errv != nil {
+				cleanV = true
+			}
+		}
+		if cleanV {
+			unused = append(unused, v.MD5Sum)
+		}
+		for _, old := range toClean {
+			if errd := f.fs.Indexer.DeleteVersion(old); errd == nil {
+				unused = append(unused, old.MD5Sum)
+			}
+		}
+		_ = f.fs.unrefBlobs(unused)
+	}
+
+	if f.capsize > 0 && f.size >= f.capsize {
+		vfs.PushDiskQuotaAlert(f.fs, true)
+	}
+
+	return nil
+}
+
+var (
+	_ vfs.VFS            = &swiftVFSV4{}
+	_ vfs.PhysicalUsager = &swiftVFSV4{}
+	_ vfs.File           = &swiftFileCreationV4{}
+)
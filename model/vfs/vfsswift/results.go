@@ -0,0 +1,87 @@
+package vfsswift
+
+import (
+	"io"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/ncw/swift"
+)
+
+// The large results of the jobs are stored in the same container as the
+// chunks of the resumable uploads, with a "jobs-results/" prefix.
+const jobResultsPrefix = "jobs-results/"
+
+func (sfs *swiftVFS) CreateJobResult(jobID string) (vfs.ChunkFiler, error) {
+	return createJobResult(sfs.c, sfs.dataContainer, jobID)
+}
+
+func (sfs *swiftVFS) OpenJobResult(jobID string) (io.ReadCloser, error) {
+	return openJobResult(sfs.c, sfs.dataContainer, jobID)
+}
+
+func (sfs *swiftVFS) DeleteJobResult(jobID string) error {
+	return deleteJobResult(sfs.c, sfs.dataContainer, jobID)
+}
+
+func (sfs *swiftVFSV2) CreateJobResult(jobID string) (vfs.ChunkFiler, error) {
+	return createJobResult(sfs.c, sfs.dataContainer, jobID)
+}
+
+func (sfs *swiftVFSV2) OpenJobResult(jobID string) (io.ReadCloser, error) {
+	return openJobResult(sfs.c, sfs.dataContainer, jobID)
+}
+
+func (sfs *swiftVFSV2) DeleteJobResult(jobID string) error {
+	return deleteJobResult(sfs.c, sfs.dataContainer, jobID)
+}
+
+func (sfs *swiftVFSV3) CreateJobResult(jobID string) (vfs.ChunkFiler, error) {
+	return createJobResult(sfs.c, sfs.container, jobID)
+}
+
+func (sfs *swiftVFSV3) OpenJobResult(jobID string) (io.ReadCloser, error) {
+	return openJobResult(sfs.c, sfs.container, jobID)
+}
+
+func (sfs *swiftVFSV3) DeleteJobResult(jobID string) error {
+	return deleteJobResult(sfs.c, sfs.container, jobID)
+}
+
+func createJobResult(c *swift.Connection, container, jobID string) (vfs.ChunkFiler, error) {
+	name := jobResultsPrefix + jobID
+	obj, err := c.ObjectCreate(container, name, true, "", "application/json", nil)
+	if err != nil {
+		if _, _, errc := c.Container(container); errc != swift.ContainerNotFound {
+			return nil, err
+		}
+		if err = c.ContainerCreate(container, nil); err != nil {
+			return nil, err
+		}
+		obj, err = c.ObjectCreate(container, name, true, "", "application/json", nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &thumb{
+		WriteCloser: obj,
+		c:           c,
+		container:   container,
+		name:        name,
+	}, nil
+}
+
+func openJobResult(c *swift.Connection, container, jobID string) (io.ReadCloser, error) {
+	f, _, err := c.ObjectOpen(container, jobResultsPrefix+jobID, false, nil)
+	if err != nil {
+		return nil, wrapSwiftErr(err)
+	}
+	return f, nil
+}
+
+func deleteJobResult(c *swift.Connection, container, jobID string) error {
+	err := c.ObjectDelete(container, jobResultsPrefix+jobID)
+	if err == swift.ObjectNotFound || err == swift.ContainerNotFound {
+		return nil
+	}
+	return err
+}
@@ -31,6 +31,14 @@ func NewThumbsFsV3(c *swift.Connection, db prefixer.Prefixer) vfs.Thumbser {
 	return &thumbsV2{c: c, container: swiftV3ContainerPrefix + db.DBPrefix()}
 }
 
+// NewThumbsFsV4 creates a new thumb filesystem base on swift.
+//
+// The thumbnails are not deduplicated: they are stored like for the V3
+// layout, in the single container of the instance.
+func NewThumbsFsV4(c *swift.Connection, db prefixer.Prefixer) vfs.Thumbser {
+	return &thumbsV2{c: c, container: swiftV4ContainerPrefix + db.DBPrefix()}
+}
+
 type thumbsV2 struct {
 	c         *swift.Connection
 	container string
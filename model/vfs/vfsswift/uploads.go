@@ -0,0 +1,106 @@
+package vfsswift
+
+import (
+	"io"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/ncw/swift"
+)
+
+// The chunks of the resumable uploads are stored in the container of the
+// thumbnails for the V1 and V2 layouts, and in the only container of the
+// instance for the V3 and V4 layouts, with an "uploads/" prefix.
+const uploadsPrefix = "uploads/"
+
+func (sfs *swiftVFS) CreateUploadChunk(uploadID string, offset int64) (vfs.ChunkFiler, error) {
+	return createUploadChunk(sfs.c, sfs.dataContainer, uploadID, offset)
+}
+
+func (sfs *swiftVFS) OpenUploadChunks(uploadID string) (io.ReadCloser, error) {
+	return openUploadChunks(sfs.c, sfs.dataContainer, uploadID)
+}
+
+func (sfs *swiftVFS) DeleteUploadChunks(uploadID string) error {
+	return deleteUploadChunks(sfs.c, sfs.dataContainer, uploadID)
+}
+
+func (sfs *swiftVFSV2) CreateUploadChunk(uploadID string, offset int64) (vfs.ChunkFiler, error) {
+	return createUploadChunk(sfs.c, sfs.dataContainer, uploadID, offset)
+}
+
+func (sfs *swiftVFSV2) OpenUploadChunks(uploadID string) (io.ReadCloser, error) {
+	return openUploadChunks(sfs.c, sfs.dataContainer, uploadID)
+}
+
+func (sfs *swiftVFSV2) DeleteUploadChunks(uploadID string) error {
+	return deleteUploadChunks(sfs.c, sfs.dataContainer, uploadID)
+}
+
+func (sfs *swiftVFSV3) CreateUploadChunk(uploadID string, offset int64) (vfs.ChunkFiler, error) {
+	return createUploadChunk(sfs.c, sfs.container, uploadID, offset)
+}
+
+func (sfs *swiftVFSV3) OpenUploadChunks(uploadID string) (io.ReadCloser, error) {
+	return openUploadChunks(sfs.c, sfs.container, uploadID)
+}
+
+func (sfs *swiftVFSV3) DeleteUploadChunks(uploadID string) error {
+	return deleteUploadChunks(sfs.c, sfs.container, uploadID)
+}
+
+func createUploadChunk(c *swift.Connection, container, uploadID string, offset int64) (vfs.ChunkFiler, error) {
+	name := uploadsPrefix + uploadID + "/" + vfs.UploadChunkName(offset)
+	obj, err := c.ObjectCreate(container, name, true, "", "application/octet-stream", nil)
+	if err != nil {
+		if _, _, errc := c.Container(container); errc != swift.ContainerNotFound {
+			return nil, err
+		}
+		if err = c.ContainerCreate(container, nil); err != nil {
+			return nil, err
+		}
+		obj, err = c.ObjectCreate(container, name, true, "", "application/octet-stream", nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The chunks can be aborted and committed like the thumbnails
+	return &thumb{
+		WriteCloser: obj,
+		c:           c,
+		container:   container,
+		name:        name,
+	}, nil
+}
+
+func uploadChunkNames(c *swift.Connection, container, uploadID string) ([]string, error) {
+	names, err := c.ObjectNamesAll(container, &swift.ObjectsOpts{
+		Prefix: uploadsPrefix + uploadID + "/",
+	})
+	if err == swift.ContainerNotFound {
+		return nil, nil
+	}
+	return names, err
+}
+
+func openUploadChunks(c *swift.Connection, container, uploadID string) (io.ReadCloser, error) {
+	names, err := uploadChunkNames(c, container, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.NewChunksReader(names, func(name string) (io.ReadCloser, error) {
+		f, _, err := c.ObjectOpen(container, name, false, nil)
+		if err != nil {
+			return nil, wrapSwiftErr(err)
+		}
+		return f, nil
+	}), nil
+}
+
+func deleteUploadChunks(c *swift.Connection, container, uploadID string) error {
+	names, err := uploadChunkNames(c, container, uploadID)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	_, err = c.BulkDelete(container, names)
+	return err
+}
@@ -0,0 +1,231 @@
+package appfs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/filetype"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/s3"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// The applications are stored in the bucket with the same layout as in the
+// Swift containers, but the name of the container is used as a prefix for the
+// keys of the objects.
+
+type s3Copier struct {
+	c       *s3.Client
+	bucket  string
+	prefix  string
+	appObj  string
+	tmpObj  string
+	started bool
+}
+
+// NewS3Copier defines a Copier storing data into a S3 bucket.
+func NewS3Copier(c *s3.Client, bucket string, appsType consts.AppType) Copier {
+	return &s3Copier{
+		c:      c,
+		bucket: bucket,
+		prefix: containerName(appsType) + "/",
+	}
+}
+
+func (f *s3Copier) Start(slug, version, shasum string) (bool, error) {
+	f.appObj = f.prefix + path.Join(slug, version)
+	if shasum != "" {
+		f.appObj += "-" + shasum
+	}
+	_, err := f.c.HeadObject(f.bucket, f.appObj)
+	if err == nil {
+		return true, nil
+	}
+	if !s3.IsNotFound(err) {
+		return false, err
+	}
+	f.tmpObj = f.prefix + "tmp-" + utils.RandomString(20) + "/"
+	f.started = true
+	return false, nil
+}
+
+func (f *s3Copier) Copy(stat os.FileInfo, src io.Reader) (err error) {
+	if !f.started {
+		panic("copier should call Start() before Copy()")
+	}
+
+	contentType := filetype.ByExtension(path.Ext(stat.Name()))
+	if contentType == "" {
+		contentType, src = filetype.FromReader(src)
+	}
+
+	w := f.c.NewWriter(f.bucket, path.Join(f.tmpObj, stat.Name()), &s3.PutOptions{
+		ContentType:     contentType,
+		ContentEncoding: "gzip",
+		Metadata: map[string]string{
+			"original-content-length": strconv.FormatInt(stat.Size(), 10),
+		},
+	})
+	defer func() {
+		if err != nil {
+			_ = w.Abort()
+		} else {
+			err = w.Close()
+		}
+	}()
+
+	gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(gw, src); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func (f *s3Copier) Abort() error {
+	return f.c.DeletePrefix(f.bucket, f.tmpObj)
+}
+
+func (f *s3Copier) Commit() (err error) {
+	keys, err := f.c.ListKeys(f.bucket, f.tmpObj)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errc := f.c.DeleteObjects(f.bucket, keys); errc != nil {
+			logger.WithNamespace("appfs").Errorf("Cannot DeleteObjects after commit: %s", errc)
+		}
+	}()
+	// We check if the appObj has not been created concurrently by another
+	// copier.
+	if _, err = f.c.HeadObject(f.bucket, f.appObj); err == nil {
+		return nil
+	}
+	for _, srcKey := range keys {
+		dstKey := path.Join(f.appObj, strings.TrimPrefix(srcKey, f.tmpObj))
+		if _, err = f.c.CopyObject(f.bucket, srcKey, dstKey); err != nil {
+			return err
+		}
+	}
+	_, err = f.c.PutObjectBytes(f.bucket, f.appObj, nil, &s3.PutOptions{ContentType: "text/plain"})
+	return err
+}
+
+type s3Server struct {
+	c      *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3FileServer returns provides the apps.FileServer implementation
+// using the S3 backend as file server.
+func NewS3FileServer(c *s3.Client, bucket string, appsType consts.AppType) FileServer {
+	return &s3Server{
+		c:      c,
+		bucket: bucket,
+		prefix: containerName(appsType) + "/",
+	}
+}
+
+func (s *s3Server) open(key string) (*s3.Object, error) {
+	obj, err := s.c.OpenObject(s.bucket, key)
+	if s3.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	return obj, err
+}
+
+func (s *s3Server) Open(slug, version, shasum, file string) (io.ReadCloser, error) {
+	obj, err := s.open(s.makeObjectName(slug, version, shasum, file))
+	if err != nil {
+		return nil, err
+	}
+	if obj.Info.ContentEncoding == "gzip" {
+		return newGzipReadCloser(obj)
+	}
+	return obj, nil
+}
+
+func (s *s3Server) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, shasum, file string) error {
+	obj, err := s.open(s.makeObjectName(slug, version, shasum, file))
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	if checkETag := req.Header.Get("Cache-Control") == ""; checkETag {
+		etag := obj.Info.ETag
+		if len(etag) > 10 {
+			etag = etag[:10]
+		}
+		etag = fmt.Sprintf(`"%s"`, etag)
+		if utils.CheckPreconditions(w, req, etag) {
+			return nil
+		}
+		w.Header().Set("Etag", etag)
+	}
+
+	var r io.Reader = obj
+	size := obj.Info.Size
+	if obj.Info.ContentEncoding == "gzip" {
+		if acceptGzipEncoding(req) {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else {
+			size, _ = strconv.ParseInt(obj.Info.Metadata["original-content-length"], 10, 64)
+			var gr *gzip.Reader
+			gr, err = gzip.NewReader(obj)
+			if err != nil {
+				return err
+			}
+			defer gr.Close()
+			r = gr
+		}
+	}
+
+	ext := path.Ext(file)
+	contentType := obj.Info.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(ext)
+	}
+	if contentType == "text/xml" && ext == ".svg" {
+		// override for files with text/xml content because of leading <?xml tag
+		contentType = "image/svg+xml"
+	}
+
+	utils.ServeContent(w, req, contentType, size, r)
+	return nil
+}
+
+func (s *s3Server) makeObjectName(slug, version, shasum, file string) string {
+	basepath := path.Join(slug, version)
+	if shasum != "" {
+		basepath += "-" + shasum
+	}
+	return s.prefix + path.Join(basepath, file)
+}
+
+func (s *s3Server) FilesList(slug, version, shasum string) ([]string, error) {
+	prefix := s.makeObjectName(slug, version, shasum, "") + "/"
+	keys, err := s.c.ListKeys(s.bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	filtered := keys[:0]
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, prefix)
+		if k != "" {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered, nil
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/assets/model"
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/s3"
 	"github.com/ncw/swift"
 	"github.com/spf13/afero"
 )
@@ -38,6 +39,13 @@ type swiftFS struct {
 	swiftConn *swift.Connection
 }
 
+// s3FS stores the dynamic assets in the S3 bucket, with the name of the Swift
+// container as a prefix for the keys.
+type s3FS struct {
+	c      *s3.Client
+	bucket string
+}
+
 type aferoFS struct {
 	fs     afero.Fs
 	folder *url.URL
@@ -63,6 +71,8 @@ func InitDynamicAssetFS() error {
 		if err != nil {
 			return err
 		}
+	case config.SchemeS3, config.SchemeS3Secure:
+		assetFS = newS3FS()
 	default:
 		return fmt.Errorf("Invalid scheme %s for dynamic assets FS", scheme)
 	}
@@ -96,6 +106,10 @@ func newswiftFS() (*swiftFS, error) {
 	return swiftFS, nil
 }
 
+func newS3FS() *s3FS {
+	return &s3FS{c: config.GetS3Client(), bucket: config.GetS3Bucket()}
+}
+
 func (a *aferoFS) Add(context, name string, asset *model.Asset) error {
 	filePath := a.GetAssetFolderName(context, name)
 
@@ -248,3 +262,58 @@ func (s *swiftFS) CheckStatus() (time.Duration, error) {
 	}
 	return time.Since(before), nil
 }
+
+func (s *s3FS) key(context, name string) string {
+	return DynamicAssetsContainerName + "/" + path.Join(context, name)
+}
+
+func (s *s3FS) Add(context, name string, asset *model.Asset) error {
+	key := s.key(asset.Context, asset.Name)
+	_, err := s.c.PutObjectBytes(s.bucket, key, asset.GetUnzippedData(), nil)
+	return err
+}
+
+func (s *s3FS) Get(context, name string) ([]byte, error) {
+	content, _, err := s.c.GetObject(s.bucket, s.key(context, name))
+	if s3.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	return content, err
+}
+
+func (s *s3FS) Remove(context, name string) error {
+	return s.c.DeleteObject(s.bucket, s.key(context, name))
+}
+
+func (s *s3FS) List() (map[string][]*model.Asset, error) {
+	objs := map[string][]*model.Asset{}
+
+	prefix := DynamicAssetsContainerName + "/"
+	keys, err := s.c.ListKeys(s.bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		splitted := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)
+		ctx := splitted[0]
+		assetName := model.NormalizeAssetName(splitted[1])
+
+		a, err := GetAsset(ctx, assetName)
+		if err != nil {
+			return nil, err
+		}
+
+		objs[ctx] = append(objs[ctx], a)
+	}
+
+	return objs, nil
+}
+
+func (s *s3FS) CheckStatus() (time.Duration, error) {
+	before := time.Now()
+	if err := s.c.HeadBucket(s.bucket); err != nil {
+		return 0, err
+	}
+	return time.Since(before), nil
+}
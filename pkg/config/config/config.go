@@ -72,6 +72,12 @@ const (
 	// SchemeSwiftSecure is the URL scheme used to configure the swift filesystem
 	// in secure mode (HTTPS).
 	SchemeSwiftSecure = "swift+https"
+	// SchemeS3 is the URL scheme used to configure an S3-compatible
+	// filesystem.
+	SchemeS3 = "s3"
+	// SchemeS3Secure is the URL scheme used to configure an S3-compatible
+	// filesystem in secure mode (HTTPS).
+	SchemeS3Secure = "s3+https"
 )
 
 // defaultAdminSecretFileName is the default name of the file containing the
@@ -105,6 +111,7 @@ type Config struct {
 
 	CredentialsEncryptorKey string
 	CredentialsDecryptorKey string
+	FsEncryptionKey         string
 
 	RemoteAssets map[string]string
 
@@ -143,6 +150,7 @@ type Config struct {
 type Vault struct {
 	credsEncryptor *keymgmt.NACLKey
 	credsDecryptor *keymgmt.NACLKey
+	fsEncryption   *keymgmt.SecretKey
 }
 
 // CredentialsEncryptorKey returns the key used to encrypt credentials values,
@@ -157,6 +165,13 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 	return v.credsDecryptor
 }
 
+// FsEncryptionKey returns the master key used to wrap the keys that encrypt
+// the content of the files of the instances (only for the local file-system).
+// It is nil if the files are not encrypted.
+func (v *Vault) FsEncryptionKey() *keymgmt.SecretKey {
+	return v.fsEncryption
+}
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	Auth          *url.Userinfo
@@ -187,7 +202,11 @@ type Jobs struct {
 	NoWorkers             bool
 	WhiteList             bool
 	Workers               []Worker
+	Weights               map[string]int
 	ImageMagickConvertCmd string
+	// AllowPrivateWebhooks allows the outgoing webhooks to call a loopback or
+	// private address. It is only for development.
+	AllowPrivateWebhooks bool
 	// XXX for retro-compatibility
 	NbWorkers             int
 	DefaultDurationToKeep string
@@ -221,10 +240,11 @@ type Notifications struct {
 
 // Worker contains the configuration fields for a specific worker type.
 type Worker struct {
-	WorkerType   string
-	Concurrency  *int
-	MaxExecCount *int
-	Timeout      *time.Duration
+	WorkerType          string
+	Concurrency         *int
+	InstanceConcurrency *int
+	MaxExecCount        *int
+	Timeout             *time.Duration
 }
 
 // RedisConfig contains the configuration values for a redis system
@@ -577,6 +597,7 @@ func UseViper(v *viper.Viper) error {
 		RedisConfig:           jobsRedis,
 		ImageMagickConvertCmd: v.GetString("jobs.imagemagick_convert_cmd"),
 		DefaultDurationToKeep: v.GetString("jobs.defaultDurationToKeep"),
+		AllowPrivateWebhooks:  build.IsDevRelease() && v.GetBool("jobs.allow_private_webhooks"),
 	}
 	{
 		isWhiteList := v.GetBool("jobs.whitelist")
@@ -604,6 +625,10 @@ func UseViper(v *viper.Viper) error {
 							if concurrency, ok := v.(int); ok {
 								w.Concurrency = &concurrency
 							}
+						case "instance_concurrency":
+							if concurrency, ok := v.(int); ok {
+								w.InstanceConcurrency = &concurrency
+							}
 						case "max_exec_count":
 							if maxExecCount, ok := v.(int); ok {
 								w.MaxExecCount = &maxExecCount
@@ -632,6 +657,18 @@ func UseViper(v *viper.Viper) error {
 			}
 			jobs.Workers = workers
 		}
+		if weightsMap := v.GetStringMap("jobs.weights"); len(weightsMap) > 0 {
+			weights := make(map[string]int, len(weightsMap))
+			for contextName, weight := range weightsMap {
+				w, ok := weight.(int)
+				if !ok || w <= 0 {
+					return fmt.Errorf("config: expecting a positive integer in the key %q",
+						"jobs.weights."+contextName)
+				}
+				weights[contextName] = w
+			}
+			jobs.Weights = weights
+		}
 	}
 
 	// Use the layout v3 (value 2) for missing/invalid value
@@ -666,6 +703,7 @@ func UseViper(v *viper.Viper) error {
 
 		CredentialsEncryptorKey: v.GetString("vault.credentials_encryptor_key"),
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
+		FsEncryptionKey:         v.GetString("vault.fs_encryption_key"),
 
 		Fs: Fs{
 			URL:           fsURL,
@@ -773,6 +811,18 @@ func MakeVault(c *Config) error {
 		}
 	}
 
+	var fsEncryption *keymgmt.SecretKey
+	if fsEncryptionKey := config.FsEncryptionKey; fsEncryptionKey != "" {
+		keyBytes, err := ioutil.ReadFile(fsEncryptionKey)
+		if err != nil {
+			return err
+		}
+		fsEncryption, err = keymgmt.UnmarshalSecretKey(keyBytes)
+		if err != nil {
+			return err
+		}
+	}
+
 	if credsEncryptor == nil && credsDecryptor == nil {
 		// XXX For build instance, it is practical to not have to manually
 		// setup credentials for the vault. In that case, if the user does not
@@ -784,6 +834,7 @@ func MakeVault(c *Config) error {
 		// should not be used to store sensible data. But for development, it
 		// should be enough.
 		if !build.IsDevRelease() {
+			vault = &Vault{fsEncryption: fsEncryption}
 			return nil
 		}
 		var err error
@@ -797,6 +848,7 @@ func MakeVault(c *Config) error {
 	vault = &Vault{
 		credsEncryptor: credsEncryptor,
 		credsDecryptor: credsDecryptor,
+		fsEncryption:   fsEncryption,
 	}
 	return nil
 }
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+var s3Client *s3.Client
+var s3Bucket string
+
+// InitDefaultS3Client initializes the default S3 client.
+func InitDefaultS3Client() error {
+	return InitS3Client(config.Fs)
+}
+
+// InitS3Client initializes the global S3 client, and creates the bucket if it
+// does not exist. This is not a thread-safe method.
+//
+// The URL is like s3+https://host:port/bucket?AccessKey=...&SecretKey=...
+// The region and the size of the parts for the multipart uploads can be given
+// with the Region and PartSize parameters.
+func InitS3Client(fs Fs) error {
+	fsURL := fs.URL
+	if fsURL.Scheme != SchemeS3 && fsURL.Scheme != SchemeS3Secure {
+		return nil
+	}
+
+	bucket := strings.Trim(fsURL.Path, "/")
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return errors.New("s3: the bucket must be given as the path of the URL")
+	}
+
+	q := fsURL.Query()
+	endpoint := &url.URL{Scheme: "http", Host: fsURL.Host}
+	if fsURL.Scheme == SchemeS3Secure {
+		endpoint.Scheme = "https"
+	}
+	var partSize int64
+	if size := q.Get("PartSize"); size != "" {
+		var err error
+		if partSize, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return err
+		}
+	}
+
+	s3Client = s3.New(s3.Options{
+		Endpoint:  endpoint,
+		Region:    q.Get("Region"),
+		AccessKey: q.Get("AccessKey"),
+		SecretKey: q.Get("SecretKey"),
+		Transport: fs.Transport,
+		PartSize:  partSize,
+	})
+	s3Bucket = bucket
+
+	if err := s3Client.EnsureBucket(s3Bucket); err != nil {
+		log.Errorf("Cannot use the bucket %s on the S3 server %s: %s",
+			s3Bucket, endpoint.Host, err)
+		return err
+	}
+	log.Infof("Successfully connected to the S3 server %s", endpoint.Host)
+	return nil
+}
+
+// GetS3Client returns the S3 client created from the actual configuration.
+func GetS3Client() *s3.Client {
+	if s3Client == nil {
+		panic("Called GetS3Client() before InitS3Client()")
+	}
+	return s3Client
+}
+
+// GetS3Bucket returns the name of the bucket where the files are stored.
+func GetS3Bucket() string {
+	return s3Bucket
+}
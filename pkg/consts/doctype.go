@@ -29,11 +29,25 @@ const (
 	FilesMetadata = "io.cozy.files.metadata"
 	// FilesVersions doc type for versioning file contents
 	FilesVersions = "io.cozy.files.versions"
+	// FilesUploads doc type for the sessions of the resumable uploads
+	FilesUploads = "io.cozy.files.uploads"
+	// FilesBlobs doc type for counting the references to the contents stored
+	// with a content-addressed layout
+	FilesBlobs = "io.cozy.files.blobs"
+	// FilesSearchIndex doc type for the entries of the full-text search index
+	// of the files
+	FilesSearchIndex = "io.cozy.files.search"
 	// FilesShortcuts doc type for high-level information about .url files
 	FilesShortcuts = "io.cozy.files.shortcuts"
+	// FilesRepairs doc type for the journal of the repairs made after a file
+	// system check
+	FilesRepairs = "io.cozy.files.repairs"
 	// Thumbnails is a synthetic doctype for thumbnails, used for realtime
 	// events
 	Thumbnails = "io.cozy.files.thumbnails"
+	// FilesCopies is a synthetic doctype for the progress of the copy of a
+	// directory, used for realtime events
+	FilesCopies = "io.cozy.files.copies"
 	// PhotosAlbums doc type for photos albums
 	PhotosAlbums = "io.cozy.photos.albums"
 	// Intents doc type for intents persisted in couchdb
@@ -42,6 +56,11 @@ const (
 	Jobs = "io.cozy.jobs"
 	// JobEvents doc type for real time events sent by jobs
 	JobEvents = "io.cozy.jobs.events"
+	// JobsWorkflows doc type for the workflows of chained jobs
+	JobsWorkflows = "io.cozy.jobs.workflows"
+	// JobsDeadLetters doc type for the jobs that have failed after all their
+	// retries
+	JobsDeadLetters = "io.cozy.jobs.dead_letters"
 	// Notifications doc type for notifications
 	Notifications = "io.cozy.notifications"
 	// OAuthAccessCodes doc type for OAuth2 access codes
@@ -99,4 +118,7 @@ const (
 	NotesEvents = "io.cozy.notes.events"
 	// NotesURL doc type is used to return the URL where a note can be edited.
 	NotesURL = "io.cozy.notes.url"
+	// Presence doc type is used for the realtime events about the users that
+	// are viewing or editing a document.
+	Presence = "io.cozy.presence"
 )
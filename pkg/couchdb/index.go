@@ -7,7 +7,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 27
+const IndexViewsVersion int = 28
 
 // Indexes is the index list required by an instance to run properly.
 var Indexes = []*mango.Index{
@@ -71,6 +71,21 @@ function(doc) {
 	Reduce: "_sum",
 }
 
+// BlobsDiskUsageView is the view used for computing the space really used by
+// the contents of the files for the content-addressed layouts. It is not in
+// the list of views created for all the instances, as most of them don't have
+// such a layout: it is defined on the first use.
+var BlobsDiskUsageView = &View{
+	Name:    "blobs-disk-usage",
+	Doctype: consts.FilesBlobs,
+	Map: `
+function(doc) {
+  emit(doc._id, +doc.size);
+}
+`,
+	Reduce: "_sum",
+}
+
 // FilesReferencedByView is the view used for fetching files referenced by a
 // given document
 var FilesReferencedByView = &View{
@@ -228,6 +243,34 @@ function(doc) {
 `,
 }
 
+// FilesSearchByTermView is the inverted index used by the full-text search:
+// it emits the terms of the indexed files, with their weight as value.
+var FilesSearchByTermView = &View{
+	Name:    "search-by-term",
+	Doctype: consts.FilesSearchIndex,
+	Map: `
+function(doc) {
+  if (doc.terms) {
+    Object.keys(doc.terms).forEach(function(t) {
+      emit(t, doc.terms[t]);
+    });
+  }
+}`,
+}
+
+// TriggersByWebhookTokenView is used to find a @webhook trigger from the
+// token of its URL.
+var TriggersByWebhookTokenView = &View{
+	Name:    "triggers-by-webhook-token",
+	Doctype: consts.Triggers,
+	Map: `
+function(doc) {
+  if (doc.type === "@webhook" && doc.webhook && doc.webhook.token) {
+    emit(doc.webhook.token);
+  }
+}`,
+}
+
 // Views is the list of all views that are created by the stack.
 var Views = []*View{
 	DiskUsageView,
@@ -242,6 +285,8 @@ var Views = []*View{
 	SharedDocsBySharingID,
 	SharingsByDocTypeView,
 	ContactByEmail,
+	FilesSearchByTermView,
+	TriggersByWebhookTokenView,
 }
 
 // ViewsByDoctype returns the list of views for a specified doc type.
@@ -295,10 +340,27 @@ function(doc) {
 `,
 }
 
+// DeadLettersView is used to list the dead letters of the jobs, sorted by
+// date of failure, for all the instances, for a domain, for a worker, or for
+// a domain and a worker.
+var DeadLettersView = &View{
+	Name:    "dead-letters",
+	Doctype: consts.JobsDeadLetters,
+	Map: `
+function(doc) {
+  emit(["all", "", doc.failed_at]);
+  emit(["domain", doc.domain, doc.failed_at]);
+  emit(["worker", doc.worker, doc.failed_at]);
+  emit(["domain-worker", doc.domain + "/" + doc.worker, doc.failed_at]);
+}
+`,
+}
+
 // globalViews is the list of all views that are created by the stack on the
 // global databases.
 var globalViews = []*View{
 	DomainAndAliasesView,
+	DeadLettersView,
 }
 
 // InitGlobalDB defines views and indexes on the global databases. It is called
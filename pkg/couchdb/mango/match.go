@@ -0,0 +1,356 @@
+package mango
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The operators below are only used by the selectors evaluated in memory
+
+// eq ($eq) checks that field == value
+const eq ValueOperator = "$eq"
+
+// in ($in) checks that the field is one of the values
+const in ValueOperator = "$in"
+
+// nin ($nin) checks that the field is none of the values
+const nin ValueOperator = "$nin"
+
+// regex ($regex) checks that the field matches a regular expression
+const regex ValueOperator = "$regex"
+
+// changed ($changed) is not a mango operator, but an extension of the stack:
+// it checks that the value of the field is not the same in the old version of
+// the document.
+const changed ValueOperator = "$changed"
+
+// ErrInvalidSelector is used when a selector cannot be evaluated in memory.
+var ErrInvalidSelector = errors.New("mango: invalid selector")
+
+// Selector is a mango selector compiled to be evaluated in memory, against a
+// document and optionally its previous version. It supports the logic
+// operators, $eq, $ne, $gt, $gte, $lt, $lte, $exists, $in, $nin, $regex and
+// $changed. The values can only be compared if they have the same JSON type,
+// except for the numbers in strings that can be compared to numbers.
+type Selector struct {
+	match matcher
+}
+
+// matcher returns true if the document (with its old version, that can be
+// nil) matches a part of a selector.
+type matcher func(doc, old map[string]interface{}) bool
+
+// NewSelector compiles the given mango selector.
+func NewSelector(selector Map) (*Selector, error) {
+	m, err := compileSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return &Selector{match: m}, nil
+}
+
+// Match returns true if the document matches the selector. The old version of
+// the document is only used by the $changed operator, and if it is nil, all
+// the fields are seen as changed.
+func (s *Selector) Match(doc, old map[string]interface{}) bool {
+	return s.match(doc, old)
+}
+
+func compileSelector(selector map[string]interface{}) (matcher, error) {
+	var matchers []matcher
+	for key, value := range selector {
+		var m matcher
+		var err error
+		switch LogicOperator(key) {
+		case and, or, nor:
+			m, err = compileLogic(LogicOperator(key), value)
+		case not:
+			sub, ok := asMap(value)
+			if !ok {
+				return nil, ErrInvalidSelector
+			}
+			var inner matcher
+			if inner, err = compileSelector(sub); err == nil {
+				m = func(doc, old map[string]interface{}) bool { return !inner(doc, old) }
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, ErrInvalidSelector
+			}
+			m, err = compileField(strings.Split(key, "."), value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return allOf(matchers), nil
+}
+
+func compileLogic(op LogicOperator, value interface{}) (matcher, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		if maps, isMaps := value.([]Map); isMaps {
+			for _, m := range maps {
+				list = append(list, m)
+			}
+		} else {
+			return nil, ErrInvalidSelector
+		}
+	}
+	matchers := make([]matcher, len(list))
+	for i, item := range list {
+		sub, ok := asMap(item)
+		if !ok {
+			return nil, ErrInvalidSelector
+		}
+		m, err := compileSelector(sub)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	switch op {
+	case and:
+		return allOf(matchers), nil
+	case or:
+		return anyOf(matchers), nil
+	default: // nor
+		some := anyOf(matchers)
+		return func(doc, old map[string]interface{}) bool { return !some(doc, old) }, nil
+	}
+}
+
+func compileField(path []string, value interface{}) (matcher, error) {
+	sub, ok := asMap(value)
+	if !ok {
+		return compileOperator(path, eq, value)
+	}
+	var matchers []matcher
+	for key, v := range sub {
+		var m matcher
+		var err error
+		if strings.HasPrefix(key, "$") {
+			m, err = compileOperator(path, ValueOperator(key), v)
+		} else {
+			// Nested field, like {"metadata": {"width": 800}}
+			m, err = compileField(append(path[:len(path):len(path)], strings.Split(key, ".")...), v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return allOf(matchers), nil
+}
+
+func compileOperator(path []string, op ValueOperator, value interface{}) (matcher, error) {
+	switch op {
+	case eq:
+		return fieldMatcher(path, func(v interface{}) bool { return equal(v, value) }), nil
+	case ne:
+		return fieldMatcher(path, func(v interface{}) bool { return !equal(v, value) }), nil
+	case gt, gte, lt, lte:
+		return fieldMatcher(path, func(v interface{}) bool {
+			cmp, ok := compare(v, value)
+			if !ok {
+				return false
+			}
+			switch op {
+			case gt:
+				return cmp > 0
+			case gte:
+				return cmp >= 0
+			case lt:
+				return cmp < 0
+			default:
+				return cmp <= 0
+			}
+		}), nil
+	case in, nin:
+		values, ok := value.([]interface{})
+		if !ok {
+			return nil, ErrInvalidSelector
+		}
+		return fieldMatcher(path, func(v interface{}) bool {
+			found := false
+			for _, val := range values {
+				if equal(v, val) {
+					found = true
+					break
+				}
+			}
+			return found == (op == in)
+		}), nil
+	case regex:
+		pattern, ok := value.(string)
+		if !ok {
+			return nil, ErrInvalidSelector
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, ErrInvalidSelector
+		}
+		return fieldMatcher(path, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		}), nil
+	case exists:
+		expected, ok := value.(bool)
+		if !ok {
+			return nil, ErrInvalidSelector
+		}
+		return func(doc, _ map[string]interface{}) bool {
+			_, found := getField(doc, path)
+			return found == expected
+		}, nil
+	case changed:
+		expected, ok := value.(bool)
+		if !ok {
+			return nil, ErrInvalidSelector
+		}
+		return func(doc, old map[string]interface{}) bool {
+			if old == nil {
+				return expected
+			}
+			v, found := getField(doc, path)
+			oldV, oldFound := getField(old, path)
+			same := found == oldFound && equal(v, oldV)
+			return same != expected
+		}, nil
+	case ValueOperator(not):
+		sub, ok := asMap(value)
+		if !ok {
+			return nil, ErrInvalidSelector
+		}
+		inner, err := compileField(path, sub)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc, old map[string]interface{}) bool { return !inner(doc, old) }, nil
+	}
+	return nil, ErrInvalidSelector
+}
+
+// fieldMatcher returns a matcher that checks the value of a field. A missing
+// field never matches.
+func fieldMatcher(path []string, fn func(v interface{}) bool) matcher {
+	return func(doc, _ map[string]interface{}) bool {
+		v, ok := getField(doc, path)
+		return ok && fn(v)
+	}
+}
+
+func allOf(matchers []matcher) matcher {
+	return func(doc, old map[string]interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc, old) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func anyOf(matchers []matcher) matcher {
+	return func(doc, old map[string]interface{}) bool {
+		for _, m := range matchers {
+			if m(doc, old) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func getField(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, key := range path {
+		m, ok := asMap(current)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case Map:
+		return v, true
+	}
+	return nil, false
+}
+
+// toFloat converts the numbers to float64, as they are decoded from JSON.
+// The strings with a number are also converted, as some fields like the size
+// of the files are serialized as strings.
+func toFloat(v interface{}) (float64, bool) {
+	if s, ok := v.(string); ok {
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// compare returns -1, 0 or 1 if a is lower, equal or greater than b. The
+// boolean is false if the values cannot be compared.
+func compare(a, b interface{}) (int, bool) {
+	// Two strings are compared as strings, even if they have numbers
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return strings.Compare(sa, sb), true
+		}
+	}
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	if ba, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case ba == bb:
+			return 0, true
+		case bb:
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func equal(a, b interface{}) bool {
+	if cmp, ok := compare(a, b); ok {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
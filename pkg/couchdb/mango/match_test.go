@@ -0,0 +1,104 @@
+package mango
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseSelector(t *testing.T, s string) *Selector {
+	var m Map
+	if !assert.NoError(t, json.Unmarshal([]byte(s), &m)) {
+		t.FailNow()
+	}
+	selector, err := NewSelector(m)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return selector
+}
+
+func parseDoc(t *testing.T, s string) map[string]interface{} {
+	var doc map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal([]byte(s), &doc)) {
+		t.FailNow()
+	}
+	return doc
+}
+
+func TestSelectorMatch(t *testing.T) {
+	doc := parseDoc(t, `{
+		"type": "file",
+		"class": "image",
+		"size": 2000000,
+		"bytes": "2000000",
+		"tags": ["holidays"],
+		"metadata": {"width": 800, "height": 600}
+	}`)
+
+	tests := []struct {
+		selector string
+		match    bool
+	}{
+		{`{}`, true},
+		{`{"class": "image"}`, true},
+		{`{"class": "pdf"}`, false},
+		{`{"class": "image", "size": {"$gt": 1000000}}`, true},
+		{`{"class": "image", "size": {"$lte": 1000000}}`, false},
+		{`{"size": {"$gte": 2000000, "$lt": 3000000}}`, true},
+		{`{"size": {"$gt": true}}`, false},
+		{`{"bytes": {"$gt": 1000000}}`, true},
+		{`{"bytes": {"$gt": "9"}}`, false},
+		{`{"metadata.width": 800}`, true},
+		{`{"metadata": {"height": {"$lt": 500}}}`, false},
+		{`{"class": {"$in": ["image", "video"]}}`, true},
+		{`{"class": {"$nin": ["image", "video"]}}`, false},
+		{`{"class": {"$ne": "pdf"}}`, true},
+		{`{"name": {"$exists": false}}`, true},
+		{`{"name": {"$ne": "foo"}}`, false},
+		{`{"class": {"$regex": "^im"}}`, true},
+		{`{"tags": ["holidays"]}`, true},
+		{`{"$or": [{"class": "pdf"}, {"size": {"$gt": 1}}]}`, true},
+		{`{"$nor": [{"class": "pdf"}, {"size": {"$gt": 1}}]}`, false},
+		{`{"$not": {"class": "pdf"}}`, true},
+		{`{"class": {"$not": {"$eq": "image"}}}`, false},
+	}
+	for _, test := range tests {
+		selector := parseSelector(t, test.selector)
+		assert.Equal(t, test.match, selector.Match(doc, nil), test.selector)
+	}
+
+	for _, invalid := range []string{
+		`{"$foo": 1}`,
+		`{"class": {"$foo": 1}}`,
+		`{"$or": {"class": "image"}}`,
+		`{"class": {"$in": "image"}}`,
+		`{"class": {"$regex": "("}}`,
+		`{"name": {"$changed": "yes"}}`,
+	} {
+		var m Map
+		assert.NoError(t, json.Unmarshal([]byte(invalid), &m))
+		_, err := NewSelector(m)
+		assert.Equal(t, ErrInvalidSelector, err, invalid)
+	}
+}
+
+func TestSelectorChanged(t *testing.T) {
+	old := parseDoc(t, `{"name": "foo.jpg", "dir_id": "a", "metadata": {"width": 800}}`)
+	renamed := parseDoc(t, `{"name": "bar.jpg", "dir_id": "a", "metadata": {"width": 800}}`)
+	moved := parseDoc(t, `{"name": "foo.jpg", "dir_id": "b"}`)
+
+	selector := parseSelector(t, `{"name": {"$changed": true}}`)
+	assert.True(t, selector.Match(renamed, old))
+	assert.False(t, selector.Match(moved, old))
+	assert.True(t, selector.Match(moved, nil))
+
+	selector = parseSelector(t, `{"metadata.width": {"$changed": true}}`)
+	assert.False(t, selector.Match(renamed, old))
+	assert.True(t, selector.Match(moved, old))
+
+	selector = parseSelector(t, `{"dir_id": {"$changed": false}, "name": {"$regex": "\\.jpg$"}}`)
+	assert.True(t, selector.Match(renamed, old))
+	assert.False(t, selector.Match(moved, old))
+}
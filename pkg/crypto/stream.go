@@ -0,0 +1,315 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// The encrypted streams are made of a header followed by chunks. The header
+// has a magic string, the identifier of the key and a random salt used to
+// derive a key specific to this stream. Each chunk has up to
+// StreamChunkSize bytes of plaintext, encrypted with AES-256-GCM. The nonce
+// is the index of the chunk, and the last chunk is flagged in the additional
+// data to detect truncations. As the chunks have a fixed size, it is possible
+// to decrypt any part of the stream without reading what is before it.
+const (
+	// StreamChunkSize is the size of the plaintext in a chunk of an encrypted
+	// stream.
+	StreamChunkSize = 64 * 1024
+	// StreamKeyIDLen is the length of the identifier of a key.
+	StreamKeyIDLen = 8
+
+	streamSaltLen    = 32
+	streamTagLen     = 16
+	streamHeaderLen  = len(streamMagic) + StreamKeyIDLen + streamSaltLen
+	streamCipherSize = StreamChunkSize + streamTagLen
+)
+
+const streamMagic = "COZYENC1"
+
+var (
+	// ErrStreamKeyMismatch is used when a stream has not been encrypted with
+	// the given key.
+	ErrStreamKeyMismatch = errors.New("crypto: the stream has been encrypted with another key")
+	// ErrStreamCorrupted is used when a stream cannot be decrypted.
+	ErrStreamCorrupted = errors.New("crypto: the encrypted stream is corrupted")
+)
+
+// StreamKeyID returns the identifier of a key, as written in the header of
+// the streams encrypted with it.
+func StreamKeyID(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte("cozy-stream-key-id"))
+	return h.Sum(nil)[:StreamKeyIDLen]
+}
+
+// ReadStreamKeyID returns the identifier of the key used to encrypt the
+// stream, or nil if the stream is not encrypted.
+func ReadStreamKeyID(r io.ReaderAt) ([]byte, error) {
+	header := make([]byte, streamHeaderLen)
+	n, err := r.ReadAt(header, 0)
+	if n < streamHeaderLen {
+		if err == io.EOF || err == nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(streamMagic)], []byte(streamMagic)) {
+		return nil, nil
+	}
+	return header[len(streamMagic) : len(streamMagic)+StreamKeyIDLen], nil
+}
+
+// StreamPlainSize returns the size of the plaintext for an encrypted stream
+// of the given size.
+func StreamPlainSize(cipherSize int64) int64 {
+	body := cipherSize - int64(streamHeaderLen)
+	if body <= 0 {
+		return 0
+	}
+	chunks := (body + streamCipherSize - 1) / streamCipherSize
+	return body - chunks*streamTagLen
+}
+
+func newStreamAEAD(key, salt []byte) (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(salt)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func streamNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+func streamAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// StreamWriter encrypts the data written to it, and writes them to the
+// underlying writer. It must be closed to write the last chunk.
+type StreamWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	index  int64
+	closed bool
+}
+
+// NewStreamWriter returns a writer that encrypts the data with the given key
+// (32 bytes) before writing them to w.
+func NewStreamWriter(w io.Writer, key []byte) (*StreamWriter, error) {
+	salt := GenerateRandomBytes(streamSaltLen)
+	aead, err := newStreamAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, streamHeaderLen)
+	header = append(header, streamMagic...)
+	header = append(header, StreamKeyID(key)...)
+	header = append(header, salt...)
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &StreamWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, StreamChunkSize),
+	}, nil
+}
+
+// Write encrypts the data in p. The last chunk is kept in memory until the
+// writer is closed.
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == StreamChunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := StreamChunkSize - len(s.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *StreamWriter) flush(last bool) error {
+	nonce := streamNonce(s.aead, s.index)
+	sealed := s.aead.Seal(nil, nonce, s.buf, streamAdditionalData(last))
+	s.buf = s.buf[:0]
+	s.index++
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close writes the last chunk. It does not close the underlying writer.
+func (s *StreamWriter) Close() error {
+	if s.closed {
+		return os.ErrClosed
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+// StreamReader decrypts an encrypted stream. It implements io.Reader,
+// io.ReaderAt and io.Seeker, with the offsets in the plaintext.
+type StreamReader struct {
+	r          io.ReaderAt
+	aead       cipher.AEAD
+	cipherSize int64
+	plainSize  int64
+	offset     int64
+
+	// the last decrypted chunk
+	index int64
+	chunk []byte
+}
+
+// NewStreamReader returns a reader for the encrypted stream r, of the given
+// size, that has been encrypted with the given key.
+func NewStreamReader(r io.ReaderAt, cipherSize int64, key []byte) (*StreamReader, error) {
+	header := make([]byte, streamHeaderLen)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrStreamCorrupted
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(streamMagic)], []byte(streamMagic)) {
+		return nil, ErrStreamCorrupted
+	}
+	keyID := header[len(streamMagic) : len(streamMagic)+StreamKeyIDLen]
+	if !hmac.Equal(keyID, StreamKeyID(key)) {
+		return nil, ErrStreamKeyMismatch
+	}
+	if cipherSize < int64(streamHeaderLen+streamTagLen) {
+		return nil, ErrStreamCorrupted
+	}
+	aead, err := newStreamAEAD(key, header[len(streamMagic)+StreamKeyIDLen:])
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader{
+		r:          r,
+		aead:       aead,
+		cipherSize: cipherSize,
+		plainSize:  StreamPlainSize(cipherSize),
+		index:      -1,
+	}, nil
+}
+
+// Size returns the size of the plaintext.
+func (s *StreamReader) Size() int64 {
+	return s.plainSize
+}
+
+func (s *StreamReader) loadChunk(index int64) error {
+	if index == s.index {
+		return nil
+	}
+	start := int64(streamHeaderLen) + index*streamCipherSize
+	end := start + streamCipherSize
+	if end > s.cipherSize {
+		end = s.cipherSize
+	}
+	if end-start < streamTagLen {
+		return ErrStreamCorrupted
+	}
+	sealed := make([]byte, end-start)
+	if _, err := s.r.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return err
+	}
+	nonce := streamNonce(s.aead, index)
+	last := end == s.cipherSize
+	chunk, err := s.aead.Open(sealed[:0], nonce, sealed, streamAdditionalData(last))
+	if err != nil {
+		return ErrStreamCorrupted
+	}
+	s.index = index
+	s.chunk = chunk
+	return nil
+}
+
+// ReadAt reads len(p) bytes of plaintext, starting at the offset off.
+func (s *StreamReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	read := 0
+	for len(p) > 0 {
+		if off >= s.plainSize {
+			return read, io.EOF
+		}
+		index := off / StreamChunkSize
+		if err := s.loadChunk(index); err != nil {
+			return read, err
+		}
+		start := off - index*StreamChunkSize
+		if start >= int64(len(s.chunk)) {
+			return read, ErrStreamCorrupted
+		}
+		n := copy(p, s.chunk[start:])
+		p = p[n:]
+		off += int64(n)
+		read += n
+	}
+	return read, nil
+}
+
+// Read reads up to len(p) bytes of plaintext.
+func (s *StreamReader) Read(p []byte) (int, error) {
+	if s.offset >= s.plainSize {
+		return 0, io.EOF
+	}
+	if remaining := s.plainSize - s.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := s.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (s *StreamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.plainSize
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	s.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptStream(t *testing.T, key, plain []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := NewStreamWriter(buf, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Write in small pieces to cross the chunk boundaries
+	for len(plain) > 0 {
+		n := 1000
+		if n > len(plain) {
+			n = len(plain)
+		}
+		_, err = w.Write(plain[:n])
+		assert.NoError(t, err)
+		plain = plain[n:]
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestStreamEncryption(t *testing.T) {
+	key := GenerateRandomBytes(32)
+	for _, size := range []int{0, 1, 1000, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 42} {
+		plain := GenerateRandomBytes(size)
+		encrypted := encryptStream(t, key, plain)
+		assert.Equal(t, int64(size), StreamPlainSize(int64(len(encrypted))))
+
+		keyID, err := ReadStreamKeyID(bytes.NewReader(encrypted))
+		assert.NoError(t, err)
+		assert.Equal(t, StreamKeyID(key), keyID)
+
+		r, err := NewStreamReader(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, int64(size), r.Size())
+		decrypted, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plain, decrypted))
+
+		if size > 100 {
+			off := int64(size - 50)
+			_, err = r.Seek(off, io.SeekStart)
+			assert.NoError(t, err)
+			end, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, plain[off:], end)
+
+			part := make([]byte, 30)
+			n, err := r.ReadAt(part, 10)
+			assert.NoError(t, err)
+			assert.Equal(t, 30, n)
+			assert.Equal(t, plain[10:40], part)
+		}
+	}
+}
+
+func TestStreamNotEncrypted(t *testing.T) {
+	keyID, err := ReadStreamKeyID(bytes.NewReader([]byte("foobar")))
+	assert.NoError(t, err)
+	assert.Nil(t, keyID)
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	key := GenerateRandomBytes(32)
+	encrypted := encryptStream(t, key, []byte("foobar"))
+	other := GenerateRandomBytes(32)
+	_, err := NewStreamReader(bytes.NewReader(encrypted), int64(len(encrypted)), other)
+	assert.Equal(t, ErrStreamKeyMismatch, err)
+}
+
+func TestStreamTruncated(t *testing.T) {
+	key := GenerateRandomBytes(32)
+	plain := GenerateRandomBytes(2 * StreamChunkSize)
+	encrypted := encryptStream(t, key, plain)
+	truncated := encrypted[:len(encrypted)-streamCipherSize]
+	r, err := NewStreamReader(bytes.NewReader(truncated), int64(len(truncated)), key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrStreamCorrupted, err)
+
+	encrypted[len(encrypted)-1] ^= 0xff
+	r, err = NewStreamReader(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrStreamCorrupted, err)
+}
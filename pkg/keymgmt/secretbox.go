@@ -0,0 +1,94 @@
+package keymgmt
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	secretKeyBlockType = "NACL SECRET KEY"
+
+	secretKeyLen   = 32
+	secretNonceLen = 24
+)
+
+var (
+	errSecretBadKey  = errors.New("keymgmt: bad secret key")
+	errSecretCorrupt = errors.New("keymgmt: cannot open the sealed value")
+)
+
+// SecretKey is a symmetric key that can be used to wrap other keys, with the
+// nacl secretbox API.
+type SecretKey struct {
+	key *[secretKeyLen]byte
+}
+
+// GenerateSecretKey returns a new secret key.
+func GenerateSecretKey(r io.Reader) (*SecretKey, error) {
+	key := new([secretKeyLen]byte)
+	if _, err := io.ReadFull(r, key[:]); err != nil {
+		return nil, err
+	}
+	return &SecretKey{key}, nil
+}
+
+// GenerateEncodedSecretKey returns the encoded value of a freshly generated
+// secret key.
+func GenerateEncodedSecretKey() ([]byte, error) {
+	key, err := GenerateSecretKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalSecretKey(key), nil
+}
+
+// UnmarshalSecretKey takes an encoded value of a secret key and returns the
+// associated key.
+func UnmarshalSecretKey(marshaledKey []byte) (*SecretKey, error) {
+	keyBytes, err := unmarshalPEMBlock(marshaledKey, secretKeyBlockType)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) != secretKeyLen {
+		return nil, errSecretBadKey
+	}
+	key := new([secretKeyLen]byte)
+	copy(key[:], keyBytes)
+	return &SecretKey{key}, nil
+}
+
+// MarshalSecretKey takes a secret key and returns its encoded version.
+func MarshalSecretKey(key *SecretKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  secretKeyBlockType,
+		Bytes: key.key[:],
+	})
+}
+
+// Seal encrypts and authenticates the given value (typically another key).
+// The nonce is prepended to the result.
+func (k *SecretKey) Seal(value []byte) []byte {
+	var nonce [secretNonceLen]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+	return secretbox.Seal(nonce[:], value, &nonce, k.key)
+}
+
+// Open decrypts a value sealed with the Seal method.
+func (k *SecretKey) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < secretNonceLen {
+		return nil, errSecretCorrupt
+	}
+	var nonce [secretNonceLen]byte
+	copy(nonce[:], sealed[:secretNonceLen])
+	value, ok := secretbox.Open(nil, sealed[secretNonceLen:], &nonce, k.key)
+	if !ok {
+		return nil, errSecretCorrupt
+	}
+	return value, nil
+}
@@ -64,6 +64,11 @@ const (
 	SendHintByMail
 	// JobNotesPersistType is used for saving notes to the VFS
 	JobNotesPersistType
+	// JobWebhookType is used for counting the calls to a @webhook trigger
+	JobWebhookType
+	// JobWebhookFailureType is used for counting the calls to a @webhook
+	// trigger with an invalid signature
+	JobWebhookFailureType
 )
 
 type counterConfig struct {
@@ -175,6 +180,18 @@ var configs = []counterConfig{
 		Limit:  100,
 		Period: 1 * time.Hour,
 	},
+	// JobWebhookType
+	{
+		Prefix: "job-webhook",
+		Limit:  100,
+		Period: 1 * time.Hour,
+	},
+	// JobWebhookFailureType
+	{
+		Prefix: "job-webhook-failure",
+		Limit:  100,
+		Period: 1 * time.Hour,
+	},
 }
 
 // Counter is an interface for counting number of attempts that can be used to
@@ -0,0 +1,114 @@
+package presence
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// memStore is the store used when there is no redis: the sessions are kept
+// in memory, by database prefix and key of the document.
+type memStore struct {
+	mu       sync.Mutex
+	sessions map[string]map[string]*entry
+}
+
+func newMemStore() *memStore {
+	return &memStore{sessions: make(map[string]map[string]*entry)}
+}
+
+func memKey(db prefixer.Prefixer, doctype, id string) string {
+	return db.DBPrefix() + ":" + Key(doctype, id)
+}
+
+func (m *memStore) Put(db prefixer.Prefixer, s *Session, owner string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memKey(db, s.Type, s.DocID)
+	sessions, ok := m.sessions[key]
+	if !ok {
+		sessions = make(map[string]*entry)
+		m.sessions[key] = sessions
+	}
+	var old *Session
+	if e, ok := sessions[s.SessionID]; ok && e.ExpiresAt.After(time.Now()) {
+		if e.Owner != owner {
+			return nil, ErrForbiddenSession
+		}
+		old = e.Session
+		if s.State == nil {
+			s.State = old.State
+		}
+		s.JoinedAt = old.JoinedAt
+	}
+	cloned := *s
+	sessions[s.SessionID] = &entry{
+		Domain:  db.DomainName(),
+		Prefix:  db.DBPrefix(),
+		Owner:   owner,
+		Session: &cloned,
+	}
+	return old, nil
+}
+
+func (m *memStore) Remove(db prefixer.Prefixer, doctype, id, sessionID, owner string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memKey(db, doctype, id)
+	sessions := m.sessions[key]
+	e, ok := sessions[sessionID]
+	if !ok || !e.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	if e.Owner != owner {
+		return nil, ErrForbiddenSession
+	}
+	delete(sessions, sessionID)
+	if len(sessions) == 0 {
+		delete(m.sessions, key)
+	}
+	return e.Session, nil
+}
+
+func (m *memStore) List(db prefixer.Prefixer, doctype, id string) ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	list := make([]*Session, 0)
+	for _, e := range m.sessions[memKey(db, doctype, id)] {
+		if e.ExpiresAt.After(now) {
+			cloned := *e.Session
+			list = append(list, &cloned)
+		}
+	}
+	sortSessions(list)
+	return list, nil
+}
+
+func (m *memStore) expire(now time.Time) ([]*entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var expired []*entry
+	for key, sessions := range m.sessions {
+		for id, e := range sessions {
+			if !e.ExpiresAt.After(now) {
+				expired = append(expired, e)
+				delete(sessions, id)
+			}
+		}
+		if len(sessions) == 0 {
+			delete(m.sessions, key)
+		}
+	}
+	return expired, nil
+}
+
+func sortSessions(list []*Session) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].SessionID < list[j].SessionID
+	})
+}
+
+var _ Store = &memStore{}
@@ -0,0 +1,246 @@
+// Package presence is used to know who is viewing or editing a document. A
+// client joins a document with a session, sends heartbeats to stay present,
+// and leaves it. The sessions expire when there are no heartbeats, and the
+// changes are published on the realtime hub.
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// TTL is the duration after which a session expires if there is no
+	// heartbeat.
+	TTL = 60 * time.Second
+	// MaxStateSize is the maximal size of the JSON state of a session.
+	MaxStateSize = 1024
+
+	// sweepInterval is the time between two checks of the expired sessions.
+	sweepInterval = 5 * time.Second
+)
+
+var (
+	// ErrInvalidSession is used when the identifier of a session is invalid.
+	ErrInvalidSession = errors.New("presence: invalid session")
+	// ErrStateTooLarge is used when the state of a session is too large.
+	ErrStateTooLarge = errors.New("presence: the state is too large")
+	// ErrForbiddenSession is used when a client tries to refresh or remove a
+	// session created by another client.
+	ErrForbiddenSession = errors.New("presence: the session belongs to another client")
+)
+
+var sessionIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Session is the presence of a user on a document.
+type Session struct {
+	// Type and DocID are the doctype and the identifier of the document
+	Type      string `json:"doctype"`
+	DocID     string `json:"doc_id"`
+	SessionID string `json:"session_id"`
+	// Instance is the cozy instance of the user, that can be another member
+	// of a sharing
+	Instance  string          `json:"instance,omitempty"`
+	State     json.RawMessage `json:"state,omitempty"`
+	JoinedAt  time.Time       `json:"joined_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// ID returns the key of the document, used as the identifier for the
+// realtime events: it can be watched by the clients.
+func (s *Session) ID() string { return Key(s.Type, s.DocID) }
+
+// DocType returns the synthetic doctype for the presence.
+func (s *Session) DocType() string { return consts.Presence }
+
+// Validate checks that the session can be saved.
+func (s *Session) Validate() error {
+	if s.Type == "" || s.DocID == "" || strings.Contains(s.Type, "/") {
+		return ErrInvalidSession
+	}
+	if !sessionIDRegexp.MatchString(s.SessionID) {
+		return ErrInvalidSession
+	}
+	if len(s.State) > MaxStateSize {
+		return ErrStateTooLarge
+	}
+	if len(s.State) > 0 && !json.Valid(s.State) {
+		return ErrInvalidSession
+	}
+	return nil
+}
+
+// Key returns the key of a document, used for storing its sessions.
+func Key(doctype, id string) string {
+	return doctype + "/" + id
+}
+
+// SplitKey returns the doctype and the identifier of a document from its key.
+func SplitKey(key string) (string, string, bool) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// entry is a session with the instance where it is stored, and the client
+// that owns it, as saved in the store.
+type entry struct {
+	Domain string `json:"domain"`
+	Prefix string `json:"prefix,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	*Session
+}
+
+func (e *entry) DomainName() string { return e.Domain }
+func (e *entry) DBPrefix() string {
+	if e.Prefix != "" {
+		return e.Prefix
+	}
+	return e.Domain
+}
+
+// Store is the interface for the storage of the sessions, in memory or in
+// redis.
+type Store interface {
+	// Put saves a session, and returns its previous version (or nil). If the
+	// state of the session is nil, the state of the previous version is kept.
+	// ErrForbiddenSession is returned if the session has another owner.
+	Put(db prefixer.Prefixer, s *Session, owner string) (*Session, error)
+	// Remove deletes a session, and returns it (or nil if it was not found).
+	// ErrForbiddenSession is returned if the session has another owner.
+	Remove(db prefixer.Prefixer, doctype, id, sessionID, owner string) (*Session, error)
+	// List returns the sessions that are not expired for a document.
+	List(db prefixer.Prefixer, doctype, id string) ([]*Session, error)
+	// expire removes the sessions that have expired before now.
+	expire(now time.Time) ([]*entry, error)
+}
+
+var globalStoreMu sync.Mutex
+var globalStore Store
+
+// GetStore returns the global store of the sessions.
+func GetStore() Store {
+	globalStoreMu.Lock()
+	defer globalStoreMu.Unlock()
+	if globalStore != nil {
+		return globalStore
+	}
+	cli := config.GetConfig().Realtime.Client()
+	if cli == nil {
+		globalStore = newMemStore()
+	} else {
+		globalStore = newRedisStore(cli)
+	}
+	return globalStore
+}
+
+// Join adds a session on a document, or refreshes it for a heartbeat (the
+// state can be omitted to keep the current one). The owner identifies the
+// client, and only this client can refresh or remove the session. The realtime
+// event is published if the session is new, or if its state has changed.
+//
+// It returns true if the change must be sent to the other members of the
+// sharings of the document: when the session is new or its state has changed,
+// and for a heartbeat from time to time, so that the session doesn't expire
+// on the other instances.
+func Join(db prefixer.Prefixer, s *Session, owner string) (bool, error) {
+	if err := s.Validate(); err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	s.JoinedAt = now
+	s.ExpiresAt = now.Add(TTL)
+	old, err := GetStore().Put(db, s, owner)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case old == nil:
+		realtime.GetHub().Publish(db, realtime.EventCreate, s, nil)
+		return true, nil
+	case string(old.State) != string(s.State) || old.Instance != s.Instance:
+		realtime.GetHub().Publish(db, realtime.EventUpdate, s, old)
+		return true, nil
+	}
+	// The heartbeats are relayed once per half TTL, counted from the join
+	lastBeat := old.ExpiresAt.Add(-TTL)
+	period := TTL / 2
+	return lastBeat.Sub(s.JoinedAt)/period != now.Sub(s.JoinedAt)/period, nil
+}
+
+// Leave removes a session from a document. It returns true if the session
+// was present.
+func Leave(db prefixer.Prefixer, doctype, id, sessionID, owner string) (bool, error) {
+	old, err := GetStore().Remove(db, doctype, id, sessionID, owner)
+	if err != nil {
+		return false, err
+	}
+	if old == nil {
+		return false, nil
+	}
+	realtime.GetHub().Publish(db, realtime.EventDelete, old, nil)
+	return true, nil
+}
+
+// List returns the sessions on a document.
+func List(db prefixer.Prefixer, doctype, id string) ([]*Session, error) {
+	return GetStore().List(db, doctype, id)
+}
+
+// sweep removes the expired sessions and publishes their deletion.
+func sweep(now time.Time) error {
+	expired, err := GetStore().expire(now)
+	for _, e := range expired {
+		realtime.GetHub().Publish(e, realtime.EventDelete, e.Session, nil)
+	}
+	return err
+}
+
+// SweepExpiredSessions starts a loop that removes the expired sessions.
+func SweepExpiredSessions() utils.Shutdowner {
+	closed := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := sweep(now); err != nil {
+					logger.WithNamespace("presence").
+						Errorf("Could not sweep the expired sessions: %s", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return &sweeper{closed}
+}
+
+type sweeper struct {
+	closed chan struct{}
+}
+
+func (s *sweeper) Shutdown(ctx context.Context) error {
+	select {
+	case s.closed <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+var _ realtime.Doc = &Session{}
@@ -0,0 +1,223 @@
+package presence
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testingDB = prefixer.NewPrefixer("presence.example.net", "presence-example-net")
+
+func nextEvent(t *testing.T, sub *realtime.DynamicSubscriber) *realtime.Event {
+	select {
+	case e := <-sub.Channel:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the realtime event")
+		return nil
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := &Session{Type: consts.Files, DocID: "123", SessionID: "abc-42"}
+	assert.NoError(t, s.Validate())
+
+	s.SessionID = "no spaces"
+	assert.Equal(t, ErrInvalidSession, s.Validate())
+	s.SessionID = "abc-42"
+
+	s.Type = "io.cozy/files"
+	assert.Equal(t, ErrInvalidSession, s.Validate())
+	s.Type = consts.Files
+
+	s.State = json.RawMessage(`{"cursor":`)
+	assert.Equal(t, ErrInvalidSession, s.Validate())
+
+	s.State = make(json.RawMessage, MaxStateSize+1)
+	assert.Equal(t, ErrStateTooLarge, s.Validate())
+}
+
+func TestSplitKey(t *testing.T) {
+	doctype, id, ok := SplitKey(Key(consts.Files, "123/456"))
+	assert.True(t, ok)
+	assert.Equal(t, consts.Files, doctype)
+	assert.Equal(t, "123/456", id)
+
+	_, _, ok = SplitKey("io.cozy.files")
+	assert.False(t, ok)
+	_, _, ok = SplitKey("io.cozy.files/")
+	assert.False(t, ok)
+}
+
+func TestJoinAndLeave(t *testing.T) {
+	sub := realtime.GetHub().Subscriber(testingDB)
+	defer sub.Close()
+	key := Key(consts.Files, "join-leave")
+	require.NoError(t, sub.Watch(consts.Presence, key))
+
+	s := &Session{
+		Type:      consts.Files,
+		DocID:     "join-leave",
+		SessionID: "session-1",
+		State:     json.RawMessage(`{"cursor":1}`),
+	}
+	relay, err := Join(testingDB, s, "alice")
+	require.NoError(t, err)
+	assert.True(t, relay)
+	e := nextEvent(t, sub)
+	assert.Equal(t, realtime.EventCreate, e.Verb)
+	assert.Equal(t, key, e.Doc.ID())
+
+	// A heartbeat without a state keeps the current state, and is not
+	// published nor relayed
+	relay, err = Join(testingDB, &Session{
+		Type:      consts.Files,
+		DocID:     "join-leave",
+		SessionID: "session-1",
+	}, "alice")
+	require.NoError(t, err)
+	assert.False(t, relay)
+	list, err := List(testingDB, consts.Files, "join-leave")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.JSONEq(t, `{"cursor":1}`, string(list[0].State))
+
+	relay, err = Join(testingDB, &Session{
+		Type:      consts.Files,
+		DocID:     "join-leave",
+		SessionID: "session-1",
+		State:     json.RawMessage(`{"cursor":2}`),
+	}, "alice")
+	require.NoError(t, err)
+	assert.True(t, relay)
+	e = nextEvent(t, sub)
+	assert.Equal(t, realtime.EventUpdate, e.Verb)
+
+	// The session can't be refreshed or removed by another client
+	_, err = Join(testingDB, &Session{
+		Type:      consts.Files,
+		DocID:     "join-leave",
+		SessionID: "session-1",
+		State:     json.RawMessage(`{"cursor":3}`),
+	}, "mallory")
+	assert.Equal(t, ErrForbiddenSession, err)
+	_, err = Leave(testingDB, consts.Files, "join-leave", "session-1", "mallory")
+	assert.Equal(t, ErrForbiddenSession, err)
+
+	_, err = Join(testingDB, &Session{
+		Type:      consts.Files,
+		DocID:     "join-leave",
+		SessionID: "session-0",
+	}, "bob")
+	require.NoError(t, err)
+	e = nextEvent(t, sub)
+	assert.Equal(t, realtime.EventCreate, e.Verb)
+	list, err = List(testingDB, consts.Files, "join-leave")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "session-0", list[0].SessionID)
+	assert.Equal(t, "session-1", list[1].SessionID)
+	assert.JSONEq(t, `{"cursor":2}`, string(list[1].State))
+
+	other := prefixer.NewPrefixer("other.example.net", "other-example-net")
+	list, err = List(other, consts.Files, "join-leave")
+	require.NoError(t, err)
+	assert.Len(t, list, 0)
+
+	left, err := Leave(testingDB, consts.Files, "join-leave", "session-1", "alice")
+	require.NoError(t, err)
+	assert.True(t, left)
+	e = nextEvent(t, sub)
+	assert.Equal(t, realtime.EventDelete, e.Verb)
+	left, err = Leave(testingDB, consts.Files, "join-leave", "session-1", "alice")
+	require.NoError(t, err)
+	assert.False(t, left)
+	list, err = List(testingDB, consts.Files, "join-leave")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "session-0", list[0].SessionID)
+}
+
+func TestRelayHeartbeats(t *testing.T) {
+	s := &Session{
+		Type:      consts.Files,
+		DocID:     "heartbeats",
+		SessionID: "session-1",
+	}
+	relay, err := Join(testingDB, s, "alice")
+	require.NoError(t, err)
+	assert.True(t, relay)
+
+	// Simulate a join a bit less than half a TTL ago
+	store := globalStore.(*memStore)
+	store.mu.Lock()
+	e := store.sessions[memKey(testingDB, consts.Files, "heartbeats")]["session-1"]
+	e.JoinedAt = e.JoinedAt.Add(-TTL/2 + 2*time.Second)
+	e.ExpiresAt = e.JoinedAt.Add(TTL)
+	store.mu.Unlock()
+	relay, err = Join(testingDB, &Session{
+		Type:      consts.Files,
+		DocID:     "heartbeats",
+		SessionID: "session-1",
+	}, "alice")
+	require.NoError(t, err)
+	assert.False(t, relay)
+
+	// 4 seconds later, the first heartbeat after half a TTL is relayed, to
+	// keep the session on the other instances
+	store.mu.Lock()
+	e = store.sessions[memKey(testingDB, consts.Files, "heartbeats")]["session-1"]
+	e.JoinedAt = e.JoinedAt.Add(-4 * time.Second)
+	e.ExpiresAt = e.ExpiresAt.Add(-4 * time.Second)
+	store.mu.Unlock()
+	relay, err = Join(testingDB, &Session{
+		Type:      consts.Files,
+		DocID:     "heartbeats",
+		SessionID: "session-1",
+	}, "alice")
+	require.NoError(t, err)
+	assert.True(t, relay)
+}
+
+func TestExpiration(t *testing.T) {
+	sub := realtime.GetHub().Subscriber(testingDB)
+	defer sub.Close()
+	key := Key("io.cozy.photos.albums", "expiration")
+	require.NoError(t, sub.Watch(consts.Presence, key))
+
+	_, err := Join(testingDB, &Session{
+		Type:      "io.cozy.photos.albums",
+		DocID:     "expiration",
+		SessionID: "session-1",
+	}, "alice")
+	require.NoError(t, err)
+	e := nextEvent(t, sub)
+	assert.Equal(t, realtime.EventCreate, e.Verb)
+
+	require.NoError(t, sweep(time.Now()))
+	list, err := List(testingDB, "io.cozy.photos.albums", "expiration")
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	require.NoError(t, sweep(time.Now().Add(TTL+time.Second)))
+	e = nextEvent(t, sub)
+	assert.Equal(t, realtime.EventDelete, e.Verb)
+	assert.Equal(t, key, e.Doc.ID())
+	list, err = List(testingDB, "io.cozy.photos.albums", "expiration")
+	require.NoError(t, err)
+	assert.Len(t, list, 0)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	globalStore = newMemStore()
+	os.Exit(m.Run())
+}
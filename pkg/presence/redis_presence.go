@@ -0,0 +1,172 @@
+package presence
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/go-redis/redis/v7"
+)
+
+// expiryKey is the key of the sorted set in redis used for the expiration of
+// the sessions. The members are "<session-id> <hash key>", and the score is
+// the expiration time.
+const expiryKey = "presence:expiry"
+
+// luaExpire returns the lua script used for removing the expired sessions. It
+// returns the JSON of the removed sessions.
+const luaExpire = `
+local r = redis.call("ZRANGEBYSCORE", "` + expiryKey + `", 0, KEYS[1], "LIMIT", 0, 100)
+local expired = {}
+for _, m in ipairs(r) do
+  redis.call("ZREM", "` + expiryKey + `", m)
+  local sep = string.find(m, " ", 1, true)
+  if sep then
+    local field = string.sub(m, 1, sep - 1)
+    local key = string.sub(m, sep + 1)
+    local e = redis.call("HGET", key, field)
+    if e then
+      redis.call("HDEL", key, field)
+      table.insert(expired, e)
+    end
+  end
+end
+return expired`
+
+// redisStore is the store used when the realtime uses redis: the sessions of
+// a document are kept in a hash, with a sorted set for their expiration.
+type redisStore struct {
+	c redis.UniversalClient
+}
+
+func newRedisStore(c redis.UniversalClient) *redisStore {
+	return &redisStore{c: c}
+}
+
+func hashKey(db prefixer.Prefixer, doctype, id string) string {
+	return "presence:" + db.DBPrefix() + ":" + Key(doctype, id)
+}
+
+func (r *redisStore) get(key, sessionID string) (*entry, error) {
+	buf, err := r.c.HGet(key, sessionID).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e entry
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return nil, err
+	}
+	if !e.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+func (r *redisStore) Put(db prefixer.Prefixer, s *Session, owner string) (*Session, error) {
+	key := hashKey(db, s.Type, s.DocID)
+	old, err := r.get(key, s.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		if old.Owner != owner {
+			return nil, ErrForbiddenSession
+		}
+		if s.State == nil {
+			s.State = old.State
+		}
+		s.JoinedAt = old.JoinedAt
+	}
+	buf, err := json.Marshal(&entry{
+		Domain:  db.DomainName(),
+		Prefix:  db.DBPrefix(),
+		Owner:   owner,
+		Session: s,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pipe := r.c.TxPipeline()
+	pipe.HSet(key, s.SessionID, buf)
+	pipe.Expire(key, 2*TTL)
+	pipe.ZAdd(expiryKey, &redis.Z{
+		Score:  float64(s.ExpiresAt.Unix()),
+		Member: s.SessionID + " " + key,
+	})
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, nil
+	}
+	return old.Session, nil
+}
+
+func (r *redisStore) Remove(db prefixer.Prefixer, doctype, id, sessionID, owner string) (*Session, error) {
+	key := hashKey(db, doctype, id)
+	old, err := r.get(key, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, nil
+	}
+	if old.Owner != owner {
+		return nil, ErrForbiddenSession
+	}
+	pipe := r.c.TxPipeline()
+	deleted := pipe.HDel(key, sessionID)
+	pipe.ZRem(expiryKey, sessionID+" "+key)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	if deleted.Val() == 0 {
+		return nil, nil
+	}
+	return old.Session, nil
+}
+
+func (r *redisStore) List(db prefixer.Prefixer, doctype, id string) ([]*Session, error) {
+	values, err := r.c.HGetAll(hashKey(db, doctype, id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	list := make([]*Session, 0, len(values))
+	for _, value := range values {
+		var e entry
+		if err := json.Unmarshal([]byte(value), &e); err != nil {
+			continue
+		}
+		if e.Session != nil && e.ExpiresAt.After(now) {
+			list = append(list, e.Session)
+		}
+	}
+	sortSessions(list)
+	return list, nil
+}
+
+func (r *redisStore) expire(now time.Time) ([]*entry, error) {
+	keys := []string{strconv.FormatInt(now.Unix(), 10)}
+	res, err := r.c.Eval(luaExpire, keys).Result()
+	if err != nil {
+		return nil, err
+	}
+	results, _ := res.([]interface{})
+	expired := make([]*entry, 0, len(results))
+	for _, result := range results {
+		buf, _ := result.(string)
+		var e entry
+		if err := json.Unmarshal([]byte(buf), &e); err != nil || e.Session == nil {
+			continue
+		}
+		expired = append(expired, &e)
+	}
+	return expired, nil
+}
+
+var _ Store = &redisStore{}
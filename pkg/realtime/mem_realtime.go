@@ -1,8 +1,12 @@
 package realtime
 
 import (
+	"encoding/json"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
@@ -11,15 +15,99 @@ var globalPrefixer = prefixer.NewPrefixer("", "*")
 type memHub struct {
 	sync.RWMutex
 	topics map[string]*topic
+
+	lmu       sync.Mutex
+	logs      map[string]*eventsLog
+	lastSweep time.Time
+}
+
+// eventsLog keeps the last events of an instance. The IDs of the events are
+// consecutive numbers.
+type eventsLog struct {
+	last      uint64
+	events    []*Event
+	updatedAt time.Time
 }
 
+// eventsLogSweepInterval is the minimal time between two sweeps of the logs
+// of the instances without recent events.
+const eventsLogSweepInterval = 10 * time.Minute
+
 func newMemHub() *memHub {
-	return &memHub{topics: make(map[string]*topic)}
+	return &memHub{
+		topics:    make(map[string]*topic),
+		logs:      make(map[string]*eventsLog),
+		lastSweep: time.Now(),
+	}
 }
 
 func (h *memHub) Publish(db prefixer.Prefixer, verb string, doc, oldDoc Doc) {
 	e := newEvent(db, verb, doc, oldDoc)
-	topic := h.get(e, doc.DocType())
+	h.addToLog(e)
+	h.publish(e)
+}
+
+// addToLog gives an ID to the event, and keeps it in the log of its instance.
+func (h *memHub) addToLog(e *Event) {
+	h.lmu.Lock()
+	defer h.lmu.Unlock()
+	now := time.Now()
+	if now.Sub(h.lastSweep) > eventsLogSweepInterval {
+		h.sweepLogs(now)
+	}
+	l, ok := h.logs[e.DBPrefix()]
+	if !ok {
+		l = &eventsLog{}
+		h.logs[e.DBPrefix()] = l
+	}
+	l.updatedAt = now
+	l.last++
+	e.ID = strconv.FormatUint(l.last, 10)
+	if len(l.events) >= eventsLogSize {
+		l.events = append(l.events[1:], e)
+	} else {
+		l.events = append(l.events, e)
+	}
+}
+
+// sweepLogs removes the logs of the instances without events for more than
+// eventsLogTTL, like the EXPIRE for the redis hub. It must be called with the
+// lmu lock.
+func (h *memHub) sweepLogs(now time.Time) {
+	for prefix, l := range h.logs {
+		if now.Sub(l.updatedAt) > eventsLogTTL {
+			delete(h.logs, prefix)
+		}
+	}
+	h.lastSweep = now
+}
+
+func (h *memHub) EventsSince(db prefixer.Prefixer, lastEventID string) ([]*Event, error) {
+	n, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return nil, ErrGapTooLarge
+	}
+	h.lmu.Lock()
+	defer h.lmu.Unlock()
+	l, ok := h.logs[db.DBPrefix()]
+	if !ok {
+		// No events have been published since the start of the stack
+		if n == 0 {
+			return nil, nil
+		}
+		return nil, ErrGapTooLarge
+	}
+	oldest := l.last - uint64(len(l.events)) + 1
+	if n > l.last || n+1 < oldest {
+		return nil, ErrGapTooLarge
+	}
+	events := l.events[n+1-oldest:]
+	return append([]*Event(nil), events...), nil
+}
+
+// publish sends the event to the subscribers in this process.
+func (h *memHub) publish(e *Event) {
+	topic := h.get(e, e.Doc.DocType())
 	if topic != nil {
 		topic.broadcast <- e
 	}
@@ -63,13 +151,15 @@ func (h *memHub) topicKey(db prefixer.Prefixer, doctype string) string {
 }
 
 type filter struct {
-	whole bool // true if the events for the whole doctype should be sent
-	ids   []string
+	whole     bool // true if the events for the whole doctype should be sent
+	ids       []string
+	selectors []*mango.Selector
 }
 
 type toWatch struct {
-	sub *MemSub
-	id  string
+	sub      *MemSub
+	id       string
+	selector *mango.Selector
 }
 
 type topic struct {
@@ -114,29 +204,88 @@ func (t *topic) loop() {
 			}
 		case w := <-t.subscribe:
 			f := t.subs[w.sub]
-			if w.id == "" {
+			if w.selector != nil {
+				f.selectors = append(f.selectors, w.selector)
+			} else if w.id == "" {
 				f.whole = true
 			} else {
 				f.ids = append(f.ids, w.id)
 			}
 			t.subs[w.sub] = f
 		case e := <-t.broadcast:
+			m := &eventMaps{e: e}
 			for s, f := range t.subs {
-				ok := false
-				if f.whole {
-					ok = true
-				} else {
-					for _, id := range f.ids {
-						if e.Doc.ID() == id {
-							ok = true
-							break
-						}
-					}
-				}
-				if ok {
+				if f.match(e, m) {
 					*s <- e
 				}
 			}
 		}
 	}
 }
+
+func (f *filter) match(e *Event, m *eventMaps) bool {
+	if f.whole {
+		return true
+	}
+	for _, id := range f.ids {
+		if e.Doc.ID() == id {
+			return true
+		}
+	}
+	for _, selector := range f.selectors {
+		if m.match(selector) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventMaps converts the documents of an event to maps for the selectors. It
+// is done only once, and only if a subscriber has a selector.
+type eventMaps struct {
+	e    *Event
+	done bool
+	doc  map[string]interface{}
+	old  map[string]interface{}
+}
+
+func (m *eventMaps) get() (map[string]interface{}, map[string]interface{}) {
+	if !m.done {
+		m.done = true
+		m.doc = docToMap(m.e.Doc)
+		m.old = docToMap(m.e.OldDoc)
+	}
+	return m.doc, m.old
+}
+
+// match returns true if the document, or its old version, matches the
+// selector. The old version is used to send an event when a document no
+// longer matches the selector.
+func (m *eventMaps) match(selector *mango.Selector) bool {
+	doc, old := m.get()
+	if doc != nil && selector.Match(doc, old) {
+		return true
+	}
+	return old != nil && selector.Match(old, old)
+}
+
+func docToMap(doc Doc) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	if d, ok := doc.(*JSONDoc); ok {
+		if d == nil {
+			return nil
+		}
+		return d.M
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	return m
+}
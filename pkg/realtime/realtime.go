@@ -2,10 +2,13 @@ package realtime
 
 import (
 	"errors"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
@@ -23,8 +26,18 @@ type Doc interface {
 	DocType() string
 }
 
+// eventsLogSize is the number of events kept for each instance, so that the
+// clients can get the events that they have missed while reconnecting.
+const eventsLogSize = 1000
+
+// ErrGapTooLarge is used when a client asks for the events since an event that
+// is no longer in the log: some events have been lost, and the client must
+// fetch again its data.
+var ErrGapTooLarge = errors.New("realtime: too many events have been missed")
+
 // Event is the basic message structure manipulated by the realtime package
 type Event struct {
+	ID     string `json:"id,omitempty"`
 	Domain string `json:"domain"`
 	Prefix string `json:"prefix,omitempty"`
 	Verb   string `json:"verb"`
@@ -42,6 +55,39 @@ func newEvent(db prefixer.Prefixer, verb string, doc Doc, oldDoc Doc) *Event {
 	}
 }
 
+// CompareEventIDs returns -1, 0 or 1 if the event with the ID a has been
+// published before, at the same time, or after the event with the ID b. The
+// IDs are numbers for the in-memory hub, and the IDs of a redis stream
+// (timestamp-sequence) for the redis hub.
+func CompareEventIDs(a, b string) int {
+	ta, sa := parseEventID(a)
+	tb, sb := parseEventID(b)
+	switch {
+	case ta < tb || (ta == tb && sa < sb):
+		return -1
+	case ta > tb || (ta == tb && sa > sb):
+		return 1
+	}
+	return 0
+}
+
+func parseEventID(id string) (uint64, uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	first, _ := strconv.ParseUint(parts[0], 10, 64)
+	var second uint64
+	if len(parts) == 2 {
+		second, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return first, second
+}
+
+// MatchSelector returns true if the document of the event, or its old
+// version, matches the given selector.
+func (e *Event) MatchSelector(selector *mango.Selector) bool {
+	m := &eventMaps{e: e}
+	return m.match(selector)
+}
+
 // DBPrefix implements the prefixer.Prefixer interface.
 func (e *Event) DBPrefix() string {
 	if e.Prefix != "" {
@@ -70,6 +116,11 @@ type Hub interface {
 	// cozy-stack process.
 	SubscribeLocalAll() *DynamicSubscriber
 
+	// EventsSince returns the events published for the instance after the
+	// event with the given ID, or ErrGapTooLarge if this event is no longer
+	// in the log.
+	EventsSince(db prefixer.Prefixer, lastEventID string) ([]*Event, error)
+
 	// GetTopic returns the topic for the given domain+doctype.
 	// It creates the topic if it does not exist.
 	GetTopic(db prefixer.Prefixer, doctype string) *topic
@@ -105,6 +156,18 @@ func (ds *DynamicSubscriber) Subscribe(doctype string) error {
 	return nil
 }
 
+// SubscribeSelector adds a listener for the events on a doctype, where the
+// document (or its old version) matches the given mango selector. The
+// selector is evaluated in the hub, before the event is sent to the channel.
+func (ds *DynamicSubscriber) SubscribeSelector(doctype string, selector *mango.Selector) error {
+	if ds.Closed() || ds.hub == nil {
+		return errors.New("Can't subscribe")
+	}
+	t := ds.hub.GetTopic(ds, doctype)
+	ds.addWatch(t, &toWatch{sub: &ds.Channel, selector: selector})
+	return nil
+}
+
 // Unsubscribe removes a listener for events on a whole doctype
 func (ds *DynamicSubscriber) Unsubscribe(doctype string) error {
 	if ds.Closed() || ds.hub == nil {
@@ -136,6 +199,10 @@ func (ds *DynamicSubscriber) Unwatch(doctype, id string) error {
 }
 
 func (ds *DynamicSubscriber) addTopic(t *topic, id string) {
+	ds.addWatch(t, &toWatch{sub: &ds.Channel, id: id})
+}
+
+func (ds *DynamicSubscriber) addWatch(t *topic, w *toWatch) {
 	found := false
 	for _, topic := range ds.topics {
 		if t == topic {
@@ -146,13 +213,13 @@ func (ds *DynamicSubscriber) addTopic(t *topic, id string) {
 	if !found {
 		ds.topics = append(ds.topics, t)
 	}
-	t.subscribe <- &toWatch{&ds.Channel, id}
+	t.subscribe <- w
 }
 
 func (ds *DynamicSubscriber) removeTopic(t *topic, id string) {
 	for _, topic := range ds.topics {
 		if t == topic {
-			t.unsubscribe <- &toWatch{&ds.Channel, id}
+			t.unsubscribe <- &toWatch{sub: &ds.Channel, id: id}
 		}
 	}
 }
@@ -174,7 +241,7 @@ func (ds *DynamicSubscriber) Close() error {
 		go func(t *topic) {
 			for {
 				select {
-				case t.unsubscribe <- &toWatch{&ds.Channel, ""}:
+				case t.unsubscribe <- &toWatch{sub: &ds.Channel}:
 					wg.Done()
 					return
 				case <-ds.Channel:
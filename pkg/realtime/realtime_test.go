@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/go-redis/redis/v7"
 	"github.com/stretchr/testify/assert"
@@ -316,3 +317,89 @@ func TestRedisRealtime(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestMemEventsSince(t *testing.T) {
+	h := newMemHub()
+	_, err := h.EventsSince(testingDB, "0")
+	assert.NoError(t, err)
+
+	for i := 0; i < eventsLogSize+10; i++ {
+		h.Publish(testingDB, EventCreate, &testDoc{
+			id:      "foo",
+			doctype: "io.cozy.testobject",
+		}, nil)
+	}
+
+	events, err := h.EventsSince(testingDB, "1000")
+	assert.NoError(t, err)
+	if assert.Len(t, events, 10) {
+		assert.Equal(t, "1001", events[0].ID)
+		assert.Equal(t, "1010", events[9].ID)
+	}
+
+	events, err = h.EventsSince(testingDB, "1010")
+	assert.NoError(t, err)
+	assert.Len(t, events, 0)
+
+	events, err = h.EventsSince(testingDB, "10")
+	assert.NoError(t, err)
+	assert.Len(t, events, eventsLogSize)
+
+	_, err = h.EventsSince(testingDB, "9")
+	assert.Equal(t, ErrGapTooLarge, err)
+	_, err = h.EventsSince(testingDB, "2000")
+	assert.Equal(t, ErrGapTooLarge, err)
+	_, err = h.EventsSince(testingDB, "foo")
+	assert.Equal(t, ErrGapTooLarge, err)
+
+	// The log is removed when the instance has no events for a long time
+	h.lmu.Lock()
+	h.sweepLogs(time.Now().Add(eventsLogTTL - time.Minute))
+	h.lmu.Unlock()
+	_, err = h.EventsSince(testingDB, "1010")
+	assert.NoError(t, err)
+	h.lmu.Lock()
+	h.sweepLogs(time.Now().Add(eventsLogTTL + time.Minute))
+	h.lmu.Unlock()
+	_, err = h.EventsSince(testingDB, "1010")
+	assert.Equal(t, ErrGapTooLarge, err)
+
+	assert.Equal(t, -1, CompareEventIDs("9", "10"))
+	assert.Equal(t, 1, CompareEventIDs("1600000000000-1", "1600000000000-0"))
+	assert.Equal(t, 0, CompareEventIDs("42", "42"))
+}
+
+func TestMemSelector(t *testing.T) {
+	h := newMemHub()
+	c := h.Subscriber(testingDB)
+	selector, err := mango.NewSelector(mango.Map{"dir_id": "foo"})
+	assert.NoError(t, err)
+	err = c.SubscribeSelector("io.cozy.testobject", selector)
+	assert.NoError(t, err)
+	time.Sleep(1 * time.Millisecond)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		e := <-c.Channel
+		assert.Equal(t, "in", e.Doc.ID())
+		e = <-c.Channel
+		assert.Equal(t, "moved", e.Doc.ID())
+		assert.Equal(t, EventUpdate, e.Verb)
+		wg.Done()
+	}()
+
+	newDoc := func(id, dirID string) *JSONDoc {
+		return &JSONDoc{
+			Type: "io.cozy.testobject",
+			M:    map[string]interface{}{"_id": id, "dir_id": dirID},
+		}
+	}
+	h.Publish(testingDB, EventCreate, newDoc("out", "bar"), nil)
+	h.Publish(testingDB, EventCreate, newDoc("in", "foo"), nil)
+	h.Publish(testingDB, EventUpdate, newDoc("out", "baz"), newDoc("out", "bar"))
+	h.Publish(testingDB, EventUpdate, newDoc("moved", "bar"), newDoc("moved", "foo"))
+	wg.Wait()
+
+	c.Close()
+}
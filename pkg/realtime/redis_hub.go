@@ -3,6 +3,7 @@ package realtime
 import (
 	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -11,6 +12,29 @@ import (
 
 const eventsRedisKey = "realtime:events"
 
+// eventsLogTTL is the time after which the log of the events of an instance is
+// removed if there is no new event (from redis, or from the memory for the
+// in-memory hub).
+const eventsLogTTL = 24 * time.Hour
+
+// luaPublish is the lua script used to add an event to the log of its
+// instance (a redis stream), and to publish it with its ID.
+// KEYS[1]: the key of the stream
+// ARGV[1]: the doctype
+// ARGV[2]: the event serialized in JSON
+// ARGV[3]: the maximal length of the stream
+// ARGV[4]: the TTL of the stream in seconds
+const luaPublish = `
+local id = redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[3], "*", "doctype", ARGV[1], "event", ARGV[2])
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+local payload = '{"id":"' .. id .. '",' .. string.sub(ARGV[2], 2)
+redis.call("PUBLISH", "` + eventsRedisKey + `", ARGV[1] .. "," .. payload)
+return id`
+
+func eventsLogKey(db prefixer.Prefixer) string {
+	return "realtime:log:" + db.DBPrefix()
+}
+
 type redisHub struct {
 	c     redis.UniversalClient
 	mem   *memHub
@@ -65,6 +89,7 @@ func toJSONDoc(d map[string]interface{}) *JSONDoc {
 }
 
 type jsonEvent struct {
+	ID     string
 	Domain string
 	Prefix string
 	Verb   string
@@ -77,6 +102,7 @@ func (j *jsonEvent) UnmarshalJSON(buf []byte) error {
 	if err := json.Unmarshal(buf, &m); err != nil {
 		return err
 	}
+	j.ID, _ = m["id"].(string)
 	j.Domain, _ = m["domain"].(string)
 	j.Prefix, _ = m["prefix"].(string)
 	j.Verb, _ = m["verb"].(string)
@@ -105,31 +131,86 @@ func (h *redisHub) start() {
 			log.Warnf("Error on start: %s", err)
 			continue
 		}
-		if je.Doc != nil {
-			je.Doc.Type = doctype
-		}
-		if je.Old != nil {
-			je.Old.Type = doctype
+		if je.Doc == nil {
+			log.Warnf("Invalid payload: %s", msg.Payload)
+			continue
 		}
-		db := prefixer.NewPrefixer(je.Domain, je.Prefix)
-		h.mem.Publish(db, je.Verb, je.Doc, je.Old)
+		h.mem.publish(je.toEvent(doctype))
 	}
 }
 
+func (je *jsonEvent) toEvent(doctype string) *Event {
+	db := prefixer.NewPrefixer(je.Domain, je.Prefix)
+	var doc, old Doc
+	if je.Doc != nil {
+		je.Doc.Type = doctype
+		doc = je.Doc
+	}
+	if je.Old != nil {
+		je.Old.Type = doctype
+		old = je.Old
+	}
+	e := newEvent(db, je.Verb, doc, old)
+	e.ID = je.ID
+	return e
+}
+
 func (h *redisHub) GetTopic(db prefixer.Prefixer, doctype string) *topic {
 	return nil
 }
 
 func (h *redisHub) Publish(db prefixer.Prefixer, verb string, doc, oldDoc Doc) {
 	e := newEvent(db, verb, doc, oldDoc)
-	h.local.broadcast <- e
 	buf, err := json.Marshal(e)
 	if err != nil {
+		h.local.broadcast <- e
 		log := logger.WithNamespace("realtime-redis")
 		log.Warnf("Error on publish: %s", err)
 		return
 	}
-	h.c.Publish(eventsRedisKey, e.Doc.DocType()+","+string(buf))
+	keys := []string{eventsLogKey(db)}
+	ttl := int64(eventsLogTTL.Seconds())
+	id, err := h.c.Eval(luaPublish, keys, e.Doc.DocType(), string(buf), eventsLogSize, ttl).Result()
+	if err != nil {
+		log := logger.WithNamespace("realtime-redis")
+		log.Warnf("Error on publish: %s", err)
+		// The event is not in the log, but it is still sent to the other
+		// stacks, without an ID.
+		payload := e.Doc.DocType() + "," + string(buf)
+		if err = h.c.Publish(eventsRedisKey, payload).Err(); err != nil {
+			log.Warnf("Error on publish: %s", err)
+		}
+	}
+	e.ID, _ = id.(string)
+	h.local.broadcast <- e
+}
+
+func (h *redisHub) EventsSince(db prefixer.Prefixer, lastEventID string) ([]*Event, error) {
+	msgs, err := h.c.XRangeN(eventsLogKey(db), lastEventID, "+", eventsLogSize+1).Result()
+	if err != nil {
+		// An invalid ID is rejected by redis
+		if strings.HasPrefix(err.Error(), "ERR") {
+			return nil, ErrGapTooLarge
+		}
+		return nil, err
+	}
+	// The IDs of the redis stream are not consecutive: we can't know if an
+	// event has been missed if the last event is no longer in the stream.
+	if len(msgs) == 0 || msgs[0].ID != lastEventID {
+		return nil, ErrGapTooLarge
+	}
+	events := make([]*Event, 0, len(msgs)-1)
+	for _, msg := range msgs[1:] {
+		doctype, _ := msg.Values["doctype"].(string)
+		buf, _ := msg.Values["event"].(string)
+		je := jsonEvent{}
+		if err := json.Unmarshal([]byte(buf), &je); err != nil {
+			continue
+		}
+		je.ID = msg.ID
+		events = append(events, je.toEvent(doctype))
+	}
+	return events, nil
 }
 
 func (h *redisHub) Subscriber(db prefixer.Prefixer) *DynamicSubscriber {
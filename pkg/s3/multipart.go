@@ -0,0 +1,235 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var (
+	// ErrWriterClosed is returned when writing to a Writer that has already
+	// been closed or aborted.
+	ErrWriterClosed = errors.New("s3: writer is closed")
+	// ErrTooLarge is returned when writing to a Writer more than the maximal
+	// size of an object.
+	ErrTooLarge = errors.New("s3: object is too large")
+)
+
+const (
+	// maxParts is the maximal number of parts for a multipart upload.
+	maxParts = 10000
+	// maxObjectSize is the maximal size of an object (5 TiB).
+	maxObjectSize = 5 << 40
+)
+
+// MaxObjectSize returns the maximal size of an object that can be created with
+// a Writer.
+func (c *Client) MaxObjectSize() int64 {
+	if size := maxParts * c.partSize; size < maxObjectSize {
+		return size
+	}
+	return maxObjectSize
+}
+
+// Part is a part of a multipart upload that has been sent.
+type Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type initiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []Part   `xml:"Part"`
+}
+
+type completeResult struct {
+	ETag string `xml:"ETag"`
+}
+
+// CreateMultipartUpload starts a multipart upload, and returns its
+// identifier.
+func (c *Client) CreateMultipartUpload(bucket, key string, opts *PutOptions) (string, error) {
+	req := c.newRequest(http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil)
+	opts.setHeaders(req.Header, false)
+	res, err := c.do(req, emptyPayload)
+	if err != nil {
+		return "", err
+	}
+	var result initiateResult
+	if err = parseBody(res, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart sends a part of a multipart upload.
+func (c *Client) UploadPart(bucket, key, uploadID string, partNumber int, content []byte) (*Part, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	res, err := c.doWithBody(http.MethodPut, bucket, key, query, content)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return &Part{PartNumber: partNumber, ETag: res.Header.Get("Etag")}, nil
+}
+
+// CompleteMultipartUpload finishes a multipart upload: the object is created
+// from the parts.
+func (c *Client) CompleteMultipartUpload(bucket, key, uploadID string, parts []Part) (*ObjectInfo, error) {
+	body, err := xml.Marshal(completeRequest{Parts: parts})
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.doWithBody(http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return nil, err
+	}
+	var result completeResult
+	if err = parseBody(res, &result); err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, ETag: trimETag(result.ETag)}, nil
+}
+
+// AbortMultipartUpload cancels a multipart upload, and removes the parts
+// already sent.
+func (c *Client) AbortMultipartUpload(bucket, key, uploadID string) error {
+	req := c.newRequest(http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, nil)
+	res, err := c.do(req, emptyPayload)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Writer is used to create an object when its size is not known in advance.
+// The content is buffered, and sent with a multipart upload when it is larger
+// than the part size, or with a single request else. The object is created
+// only when the writer is closed.
+type Writer struct {
+	c        *Client
+	bucket   string
+	key      string
+	opts     *PutOptions
+	buf      bytes.Buffer
+	uploadID string
+	parts    []Part
+	size     int64
+	closed   bool
+	err      error
+	info     *ObjectInfo
+}
+
+// NewWriter returns a writer for creating the object with the given key.
+func (c *Client) NewWriter(bucket, key string, opts *PutOptions) *Writer {
+	return &Writer{c: c, bucket: bucket, key: key, opts: opts}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.size+int64(len(p)) > w.c.MaxObjectSize() {
+		w.err = ErrTooLarge
+		return 0, w.err
+	}
+	n, _ := w.buf.Write(p)
+	w.size += int64(n)
+	for int64(w.buf.Len()) >= w.c.partSize {
+		if w.err = w.sendPart(w.buf.Next(int(w.c.partSize))); w.err != nil {
+			return n, w.err
+		}
+	}
+	return n, nil
+}
+
+func (w *Writer) sendPart(content []byte) error {
+	if w.uploadID == "" {
+		uploadID, err := w.c.CreateMultipartUpload(w.bucket, w.key, w.opts)
+		if err != nil {
+			return err
+		}
+		w.uploadID = uploadID
+	}
+	part, err := w.c.UploadPart(w.bucket, w.key, w.uploadID, len(w.parts)+1, content)
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, *part)
+	return nil
+}
+
+// Close sends the remaining content, and creates the object.
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+	if w.err != nil {
+		_ = w.abort()
+		return w.err
+	}
+	if w.uploadID == "" {
+		content := w.buf.Bytes()
+		w.info, w.err = w.c.PutObjectBytes(w.bucket, w.key, content, w.opts)
+		return w.err
+	}
+	if w.buf.Len() > 0 {
+		if w.err = w.sendPart(w.buf.Bytes()); w.err != nil {
+			_ = w.abort()
+			return w.err
+		}
+	}
+	w.info, w.err = w.c.CompleteMultipartUpload(w.bucket, w.key, w.uploadID, w.parts)
+	if w.err != nil {
+		_ = w.abort()
+	}
+	return w.err
+}
+
+// Abort cancels the creation of the object.
+func (w *Writer) Abort() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+	return w.abort()
+}
+
+func (w *Writer) abort() error {
+	w.buf.Reset()
+	if w.uploadID == "" {
+		return nil
+	}
+	return w.c.AbortMultipartUpload(w.bucket, w.key, w.uploadID)
+}
+
+// Size returns the number of bytes written.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// Info returns the description of the object, after it has been created by
+// Close.
+func (w *Writer) Info() *ObjectInfo {
+	if w.info != nil {
+		w.info.Size = w.size
+	}
+	return w.info
+}
@@ -0,0 +1,138 @@
+package s3
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// Object is a reader on the content of an object. It implements io.Reader,
+// io.Seeker, io.ReaderAt and io.Closer: when seeking, the content is read
+// again with a request for the range that starts at the new offset.
+type Object struct {
+	c      *Client
+	bucket string
+	Info   *ObjectInfo
+	body   io.ReadCloser
+	offset int64
+}
+
+// OpenObject returns a reader on the content of the object.
+func (c *Client) OpenObject(bucket, key string) (*Object, error) {
+	req := c.newRequest(http.MethodGet, bucket, key, nil, nil)
+	res, err := c.do(req, emptyPayload)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &Object{
+		c:      c,
+		bucket: bucket,
+		Info:   objectInfoFromHeaders(key, res.Header, res.ContentLength),
+		body:   res.Body,
+	}, nil
+}
+
+// GetObject returns the content of an object.
+func (c *Client) GetObject(bucket, key string) ([]byte, *ObjectInfo, error) {
+	obj, err := c.OpenObject(bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer obj.Close()
+	content, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, obj.Info, nil
+}
+
+func (o *Object) openRange(start, end int64) (io.ReadCloser, error) {
+	req := o.c.newRequest(http.MethodGet, o.bucket, o.Info.Key, nil, nil)
+	req.Header.Set("Range", formatRange(start, end))
+	res, err := o.c.do(req, emptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, errors.New("s3: range requests are not supported")
+	}
+	return res.Body, nil
+}
+
+func (o *Object) Read(p []byte) (int, error) {
+	if o.offset >= o.Info.Size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		body, err := o.openRange(o.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (o *Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.Info.Size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (o *Object) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.Info.Size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	end := off + int64(len(p))
+	if end > o.Info.Size {
+		end = o.Info.Size
+	}
+	body, err := o.openRange(off, end-1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:end-off])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (o *Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,553 @@
+// Package s3 is a minimal client for the S3 API. It implements only the
+// operations needed by the stack to store its files on an S3-compatible
+// object storage (AWS, Ceph RGW, MinIO, etc.): buckets, objects, listing,
+// bulk delete and multipart uploads.
+//
+// The requests use the path-style addressing
+// (https://endpoint/bucket/key), and they are signed with the AWS Signature
+// Version 4.
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRegion is the region used when none is given in the options.
+	DefaultRegion = "us-east-1"
+	// DefaultPartSize is the size of the parts for the multipart uploads when
+	// none is given in the options.
+	DefaultPartSize = 16 << 20
+	// MinPartSize is the minimal size of a part for the multipart uploads
+	// (except for the last part).
+	MinPartSize = 5 << 20
+
+	// maxKeysPerDelete is the maximal number of keys in a single request to
+	// delete several objects.
+	maxKeysPerDelete = 1000
+
+	metaHeaderPrefix = "X-Amz-Meta-"
+)
+
+// ErrNotFound is returned when the bucket or the object does not exist.
+var ErrNotFound = errors.New("s3: not found")
+
+// Options is used to configure a new Client.
+type Options struct {
+	// Endpoint is the URL of the S3 service, only its scheme and host are
+	// used.
+	Endpoint  *url.URL
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Transport is the optional http transport used for the requests.
+	Transport http.RoundTripper
+	// PartSize is the size of the parts for the multipart uploads.
+	PartSize int64
+}
+
+// Client can be used to make requests to an S3 service. It is safe to use it
+// from several goroutines.
+type Client struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	partSize  int64
+	http      *http.Client
+}
+
+// New returns a client for the given options.
+func New(opts Options) *Client {
+	region := opts.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	partSize := opts.PartSize
+	if partSize < MinPartSize {
+		partSize = DefaultPartSize
+	}
+	return &Client{
+		endpoint:  &url.URL{Scheme: opts.Endpoint.Scheme, Host: opts.Endpoint.Host},
+		region:    region,
+		accessKey: opts.AccessKey,
+		secretKey: opts.SecretKey,
+		partSize:  partSize,
+		http:      &http.Client{Transport: opts.Transport},
+	}
+}
+
+// Error is the error returned by the S3 service.
+type Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	Key        string `xml:"Key"`
+}
+
+func (e *Error) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("s3: %s (%d) on %s: %s", e.Code, e.StatusCode, e.Key, e.Message)
+	}
+	return fmt.Sprintf("s3: %s (%d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// IsNotFound returns true if the error means that the bucket, the object or
+// the multipart upload does not exist.
+func IsNotFound(err error) bool {
+	if err == ErrNotFound {
+		return true
+	}
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// ObjectInfo is the description of an object.
+type ObjectInfo struct {
+	Key             string
+	Size            int64
+	ETag            string
+	LastModified    time.Time
+	ContentType     string
+	ContentEncoding string
+	// Metadata are the user-defined metadata (x-amz-meta-*), with their keys
+	// in lower case.
+	Metadata map[string]string
+}
+
+// PutOptions are the options that can be given when creating an object.
+type PutOptions struct {
+	ContentType     string
+	ContentEncoding string
+	// ContentMD5 is the optional md5sum of the content: the object is not
+	// created if the content does not match. It is ignored for the
+	// multipart uploads.
+	ContentMD5 []byte
+	Metadata   map[string]string
+}
+
+func (o *PutOptions) setHeaders(h http.Header, withMD5 bool) {
+	if o == nil {
+		return
+	}
+	if o.ContentType != "" {
+		h.Set("Content-Type", o.ContentType)
+	}
+	if o.ContentEncoding != "" {
+		h.Set("Content-Encoding", o.ContentEncoding)
+	}
+	if withMD5 && len(o.ContentMD5) > 0 {
+		h.Set("Content-Md5", base64.StdEncoding.EncodeToString(o.ContentMD5))
+	}
+	for k, v := range o.Metadata {
+		h.Set(metaHeaderPrefix+k, v)
+	}
+}
+
+func (c *Client) newRequest(method, bucket, key string, query url.Values, body []byte) *http.Request {
+	p := "/" + bucket
+	if key != "" {
+		p += "/" + key
+	}
+	u := *c.endpoint
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	if query != nil {
+		u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+	req := &http.Request{
+		Method:     method,
+		URL:        &u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return req
+}
+
+// do signs and sends the request. The body of the response must be closed by
+// the caller if there is no error.
+func (c *Client) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	c.sign(req, payloadHash, time.Now())
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, parseError(res)
+	}
+	return res, nil
+}
+
+// doWithBody sends a request with a body kept in memory.
+func (c *Client) doWithBody(method, bucket, key string, query url.Values, body []byte) (*http.Response, error) {
+	req := c.newRequest(method, bucket, key, query, body)
+	sum := md5.Sum(body)
+	req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	return c.do(req, hashHex(body))
+}
+
+func parseError(res *http.Response) error {
+	e := &Error{StatusCode: res.StatusCode}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if len(body) == 0 || xml.Unmarshal(body, e) != nil {
+		e.Code = http.StatusText(res.StatusCode)
+	}
+	return e
+}
+
+// parseBody reads an XML response. Some operations can return an error in the
+// body of a response with a 200 status code, and this function checks for it.
+func parseBody(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		e := &Error{StatusCode: res.StatusCode}
+		if err = xml.Unmarshal(body, e); err == nil {
+			return e
+		}
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(body, v)
+}
+
+// HeadBucket checks that the bucket exists.
+func (c *Client) HeadBucket(bucket string) error {
+	req := c.newRequest(http.MethodHead, bucket, "", nil, nil)
+	res, err := c.do(req, emptyPayload)
+	if err != nil {
+		if IsNotFound(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return res.Body.Close()
+}
+
+// CreateBucket creates a new bucket.
+func (c *Client) CreateBucket(bucket string) error {
+	var body []byte
+	if c.region != DefaultRegion {
+		body = []byte(`<CreateBucketConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+			`<LocationConstraint>` + c.region + `</LocationConstraint>` +
+			`</CreateBucketConfiguration>`)
+	}
+	req := c.newRequest(http.MethodPut, bucket, "", nil, body)
+	payloadHash := emptyPayload
+	if body != nil {
+		payloadHash = hashHex(body)
+	}
+	res, err := c.do(req, payloadHash)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// EnsureBucket creates the bucket if it does not exist yet.
+func (c *Client) EnsureBucket(bucket string) error {
+	err := c.HeadBucket(bucket)
+	if err != ErrNotFound {
+		return err
+	}
+	err = c.CreateBucket(bucket)
+	if e, ok := err.(*Error); ok && e.Code == "BucketAlreadyOwnedByYou" {
+		return nil
+	}
+	return err
+}
+
+// DeleteBucket deletes a bucket, that must be empty.
+func (c *Client) DeleteBucket(bucket string) error {
+	req := c.newRequest(http.MethodDelete, bucket, "", nil, nil)
+	res, err := c.do(req, emptyPayload)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// PutObject creates an object with the content read from r, that must have
+// the given size.
+func (c *Client) PutObject(bucket, key string, r io.Reader, size int64, opts *PutOptions) (*ObjectInfo, error) {
+	req := c.newRequest(http.MethodPut, bucket, key, nil, nil)
+	req.Body = ioutil.NopCloser(r)
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	opts.setHeaders(req.Header, true)
+	res, err := c.do(req, unsignedPayload)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return &ObjectInfo{
+		Key:  key,
+		Size: size,
+		ETag: trimETag(res.Header.Get("Etag")),
+	}, nil
+}
+
+// PutObjectBytes creates an object with the given content.
+func (c *Client) PutObjectBytes(bucket, key string, content []byte, opts *PutOptions) (*ObjectInfo, error) {
+	return c.PutObject(bucket, key, bytes.NewReader(content), int64(len(content)), opts)
+}
+
+// MaxCopySize is the maximal size of an object that can be copied with
+// CopyObject (5 GiB).
+const MaxCopySize = 5 << 30
+
+type copyResult struct {
+	ETag string `xml:"ETag"`
+}
+
+// CopyObject creates the object dstKey in the bucket with the content and
+// the metadata of the object srcKey of the same bucket, without having to
+// download and send again the content.
+func (c *Client) CopyObject(bucket, srcKey, dstKey string) (*ObjectInfo, error) {
+	req := c.newRequest(http.MethodPut, bucket, dstKey, nil, nil)
+	req.Header.Set("X-Amz-Copy-Source", uriEncode("/"+bucket+"/"+srcKey, false))
+	res, err := c.do(req, emptyPayload)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var result copyResult
+	if err = parseBody(res, &result); err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: dstKey, ETag: trimETag(result.ETag)}, nil
+}
+
+// HeadObject returns the description of an object.
+func (c *Client) HeadObject(bucket, key string) (*ObjectInfo, error) {
+	req := c.newRequest(http.MethodHead, bucket, key, nil, nil)
+	res, err := c.do(req, emptyPayload)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	res.Body.Close()
+	return objectInfoFromHeaders(key, res.Header, res.ContentLength), nil
+}
+
+// DeleteObject deletes an object. No error is returned if the object does not
+// exist.
+func (c *Client) DeleteObject(bucket, key string) error {
+	req := c.newRequest(http.MethodDelete, bucket, key, nil, nil)
+	res, err := c.do(req, emptyPayload)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return res.Body.Close()
+}
+
+type deleteRequest struct {
+	XMLName xml.Name       `xml:"Delete"`
+	Quiet   bool           `xml:"Quiet"`
+	Objects []deleteObject `xml:"Object"`
+}
+
+type deleteObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteResult struct {
+	Errors []Error `xml:"Error"`
+}
+
+// DeleteObjects deletes several objects. The keys that do not exist are
+// ignored.
+func (c *Client) DeleteObjects(bucket string, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxKeysPerDelete {
+			n = maxKeysPerDelete
+		}
+		if err := c.deleteObjects(bucket, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func (c *Client) deleteObjects(bucket string, keys []string) error {
+	del := deleteRequest{Quiet: true, Objects: make([]deleteObject, len(keys))}
+	for i, key := range keys {
+		del.Objects[i].Key = key
+	}
+	body, err := xml.Marshal(del)
+	if err != nil {
+		return err
+	}
+	res, err := c.doWithBody(http.MethodPost, bucket, "", url.Values{"delete": {""}}, body)
+	if err != nil {
+		return err
+	}
+	var result deleteResult
+	if err = parseBody(res, &result); err != nil {
+		return err
+	}
+	for _, e := range result.Errors {
+		if e.Code != "NoSuchKey" {
+			e.StatusCode = res.StatusCode
+			return &e
+		}
+	}
+	return nil
+}
+
+type listResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+// ListObjects calls fn for each object of the bucket whose key starts with
+// the given prefix, in the lexicographic order of the keys. The size, etag
+// and date of last modification are filled in the ObjectInfo, but not the
+// content-type and the metadata.
+func (c *Client) ListObjects(bucket, prefix string, fn func(obj *ObjectInfo) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req := c.newRequest(http.MethodGet, bucket, "", query, nil)
+		res, err := c.do(req, emptyPayload)
+		if err != nil {
+			return err
+		}
+		var result listResult
+		if err = parseBody(res, &result); err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			info := &ObjectInfo{
+				Key:          obj.Key,
+				Size:         obj.Size,
+				ETag:         trimETag(obj.ETag),
+				LastModified: obj.LastModified,
+			}
+			if err = fn(info); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// ListKeys returns the keys of the objects of the bucket that starts with the
+// given prefix.
+func (c *Client) ListKeys(bucket, prefix string) ([]string, error) {
+	var keys []string
+	err := c.ListObjects(bucket, prefix, func(obj *ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	return keys, err
+}
+
+// DeletePrefix deletes all the objects of the bucket whose key starts with
+// the given prefix.
+func (c *Client) DeletePrefix(bucket, prefix string) error {
+	keys, err := c.ListKeys(bucket, prefix)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return c.DeleteObjects(bucket, keys)
+}
+
+func objectInfoFromHeaders(key string, h http.Header, size int64) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:             key,
+		Size:            size,
+		ETag:            trimETag(h.Get("Etag")),
+		ContentType:     h.Get("Content-Type"),
+		ContentEncoding: h.Get("Content-Encoding"),
+		Metadata:        make(map[string]string),
+	}
+	if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+	for name, values := range h {
+		if strings.HasPrefix(name, metaHeaderPrefix) && len(values) > 0 {
+			info.Metadata[strings.ToLower(name[len(metaHeaderPrefix):])] = values[0]
+		}
+	}
+	return info
+}
+
+func trimETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// MD5Sum returns the md5sum of the content of the object from its ETag. It
+// returns nil when the ETag is not a md5sum, like for the objects created with
+// a multipart upload.
+func (o *ObjectInfo) MD5Sum() []byte {
+	if len(o.ETag) != 2*md5.Size {
+		return nil
+	}
+	sum, err := hex.DecodeString(o.ETag)
+	if err != nil {
+		return nil
+	}
+	return sum
+}
+
+func formatRange(start, end int64) string {
+	if end < 0 {
+		return "bytes=" + strconv.FormatInt(start, 10) + "-"
+	}
+	return "bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10)
+}
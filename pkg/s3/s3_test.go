@@ -0,0 +1,163 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/s3/s3test"
+	"github.com/stretchr/testify/assert"
+)
+
+var client *Client
+
+const bucket = "cozy-test"
+
+func TestBucket(t *testing.T) {
+	assert.Equal(t, ErrNotFound, client.HeadBucket("unknown"))
+	assert.NoError(t, client.EnsureBucket(bucket))
+	assert.NoError(t, client.EnsureBucket(bucket))
+	assert.NoError(t, client.HeadBucket(bucket))
+}
+
+func TestObject(t *testing.T) {
+	opts := &PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"creation-name": "foo.txt"},
+	}
+	content := []byte("Hello world")
+	info, err := client.PutObjectBytes(bucket, "dir/foo bar+baz.txt", content, opts)
+	assert.NoError(t, err)
+	sum := md5.Sum(content)
+	assert.Equal(t, sum[:], info.MD5Sum())
+
+	info, err = client.HeadObject(bucket, "dir/foo bar+baz.txt")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 11, info.Size)
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.Equal(t, "foo.txt", info.Metadata["creation-name"])
+
+	buf, _, err := client.GetObject(bucket, "dir/foo bar+baz.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, buf)
+
+	obj, err := client.OpenObject(bucket, "dir/foo bar+baz.txt")
+	assert.NoError(t, err)
+	_, err = obj.Seek(6, io.SeekStart)
+	assert.NoError(t, err)
+	buf, err = ioutil.ReadAll(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(buf))
+	p := make([]byte, 5)
+	n, err := obj.ReadAt(p, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "llo w", string(p))
+	n, err = obj.ReadAt(p, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "rld", string(p[:n]))
+	assert.NoError(t, obj.Close())
+
+	info, err = client.CopyObject(bucket, "dir/foo bar+baz.txt", "dir/copy")
+	assert.NoError(t, err)
+	assert.Equal(t, sum[:], info.MD5Sum())
+	buf, info, err = client.GetObject(bucket, "dir/copy")
+	assert.NoError(t, err)
+	assert.Equal(t, content, buf)
+	assert.Equal(t, "foo.txt", info.Metadata["creation-name"])
+	_, err = client.CopyObject(bucket, "dir/unknown", "dir/copy2")
+	assert.True(t, IsNotFound(err))
+
+	_, err = client.PutObjectBytes(bucket, "dir/bad-md5", content, &PutOptions{ContentMD5: []byte("0123456789abcdef")})
+	assert.Error(t, err)
+
+	assert.NoError(t, client.DeleteObject(bucket, "dir/foo bar+baz.txt"))
+	assert.NoError(t, client.DeleteObject(bucket, "dir/foo bar+baz.txt"))
+	_, err = client.HeadObject(bucket, "dir/foo bar+baz.txt")
+	assert.True(t, IsNotFound(err))
+	_, err = client.OpenObject(bucket, "dir/foo bar+baz.txt")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestListAndDelete(t *testing.T) {
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("list/%03d", i)
+		_, err := client.PutObjectBytes(bucket, key, []byte(key), nil)
+		assert.NoError(t, err)
+	}
+	_, err := client.PutObjectBytes(bucket, "other", []byte("other"), nil)
+	assert.NoError(t, err)
+
+	keys, err := client.ListKeys(bucket, "list/")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 250)
+	assert.Equal(t, "list/000", keys[0])
+	assert.Equal(t, "list/249", keys[249])
+
+	assert.NoError(t, client.DeletePrefix(bucket, "list/"))
+	keys, err = client.ListKeys(bucket, "list/")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 0)
+	_, err = client.HeadObject(bucket, "other")
+	assert.NoError(t, err)
+}
+
+func TestWriter(t *testing.T) {
+	w := client.NewWriter(bucket, "small", &PutOptions{ContentType: "text/plain"})
+	_, err := w.Write([]byte("foo"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.EqualValues(t, 3, w.Info().Size)
+	buf, info, err := client.GetObject(bucket, "small")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+	assert.Equal(t, "text/plain", info.ContentType)
+
+	content := bytes.Repeat([]byte("0123456789"), 1200*1024)
+	w = client.NewWriter(bucket, "big", &PutOptions{ContentType: "text/plain"})
+	for i := 0; i < len(content); i += 100000 {
+		end := i + 100000
+		if end > len(content) {
+			end = len(content)
+		}
+		_, err = w.Write(content[i:end])
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	assert.Len(t, w.parts, 3)
+	assert.Nil(t, w.Info().MD5Sum())
+	buf, info, err = client.GetObject(bucket, "big")
+	assert.NoError(t, err)
+	assert.Equal(t, content, buf)
+	assert.Equal(t, "text/plain", info.ContentType)
+
+	w = client.NewWriter(bucket, "aborted", nil)
+	_, err = w.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Abort())
+	_, err = client.HeadObject(bucket, "aborted")
+	assert.True(t, IsNotFound(err))
+	_, err = w.Write(content)
+	assert.Equal(t, ErrWriterClosed, err)
+}
+
+func TestMain(m *testing.M) {
+	srv, err := s3test.NewServer("")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	client = New(Options{
+		Endpoint:  srv.Endpoint(),
+		AccessKey: s3test.AccessKey,
+		SecretKey: s3test.SecretKey,
+		PartSize:  MinPartSize,
+	})
+	res := m.Run()
+	srv.Close()
+	os.Exit(res)
+}
@@ -0,0 +1,516 @@
+// Package s3test provides a fake S3 server, that keeps its objects in memory.
+// It implements only the subset of the S3 API used by the s3 package, and it
+// can be used for the tests.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AccessKey is the access key accepted by the server.
+	AccessKey = "s3test"
+	// SecretKey is the secret key to use with the server. The signatures are
+	// not verified.
+	SecretKey = "s3test"
+
+	// maxKeys is the number of keys returned on a page of a listing. It is
+	// low to test the pagination.
+	maxKeys = 100
+)
+
+// Server is a fake S3 server.
+type Server struct {
+	URL string
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	uploads map[string]*upload
+	nextID  int
+}
+
+type bucket struct {
+	objects map[string]*object
+}
+
+type object struct {
+	content  []byte
+	etag     string
+	modified time.Time
+	headers  http.Header
+}
+
+type upload struct {
+	bucket  string
+	key     string
+	headers http.Header
+	parts   map[int][]byte
+}
+
+// NewServer starts a new fake S3 server. The address can be empty to listen
+// on a random port of localhost.
+func NewServer(addr string) (*Server, error) {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		buckets: make(map[string]*bucket),
+		uploads: make(map[string]*upload),
+	}
+	s.srv = &httptest.Server{
+		Listener: l,
+		Config:   &http.Server{Handler: s},
+	}
+	s.srv.Start()
+	s.URL = s.srv.URL
+	return s, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(s3Error{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.Contains(auth, "Credential="+AccessKey+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "Bad access key")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucketName := parts[0]
+	if bucketName == "" {
+		writeError(w, http.StatusBadRequest, "InvalidBucketName", "No bucket")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(parts) == 1 || parts[1] == "" {
+		s.serveBucket(w, r, bucketName)
+		return
+	}
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The bucket does not exist")
+		return
+	}
+	s.serveObject(w, r, bucketName, b, parts[1])
+}
+
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, name string) {
+	b, ok := s.buckets[name]
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodPut:
+		if ok {
+			writeError(w, http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists")
+			return
+		}
+		s.buckets[name] = &bucket{objects: make(map[string]*object)}
+		return
+	}
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The bucket does not exist")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		return
+	case http.MethodDelete:
+		if len(b.objects) > 0 {
+			writeError(w, http.StatusConflict, "BucketNotEmpty", "The bucket is not empty")
+			return
+		}
+		delete(s.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		s.listObjects(w, b, query.Get("prefix"), query.Get("continuation-token"))
+	case http.MethodPost:
+		if _, ok := query["delete"]; ok {
+			s.deleteObjects(w, r, b)
+			return
+		}
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Unknown operation")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Bad method")
+	}
+}
+
+type listContent struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int       `xml:"Size"`
+}
+
+type listResult struct {
+	XMLName               xml.Name      `xml:"ListBucketResult"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+	Contents              []listContent `xml:"Contents"`
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, b *bucket, prefix, token string) {
+	var keys []string
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var result listResult
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[maxKeys-1]
+	}
+	for _, key := range keys {
+		obj := b.objects[key]
+		result.Contents = append(result.Contents, listContent{
+			Key:          key,
+			LastModified: obj.modified,
+			ETag:         `"` + obj.etag + `"`,
+			Size:         len(obj.content),
+		})
+	}
+	writeXML(w, result)
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, b *bucket) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !checkMD5(r, body) {
+		writeError(w, http.StatusBadRequest, "BadDigest", "The Content-MD5 does not match")
+		return
+	}
+	var del deleteRequest
+	if err = xml.Unmarshal(body, &del); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	for _, obj := range del.Objects {
+		delete(b.objects, obj.Key)
+	}
+	writeXML(w, deleteResult{})
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, bucketName string, b *bucket, key string) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodPut:
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			s.uploadPart(w, r, uploadID, query.Get("partNumber"))
+			return
+		}
+		s.putObject(w, r, b, key)
+	case http.MethodPost:
+		if _, ok := query["uploads"]; ok {
+			s.nextID++
+			uploadID := strconv.Itoa(s.nextID)
+			s.uploads[uploadID] = &upload{
+				bucket:  bucketName,
+				key:     key,
+				headers: objectHeaders(r.Header),
+				parts:   make(map[int][]byte),
+			}
+			writeXML(w, struct {
+				XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+				UploadID string   `xml:"UploadId"`
+			}{UploadID: uploadID})
+			return
+		}
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			s.completeUpload(w, r, b, uploadID)
+			return
+		}
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Unknown operation")
+	case http.MethodDelete:
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			if _, ok := s.uploads[uploadID]; !ok {
+				writeError(w, http.StatusNotFound, "NoSuchUpload", "The upload does not exist")
+				return
+			}
+			delete(s.uploads, uploadID)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := b.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The key does not exist")
+			return
+		}
+		for name, values := range obj.headers {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Etag", `"`+obj.etag+`"`)
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+		content := obj.content
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end, ok := parseRange(rng, len(content))
+			if !ok {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "Bad range")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+			content = content[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Bad method")
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, b *bucket, key string) {
+	if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+		s.copyObject(w, source, b, key)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !checkMD5(r, body) {
+		writeError(w, http.StatusBadRequest, "BadDigest", "The Content-MD5 does not match")
+		return
+	}
+	sum := md5.Sum(body)
+	obj := &object{
+		content:  body,
+		etag:     hex.EncodeToString(sum[:]),
+		modified: time.Now(),
+		headers:  objectHeaders(r.Header),
+	}
+	b.objects[key] = obj
+	w.Header().Set("Etag", `"`+obj.etag+`"`)
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, source string, dst *bucket, key string) {
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Bad copy source")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) != 2 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Bad copy source")
+		return
+	}
+	var src *object
+	if b, ok := s.buckets[parts[0]]; ok {
+		src = b.objects[parts[1]]
+	}
+	if src == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The key does not exist")
+		return
+	}
+	obj := &object{
+		content:  src.content,
+		etag:     src.etag,
+		modified: time.Now(),
+		headers:  src.headers,
+	}
+	dst.objects[key] = obj
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		ETag    string   `xml:"ETag"`
+	}{ETag: `"` + obj.etag + `"`})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, uploadID, partNumber string) {
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The upload does not exist")
+		return
+	}
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Bad part number")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !checkMD5(r, body) {
+		writeError(w, http.StatusBadRequest, "BadDigest", "The Content-MD5 does not match")
+		return
+	}
+	u.parts[n] = body
+	sum := md5.Sum(body)
+	w.Header().Set("Etag", `"`+hex.EncodeToString(sum[:])+`"`)
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, b *bucket, uploadID string) {
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The upload does not exist")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	var req completeRequest
+	if err = xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "Bad request")
+		return
+	}
+	var content bytes.Buffer
+	var sums []byte
+	for i, p := range req.Parts {
+		part, ok := u.parts[p.PartNumber]
+		sum := md5.Sum(part)
+		if !ok || strings.Trim(p.ETag, `"`) != hex.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", "Bad part")
+			return
+		}
+		if i < len(req.Parts)-1 && len(part) < 5<<20 {
+			writeError(w, http.StatusBadRequest, "EntityTooSmall", "The part is too small")
+			return
+		}
+		content.Write(part)
+		sums = append(sums, sum[:]...)
+	}
+	sum := md5.Sum(sums)
+	obj := &object{
+		content:  content.Bytes(),
+		etag:     fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(req.Parts)),
+		modified: time.Now(),
+		headers:  u.headers,
+	}
+	b.objects[u.key] = obj
+	delete(s.uploads, uploadID)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Key: u.key, ETag: `"` + obj.etag + `"`})
+}
+
+func objectHeaders(h http.Header) http.Header {
+	headers := make(http.Header)
+	for name, values := range h {
+		if strings.HasPrefix(name, "X-Amz-Meta-") ||
+			name == "Content-Type" || name == "Content-Encoding" {
+			headers[name] = values
+		}
+	}
+	if headers.Get("Content-Type") == "" {
+		headers.Set("Content-Type", "binary/octet-stream")
+	}
+	return headers
+}
+
+func checkMD5(r *http.Request, body []byte) bool {
+	expected := r.Header.Get("Content-Md5")
+	if expected == "" {
+		return true
+	}
+	sum := md5.Sum(body)
+	return expected == base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func parseRange(rng string, size int) (int, int, bool) {
+	if !strings.HasPrefix(rng, "bytes=") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if parts[1] != "" {
+		if end, err = strconv.Atoi(parts[1]); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+// Endpoint returns the URL of the server, parsed.
+func (s *Server) Endpoint() *url.URL {
+	u, _ := url.Parse(s.URL)
+	return u
+}
@@ -0,0 +1,143 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm   = "AWS4-HMAC-SHA256"
+	signService     = "s3"
+	amzDateFormat   = "20060102T150405Z"
+	amzScopeFormat  = "20060102"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// sign adds the headers for the AWS Signature Version 4 to the request. The
+// payloadHash is the hex-encoded SHA256 of the body, or UNSIGNED-PAYLOAD when
+// the body is streamed.
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	scope := strings.Join([]string{
+		now.Format(amzScopeFormat),
+		c.region,
+		signService,
+		"aws4_request",
+	}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		amzDate,
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), []byte(now.Format(amzScopeFormat)))
+	key = hmacSHA256(key, []byte(c.region))
+	key = hmacSHA256(key, []byte(signService))
+	key = hmacSHA256(key, []byte("aws4_request"))
+	signature := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+
+	req.Header.Set("Authorization", signAlgorithm+
+		" Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// canonicalHeaders returns the list of the signed headers, and their
+// canonical form. The host, the content-type, the content-md5 and all the
+// x-amz-* headers are signed.
+func canonicalHeaders(req *http.Request) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "content-md5" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf strings.Builder
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte(':')
+		buf.WriteString(headers[name])
+		buf.WriteByte('\n')
+	}
+	return strings.Join(names, ";"), buf.String()
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		vals := values[key]
+		sort.Strings(vals)
+		for _, val := range vals {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(val, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes a string with the rules of the AWS signature: only the
+// unreserved characters are kept as is, and the slashes too when they are
+// used in a path.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexChars = "0123456789ABCDEF"
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(hexChars[c>>4])
+			buf.WriteByte(hexChars[c&15])
+		}
+	}
+	return buf.String()
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(data)
+	return h.Sum(nil)
+}
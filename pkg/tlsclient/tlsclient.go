@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -14,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -33,8 +35,16 @@ type HTTPEndpoint struct {
 	InsecureSkipValidation bool
 	MaxIdleConnsPerHost    int
 	DisableCompression     bool
+	// PublicIPsOnly rejects the connections to the loopback, private and
+	// link-local addresses, after the DNS resolution. It is used for the
+	// requests to URLs given by the users, to avoid SSRF.
+	PublicIPsOnly bool
 }
 
+// ErrPrivateIP is used when a connection to a non-public IP address is
+// rejected.
+var ErrPrivateIP = errors.New("tlsclient: connection to a private IP address is not allowed")
+
 // ClientCertificateFilePair is a struct with a certificate and a key pair
 type ClientCertificateFilePair struct {
 	KeyFile         string
@@ -48,6 +58,19 @@ type tlsConfig struct {
 	skipVerification   bool
 }
 
+// publicIPsOnly is used as the Control function of a net.Dialer: it is called
+// with the resolved address, just before the connection.
+func publicIPsOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !utils.IsPublicIP(net.ParseIP(host)) {
+		return ErrPrivateIP
+	}
+	return nil
+}
+
 func generateURL(host string, port int) (*url.URL, error) {
 	u, err := url.Parse(host)
 	if err != nil {
@@ -111,6 +134,14 @@ func NewHTTPClient(opt HTTPEndpoint) (client *http.Client, u *url.URL, err error
 	if opt.DisableCompression {
 		tr.DisableCompression = true
 	}
+	if opt.PublicIPsOnly {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   publicIPsOnly,
+		}
+		tr.DialContext = dialer.DialContext
+	}
 	client = &http.Client{
 		Timeout:   opt.Timeout,
 		Transport: &tr,
@@ -73,6 +73,45 @@ func StripPort(domain string) string {
 	return domain
 }
 
+// privateNetworks are the IP ranges that are not reachable on internet: the
+// private networks (RFC 1918 and RFC 4193) and the shared address space of the
+// carrier-grade NAT (RFC 6598).
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// IsPublicIP returns true if the IP address is a public unicast address,
+// ie not a loopback, private, link-local, multicast or unspecified address.
+func IsPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4[0] == 0 || ip4.Equal(net.IPv4bcast) {
+			return false
+		}
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
 // CookieDomain removes the port and does IDNA encoding.
 func CookieDomain(domain string) string {
 	domain = StripPort(domain)
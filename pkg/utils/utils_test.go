@@ -2,6 +2,7 @@ package utils
 
 import (
 	"math/rand"
+	"net"
 	"os"
 	"sync"
 	"testing"
@@ -80,6 +81,20 @@ func TestSplitTrimString(t *testing.T) {
 	assert.EqualValues(t, []string{}, parts5)
 }
 
+func TestIsPublicIP(t *testing.T) {
+	for _, s := range []string{"1.1.1.1", "212.47.224.1", "2606:4700:4700::1111"} {
+		assert.True(t, IsPublicIP(net.ParseIP(s)), s)
+	}
+	for _, s := range []string{
+		"127.0.0.1", "0.0.0.0", "10.1.2.3", "172.17.0.1", "192.168.1.1",
+		"169.254.169.254", "100.64.0.1", "255.255.255.255", "::1", "::",
+		"fe80::1", "fd00::1", "::ffff:127.0.0.1", "::ffff:10.0.0.1",
+	} {
+		assert.False(t, IsPublicIP(net.ParseIP(s)), s)
+	}
+	assert.False(t, IsPublicIP(nil))
+}
+
 func TestFileExists(t *testing.T) {
 	exists, err := FileExists("/no/such/file")
 	assert.NoError(t, err)
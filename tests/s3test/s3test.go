@@ -0,0 +1,34 @@
+// This script can be used to start a S3-like server that keeps in memory its
+// objects. It can be stared with `go run ./tests/s3test`. The access key and
+// secret key to use are both 's3test'.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+
+	"github.com/cozy/cozy-stack/pkg/s3/s3test"
+)
+
+func main() {
+	srv, err := s3test.NewServer("localhost:6007")
+	if err != nil {
+		panic(err)
+	}
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("cozy-stack serve '--fs-url=s3://%s/cozy?AccessKey=%s&SecretKey=%s'\n",
+		u.Host, s3test.AccessKey, s3test.SecretKey)
+
+	// Wait for CTRL-C
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+}
@@ -0,0 +1,113 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/notification/center"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// maxDropNameConflicts is the maximal number of suffixes tried to find a free
+// name for a file uploaded in a file drop.
+const maxDropNameConflicts = 1000
+
+// dropFileHandler is used to upload a file with the permissions of a file
+// drop. The link holder cannot see the content of the directory: the file is
+// renamed if another file has the same name, and only its name and size are
+// sent in the response.
+func dropFileHandler(c echo.Context, inst *instance.Instance, pdoc *permission.Permission) error {
+	if c.QueryParam("Type") != consts.FileType {
+		return middlewares.ErrForbidden
+	}
+	dirID := c.Param("file-id")
+	if dirID == "" || dirID != pdoc.DropDirID() {
+		return middlewares.ErrForbidden
+	}
+
+	fs := inst.VFS()
+	doc, err := FileDocFromReq(c, c.QueryParam("Name"), dirID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	doc.Tags = nil
+	doc.Executable = false
+	doc.CozyMetadata, _ = CozyMetadataFromClaims(c, true)
+	// AllowVFS rejects the permissions of a file drop, as the limits are
+	// checked only here.
+	if err = vfs.Allows(fs, pdoc.Permissions, permission.POST, doc); err != nil {
+		return middlewares.ErrForbidden
+	}
+	if doc.DocName, err = freeDropName(fs, dirID, doc.DocName); err != nil {
+		return WrapVfsError(err)
+	}
+
+	// The file is counted before the upload, so that concurrent uploads
+	// can't exceed the limits of the file drop.
+	log := inst.Logger().WithField("nspace", "files")
+	size := c.Request().ContentLength
+	if _, err = permission.ReserveDrop(inst, pdoc.ID(), size); err != nil {
+		return err
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	file, err := fs.CreateFile(doc, nil)
+	if err == nil {
+		_, err = io.Copy(file, c.Request().Body)
+		if cerr := file.Close(); cerr != nil && (err == nil || err == io.ErrUnexpectedEOF) {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Warnf("Error on uploading file in a file drop: %s", err)
+		if _, aerr := permission.AdjustDrop(inst, pdoc.ID(), -1, -size); aerr != nil {
+			log.Warnf("Cannot update the counters of the file drop %s: %s", pdoc.ID(), aerr)
+		}
+		return WrapVfsError(err)
+	}
+	if doc.ByteSize != size {
+		if _, err = permission.AdjustDrop(inst, pdoc.ID(), 0, doc.ByteSize-size); err != nil {
+			log.Warnf("Cannot update the counters of the file drop %s: %s", pdoc.ID(), err)
+		}
+	}
+	if dir, err := fs.DirByID(dirID); err == nil {
+		if err = center.PushFileDrop(inst, dir, doc); err != nil {
+			log.Warnf("Cannot notify about the file drop %s: %s", pdoc.ID(), err)
+		}
+	}
+
+	return c.JSON(http.StatusCreated, echo.Map{
+		"name": doc.DocName,
+		"size": doc.ByteSize,
+	})
+}
+
+// freeDropName returns a name for a file uploaded in a file drop that is not
+// used by another file or directory of the same directory.
+func freeDropName(fs vfs.VFS, dirID, name string) (string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; i < maxDropNameConflicts; i++ {
+		exists, err := fs.DirChildExists(dirID, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	return "", os.ErrExist
+}
@@ -62,6 +62,10 @@ var ErrDocTypeInvalid = errors.New("Invalid document type")
 // create a new directory.
 func CreationHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
+	if pdoc, err := middlewares.GetPermission(c); err == nil && pdoc.Type == permission.TypeShareDrop {
+		return dropFileHandler(c, instance, pdoc)
+	}
+
 	var doc jsonapi.Object
 	var err error
 	switch c.QueryParam("Type") {
@@ -207,7 +211,7 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 	if olddoc.CozyMetadata != nil {
 		newdoc.CozyMetadata = olddoc.CozyMetadata.Clone()
 	}
-	updateFileCozyMetadata(c, newdoc, true)
+	UpdateFileCozyMetadata(c, newdoc, true)
 
 	err = checkPerm(c, permission.PUT, nil, olddoc)
 	if err != nil {
@@ -405,7 +409,7 @@ func CopyVersionHandler(c echo.Context) error {
 	newdoc := olddoc.Clone().(*vfs.FileDoc)
 	newdoc.Metadata = meta
 	newdoc.Tags = utils.SplitTrimString(c.QueryParam("Tags"), TagSeparator)
-	updateFileCozyMetadata(c, newdoc, true)
+	UpdateFileCozyMetadata(c, newdoc, true)
 
 	content, err := fs.OpenFile(olddoc)
 	if err != nil {
@@ -433,6 +437,108 @@ func CopyVersionHandler(c echo.Context) error {
 	return err
 }
 
+// CopyHandler handles POST requests on /files/:file-id/copy.
+//
+// It can be used to copy a file or a directory, without having to download
+// and upload again the content. The copy of a directory is made by a job, and
+// its progress is sent via the realtime.
+func CopyHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+	dir, file, err := fs.DirOrFileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permission.GET, dir, file); err != nil {
+		return err
+	}
+
+	opts := &vfs.CopyOptions{
+		Metadata:     boolQueryParam(c, "CopyMetadata", true),
+		Tags:         boolQueryParam(c, "CopyTags", true),
+		ReferencedBy: boolQueryParam(c, "CopyReferencedBy", false),
+	}
+	opts.CozyMetadata, _ = CozyMetadataFromClaims(c, true)
+
+	dirID := c.QueryParam("DirID")
+	name := c.QueryParam("Name")
+	if file != nil {
+		if dirID == "" {
+			dirID = file.DirID
+		}
+		if name == "" {
+			name = file.DocName
+		}
+		newdoc, err := vfs.NewFileDocForCopy(file, dirID, name, opts)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if err = checkPerm(c, permission.POST, nil, newdoc); err != nil {
+			return err
+		}
+		if err = fs.CopyFile(file, newdoc); err != nil {
+			return WrapVfsError(err)
+		}
+		return FileData(c, http.StatusCreated, newdoc, false, nil)
+	}
+
+	if dirID == "" {
+		dirID = dir.DirID
+	}
+	if name == "" {
+		name = dir.DocName
+	}
+	parent, err := fs.DirByID(dirID)
+	if err != nil {
+		return WrapVfsError(vfs.ErrParentDoesNotExist)
+	}
+	newdir, err := vfs.NewDirDocForCopy(dir, parent, name, opts)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if newdir.Fullpath == dir.Fullpath || strings.HasPrefix(newdir.Fullpath, dir.Fullpath+"/") {
+		return WrapVfsError(vfs.ErrForbiddenDocMove)
+	}
+	if err = checkPerm(c, permission.POST, newdir, nil); err != nil {
+		return err
+	}
+	_, size, err := vfs.DirSize(fs, dir)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = vfs.CheckQuotaForCopy(fs, size); err != nil {
+		return WrapVfsError(err)
+	}
+	if err = fs.CreateDir(newdir); err != nil {
+		return WrapVfsError(err)
+	}
+
+	msg, err := job.NewMessage(&vfs.CopyDirMessage{
+		SourceID: dir.ID(),
+		DirID:    newdir.ID(),
+		Options:  *opts,
+	})
+	if err == nil {
+		_, err = job.System().PushJob(inst, &job.JobRequest{
+			WorkerType: "copy",
+			Message:    msg,
+		})
+	}
+	if err != nil {
+		_ = fs.DeleteDirDoc(newdir)
+		return err
+	}
+	return jsonapi.Data(c, http.StatusAccepted, newDir(newdir), nil)
+}
+
+func boolQueryParam(c echo.Context, param string, defaultValue bool) bool {
+	b, err := strconv.ParseBool(c.QueryParam(param))
+	if err != nil {
+		return defaultValue
+	}
+	return b
+}
+
 // ClearOldVersions is the handler for DELETE /files/versions.
 // It deletes all the old versions of all files to make space for new files.
 func ClearOldVersions(c echo.Context) error {
@@ -533,18 +639,18 @@ func applyPatch(c echo.Context, fs vfs.VFS, patch *docPatch) (err error) {
 		}
 	} else if patch.Trash {
 		if dir != nil {
-			updateDirCozyMetadata(c, dir)
+			UpdateDirCozyMetadata(c, dir)
 			dir, err = vfs.TrashDir(fs, dir)
 		} else {
-			updateFileCozyMetadata(c, file, false)
+			UpdateFileCozyMetadata(c, file, false)
 			file, err = vfs.TrashFile(fs, file)
 		}
 	} else {
 		if dir != nil {
-			updateDirCozyMetadata(c, dir)
+			UpdateDirCozyMetadata(c, dir)
 			dir, err = vfs.ModifyDirMetadata(fs, dir, &patch.DocPatch)
 		} else {
-			updateFileCozyMetadata(c, file, false)
+			UpdateFileCozyMetadata(c, file, false)
 			file, err = vfs.ModifyFileMetadata(fs, file, &patch.DocPatch)
 		}
 	}
@@ -581,17 +687,17 @@ func applyPatches(c echo.Context, fs vfs.VFS, patches []*docPatch) (errors []*js
 			}
 		} else if patch.Trash {
 			if dir != nil {
-				updateDirCozyMetadata(c, dir)
+				UpdateDirCozyMetadata(c, dir)
 				_, errp = vfs.TrashDir(fs, dir)
 			} else if file != nil {
-				updateFileCozyMetadata(c, file, false)
+				UpdateFileCozyMetadata(c, file, false)
 				_, errp = vfs.TrashFile(fs, file)
 			}
 		} else if dir != nil {
-			updateDirCozyMetadata(c, dir)
+			UpdateDirCozyMetadata(c, dir)
 			_, errp = vfs.ModifyDirMetadata(fs, dir, &patch.DocPatch)
 		} else if file != nil {
-			updateFileCozyMetadata(c, file, false)
+			UpdateFileCozyMetadata(c, file, false)
 			_, errp = vfs.ModifyFileMetadata(fs, file, &patch.DocPatch)
 		}
 		if errp != nil {
@@ -1068,7 +1174,7 @@ func TrashHandler(c echo.Context) error {
 	}
 
 	if dir != nil {
-		updateDirCozyMetadata(c, dir)
+		UpdateDirCozyMetadata(c, dir)
 		doc, errt := vfs.TrashDir(instance.VFS(), dir)
 		if errt != nil {
 			return WrapVfsError(errt)
@@ -1076,7 +1182,7 @@ func TrashHandler(c echo.Context) error {
 		return dirData(c, http.StatusOK, doc)
 	}
 
-	updateFileCozyMetadata(c, file, false)
+	UpdateFileCozyMetadata(c, file, false)
 	doc, errt := vfs.TrashFile(instance.VFS(), file)
 	if errt != nil {
 		return WrapVfsError(errt)
@@ -1120,7 +1226,7 @@ func RestoreTrashFileHandler(c echo.Context) error {
 	}
 
 	if dir != nil {
-		updateDirCozyMetadata(c, dir)
+		UpdateDirCozyMetadata(c, dir)
 		doc, errt := vfs.RestoreDir(instance.VFS(), dir)
 		if errt != nil {
 			return WrapVfsError(errt)
@@ -1128,7 +1234,7 @@ func RestoreTrashFileHandler(c echo.Context) error {
 		return dirData(c, http.StatusOK, doc)
 	}
 
-	updateFileCozyMetadata(c, file, false)
+	UpdateFileCozyMetadata(c, file, false)
 	doc, errt := vfs.RestoreFile(instance.VFS(), file)
 	if errt != nil {
 		return WrapVfsError(errt)
@@ -1316,6 +1422,7 @@ func Routes(router *echo.Group) {
 	router.PATCH("/:file-id/:version-id", ModifyFileVersionMetadata)
 	router.DELETE("/:file-id/:version-id", DeleteFileVersionMetadata)
 	router.POST("/:file-id/versions", CopyVersionHandler)
+	router.POST("/:file-id/copy", CopyHandler)
 	router.DELETE("/versions", ClearOldVersions)
 
 	router.POST("/_find", FindFilesMango)
@@ -1335,6 +1442,13 @@ func Routes(router *echo.Group) {
 	router.PUT("/:file-id", OverwriteFileContentHandler)
 	router.POST("/upload/metadata", UploadMetadataHandler)
 
+	router.POST("/uploads", CreateUploadHandler)
+	router.HEAD("/uploads/:upload-id", HeadUploadHandler)
+	router.GET("/uploads/:upload-id", GetUploadHandler)
+	router.PATCH("/uploads/:upload-id", UploadChunkHandler)
+	router.POST("/uploads/:upload-id", FinishUploadHandler)
+	router.DELETE("/uploads/:upload-id", AbortUploadHandler)
+
 	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler)
 
 	router.POST("/archive", ArchiveDownloadCreateHandler)
@@ -1402,6 +1516,12 @@ func wrapVfsError(err error) *jsonapi.Error {
 		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
 	case vfs.ErrWrongToken:
 		return jsonapi.BadRequest(err)
+	case vfs.ErrInvalidUploadOffset:
+		return jsonapi.Conflict(err)
+	case vfs.ErrUploadIncomplete:
+		return jsonapi.PreconditionFailed("Upload-Offset", err)
+	case vfs.ErrUploadExpired:
+		return jsonapi.Errorf(http.StatusGone, "%s", err)
 	}
 	if _, ok := err.(*jsonapi.Error); !ok {
 		logger.WithNamespace("files").Warnf("Not wrapped error: %s", err)
@@ -1562,7 +1682,9 @@ func instanceURL(c echo.Context) string {
 	return middlewares.GetInstance(c).PageURL("/", nil)
 }
 
-func updateDirCozyMetadata(c echo.Context, dir *vfs.DirDoc) {
+// UpdateDirCozyMetadata updates the cozyMetadata of a directory, with the
+// information from the permission claims of the request.
+func UpdateDirCozyMetadata(c echo.Context, dir *vfs.DirDoc) {
 	fcm, _ := CozyMetadataFromClaims(c, false)
 	if dir.CozyMetadata == nil {
 		fcm.CreatedAt = dir.CreatedAt
@@ -1577,7 +1699,9 @@ func updateDirCozyMetadata(c echo.Context, dir *vfs.DirDoc) {
 	}
 }
 
-func updateFileCozyMetadata(c echo.Context, file *vfs.FileDoc, setUploadFields bool) {
+// UpdateFileCozyMetadata updates the cozyMetadata of a file, with the
+// information from the permission claims of the request.
+func UpdateFileCozyMetadata(c echo.Context, file *vfs.FileDoc, setUploadFields bool) {
 	var oldSourceAccount, oldSourceIdentifier string
 	fcm, slug := CozyMetadataFromClaims(c, setUploadFields)
 	if file.CozyMetadata == nil {
@@ -1,13 +1,16 @@
 package files
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
@@ -50,6 +53,66 @@ func TestCreateDirBadVerb(t *testing.T) {
 	assert.Equal(t, 403, res.StatusCode)
 }
 
+func TestFileDrop(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=dropzone&Type=directory")
+	assert.Equal(t, 201, res.StatusCode)
+	dirID := data["data"].(map[string]interface{})["id"].(string)
+
+	code, err := testInstance.CreateShareCode("dropper")
+	assert.NoError(t, err)
+	pdoc := &permission.Permission{
+		Type:     permission.TypeShareDrop,
+		SourceID: consts.Apps + "/drive",
+		Permissions: permission.Set{
+			permission.Rule{
+				Type:   consts.Files,
+				Verbs:  permission.Verbs(permission.POST),
+				Values: []string{dirID},
+			},
+		},
+		Codes: map[string]string{"dropper": code},
+		Drop:  &permission.DropOptions{MaxFiles: 2},
+	}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, pdoc))
+
+	res, err = request("POST", "/files/"+dirID+"?Type=file&Name=dropped.txt", code, strings.NewReader("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var body map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.Equal(t, "dropped.txt", body["name"])
+
+	res, err = request("POST", "/files/"+dirID+"?Type=file&Name=dropped.txt", code, strings.NewReader("bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.Equal(t, "dropped (2).txt", body["name"])
+
+	// The max number of files has been reached
+	res, err = request("POST", "/files/"+dirID+"?Type=file&Name=third.txt", code, strings.NewReader("baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, 413, res.StatusCode)
+
+	// The link holder cannot create a directory, nor upload in another
+	// directory, nor read the content of the directory
+	res, err = request("POST", "/files/"+dirID+"?Type=directory&Name=subdir", code, strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+	res, err = request("POST", "/files/?Type=file&Name=root.txt", code, strings.NewReader("qux"))
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+	res, err = request("GET", "/files/"+dirID, code, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+
+	updated, err := permission.GetByID(testInstance, pdoc.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, updated.Drop.FilesCount)
+	assert.EqualValues(t, 6, updated.Drop.BytesCount)
+}
+
 func request(m, path, token string, body io.Reader) (*http.Response, error) {
 	req, err := http.NewRequest(m, ts.URL+path, body)
 	if err != nil {
@@ -35,11 +35,11 @@ func AddReferencedHandler(c echo.Context) error {
 
 	if dir != nil {
 		dir.AddReferencedBy(references...)
-		updateDirCozyMetadata(c, dir)
+		UpdateDirCozyMetadata(c, dir)
 		err = couchdb.UpdateDoc(instance, dir)
 	} else {
 		file.AddReferencedBy(references...)
-		updateFileCozyMetadata(c, file, false)
+		UpdateFileCozyMetadata(c, file, false)
 		err = couchdb.UpdateDoc(instance, file)
 	}
 
@@ -75,11 +75,11 @@ func RemoveReferencedHandler(c echo.Context) error {
 
 	if dir != nil {
 		dir.RemoveReferencedBy(references...)
-		updateDirCozyMetadata(c, dir)
+		UpdateDirCozyMetadata(c, dir)
 		err = couchdb.UpdateDoc(instance, dir)
 	} else {
 		file.RemoveReferencedBy(references...)
-		updateFileCozyMetadata(c, file, false)
+		UpdateFileCozyMetadata(c, file, false)
 		err = couchdb.UpdateDoc(instance, file)
 	}
 
@@ -184,13 +184,13 @@ func AddReferencesHandler(c echo.Context) error {
 		if dir != nil {
 			oldDir := dir.Clone()
 			dir.AddReferencedBy(docRef)
-			updateDirCozyMetadata(c, dir)
+			UpdateDirCozyMetadata(c, dir)
 			docs[i] = dir
 			oldDocs[i] = oldDir
 		} else {
 			oldFile := file.Clone()
 			file.AddReferencedBy(docRef)
-			updateFileCozyMetadata(c, file, false)
+			UpdateFileCozyMetadata(c, file, false)
 			docs[i] = file
 			oldDocs[i] = oldFile
 		}
@@ -248,14 +248,14 @@ func RemoveReferencesHandler(c echo.Context) error {
 			if altRef != nil {
 				dir.RemoveReferencedBy(*altRef)
 			}
-			updateDirCozyMetadata(c, dir)
+			UpdateDirCozyMetadata(c, dir)
 			err = couchdb.UpdateDoc(instance, dir)
 		} else {
 			file.RemoveReferencedBy(docRef)
 			if altRef != nil {
 				file.RemoveReferencedBy(*altRef)
 			}
-			updateFileCozyMetadata(c, file, false)
+			UpdateFileCozyMetadata(c, file, false)
 			err = couchdb.UpdateDoc(instance, file)
 		}
 		if err != nil {
@@ -0,0 +1,207 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// UploadOffsetHeader is the HTTP header used for the offset of a
+	// resumable upload
+	UploadOffsetHeader = "Upload-Offset"
+	// UploadLengthHeader is the HTTP header used for the total size of a
+	// resumable upload
+	UploadLengthHeader = "Upload-Length"
+)
+
+type apiUpload struct {
+	*vfs.UploadSession
+}
+
+func (u *apiUpload) Relationships() jsonapi.RelationshipMap { return nil }
+func (u *apiUpload) Included() []jsonapi.Object             { return nil }
+func (u *apiUpload) MarshalJSON() ([]byte, error)           { return json.Marshal(u.UploadSession) }
+func (u *apiUpload) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/uploads/" + u.ID()}
+}
+
+var _ jsonapi.Object = (*apiUpload)(nil)
+
+func setUploadHeaders(c echo.Context, u *vfs.UploadSession) {
+	h := c.Response().Header()
+	h.Set(UploadOffsetHeader, strconv.FormatInt(u.Offset, 10))
+	h.Set(UploadLengthHeader, strconv.FormatInt(u.Size, 10))
+	h.Set("Cache-Control", "no-store")
+}
+
+func uploadData(c echo.Context, statusCode int, u *vfs.UploadSession) error {
+	setUploadHeaders(c, u)
+	return jsonapi.Data(c, statusCode, &apiUpload{u}, nil)
+}
+
+// getUploadSession returns the upload session of the request, after having
+// checked that the permissions allow to create the file of this upload.
+func getUploadSession(c echo.Context) (*vfs.UploadSession, error) {
+	inst := middlewares.GetInstance(c)
+	u, err := vfs.GetUploadSession(inst, c.Param("upload-id"))
+	if err != nil {
+		return nil, WrapVfsError(err)
+	}
+	doc, err := u.FileDoc()
+	if err != nil {
+		return nil, WrapVfsError(err)
+	}
+	if err = checkPerm(c, permission.POST, nil, doc); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// CreateUploadHandler handles POST requests on /files/uploads, to start a
+// resumable upload. The parameters are the same as for the upload of a file
+// in a single request, except that the total size of the file must be given
+// in the Size parameter (or in the Upload-Length header), and that the
+// request has no body.
+func CreateUploadHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	size := c.QueryParam("Size")
+	if size == "" {
+		size = c.Request().Header.Get(UploadLengthHeader)
+	}
+	byteSize, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || byteSize < 0 {
+		return jsonapi.InvalidParameter("Size", errors.New("Invalid size"))
+	}
+
+	dirID := c.QueryParam("DirID")
+	if dirID == "" {
+		dirID = consts.RootDirID
+	}
+	doc, err := FileDocFromReq(c, c.QueryParam("Name"), dirID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	doc.ByteSize = byteSize
+	if created := c.QueryParam("CreatedAt"); created != "" {
+		if at, err2 := time.Parse(time.RFC3339, created); err2 == nil {
+			doc.CreatedAt = at
+		}
+	}
+	doc.CozyMetadata, _ = CozyMetadataFromClaims(c, true)
+
+	if err = checkPerm(c, permission.POST, nil, doc); err != nil {
+		return err
+	}
+
+	u, err := vfs.CreateUploadSession(inst.VFS(), doc)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = pushCleanUploadTrigger(inst, u); err != nil {
+		inst.Logger().WithField("nspace", "files").
+			Warnf("Cannot add the trigger to clean the upload %s: %s", u.ID(), err)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, inst.PageURL("/files/uploads/"+u.ID(), nil))
+	return uploadData(c, http.StatusCreated, u)
+}
+
+// HeadUploadHandler handles HEAD requests on /files/uploads/:upload-id. It
+// can be used by the client to know the current offset of the upload, in the
+// Upload-Offset header, before resuming it.
+func HeadUploadHandler(c echo.Context) error {
+	u, err := getUploadSession(c)
+	if err != nil {
+		return err
+	}
+	setUploadHeaders(c, u)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetUploadHandler handles GET requests on /files/uploads/:upload-id to
+// return the state of a resumable upload.
+func GetUploadHandler(c echo.Context) error {
+	u, err := getUploadSession(c)
+	if err != nil {
+		return err
+	}
+	return uploadData(c, http.StatusOK, u)
+}
+
+// UploadChunkHandler handles PATCH requests on /files/uploads/:upload-id to
+// send a chunk of the content. The Upload-Offset header must be the current
+// offset of the upload.
+func UploadChunkHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	u, err := getUploadSession(c)
+	if err != nil {
+		return err
+	}
+
+	offset, err := strconv.ParseInt(c.Request().Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		return jsonapi.InvalidParameter(UploadOffsetHeader, errors.New("Invalid offset"))
+	}
+
+	u, err = vfs.WriteUploadChunk(inst.VFS(), u.ID(), offset, c.Request().Body)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return uploadData(c, http.StatusOK, u)
+}
+
+// FinishUploadHandler handles POST requests on /files/uploads/:upload-id to
+// finish a resumable upload, when all the content has been sent. The file is
+// created and its document is returned.
+func FinishUploadHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	u, err := getUploadSession(c)
+	if err != nil {
+		return err
+	}
+	doc, err := vfs.FinishUpload(inst.VFS(), u.ID())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return FileData(c, http.StatusCreated, doc, false, nil)
+}
+
+// AbortUploadHandler handles DELETE requests on /files/uploads/:upload-id to
+// cancel a resumable upload. The chunks already sent are removed.
+func AbortUploadHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	u, err := getUploadSession(c)
+	if err != nil {
+		return err
+	}
+	if err = vfs.AbortUpload(inst.VFS(), u.ID()); err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func pushCleanUploadTrigger(inst *instance.Instance, u *vfs.UploadSession) error {
+	msg := &vfs.CleanUploadMessage{UploadID: u.ID()}
+	t, err := job.NewTrigger(inst, job.TriggerInfos{
+		Type:       "@at",
+		WorkerType: "clean-upload",
+		Arguments:  u.ExpiresAt.Format(time.RFC3339),
+	}, msg)
+	if err != nil {
+		return err
+	}
+	return job.System().AddTrigger(t)
+}
@@ -0,0 +1,138 @@
+package files
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func createUpload(t *testing.T, query string) (*http.Response, string) {
+	req, err := http.NewRequest("POST", ts.URL+"/files/uploads?"+query, nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Content-Type", "text/plain")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	var v map[string]interface{}
+	if err = extractJSONRes(res, &v); err != nil || v == nil {
+		return res, ""
+	}
+	data := v["data"].(map[string]interface{})
+	return res, data["id"].(string)
+}
+
+func sendChunk(t *testing.T, uploadID, offset, body string) *http.Response {
+	req, err := http.NewRequest("PATCH", ts.URL+"/files/uploads/"+uploadID, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Upload-Offset", offset)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return res
+}
+
+func doUploadRequest(t *testing.T, method, uploadID string) *http.Response {
+	req, err := http.NewRequest(method, ts.URL+"/files/uploads/"+uploadID, nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return res
+}
+
+func TestResumableUploadWithNoSize(t *testing.T) {
+	res, _ := createUpload(t, "Name=nosize.txt")
+	assert.Equal(t, 422, res.StatusCode)
+}
+
+func TestResumableUploadAlreadyExists(t *testing.T) {
+	res, _ := upload(t, "/files/?Type=file&Name=resumable-exists.txt", "text/plain", "foo", "")
+	assert.Equal(t, 201, res.StatusCode)
+	res, _ = createUpload(t, "Name=resumable-exists.txt&Size=3")
+	assert.Equal(t, 409, res.StatusCode)
+}
+
+func TestResumableUploadSuccess(t *testing.T) {
+	res, uploadID := createUpload(t, "Name=resumable.txt&Size=11&Tags=foo,bar")
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "0", res.Header.Get("Upload-Offset"))
+	assert.Equal(t, "11", res.Header.Get("Upload-Length"))
+
+	res = sendChunk(t, uploadID, "0", "Hello ")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "6", res.Header.Get("Upload-Offset"))
+
+	// The file must not be visible before the end of the upload
+	_, err := testInstance.VFS().FileByPath("/resumable.txt")
+	assert.Error(t, err)
+
+	res = sendChunk(t, uploadID, "0", "Hello ")
+	assert.Equal(t, 409, res.StatusCode)
+
+	res = doUploadRequest(t, "POST", uploadID)
+	assert.Equal(t, 412, res.StatusCode)
+
+	res = doUploadRequest(t, "HEAD", uploadID)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, "6", res.Header.Get("Upload-Offset"))
+
+	res = sendChunk(t, uploadID, "6", "world and more")
+	assert.Equal(t, 412, res.StatusCode)
+
+	res = sendChunk(t, uploadID, "6", "world")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "11", res.Header.Get("Upload-Offset"))
+
+	res = doUploadRequest(t, "POST", uploadID)
+	assert.Equal(t, 201, res.StatusCode)
+	var v map[string]interface{}
+	assert.NoError(t, extractJSONRes(res, &v))
+	attrs := v["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "resumable.txt", attrs["name"])
+	assert.Equal(t, "11", attrs["size"])
+	assert.Equal(t, "text/plain", attrs["mime"])
+	assert.Len(t, attrs["tags"], 2)
+
+	buf, err := readFile(testInstance.VFS(), "/resumable.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello world", string(buf))
+
+	res = doUploadRequest(t, "HEAD", uploadID)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestResumableUploadBadHash(t *testing.T) {
+	req, err := http.NewRequest("POST", ts.URL+"/files/uploads?Name=resumable-badhash.txt&Size=3", nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Content-MD5", "3FbfoWuyA8ocQVsFzGMbEw==")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var v map[string]interface{}
+	assert.NoError(t, extractJSONRes(res, &v))
+	uploadID := v["data"].(map[string]interface{})["id"].(string)
+
+	res = sendChunk(t, uploadID, "0", "foo")
+	assert.Equal(t, 200, res.StatusCode)
+	res = doUploadRequest(t, "POST", uploadID)
+	assert.Equal(t, 412, res.StatusCode)
+
+	_, err = testInstance.VFS().FileByPath("/resumable-badhash.txt")
+	assert.Error(t, err)
+}
+
+func TestResumableUploadAbort(t *testing.T) {
+	res, uploadID := createUpload(t, "Name=resumable-aborted.txt&Size=6")
+	assert.Equal(t, 201, res.StatusCode)
+	res = sendChunk(t, uploadID, "0", "foo")
+	assert.Equal(t, 200, res.StatusCode)
+
+	res = doUploadRequest(t, "DELETE", uploadID)
+	assert.Equal(t, 204, res.StatusCode)
+	res = doUploadRequest(t, "GET", uploadID)
+	assert.Equal(t, 404, res.StatusCode)
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"time"
 
 	"github.com/cozy/cozy-stack/model/account"
 	"github.com/cozy/cozy-stack/model/app"
@@ -287,7 +289,7 @@ func orphanAccountFixer(c echo.Context) error {
 			if err != nil {
 				log.Errorf("Cannot push a job for account deletion: %v", err)
 			}
-			if err = j.WaitUntilDone(inst); err != nil {
+			if _, err = j.WaitUntilDone(inst); err != nil {
 				log.Error(err)
 			}
 		}
@@ -317,3 +319,82 @@ func indexesFixer(c echo.Context) error {
 
 	return c.NoContent(http.StatusNoContent)
 }
+
+// trashEntry is a file or directory of the trash that has expired
+type trashEntry struct {
+	FilePath  string    `json:"filepath"`
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Size      int64     `json:"size,omitempty"`
+	TrashedAt time.Time `json:"trashed_at"`
+}
+
+type trashExpirationResult struct {
+	DryRun        bool         `json:"dry_run"`
+	RetentionDays int          `json:"retention_days"`
+	Expired       []trashEntry `json:"expired"`
+	Domain        string       `json:"domain"`
+}
+
+// trashExpirationFixer lists the files and directories of the trash that
+// have expired, and pushes a job to destroy them if it is not a dry-run.
+func trashExpirationFixer(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := lifecycle.GetInstance(domain)
+	if err != nil {
+		return fmt.Errorf("Cannot find instance %s", domain)
+	}
+
+	body := struct {
+		DryRun bool `json:"dry_run"`
+	}{
+		DryRun: true,
+	}
+	_ = json.NewDecoder(c.Request().Body).Decode(&body)
+
+	retention := inst.TrashRetention()
+	res := &trashExpirationResult{
+		DryRun:        body.DryRun,
+		RetentionDays: int(retention / (24 * time.Hour)),
+		Expired:       []trashEntry{},
+		Domain:        domain,
+	}
+	if retention <= 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	dirs, files, err := vfs.ExpiredTrash(inst.VFS(), retention)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		trashedAt, _ := vfs.TrashedAt(dir, nil)
+		res.Expired = append(res.Expired, trashEntry{
+			FilePath:  dir.Fullpath,
+			ID:        dir.ID(),
+			Type:      consts.DirType,
+			TrashedAt: trashedAt,
+		})
+	}
+	for _, file := range files {
+		trashedAt, _ := vfs.TrashedAt(nil, file)
+		res.Expired = append(res.Expired, trashEntry{
+			FilePath:  path.Join(vfs.TrashDirName, file.DocName),
+			ID:        file.ID(),
+			Type:      consts.FileType,
+			Size:      file.ByteSize,
+			TrashedAt: trashedAt,
+		})
+	}
+
+	if !body.DryRun && len(res.Expired) > 0 {
+		_, err = job.System().PushJob(inst, &job.JobRequest{
+			WorkerType: "trash-expiration",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -80,6 +80,12 @@ func createHandler(c echo.Context) error {
 			return wrapError(err)
 		}
 	}
+	if contentAddressed := c.QueryParam("ContentAddressed"); contentAddressed != "" {
+		opts.ContentAddressed, err = strconv.ParseBool(contentAddressed)
+		if err != nil {
+			return wrapError(err)
+		}
+	}
 	if diskQuota := c.QueryParam("DiskQuota"); diskQuota != "" {
 		opts.DiskQuota, err = strconv.ParseInt(diskQuota, 10, 64)
 		if err != nil {
@@ -258,6 +264,50 @@ func fsckHandler(c echo.Context) (err error) {
 	return nil
 }
 
+func fsckRepairHandler(c echo.Context) error {
+	domain := c.Param("domain")
+	i, err := lifecycle.GetInstance(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	body := struct {
+		DryRun bool `json:"dry_run"`
+	}{
+		DryRun: true,
+	}
+	// Try to get the dry_run param from the body. If there is no body, ignore
+	// it
+	_ = json.NewDecoder(c.Request().Body).Decode(&body)
+
+	fs := i.VFS()
+	var logs []*vfs.FsckLog
+	if err = fs.Fsck(func(log *vfs.FsckLog) { logs = append(logs, log) }, false); err != nil {
+		return wrapError(err)
+	}
+
+	w := c.Response().Writer
+	w.WriteHeader(200)
+	encoder := json.NewEncoder(w)
+	err = vfs.RepairFsck(fs, i, logs, body.DryRun, func(entry *vfs.FsckRepair) {
+		if errenc := encoder.Encode(entry); errenc != nil {
+			i.Logger().WithField("nspace", "fsck").
+				Warnf("Cannot encode to JSON: %s (%v)", errenc, entry)
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	})
+	if err != nil {
+		log := map[string]string{"error": err.Error()}
+		if errenc := encoder.Encode(log); errenc != nil {
+			i.Logger().WithField("nspace", "fsck").
+				Warnf("Cannot encode to JSON: %s (%v)", err, log)
+		}
+	}
+	return nil
+}
+
 func updatesHandler(c echo.Context) error {
 	slugs := utils.SplitTrimString(c.QueryParam("Slugs"), ",")
 	domain := c.QueryParam("Domain")
@@ -328,6 +378,7 @@ type diskUsageResult struct {
 	Files         int64 `json:"files,string,omitempty"`
 	Versions      int64 `json:"versions,string,omitempty"`
 	VersionsCount int   `json:"versions_count,string,omitempty"`
+	Physical      int64 `json:"physical,string,omitempty"`
 }
 
 func diskUsage(c echo.Context) error {
@@ -353,6 +404,9 @@ func diskUsage(c echo.Context) error {
 	result.Files = files
 	result.Versions = versions
 	result.Quota = fs.DiskQuota()
+	if physical, err := vfs.PhysicalUsage(fs); err == nil {
+		result.Physical = physical
+	}
 	if stats, err := couchdb.DBStatus(instance, consts.Files); err == nil {
 		result.Count = stats.DocCount
 	}
@@ -469,6 +523,7 @@ func Routes(router *echo.Group) {
 
 	// Advanced features for instances
 	router.GET("/:domain/fsck", fsckHandler)
+	router.POST("/:domain/fsck/repair", fsckRepairHandler)
 	router.POST("/updates", updatesHandler)
 	router.POST("/token", createToken)
 	router.GET("/oauth_client", findClientBySoftwareID)
@@ -492,4 +547,5 @@ func Routes(router *echo.Group) {
 	router.POST("/:domain/fixers/content-mismatch", contentMismatchFixer)
 	router.POST("/:domain/fixers/orphan-account", orphanAccountFixer)
 	router.POST("/:domain/fixers/indexes", indexesFixer)
+	router.POST("/:domain/fixers/trash-expiration", trashExpirationFixer)
 }
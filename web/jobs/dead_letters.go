@@ -0,0 +1,120 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	apiDeadLetter struct {
+		d *job.DeadLetter
+	}
+	apiDeadLetterRequest struct {
+		Message json.RawMessage `json:"message"`
+	}
+)
+
+func (d apiDeadLetter) ID() string                             { return d.d.ID() }
+func (d apiDeadLetter) Rev() string                            { return d.d.Rev() }
+func (d apiDeadLetter) DocType() string                        { return consts.JobsDeadLetters }
+func (d apiDeadLetter) Clone() couchdb.Doc                     { return d }
+func (d apiDeadLetter) SetID(_ string)                         {}
+func (d apiDeadLetter) SetRev(_ string)                        {}
+func (d apiDeadLetter) Relationships() jsonapi.RelationshipMap { return nil }
+func (d apiDeadLetter) Included() []jsonapi.Object             { return nil }
+func (d apiDeadLetter) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/dead-letters/" + d.ID()}
+}
+func (d apiDeadLetter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.d)
+}
+
+func deadLetterFilter(c echo.Context) *job.DeadLetterFilter {
+	limit, _ := strconv.Atoi(c.QueryParam("Limit"))
+	return &job.DeadLetterFilter{
+		WorkerType: c.QueryParam("Worker"),
+		Domain:     c.QueryParam("Domain"),
+		Error:      c.QueryParam("Error"),
+		Limit:      limit,
+	}
+}
+
+func listDeadLetters(c echo.Context) error {
+	list, err := job.ListDeadLetters(deadLetterFilter(c))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	objs := make([]jsonapi.Object, len(list))
+	for i, d := range list {
+		objs[i] = apiDeadLetter{d}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func getDeadLetter(c echo.Context) error {
+	d, err := job.GetDeadLetter(c.Param("dead-letter-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, apiDeadLetter{d}, nil)
+}
+
+func patchDeadLetter(c echo.Context) error {
+	req := apiDeadLetterRequest{}
+	if _, err := jsonapi.Bind(c.Request().Body, &req); err != nil {
+		return wrapJobsError(err)
+	}
+	if len(req.Message) == 0 {
+		return jsonapi.InvalidAttribute("message", job.ErrMessageUnmarshal)
+	}
+	d, err := job.UpdateDeadLetterMessage(c.Param("dead-letter-id"), job.Message(req.Message))
+	if err == job.ErrMessageUnmarshal {
+		return jsonapi.InvalidAttribute("message", err)
+	}
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, apiDeadLetter{d}, nil)
+}
+
+func deleteDeadLetter(c echo.Context) error {
+	if err := job.DeleteDeadLetter(c.Param("dead-letter-id")); err != nil {
+		return wrapJobsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func replayDeadLetter(c echo.Context) error {
+	d, err := job.GetDeadLetter(c.Param("dead-letter-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	j, err := d.Replay()
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, apiJob{j}, nil)
+}
+
+func replayDeadLetters(c echo.Context) error {
+	jobs, err := job.ReplayDeadLetters(deadLetterFilter(c))
+	res := map[string]interface{}{"replayed": len(jobs)}
+	if errm, ok := err.(*multierror.Error); ok {
+		errors := make([]string, len(errm.Errors))
+		for i, e := range errm.Errors {
+			errors[i] = e.Error()
+		}
+		res["errors"] = errors
+	} else if err != nil {
+		return wrapJobsError(err)
+	}
+	return c.JSON(http.StatusOK, res)
+}
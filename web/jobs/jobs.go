@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/metadata"
@@ -26,6 +28,7 @@ import (
 
 	// import workers
 	_ "github.com/cozy/cozy-stack/worker/archive"
+	_ "github.com/cozy/cozy-stack/worker/copy"
 	"github.com/cozy/cozy-stack/worker/exec"
 	_ "github.com/cozy/cozy-stack/worker/log"
 	_ "github.com/cozy/cozy-stack/worker/mails"
@@ -33,10 +36,12 @@ import (
 	_ "github.com/cozy/cozy-stack/worker/move"
 	_ "github.com/cozy/cozy-stack/worker/notes"
 	_ "github.com/cozy/cozy-stack/worker/push"
+	_ "github.com/cozy/cozy-stack/worker/search"
 	_ "github.com/cozy/cozy-stack/worker/share"
 	_ "github.com/cozy/cozy-stack/worker/thumbnail"
 	_ "github.com/cozy/cozy-stack/worker/trash"
 	_ "github.com/cozy/cozy-stack/worker/updates"
+	_ "github.com/cozy/cozy-stack/worker/webhook"
 )
 
 type (
@@ -44,9 +49,11 @@ type (
 		j *job.Job
 	}
 	apiJobRequest struct {
-		Arguments   json.RawMessage `json:"arguments"`
-		ForwardLogs bool            `json:"forward_logs"`
-		Options     *job.JobOptions `json:"options"`
+		Arguments   json.RawMessage     `json:"arguments"`
+		ForwardLogs bool                `json:"forward_logs"`
+		Options     *job.JobOptions     `json:"options"`
+		OnSuccess   []*job.WorkflowStep `json:"on_success"`
+		OnFailure   []*job.WorkflowStep `json:"on_failure"`
 	}
 	apiQueue struct {
 		workerType string
@@ -54,18 +61,25 @@ type (
 	apiTrigger struct {
 		t *job.TriggerInfos
 	}
+	apiWorkflow struct {
+		w *job.Workflow
+	}
 	apiTriggerState struct {
 		t *job.TriggerInfos
 		s *job.TriggerState
 	}
 	apiTriggerRequest struct {
-		Type            string          `json:"type"`
-		Arguments       string          `json:"arguments"`
-		WorkerType      string          `json:"worker"`
-		Message         json.RawMessage `json:"message"`
-		WorkerArguments json.RawMessage `json:"worker_arguments"`
-		Debounce        string          `json:"debounce"`
-		Options         *job.JobOptions `json:"options"`
+		Type            string              `json:"type"`
+		Arguments       string              `json:"arguments"`
+		WorkerType      string              `json:"worker"`
+		Message         json.RawMessage     `json:"message"`
+		WorkerArguments json.RawMessage     `json:"worker_arguments"`
+		Debounce        string              `json:"debounce"`
+		TimeZone        string              `json:"time_zone"`
+		Selector        mango.Map           `json:"selector"`
+		Options         *job.JobOptions     `json:"options"`
+		OnSuccess       []*job.WorkflowStep `json:"on_success"`
+		OnFailure       []*job.WorkflowStep `json:"on_failure"`
 	}
 )
 
@@ -109,6 +123,21 @@ func (t apiTrigger) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.t)
 }
 
+func (w apiWorkflow) ID() string                             { return w.w.ID() }
+func (w apiWorkflow) Rev() string                            { return w.w.Rev() }
+func (w apiWorkflow) DocType() string                        { return consts.JobsWorkflows }
+func (w apiWorkflow) Clone() couchdb.Doc                     { return w }
+func (w apiWorkflow) SetID(_ string)                         {}
+func (w apiWorkflow) SetRev(_ string)                        {}
+func (w apiWorkflow) Relationships() jsonapi.RelationshipMap { return nil }
+func (w apiWorkflow) Included() []jsonapi.Object             { return nil }
+func (w apiWorkflow) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/workflows/" + w.ID()}
+}
+func (w apiWorkflow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.w)
+}
+
 func (t apiTriggerState) ID() string                             { return t.t.TID }
 func (t apiTriggerState) Rev() string                            { return "" }
 func (t apiTriggerState) DocType() string                        { return consts.TriggersState }
@@ -163,6 +192,8 @@ func pushJob(c echo.Context) error {
 		Options:     req.Options,
 		ForwardLogs: req.ForwardLogs,
 		Message:     job.Message(req.Arguments),
+		OnSuccess:   req.OnSuccess,
+		OnFailure:   req.OnFailure,
 	}
 
 	// TODO: uncomment to restric jobs permissions.
@@ -185,6 +216,9 @@ func pushJob(c echo.Context) error {
 			return err
 		}
 	}
+	if err := checkFollowUps(c, permd, jr); err != nil {
+		return err
+	}
 
 	j, err := job.System().PushJob(instance, jr)
 	if err != nil {
@@ -228,7 +262,11 @@ func newTrigger(c echo.Context) error {
 		Domain:     instance.Domain,
 		Arguments:  req.Arguments,
 		Debounce:   req.Debounce,
+		TimeZone:   req.TimeZone,
+		Selector:   req.Selector,
 		Options:    req.Options,
+		OnSuccess:  req.OnSuccess,
+		OnFailure:  req.OnFailure,
 		Metadata:   md,
 	}, msg)
 	if err != nil {
@@ -250,6 +288,18 @@ func newTrigger(c echo.Context) error {
 			return err
 		}
 	}
+	if err := checkFollowUps(c, permd, t.Infos().JobRequest()); err != nil {
+		return err
+	}
+	if req.WorkerType == job.WebhookWorkerType {
+		if err := checkWebhookDoctypes(c, req.Arguments); err != nil {
+			return err
+		}
+	}
+
+	if webhook := t.Infos().Webhook; webhook != nil {
+		webhook.URL = instance.PageURL("/jobs/webhooks/"+webhook.Token, nil)
+	}
 
 	if err = sched.AddTrigger(t); err != nil {
 		return wrapJobsError(err)
@@ -394,6 +444,54 @@ func launchTrigger(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusCreated, apiJob{j}, nil)
 }
 
+// maxWebhookBodySize is the maximal size of the body of a request on a
+// @webhook trigger (1MB).
+const maxWebhookBodySize = 1 << 20
+
+// callWebhook is the public route used by external services to launch the
+// job of a @webhook trigger. The token in the URL is the only credential,
+// and the body can be signed if the trigger requires it.
+func callWebhook(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	t, err := job.GetWebhookTrigger(instance, c.Param("token"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Response(), c.Request().Body, maxWebhookBodySize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	}
+
+	// The signature is checked before the rate-limit, so that the calls with
+	// an invalid signature can't use the budget of the signed calls.
+	key := instance.DomainName() + ":" + t.ID()
+	if err = t.CheckSignature(body, c.Request().Header.Get(job.WebhookSignatureHeader)); err != nil {
+		if limits.CheckRateLimitKey(key, limits.JobWebhookFailureType) == limits.ErrRateLimitReached {
+			instance.Logger().WithField("nspace", "jobs").
+				Warnf("Too many invalid signatures for the webhook of trigger %s", t.ID())
+			return echo.NewHTTPError(http.StatusTooManyRequests, limits.ErrRateLimitReached.Error())
+		}
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	if err = limits.CheckRateLimitKey(key, limits.JobWebhookType); err != nil {
+		if err == limits.ErrRateLimitReached {
+			instance.Logger().WithField("nspace", "jobs").
+				Warnf("Rate limit reached for the webhook of trigger %s", t.ID())
+		}
+		return echo.NewHTTPError(http.StatusTooManyRequests, err.Error())
+	}
+
+	req, err := t.JobRequestWithPayload(c.Request().Header.Get(echo.HeaderContentType), body)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if _, err = job.System().PushJob(t, req); err != nil {
+		return wrapJobsError(err)
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
 func deleteTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	sched := job.System()
@@ -462,6 +560,72 @@ func getJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiJob{j}, nil)
 }
 
+func getJobResult(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	j, err := job.Get(instance, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := middlewares.Allow(c, permission.GET, j); err != nil {
+		return err
+	}
+	result, err := j.GetResult(instance)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return c.JSONBlob(http.StatusOK, result)
+}
+
+func cancelJob(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	j, err := job.Get(instance, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := middlewares.Allow(c, permission.DELETE, j); err != nil {
+		return err
+	}
+	j, err = job.System().CancelJob(instance, j.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, apiJob{j}, nil)
+}
+
+// getQueueLen returns the number of queued jobs for a worker type, with the
+// details for each instance.
+func getQueueLen(c echo.Context) error {
+	workerType := c.Param("worker-type")
+	total, err := job.System().WorkerQueueLen(workerType)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	domains, err := job.System().WorkerQueueLenByDomain(workerType)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"worker":  workerType,
+		"total":   total,
+		"domains": domains,
+	})
+}
+
+func getWorkflow(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	wf, err := job.GetWorkflow(instance, c.Param("workflow-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	// The workflow can be read by the applications that can read the jobs
+	// of its first step
+	first := &job.JobRequest{WorkerType: wf.Steps[0].WorkerType}
+	if err := middlewares.Allow(c, permission.GET, first); err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, apiWorkflow{wf}, nil)
+}
+
 func cleanJobs(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	if err := middlewares.AllowWholeType(c, permission.POST, consts.Jobs); err != nil {
@@ -575,6 +739,10 @@ func purgeJobs(c echo.Context) error {
 	jobsToDelete := make([]couchdb.Doc, len(finalJobs))
 	for i, j := range finalJobs {
 		jobsToDelete[i] = j
+		if err := j.DeleteResult(instance); err != nil {
+			instance.Logger().WithField("nspace", "jobs").
+				Warnf("Cannot delete the result of the job %s: %s", j.ID(), err)
+		}
 	}
 
 	chunkSize := 1000
@@ -607,20 +775,48 @@ func Routes(router *echo.Group) {
 	router.GET("/triggers/:trigger-id/jobs", getTriggerJobs)
 	router.POST("/triggers/:trigger-id/launch", launchTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
+	router.POST("/webhooks/:token", callWebhook)
+
+	router.GET("/workflows/:workflow-id", getWorkflow)
 
 	router.POST("/clean", cleanJobs)
 	router.DELETE("/purge", purgeJobs)
 	router.GET("/:job-id", getJob)
+	router.GET("/:job-id/result", getJobResult)
+	router.DELETE("/:job-id", cancelJob)
+}
+
+// AdminRoutes sets the routing for the administration of the jobs, on the
+// admin server
+func AdminRoutes(router *echo.Group) {
+	router.GET("/queues/:worker-type", getQueueLen)
+
+	router.GET("/dead-letters", listDeadLetters)
+	router.POST("/dead-letters/replay", replayDeadLetters)
+	router.GET("/dead-letters/:dead-letter-id", getDeadLetter)
+	router.PATCH("/dead-letters/:dead-letter-id", patchDeadLetter)
+	router.DELETE("/dead-letters/:dead-letter-id", deleteDeadLetter)
+	router.POST("/dead-letters/:dead-letter-id/replay", replayDeadLetter)
 }
 
 func wrapJobsError(err error) error {
 	switch err {
 	case job.ErrNotFoundTrigger,
 		job.ErrNotFoundJob,
+		job.ErrNotFoundDeadLetter,
+		job.ErrNoResult,
 		job.ErrUnknownWorker:
 		return jsonapi.NotFound(err)
+	case job.ErrJobFinished:
+		return jsonapi.Conflict(err)
 	case job.ErrUnknownTrigger:
 		return jsonapi.InvalidAttribute("Type", err)
+	case job.ErrInvalidWorkflow:
+		return jsonapi.InvalidAttribute("on_success", err)
+	case job.ErrInvalidRetryPolicy:
+		return jsonapi.InvalidAttribute("options", err)
+	case job.ErrInvalidWebhookURL:
+		return jsonapi.InvalidAttribute("message", err)
 	case limits.ErrRateLimitReached,
 		limits.ErrRateLimitExceeded:
 		return jsonapi.BadRequest(err)
@@ -628,6 +824,39 @@ func wrapJobsError(err error) error {
 	return err
 }
 
+// checkFollowUps returns an error if the follow-up jobs of a job request use
+// some workers that the client cannot use.
+func checkFollowUps(c echo.Context, permd *permission.Permission, jr *job.JobRequest) error {
+	for _, workerType := range jr.FollowUpsWorkerTypes() {
+		step := &job.JobRequest{WorkerType: workerType}
+		if err := middlewares.Allow(c, permission.POST, step); err != nil {
+			return err
+		}
+		if permd.Type != permission.TypeCLI {
+			if err := checkReservedWorker(workerType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkWebhookDoctypes returns an error if the client cannot read the whole
+// doctypes of the arguments of an @event trigger for an outgoing webhook, as
+// the documents are sent to the webhook.
+func checkWebhookDoctypes(c echo.Context, arguments string) error {
+	for _, arg := range strings.Fields(arguments) {
+		rule, err := permission.UnmarshalRuleString(arg)
+		if err != nil {
+			return jsonapi.InvalidAttribute("arguments", err)
+		}
+		if err := middlewares.AllowWholeType(c, permission.GET, rule.Type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // checkReservedWorker returns an error if the worker should only by used by
 // the stack, and the clients must not push jobs for it.
 func checkReservedWorker(worker string) error {
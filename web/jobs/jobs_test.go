@@ -2,6 +2,9 @@ package jobs
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -68,6 +71,69 @@ func TestCreateJob(t *testing.T) {
 	assert.Equal(t, 202, res.StatusCode)
 }
 
+func TestCreateJobWithFollowUps(t *testing.T) {
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: map[string]interface{}{
+				"arguments": "first",
+				"on_success": []map[string]interface{}{
+					{"worker": "print", "message": "second"},
+				},
+				"on_failure": []map[string]interface{}{
+					{"worker": "print", "message": "failure"},
+				},
+			},
+		},
+	})
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/queue/print", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 202, res.StatusCode)
+
+	var v struct {
+		Data struct {
+			ID         string  `json:"id"`
+			Attributes job.Job `json:"attributes"`
+		}
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&v))
+	workflowID := v.Data.Attributes.WorkflowID
+	if !assert.NotEmpty(t, workflowID) {
+		return
+	}
+
+	var wf *job.Workflow
+	for i := 0; i < 50; i++ {
+		wf, err = job.GetWorkflow(testInstance, workflowID)
+		if assert.NoError(t, err) && wf.State == job.Done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, job.Done, wf.State)
+	if assert.Len(t, wf.Steps, 3) {
+		assert.Equal(t, v.Data.ID, wf.Steps[0].JobID)
+		assert.Equal(t, job.Done, wf.Steps[0].State)
+		assert.Equal(t, job.OnSuccess, wf.Steps[1].Condition)
+		assert.Equal(t, job.Done, wf.Steps[1].State)
+		assert.NotEmpty(t, wf.Steps[1].JobID)
+		assert.Equal(t, job.OnFailure, wf.Steps[2].Condition)
+		assert.Equal(t, job.Skipped, wf.Steps[2].State)
+	}
+
+	req2, err := http.NewRequest(http.MethodGet, ts.URL+"/jobs/workflows/"+workflowID, nil)
+	assert.NoError(t, err)
+	req2.Header.Add("Authorization", "Bearer "+token)
+	res2, err := http.DefaultClient.Do(req2)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res2.StatusCode)
+}
+
 func TestCreateJobForReservedWorker(t *testing.T) {
 	body, _ := json.Marshal(&jsonapiReq{
 		Data: &jsonapiData{
@@ -280,6 +346,92 @@ func TestAddGetAndDeleteTriggerIn(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, res5.StatusCode)
 }
 
+func TestAddAndCallWebhookTrigger(t *testing.T) {
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: &map[string]interface{}{
+				"type":      "@webhook",
+				"arguments": "hmac-sha256",
+				"worker":    "print",
+				"message":   map[string]string{"foo": "bar"},
+			},
+		},
+	})
+	req1, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/triggers", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req1.Header.Add("Authorization", "Bearer "+token)
+	res1, err := http.DefaultClient.Do(req1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res1.Body.Close()
+	assert.Equal(t, http.StatusCreated, res1.StatusCode)
+
+	var v struct {
+		Data struct {
+			ID         string            `json:"id"`
+			Attributes *job.TriggerInfos `json:"attributes"`
+		}
+	}
+	err = json.NewDecoder(res1.Body).Decode(&v)
+	if !assert.NoError(t, err) || !assert.NotNil(t, v.Data.Attributes.Webhook) {
+		return
+	}
+	triggerID := v.Data.ID
+	webhook := v.Data.Attributes.Webhook
+	assert.NotEmpty(t, webhook.Token)
+	assert.NotEmpty(t, webhook.Secret)
+	assert.Contains(t, webhook.URL, "/jobs/webhooks/"+webhook.Token)
+
+	payload := []byte(`{"event":"push"}`)
+	url := ts.URL + "/jobs/webhooks/" + webhook.Token
+
+	// Unknown token
+	res2, err := http.Post(ts.URL+"/jobs/webhooks/unknown", "application/json", bytes.NewReader(payload))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res2.StatusCode)
+
+	// Missing signature
+	res3, err := http.Post(url, "application/json", bytes.NewReader(payload))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res3.StatusCode)
+
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(payload)
+	req4, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	assert.NoError(t, err)
+	req4.Header.Add("Content-Type", "application/json")
+	req4.Header.Add(job.WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	res4, err := http.DefaultClient.Do(req4)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, res4.StatusCode)
+
+	jobs, err := job.GetJobs(testInstance, triggerID, 1)
+	assert.NoError(t, err)
+	if assert.Len(t, jobs, 1) {
+		assert.True(t, jobs[0].Webhook)
+		var msg map[string]interface{}
+		assert.NoError(t, jobs[0].Message.Unmarshal(&msg))
+		assert.Equal(t, "bar", msg["foo"])
+		assert.Equal(t, map[string]interface{}{
+			"content_type": "application/json",
+			"body":         map[string]interface{}{"event": "push"},
+		}, msg["webhook"])
+	}
+
+	state, err := job.GetTriggerState(testInstance, triggerID)
+	assert.NoError(t, err)
+	assert.NotNil(t, state.LastWebhookCall)
+	assert.NotEmpty(t, state.LastWebhookJobID)
+
+	req5, err := http.NewRequest("DELETE", ts.URL+"/jobs/triggers/"+triggerID, nil)
+	assert.NoError(t, err)
+	req5.Header.Add("Authorization", "Bearer "+token)
+	res5, err := http.DefaultClient.Do(req5)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, res5.StatusCode)
+}
+
 func TestAddTriggerWithMetadata(t *testing.T) {
 	at := time.Now().Add(1100 * time.Millisecond).Format(time.RFC3339)
 	body, _ := json.Marshal(&jsonapiReq{
@@ -501,6 +653,9 @@ func TestMain(m *testing.M) {
 func SetToken(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		tok := middlewares.GetRequestToken(c)
+		if tok == "" {
+			return next(c)
+		}
 		// Forcing the token parsing to have the "claims" parameter in the
 		// context (in production, it is done via
 		// middlewares.CheckInstanceBlocked)
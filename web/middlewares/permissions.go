@@ -282,6 +282,9 @@ func Allow(c echo.Context, v permission.Verb, o permission.Fetcher) error {
 	if err != nil {
 		return err
 	}
+	if pdoc.Type == permission.TypeShareDrop {
+		return ErrForbidden
+	}
 	if !pdoc.Permissions.Allow(v, o) {
 		return ErrForbidden
 	}
@@ -295,6 +298,9 @@ func AllowOnFields(c echo.Context, v permission.Verb, o permission.Fetcher, fiel
 	if err != nil {
 		return err
 	}
+	if pdoc.Type == permission.TypeShareDrop {
+		return ErrForbidden
+	}
 	if !pdoc.Permissions.AllowOnFields(v, o, fields...) {
 		return ErrForbidden
 	}
@@ -307,19 +313,27 @@ func AllowTypeAndID(c echo.Context, v permission.Verb, doctype, id string) error
 	if err != nil {
 		return err
 	}
+	if pdoc.Type == permission.TypeShareDrop {
+		return ErrForbidden
+	}
 	if !pdoc.Permissions.AllowID(v, doctype, id) {
 		return ErrForbidden
 	}
 	return nil
 }
 
-// AllowVFS validates a vfs.Fetcher against the context permission set
+// AllowVFS validates a vfs.Fetcher against the context permission set. The
+// permissions of a file drop are always rejected: they can only be used to
+// upload files via the dedicated handler, that checks the limits of the drop.
 func AllowVFS(c echo.Context, v permission.Verb, o vfs.Fetcher) error {
 	instance := GetInstance(c)
 	pdoc, err := GetPermission(c)
 	if err != nil {
 		return err
 	}
+	if pdoc.Type == permission.TypeShareDrop {
+		return ErrForbidden
+	}
 	err = vfs.Allows(instance.VFS(), pdoc.Permissions, v, o)
 	if err != nil {
 		return ErrForbidden
@@ -7,8 +7,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/oauth"
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -146,7 +148,15 @@ func createPermission(c echo.Context) error {
 		subdoc.Metadata.EnsureCreatedFields(md)
 	}
 
-	pdoc, err := permission.CreateShareSet(instance, parent, sourceID, codes, shortcodes, subdoc, expiresAt)
+	var pdoc *permission.Permission
+	if subdoc.Type == permission.TypeShareDrop {
+		if err = checkDropDirectory(instance, subdoc.Permissions); err != nil {
+			return err
+		}
+		pdoc, err = permission.CreateShareDropSet(instance, parent, sourceID, codes, shortcodes, subdoc, expiresAt)
+	} else {
+		pdoc, err = permission.CreateShareSet(instance, parent, sourceID, codes, shortcodes, subdoc, expiresAt)
+	}
 	if err != nil {
 		return err
 	}
@@ -154,6 +164,22 @@ func createPermission(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, &APIPermission{pdoc}, nil)
 }
 
+// checkDropDirectory checks that the files of a file drop will be uploaded
+// in a directory that exists and is not in the trash.
+func checkDropDirectory(inst *instance.Instance, set permission.Set) error {
+	if len(set) != 1 || len(set[0].Values) != 1 {
+		return permission.ErrInvalidDrop
+	}
+	dir, err := inst.VFS().DirByID(set[0].Values[0])
+	if err != nil {
+		return jsonapi.NotFound(err)
+	}
+	if dir.ID() == consts.TrashDirID || strings.HasPrefix(dir.Fullpath, vfs.TrashDirName+"/") {
+		return permission.ErrInvalidDrop
+	}
+	return nil
+}
+
 const (
 	defaultPermissionsByDoctype = 30
 	maxPermissionsByDoctype     = 100
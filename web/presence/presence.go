@@ -0,0 +1,197 @@
+// Package presence is for the routes used to know who is viewing or editing a
+// document.
+package presence
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/sharing"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/pkg/presence"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// maxBodySize is the maximal size of the body for joining a document: the
+// state, plus some room for the JSON around it.
+const maxBodySize = presence.MaxStateSize + 256
+
+type apiSession struct {
+	*presence.Session
+}
+
+func (s *apiSession) ID() string                             { return s.SessionID }
+func (s *apiSession) Rev() string                            { return "" }
+func (s *apiSession) DocType() string                        { return consts.Presence }
+func (s *apiSession) Clone() couchdb.Doc                     { return s }
+func (s *apiSession) SetID(_ string)                         {}
+func (s *apiSession) SetRev(_ string)                        {}
+func (s *apiSession) Relationships() jsonapi.RelationshipMap { return nil }
+func (s *apiSession) Included() []jsonapi.Object             { return nil }
+func (s *apiSession) Links() *jsonapi.LinksList              { return nil }
+
+// apiSessionRequest is the optional body for joining a document.
+type apiSessionRequest struct {
+	State json.RawMessage `json:"state"`
+}
+
+// Join is the API handler for PUT /presence/:doctype/:id/:session-id. It
+// adds a session on the document, or refreshes it (heartbeat).
+func Join(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	doctype := c.Param("doctype")
+	id := c.Param("id")
+	if err := allow(c, inst, doctype, id); err != nil {
+		return err
+	}
+	owner, err := sessionOwner(c)
+	if err != nil {
+		return err
+	}
+
+	var req apiSessionRequest
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxBodySize+1))
+	if err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	if len(body) > maxBodySize {
+		return wrapError(presence.ErrStateTooLarge)
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return jsonapi.BadJSON()
+		}
+	}
+
+	sess := &presence.Session{
+		Type:      doctype,
+		DocID:     id,
+		SessionID: c.Param("session-id"),
+		Instance:  inst.PageURL("", nil),
+		State:     req.State,
+	}
+	relay, err := presence.Join(inst, sess, owner)
+	if err != nil {
+		return wrapError(err)
+	}
+	if relay {
+		go sharing.RelayPresence(inst, sess, false, "", "")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Leave is the API handler for DELETE /presence/:doctype/:id/:session-id. It
+// removes a session from the document.
+func Leave(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	doctype := c.Param("doctype")
+	id := c.Param("id")
+	if err := allow(c, inst, doctype, id); err != nil {
+		return err
+	}
+	owner, err := sessionOwner(c)
+	if err != nil {
+		return err
+	}
+
+	sess := &presence.Session{
+		Type:      doctype,
+		DocID:     id,
+		SessionID: c.Param("session-id"),
+		Instance:  inst.PageURL("", nil),
+	}
+	if err := sess.Validate(); err != nil {
+		return wrapError(err)
+	}
+	left, err := presence.Leave(inst, doctype, id, sess.SessionID, owner)
+	if err != nil {
+		return wrapError(err)
+	}
+	if left {
+		go sharing.RelayPresence(inst, sess, true, "", "")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// List is the API handler for GET /presence/:doctype/:id. It returns the
+// sessions on the document.
+func List(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	doctype := c.Param("doctype")
+	id := c.Param("id")
+	if err := allow(c, inst, doctype, id); err != nil {
+		return err
+	}
+
+	sessions, err := presence.List(inst, doctype, id)
+	if err != nil {
+		return wrapError(err)
+	}
+	objs := make([]jsonapi.Object, len(sessions))
+	for i, s := range sessions {
+		objs[i] = &apiSession{s}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// allow checks that the permissions allow to read the document.
+func allow(c echo.Context, inst *instance.Instance, doctype, id string) error {
+	if doctype != consts.Files {
+		return middlewares.AllowTypeAndID(c, permission.GET, doctype, id)
+	}
+	dir, file, err := inst.VFS().DirOrFileByID(id)
+	if err != nil {
+		return wrapError(err)
+	}
+	if dir != nil {
+		return middlewares.AllowVFS(c, permission.GET, dir)
+	}
+	return middlewares.AllowVFS(c, permission.GET, file)
+}
+
+// sessionOwner returns an identifier for the client that makes the request:
+// the permission, and the application, OAuth client or share code with the
+// session of the user. Only this client can refresh or remove its sessions.
+func sessionOwner(c echo.Context) (string, error) {
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return "", err
+	}
+	owner := pdoc.ID()
+	if claims, ok := c.Get("claims").(permission.Claims); ok {
+		owner += "/" + claims.Audience + "/" + claims.Subject + "/" + claims.SessionID
+	}
+	sum := sha256.Sum256([]byte(owner))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Routes sets the routing for the presence.
+func Routes(router *echo.Group) {
+	router.GET("/:doctype/:id", List)
+	router.PUT("/:doctype/:id/:session-id", Join)
+	router.DELETE("/:doctype/:id/:session-id", Leave)
+}
+
+func wrapError(err error) *jsonapi.Error {
+	switch err {
+	case presence.ErrInvalidSession:
+		return jsonapi.BadRequest(err)
+	case presence.ErrForbiddenSession:
+		return jsonapi.Forbidden(err)
+	case presence.ErrStateTooLarge:
+		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
+	case os.ErrNotExist:
+		return jsonapi.NotFound(err)
+	}
+	return jsonapi.InternalServerError(err)
+}
@@ -11,9 +11,11 @@ import (
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/presence"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/gorilla/websocket"
@@ -45,8 +47,10 @@ var upgrader = websocket.Upgrader{
 type command struct {
 	Method  string `json:"method"`
 	Payload struct {
-		Type string `json:"type"`
-		ID   string `json:"id"`
+		Type        string    `json:"type"`
+		ID          string    `json:"id"`
+		Selector    mango.Map `json:"selector,omitempty"`
+		LastEventID string    `json:"last_event_id,omitempty"`
 	} `json:"payload"`
 }
 
@@ -58,9 +62,22 @@ type wsResponsePayload struct {
 
 type wsResponse struct {
 	Event   string            `json:"event"`
+	EventID string            `json:"event_id,omitempty"`
 	Payload wsResponsePayload `json:"payload"`
 }
 
+func newResponse(e *realtime.Event) *wsResponse {
+	return &wsResponse{
+		Event:   e.Verb,
+		EventID: e.ID,
+		Payload: wsResponsePayload{
+			Type: e.Doc.DocType(),
+			ID:   e.Doc.ID(),
+			Doc:  e.Doc,
+		},
+	}
+}
+
 type wsErrorPayload struct {
 	Status string      `json:"status"`
 	Code   string      `json:"code"`
@@ -121,6 +138,18 @@ func missingType(cmd *command) *wsError {
 	}
 }
 
+func invalidSelector(cmd *command) *wsError {
+	return &wsError{
+		Event: "error",
+		Payload: wsErrorPayload{
+			Status: "400 Bad Request",
+			Code:   "bad request",
+			Title:  "The selector is invalid, or used with an id",
+			Source: cmd,
+		},
+	}
+}
+
 func sendErr(ctx context.Context, errc chan *wsError, e *wsError) {
 	select {
 	case errc <- e:
@@ -129,7 +158,7 @@ func sendErr(ctx context.Context, errc chan *wsError, e *wsError) {
 }
 
 func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *websocket.Conn,
-	ds *realtime.DynamicSubscriber, errc chan *wsError, withAuthentication bool) {
+	ds *realtime.DynamicSubscriber, errc chan *wsError, replayc chan *replay, withAuthentication bool) {
 	defer close(errc)
 
 	var err error
@@ -177,28 +206,28 @@ func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *web
 			sendErr(ctx, errc, missingType(cmd))
 			continue
 		}
-		permType := cmd.Payload.Type
-		// XXX: thumbnails is a synthetic doctype, listening to its events
-		// requires a permissions on io.cozy.files. Same for note events.
-		if permType == consts.Thumbnails || permType == consts.NotesEvents {
-			permType = consts.Files
-		}
-		// XXX: no permissions are required for io.cozy.sharings.initial_sync
-		if withAuthentication && cmd.Payload.Type != consts.SharingsInitialSync {
-			var authorized bool
-			if cmd.Payload.ID == "" {
-				authorized = pdoc.Permissions.AllowWholeType(permission.GET, permType)
-			} else {
-				authorized = pdoc.Permissions.AllowID(permission.GET, permType, cmd.Payload.ID)
+		// A selector filters the events of the whole doctype, so it requires
+		// the same permissions as a subscription to the whole doctype
+		var selector *mango.Selector
+		if method == "SUBSCRIBE" && cmd.Payload.Selector != nil {
+			if cmd.Payload.ID != "" {
+				sendErr(ctx, errc, invalidSelector(cmd))
+				continue
 			}
-			if !authorized {
-				sendErr(ctx, errc, forbidden(cmd))
+			if selector, err = mango.NewSelector(cmd.Payload.Selector); err != nil {
+				sendErr(ctx, errc, invalidSelector(cmd))
 				continue
 			}
 		}
+		if withAuthentication && !allowSubscribe(pdoc, cmd.Payload.Type, cmd.Payload.ID) {
+			sendErr(ctx, errc, forbidden(cmd))
+			continue
+		}
 
 		if method == "SUBSCRIBE" {
-			if cmd.Payload.ID == "" {
+			if selector != nil {
+				err = ds.SubscribeSelector(cmd.Payload.Type, selector)
+			} else if cmd.Payload.ID == "" {
 				err = ds.Subscribe(cmd.Payload.Type)
 			} else {
 				err = ds.Watch(cmd.Payload.Type, cmd.Payload.ID)
@@ -215,10 +244,45 @@ func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *web
 				WithDomain(ds.DomainName()).
 				WithField("nspace", "realtime").
 				Warnf("Error: %s", err)
+		} else if method == "SUBSCRIBE" && cmd.Payload.LastEventID != "" {
+			r := missedEvents(ds, cmd.Payload.Type, cmd.Payload.ID, selector, cmd.Payload.LastEventID)
+			select {
+			case replayc <- r:
+			case <-ctx.Done():
+			}
 		}
 	}
 }
 
+// allowSubscribe returns true if the permissions allow to listen to the events
+// for the given doctype (and optionally a document of this doctype).
+func allowSubscribe(pdoc *permission.Permission, doctype, id string) bool {
+	// XXX: no permissions are required for io.cozy.sharings.initial_sync
+	if doctype == consts.SharingsInitialSync {
+		return true
+	}
+	// XXX: thumbnails is a synthetic doctype, listening to its events
+	// requires a permissions on io.cozy.files. Same for note events and
+	// the progress of the copies.
+	permType := doctype
+	if permType == consts.Thumbnails || permType == consts.NotesEvents ||
+		permType == consts.FilesCopies {
+		permType = consts.Files
+	}
+	// XXX: the presence on a document requires a permission on this
+	// document, the identifiers are "<doctype>/<id>".
+	if permType == consts.Presence && id != "" {
+		var ok bool
+		if permType, id, ok = presence.SplitKey(id); !ok {
+			return false
+		}
+	}
+	if id == "" {
+		return pdoc.Permissions.AllowWholeType(permission.GET, permType)
+	}
+	return pdoc.Permissions.AllowID(permission.GET, permType, id)
+}
+
 // Ws is the API handler for realtime via a websocket connection.
 func Ws(c echo.Context) error {
 	var db prefixer.Prefixer
@@ -252,7 +316,9 @@ func Ws(c echo.Context) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	errc := make(chan *wsError)
-	go readPump(ctx, c, inst, ws, ds, errc, withAuthentication)
+	replayc := make(chan *replay)
+	go readPump(ctx, c, inst, ws, ds, errc, replayc, withAuthentication)
+	sent := newSentEvents()
 
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
@@ -269,19 +335,32 @@ func Ws(c echo.Context) error {
 			if err := ws.WriteJSON(e); err != nil {
 				return nil
 			}
-		case e := <-ds.Channel:
+		case r := <-replayc:
 			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
 				return err
 			}
-			res := wsResponse{
-				Event: e.Verb,
-				Payload: wsResponsePayload{
-					Type: e.Doc.DocType(),
-					ID:   e.Doc.ID(),
-					Doc:  e.Doc,
-				},
+			if r.gap {
+				if err := ws.WriteJSON(gapResponse(r)); err != nil {
+					return nil
+				}
+				continue
+			}
+			for _, e := range r.events {
+				if !sent.add(e) {
+					continue
+				}
+				if err := ws.WriteJSON(newResponse(e)); err != nil {
+					return nil
+				}
+			}
+		case e := <-ds.Channel:
+			if !sent.add(e) {
+				continue
+			}
+			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				return err
 			}
-			if err := ws.WriteJSON(res); err != nil {
+			if err := ws.WriteJSON(newResponse(e)); err != nil {
 				return nil
 			}
 		case <-ticker.C:
@@ -324,5 +403,6 @@ func Notify(c echo.Context) error {
 // Routes set the routing for the realtime service
 func Routes(router *echo.Group) {
 	router.GET("/", Ws)
+	router.GET("/sse", SSE)
 	router.POST("/:doctype/:id", Notify)
 }
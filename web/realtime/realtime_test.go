@@ -1,24 +1,30 @@
 package realtime
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/session"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
 
 var ts *httptest.Server
+var tsLoggedIn *httptest.Server
 var inst *instance.Instance
 var token string
 
@@ -242,12 +248,109 @@ func TestWSNotify(t *testing.T) {
 	assert.Equal(t, "world", doc["hello"])
 }
 
+func TestSSE(t *testing.T) {
+	res, err := http.Get(ts.URL + "/realtime/sse?doctype=io.cozy.forbidden&bearer_token=" + token)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// The session cookie is not enough
+	res, err = http.Get(tsLoggedIn.URL + "/realtime/sse?doctype=io.cozy.forbidden")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	selector := url.QueryEscape(`{"dir_id":"io.cozy.files.root-dir"}`)
+	res, err = http.Get(tsLoggedIn.URL + "/realtime/sse?doctype=io.cozy.files&selector=" + selector)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/realtime/sse?doctype=io.cozy.foos", nil)
+	req.Header.Add("Accept", "text/event-stream")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	time.Sleep(30 * time.Millisecond)
+	realtime.GetHub().Publish(inst, realtime.EventCreate, &testDoc{
+		doctype: "io.cozy.foos",
+		id:      "foo-sse",
+	}, nil)
+
+	scanner := bufio.NewScanner(res.Body)
+	assert.True(t, scanner.Scan())
+	assert.True(t, strings.HasPrefix(scanner.Text(), "id: "))
+	eventID := strings.TrimPrefix(scanner.Text(), "id: ")
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "event: CREATED", scanner.Text())
+	assert.True(t, scanner.Scan())
+	data := strings.TrimPrefix(scanner.Text(), "data: ")
+	var msg map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(data), &msg))
+	assert.Equal(t, "CREATED", msg["event"])
+	payload := msg["payload"].(map[string]interface{})
+	assert.Equal(t, "io.cozy.foos", payload["type"])
+	assert.Equal(t, "foo-sse", payload["id"])
+	assert.Equal(t, eventID, msg["event_id"])
+	res.Body.Close()
+
+	// Resume after the first event
+	realtime.GetHub().Publish(inst, realtime.EventUpdate, &testDoc{
+		doctype: "io.cozy.foos",
+		id:      "foo-sse",
+	}, nil)
+	req, _ = http.NewRequest("GET", ts.URL+"/realtime/sse?doctype=io.cozy.foos", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Last-Event-ID", eventID)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	scanner = bufio.NewScanner(res.Body)
+	assert.True(t, scanner.Scan())
+	assert.True(t, strings.HasPrefix(scanner.Text(), "id: "))
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "event: UPDATED", scanner.Text())
+	res.Body.Close()
+
+	// Resume from an unknown event
+	req, _ = http.NewRequest("GET", ts.URL+"/realtime/sse?doctype=io.cozy.foos&last_event_id=123456789", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	scanner = bufio.NewScanner(res.Body)
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "event: GAP", scanner.Text())
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
 	setup := testutils.NewSetup(m, "realtime_test")
 	inst = setup.GetTestInstance()
 	_, token = setup.GetTestClient("io.cozy.foos io.cozy.bars io.cozy.bazs")
+	tsLoggedIn = setup.GetTestServer("/realtime", func(g *echo.Group) {
+		g.Use(fakeAuthentication)
+		Routes(g)
+	})
 	ts = setup.GetTestServer("/realtime", Routes)
 	os.Exit(setup.Run())
 }
+
+// fakeAuthentication injects a session, like for a request with the session
+// cookie of the user.
+func fakeAuthentication(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sess, _ := session.New(inst, true)
+		c.Set("session", sess)
+		return next(c)
+	}
+}
@@ -0,0 +1,78 @@
+package realtime
+
+import (
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// eventGap is sent to a client that wants to resume a subscription from an
+// event that is no longer in the log: it must fetch again its data.
+const eventGap = "GAP"
+
+// replay is the list of events missed by a client for a subscription.
+type replay struct {
+	doctype string
+	id      string
+	events  []*realtime.Event
+	gap     bool
+}
+
+func gapResponse(r *replay) *wsResponse {
+	return &wsResponse{
+		Event:   eventGap,
+		Payload: wsResponsePayload{Type: r.doctype, ID: r.id},
+	}
+}
+
+// missedEvents returns the events for the subscription that have been
+// published after the given event.
+func missedEvents(db prefixer.Prefixer, doctype, id string, selector *mango.Selector, lastEventID string) *replay {
+	r := &replay{doctype: doctype, id: id}
+	events, err := realtime.GetHub().EventsSince(db, lastEventID)
+	if err != nil {
+		r.gap = true
+		return r
+	}
+	for _, e := range events {
+		if e.Doc.DocType() != doctype || (id != "" && e.Doc.ID() != id) {
+			continue
+		}
+		if selector != nil && !e.MatchSelector(selector) {
+			continue
+		}
+		r.events = append(r.events, e)
+	}
+	return r
+}
+
+// maxSentEvents is the number of IDs of events remembered for a client, to
+// avoid sending twice an event when the missed events are replayed.
+const maxSentEvents = 1000
+
+// sentEvents is the set of the IDs of the last events sent to a client.
+type sentEvents struct {
+	ids   map[string]struct{}
+	order []string
+}
+
+func newSentEvents() *sentEvents {
+	return &sentEvents{ids: make(map[string]struct{})}
+}
+
+// add marks the event as sent, and returns false if it was already sent.
+func (s *sentEvents) add(e *realtime.Event) bool {
+	if e.ID == "" {
+		return true
+	}
+	if _, ok := s.ids[e.ID]; ok {
+		return false
+	}
+	if len(s.order) >= maxSentEvents {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.ids[e.ID] = struct{}{}
+	s.order = append(s.order, e.ID)
+	return true
+}
@@ -0,0 +1,153 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// heartbeatPeriod is the time between two comments sent on the SSE stream to
+// keep the connection open through the proxies.
+const heartbeatPeriod = 30 * time.Second
+
+const typeTextEventStream = "text/event-stream"
+
+// SSE is the API handler for realtime via Server-Sent Events, for the clients
+// that can't use a websocket. The doctype (and optionally the id of a
+// document) are given in the query-string, and the events are sent with the
+// same payloads as for the websocket.
+func SSE(c echo.Context) error {
+	doctype := c.QueryParam("doctype")
+	id := c.QueryParam("id")
+	if doctype == "" {
+		return jsonapi.BadRequest(errors.New("The doctype parameter is mandatory"))
+	}
+	var selector *mango.Selector
+	if param := c.QueryParam("selector"); param != "" {
+		var m mango.Map
+		err := json.Unmarshal([]byte(param), &m)
+		if err == nil && id == "" {
+			selector, err = mango.NewSelector(m)
+		}
+		if err != nil || id != "" {
+			return jsonapi.InvalidParameter("selector", mango.ErrInvalidSelector)
+		}
+	}
+
+	var db prefixer.Prefixer
+	inst, withAuthentication := middlewares.GetInstanceSafe(c)
+	if !withAuthentication {
+		db = prefixer.GlobalPrefixer
+	} else {
+		db = inst
+		// The EventSource API can't send an Authorization header: the token
+		// can be given in the bearer_token parameter. The session cookie is
+		// not enough, as the stream could be opened from any other website.
+		pdoc, err := middlewares.GetPermission(c)
+		if err != nil {
+			if middlewares.IsLoggedIn(c) {
+				return middlewares.ErrForbidden
+			}
+			return err
+		}
+		if !allowSubscribe(pdoc, doctype, id) {
+			return middlewares.ErrForbidden
+		}
+	}
+
+	ds := realtime.GetHub().Subscriber(db)
+	defer ds.Close()
+	var err error
+	if selector != nil {
+		err = ds.SubscribeSelector(doctype, selector)
+	} else if id == "" {
+		err = ds.Subscribe(doctype)
+	} else {
+		err = ds.Watch(doctype, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, typeTextEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	// The EventSource API sends the Last-Event-ID header when it reconnects
+	sent := newSentEvents()
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	if lastEventID != "" {
+		r := missedEvents(ds, doctype, id, selector, lastEventID)
+		if r.gap {
+			if err := writeSSE(w, "", gapResponse(r)); err != nil {
+				return nil
+			}
+		}
+		for _, e := range r.events {
+			sent.add(e)
+			if err := writeSSE(w, e.ID, newResponse(e)); err != nil {
+				return nil
+			}
+		}
+	}
+
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case e, ok := <-ds.Channel:
+			if !ok { // The subscription has been closed
+				return nil
+			}
+			if !sent.add(e) {
+				continue
+			}
+			if err := writeSSE(w, e.ID, newResponse(e)); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+// writeSSE writes an event on the SSE stream, with the same JSON as for the
+// websocket in its data.
+func writeSSE(w *echo.Response, eventID string, res *wsResponse) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if eventID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", eventID); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", res.Event, data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
@@ -29,10 +29,12 @@ import (
 	"github.com/cozy/cozy-stack/web/notifications"
 	"github.com/cozy/cozy-stack/web/oidc"
 	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/cozy-stack/web/presence"
 	"github.com/cozy/cozy-stack/web/public"
 	"github.com/cozy/cozy-stack/web/realtime"
 	"github.com/cozy/cozy-stack/web/registry"
 	"github.com/cozy/cozy-stack/web/remote"
+	"github.com/cozy/cozy-stack/web/search"
 	"github.com/cozy/cozy-stack/web/settings"
 	"github.com/cozy/cozy-stack/web/sharings"
 	"github.com/cozy/cozy-stack/web/shortcuts"
@@ -40,6 +42,7 @@ import (
 	"github.com/cozy/cozy-stack/web/status"
 	"github.com/cozy/cozy-stack/web/swift"
 	"github.com/cozy/cozy-stack/web/version"
+	"github.com/cozy/cozy-stack/web/webdav"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/prometheus/client_golang/prometheus"
@@ -188,11 +191,14 @@ func SetupRoutes(router *echo.Echo) error {
 		move.Routes(router.Group("/move", mws...))
 		permissions.Routes(router.Group("/permissions", mws...))
 		realtime.Routes(router.Group("/realtime", mws...))
+		presence.Routes(router.Group("/presence", mws...))
 		notes.Routes(router.Group("/notes", mws...))
 		remote.Routes(router.Group("/remote", mws...))
+		search.Routes(router.Group("/search", mws...))
 		sharings.Routes(router.Group("/sharings", mws...))
 		bitwarden.Routes(router.Group("/bitwarden", mws...))
 		shortcuts.Routes(router.Group("/shortcuts", mws...))
+		webdav.Routes(router, mws...)
 
 		// The settings routes needs not to be blocked
 		apps.WebappsRoutes(router.Group("/apps", mwsNotBlocked...))
@@ -250,6 +256,7 @@ func SetupAdminRoutes(router *echo.Echo) error {
 	}
 
 	instances.Routes(router.Group("/instances", mws...))
+	jobs.AdminRoutes(router.Group("/jobs", mws...))
 	version.Routes(router.Group("/version", mws...))
 	metrics.Routes(router.Group("/metrics", mws...))
 	realtime.Routes(router.Group("/realtime", mws...))
@@ -279,7 +286,9 @@ func CreateSubdomainProxy(router *echo.Echo, appsHandler echo.HandlerFunc) (*ech
 	main.HideBanner = true
 	main.HidePort = true
 	main.Renderer = router.Renderer
-	main.Any("/*", firstRouting(router, appsHandler))
+	handler := firstRouting(router, appsHandler)
+	main.Any("/*", handler)
+	main.Pre(webdav.Intercept(handler))
 
 	main.HTTPErrorHandler = errors.HTMLErrorHandler
 	return main, nil
@@ -0,0 +1,90 @@
+// Package search exposes a route for the full-text search on the files.
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/model/search"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+)
+
+// searchDocument is the JSON-API document of the response, with the truncated
+// flag in the meta.
+type searchDocument struct {
+	Data *json.RawMessage `json:"data"`
+	Meta searchMeta       `json:"meta"`
+}
+
+type searchMeta struct {
+	Count     int  `json:"count"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// QueryHandler is the handler for GET /search. It returns the files that
+// match the query, sorted by relevance. Only the files that can be read with
+// the permissions of the request are returned.
+func QueryHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	query := c.QueryParam("q")
+	if query == "" {
+		return jsonapi.InvalidParameter("q", errors.New("The query is missing"))
+	}
+	limit := defaultLimit
+	if l := c.QueryParam("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			return jsonapi.InvalidParameter("limit", errors.New("Invalid limit"))
+		}
+		if limit > maxLimit {
+			limit = maxLimit
+		}
+	}
+
+	results, truncated, err := search.Search(inst, pdoc.Permissions, query, limit)
+	if err != nil {
+		return err
+	}
+
+	fs := inst.VFS()
+	out := make([]json.RawMessage, len(results))
+	for i, result := range results {
+		f := files.NewFile(result.File, inst)
+		f.IncludePath(fs)
+		if out[i], err = jsonapi.MarshalObject(f); err != nil {
+			return jsonapi.InternalServerError(err)
+		}
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	doc := searchDocument{
+		Data: (*json.RawMessage)(&data),
+		Meta: searchMeta{Count: len(out), Truncated: truncated},
+	}
+	resp := c.Response()
+	resp.Header().Set("Content-Type", jsonapi.ContentType)
+	resp.WriteHeader(http.StatusOK)
+	return json.NewEncoder(resp).Encode(doc)
+}
+
+// Routes sets the routing for the search.
+func Routes(router *echo.Group) {
+	router.GET("", QueryHandler)
+}
@@ -0,0 +1,98 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/search"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	weberrors "github.com/cozy/cozy-stack/web/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var inst *instance.Instance
+var token string
+
+func createFile(t *testing.T, name, mime, content string, tags []string) *vfs.FileDoc {
+	fs := inst.VFS()
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, int64(len(content)), nil,
+		mime, "text", time.Now(), false, false, tags)
+	assert.NoError(t, err)
+	f, err := fs.CreateFile(doc, nil)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	doc, err = fs.FileByID(doc.ID())
+	assert.NoError(t, err)
+	assert.NoError(t, search.IndexFile(inst, doc))
+	return doc
+}
+
+func doSearch(t *testing.T, query string) []interface{} {
+	req, _ := http.NewRequest("GET", ts.URL+"/search?q="+query, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ := result["data"].([]interface{})
+	return data
+}
+
+func TestSearch(t *testing.T) {
+	recipe := createFile(t, "recipe.md", "text/markdown", "# Crêpes\n\nFlour, eggs and milk", nil)
+	bill := createFile(t, "bill.txt", "text/plain", "Electricity bill for June", []string{"invoices"})
+
+	data := doSearch(t, "crepes")
+	if assert.Len(t, data, 1) {
+		file := data[0].(map[string]interface{})
+		assert.Equal(t, recipe.ID(), file["id"])
+		attrs := file["attributes"].(map[string]interface{})
+		assert.Equal(t, "recipe.md", attrs["name"])
+		assert.Equal(t, "/recipe.md", attrs["path"])
+	}
+
+	data = doSearch(t, "invoice")
+	if assert.Len(t, data, 1) {
+		file := data[0].(map[string]interface{})
+		assert.Equal(t, bill.ID(), file["id"])
+	}
+
+	data = doSearch(t, "bill+june")
+	assert.Len(t, data, 1)
+	data = doSearch(t, "bill+july")
+	assert.Len(t, data, 0)
+}
+
+func TestSearchWithoutQuery(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/search", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "search_test")
+	inst = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.Files)
+
+	ts = setup.GetTestServer("/search", Routes)
+	ts.Config.Handler.(*echo.Echo).HTTPErrorHandler = weberrors.ErrorHandler
+	os.Exit(setup.Run())
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
@@ -19,6 +20,7 @@ type apiDiskUsage struct {
 	Files    int64  `json:"files,string"`
 	Trash    *int64 `json:"trash,string,omitempty"`
 	Versions int64  `json:"versions,string"`
+	Physical int64  `json:"physical,string"`
 }
 
 func (j *apiDiskUsage) ID() string                             { return consts.DiskUsageID }
@@ -68,9 +70,17 @@ func diskUsage(c echo.Context) error {
 	used := files + versions
 	quota := fs.DiskQuota()
 
+	// With a content-addressed layout, the contents shared by several files
+	// are stored only once, and the space used on the storage can be lower.
+	physical, err := vfs.PhysicalUsage(fs)
+	if err != nil {
+		return err
+	}
+
 	result.Used = used
 	result.Quota = quota
 	result.Files = files
 	result.Versions = versions
+	result.Physical = physical
 	return jsonapi.Data(c, http.StatusOK, &result, nil)
 }
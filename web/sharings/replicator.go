@@ -146,6 +146,32 @@ func EndInitial(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+// ReceivePresence is used to receive a change of presence on a shared
+// document from another member of the sharing
+func ReceivePresence(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		inst.Logger().WithField("nspace", "replicator").Infof("Sharing was not found: %s", err)
+		return wrapErrors(err)
+	}
+	member, err := requestMember(c, s)
+	if err != nil {
+		inst.Logger().WithField("nspace", "replicator").Infof("Member was not found: %s", err)
+		return wrapErrors(err)
+	}
+	var msg sharing.PresenceMessage
+	if err = c.Bind(&msg); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err = s.ReceivePresence(inst, member, &msg); err != nil {
+		inst.Logger().WithField("nspace", "replicator").Infof("Error on presence: %s", err)
+		return wrapErrors(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 // replicatorRoutes sets the routing for the replicator
 func replicatorRoutes(router *echo.Group) {
 	group := router.Group("", checkSharingPermissions)
@@ -155,6 +181,7 @@ func replicatorRoutes(router *echo.Group) {
 	group.PUT("/:sharing-id/io.cozy.files/:id/metadata", SyncFile, checkSharingWritePermissions)
 	group.PUT("/:sharing-id/io.cozy.files/:id", FileHandler, checkSharingWritePermissions)
 	group.DELETE("/:sharing-id/initial", EndInitial, checkSharingWritePermissions)
+	group.POST("/:sharing-id/presence", ReceivePresence, checkSharingReadPermissions)
 }
 
 func checkSharingReadPermissions(next echo.HandlerFunc) echo.HandlerFunc {
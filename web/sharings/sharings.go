@@ -17,6 +17,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/presence"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/hashicorp/go-multierror"
 	"github.com/labstack/echo/v4"
@@ -662,6 +663,12 @@ func wrapErrors(err error) error {
 		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
 	case permission.ErrExpiredToken:
 		return jsonapi.BadRequest(err)
+	case presence.ErrInvalidSession:
+		return jsonapi.BadRequest(err)
+	case presence.ErrStateTooLarge:
+		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
+	case presence.ErrForbiddenSession:
+		return jsonapi.Forbidden(err)
 	}
 	logger.WithNamespace("sharing").Warnf("Not wrapped error: %s", err)
 	return err
@@ -21,7 +21,7 @@ func ListLayouts(c echo.Context) error {
 		Counter int      `json:"counter"`
 		Domains []string `json:"domains,omitempty"`
 	}
-	var layoutV1, layoutV2a, layoutV2b, layoutUnknown, layoutV3a, layoutV3b layout
+	var layoutV1, layoutV2a, layoutV2b, layoutUnknown, layoutV3a, layoutV3b, layoutV4 layout
 
 	flagShowDomains := false
 	flagParam := c.QueryParam("show_domains")
@@ -76,6 +76,11 @@ func ListLayouts(c echo.Context) error {
 					layoutUnknown.Domains = append(layoutUnknown.Domains, inst.Domain)
 				}
 			}
+		case 3:
+			layoutV4.Counter++
+			if flagShowDomains {
+				layoutV4.Domains = append(layoutV4.Domains, inst.Domain)
+			}
 		default:
 			layoutUnknown.Counter++
 			if flagShowDomains {
@@ -91,7 +96,8 @@ func ListLayouts(c echo.Context) error {
 	output["unknown"] = layoutUnknown
 	output["v3a"] = layoutV3a
 	output["v3b"] = layoutV3b
-	output["total"] = layoutV1.Counter + layoutV2a.Counter + layoutV2b.Counter + layoutUnknown.Counter + layoutV3a.Counter + layoutV3b.Counter
+	output["v4"] = layoutV4
+	output["total"] = layoutV1.Counter + layoutV2a.Counter + layoutV2b.Counter + layoutUnknown.Counter + layoutV3a.Counter + layoutV3b.Counter + layoutV4.Counter
 
 	return c.JSON(http.StatusOK, output)
 }
@@ -214,6 +220,8 @@ func swiftContainer(i *instance.Instance) string {
 		return "cozy-v2-" + i.DBPrefix()
 	case 2:
 		return "cozy-v3-" + i.DBPrefix()
+	case 3:
+		return "cozy-v4-" + i.DBPrefix()
 	default:
 		panic(errors.New("Unknown Swift layout"))
 	}
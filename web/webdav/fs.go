@@ -0,0 +1,362 @@
+package webdav
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/webdav"
+)
+
+// davFS implements the webdav.FileSystem interface on top of the VFS of the
+// instance of the request. Every operation is checked against the
+// permissions of the request, like it is done for the JSON-API of /files.
+type davFS struct {
+	c  echo.Context
+	fs vfs.VFS
+}
+
+func newDavFS(c echo.Context) *davFS {
+	inst := middlewares.GetInstance(c)
+	return &davFS{c: c, fs: inst.VFS()}
+}
+
+func (d *davFS) allow(v permission.Verb, doc vfs.Fetcher) error {
+	if err := middlewares.AllowVFS(d.c, v, doc); err != nil {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// Mkdir is part of the webdav.FileSystem interface
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = path.Clean(name)
+	if name == "/" {
+		return os.ErrExist
+	}
+	parent, err := d.fs.DirByPath(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	dir, err := vfs.NewDirDocWithParent(path.Base(name), parent, nil)
+	if err != nil {
+		return err
+	}
+	dir.CozyMetadata, _ = files.CozyMetadataFromClaims(d.c, false)
+	if err = d.allow(permission.POST, dir); err != nil {
+		return err
+	}
+	return d.fs.CreateDir(dir)
+}
+
+// OpenFile is part of the webdav.FileSystem interface
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = path.Clean(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return d.openForReading(name)
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, os.ErrInvalid
+	}
+	return d.openForWriting(name, flag)
+}
+
+func (d *davFS) openForReading(name string) (webdav.File, error) {
+	dir, file, err := d.fs.DirOrFileByPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		if err = d.allow(permission.GET, dir); err != nil {
+			return nil, err
+		}
+		return &davDir{fs: d.fs, doc: dir}, nil
+	}
+	if err = d.allow(permission.GET, file); err != nil {
+		return nil, err
+	}
+	content, err := d.fs.OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: content, doc: file}, nil
+}
+
+func (d *davFS) openForWriting(name string, flag int) (webdav.File, error) {
+	olddoc, err := d.fs.FileByPath(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if olddoc == nil && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if olddoc != nil && flag&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+
+	var dirID string
+	if olddoc != nil {
+		dirID = olddoc.DirID
+	} else {
+		parent, err := d.fs.DirByPath(path.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		dirID = parent.ID()
+	}
+
+	filename := path.Base(name)
+	mime, class := vfs.ExtractMimeAndClassFromFilename(filename)
+	newdoc, err := vfs.NewFileDoc(filename, dirID, -1, nil, mime, class, time.Now(), false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if olddoc != nil {
+		newdoc.Tags = olddoc.Tags
+		newdoc.Executable = olddoc.Executable
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+		newdoc.CreatedAt = olddoc.CreatedAt
+		if olddoc.CozyMetadata != nil {
+			newdoc.CozyMetadata = olddoc.CozyMetadata.Clone()
+		}
+		files.UpdateFileCozyMetadata(d.c, newdoc, true)
+		if err = d.allow(permission.PUT, olddoc); err != nil {
+			return nil, err
+		}
+		newdoc.SetID(olddoc.ID()) // The ID can be useful to check permissions
+		if err = d.allow(permission.PUT, newdoc); err != nil {
+			return nil, err
+		}
+	} else {
+		newdoc.CozyMetadata, _ = files.CozyMetadataFromClaims(d.c, true)
+		if err = d.allow(permission.POST, newdoc); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := d.fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: content, doc: newdoc, writing: true}, nil
+}
+
+// RemoveAll is part of the webdav.FileSystem interface. The files and
+// directories are moved to the trash, they are not destroyed.
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	name = path.Clean(name)
+	if name == "/" || name == vfs.TrashDirName || strings.HasPrefix(name, vfs.TrashDirName+"/") {
+		return os.ErrPermission
+	}
+	dir, file, err := d.fs.DirOrFileByPath(name)
+	if err != nil {
+		return err
+	}
+	if dir != nil {
+		if err = d.allow(permission.PATCH, dir); err != nil {
+			return err
+		}
+		files.UpdateDirCozyMetadata(d.c, dir)
+		_, err = vfs.TrashDir(d.fs, dir)
+		return err
+	}
+	if err = d.allow(permission.PATCH, file); err != nil {
+		return err
+	}
+	files.UpdateFileCozyMetadata(d.c, file, false)
+	_, err = vfs.TrashFile(d.fs, file)
+	return err
+}
+
+// Rename is part of the webdav.FileSystem interface. It is used to move and
+// rename files and directories.
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = path.Clean(oldName), path.Clean(newName)
+	if oldName == "/" || newName == "/" {
+		return os.ErrPermission
+	}
+	dir, file, err := d.fs.DirOrFileByPath(oldName)
+	if err != nil {
+		return err
+	}
+	parent, err := d.fs.DirByPath(path.Dir(newName))
+	if err != nil {
+		return err
+	}
+	name := path.Base(newName)
+	patch := &vfs.DocPatch{Name: &name, DirID: &parent.DocID}
+
+	if dir != nil {
+		if err = d.allow(permission.PATCH, dir); err != nil {
+			return err
+		}
+		moved := dir.Clone().(*vfs.DirDoc)
+		moved.DirID = parent.DocID
+		moved.Fullpath = newName
+		if err = d.allow(permission.PATCH, moved); err != nil {
+			return err
+		}
+		files.UpdateDirCozyMetadata(d.c, dir)
+		_, err = vfs.ModifyDirMetadata(d.fs, dir, patch)
+		return err
+	}
+
+	if err = d.allow(permission.PATCH, file); err != nil {
+		return err
+	}
+	moved := file.Clone().(*vfs.FileDoc)
+	moved.DirID = parent.DocID
+	moved.DocName = name
+	moved.ResetFullpath()
+	if err = d.allow(permission.PATCH, moved); err != nil {
+		return err
+	}
+	files.UpdateFileCozyMetadata(d.c, file, false)
+	_, err = vfs.ModifyFileMetadata(d.fs, file, patch)
+	return err
+}
+
+// Stat is part of the webdav.FileSystem interface
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	dir, file, err := d.fs.DirOrFileByPath(path.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		if err = d.allow(permission.GET, dir); err != nil {
+			return nil, err
+		}
+		return dir, nil
+	}
+	if err = d.allow(permission.GET, file); err != nil {
+		return nil, err
+	}
+	return &fileInfo{file}, nil
+}
+
+// fileInfo is an os.FileInfo for a file, with the optional methods used by the
+// webdav package to avoid reading the content of the file for computing its
+// etag and content type.
+type fileInfo struct {
+	*vfs.FileDoc
+}
+
+// ETag is part of the webdav.ETager interface
+func (f *fileInfo) ETag(ctx context.Context) (string, error) {
+	if len(f.MD5Sum) == 0 {
+		return "", webdav.ErrNotImplemented
+	}
+	eTag := base64.StdEncoding.EncodeToString(f.MD5Sum)
+	return fmt.Sprintf(`"%s"`, eTag), nil
+}
+
+// ContentType is part of the webdav.ContentTyper interface
+func (f *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if f.Mime == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return f.Mime, nil
+}
+
+// davFile is a webdav.File for reading or writing the content of a file.
+type davFile struct {
+	vfs.File
+	doc     *vfs.FileDoc
+	writing bool
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.writing {
+		return 0, os.ErrInvalid
+	}
+	return f.File.Read(p)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, os.ErrInvalid
+	}
+	return f.File.Write(p)
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{f.doc}, nil
+}
+
+// davDir is a webdav.File for listing the content of a directory.
+type davDir struct {
+	fs   vfs.VFS
+	doc  *vfs.DirDoc
+	iter vfs.DirIterator
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+// Readdir works like os.File.Readdir: if count is positive, it returns at most
+// count entries and io.EOF at the end of the directory, and if count is zero
+// or negative, it returns all the remaining entries.
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.iter == nil {
+		d.iter = d.fs.DirIterator(d.doc, nil)
+	}
+	var infos []os.FileInfo
+	for count <= 0 || len(infos) < count {
+		dir, file, err := d.iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return infos, err
+		}
+		if dir != nil {
+			infos = append(infos, dir)
+		} else {
+			infos = append(infos, &fileInfo{file})
+		}
+	}
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return d.doc, nil
+}
+
+var (
+	_ webdav.FileSystem   = &davFS{}
+	_ webdav.File         = &davFile{}
+	_ webdav.File         = &davDir{}
+	_ webdav.ETager       = &fileInfo{}
+	_ webdav.ContentTyper = &fileInfo{}
+)
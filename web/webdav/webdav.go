@@ -0,0 +1,77 @@
+// Package webdav exposes the files of an instance with the WebDAV protocol
+// (class 1 and 2), so that a Cozy can be mounted in file managers and office
+// suites without the desktop client.
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/webdav"
+)
+
+// FilesPrefix is the path prefix for the WebDAV access to the files.
+const FilesPrefix = "/dav/files"
+
+// lockSystems keeps a webdav.LockSystem for each instance, indexed by domain.
+// The locks are only kept in memory: they are not shared between several
+// cozy-stack processes.
+var lockSystems sync.Map
+
+func getLockSystem(domain string) webdav.LockSystem {
+	ls, _ := lockSystems.LoadOrStore(domain, webdav.NewMemLS())
+	return ls.(webdav.LockSystem)
+}
+
+// Handler is the handler for all the WebDAV requests on /dav/files/*. The
+// client authenticates with a token, given in the Authorization header as a
+// Bearer token, or as the password with the Basic scheme (for the clients
+// that only know about login/password). The permissions of the token are then
+// checked for each file and directory.
+func Handler(c echo.Context) error {
+	if _, err := middlewares.GetPermission(c); err != nil {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="Cozy"`)
+		return echo.NewHTTPError(http.StatusUnauthorized)
+	}
+
+	inst := middlewares.GetInstance(c)
+	log := inst.Logger().WithField("nspace", "webdav")
+	h := &webdav.Handler{
+		Prefix:     FilesPrefix,
+		FileSystem: newDavFS(c),
+		LockSystem: getLockSystem(inst.Domain),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				log.Debugf("%s %s: %s", req.Method, req.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// Routes sets the routing for the WebDAV service. The echo router only knows
+// the standard HTTP methods, and not the WebDAV ones like MKCOL or LOCK. So,
+// the WebDAV requests are intercepted before the routing, with a Pre
+// middleware, and the given middlewares are applied to them.
+func Routes(router *echo.Echo, mws ...echo.MiddlewareFunc) {
+	router.Pre(Intercept(middlewares.Compose(Handler, mws...)))
+}
+
+// Intercept returns a Pre middleware that sends the requests on the WebDAV
+// prefix to the given handler, whatever their HTTP method, instead of letting
+// the echo router respond with a 405 Method Not Allowed.
+func Intercept(h echo.HandlerFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p := c.Request().URL.Path
+			if p == FilesPrefix || strings.HasPrefix(p, FilesPrefix+"/") {
+				return h(c)
+			}
+			return next(c)
+		}
+	}
+}
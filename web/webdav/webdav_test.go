@@ -0,0 +1,233 @@
+package webdav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	weberrors "github.com/cozy/cozy-stack/web/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var inst *instance.Instance
+var token string
+
+func doRequest(t *testing.T, method, path string, body string, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, ts.URL+FilesPrefix+path, strings.NewReader(body))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return res
+}
+
+func TestNoToken(t *testing.T) {
+	req, _ := http.NewRequest("PROPFIND", ts.URL+FilesPrefix+"/", nil)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Contains(t, res.Header.Get("WWW-Authenticate"), "Basic")
+}
+
+func TestBasicAuth(t *testing.T) {
+	req, _ := http.NewRequest("PROPFIND", ts.URL+FilesPrefix+"/", nil)
+	req.SetBasicAuth("me", token)
+	req.Header.Add("Depth", "0")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+}
+
+func TestMkcol(t *testing.T) {
+	res := doRequest(t, "MKCOL", "/Documents", "", nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	dir, err := inst.VFS().DirByPath("/Documents")
+	assert.NoError(t, err)
+	assert.Equal(t, "Documents", dir.DocName)
+
+	res = doRequest(t, "MKCOL", "/Documents", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res = doRequest(t, "MKCOL", "/not/found", "", nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+}
+
+func TestPutAndGet(t *testing.T) {
+	res := doRequest(t, "PUT", "/Documents/hello.txt", "Hello world", nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	file, err := inst.VFS().FileByPath("/Documents/hello.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), file.ByteSize)
+	assert.Equal(t, "text/plain", file.Mime)
+
+	res = doRequest(t, "GET", "/Documents/hello.txt", "", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "Hello world", string(body))
+
+	res = doRequest(t, "PUT", "/Documents/hello.txt", "Hello WebDAV", nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	updated, err := inst.VFS().FileByPath("/Documents/hello.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, file.ID(), updated.ID())
+	assert.Equal(t, int64(12), updated.ByteSize)
+
+	res = doRequest(t, "GET", "/Documents/hello.txt", "", map[string]string{
+		"Range": "bytes=6-",
+	})
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "WebDAV", string(body))
+}
+
+func TestPropfind(t *testing.T) {
+	res := doRequest(t, "PROPFIND", "/Documents", "", map[string]string{
+		"Depth": "1",
+	})
+	assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Contains(t, string(body), FilesPrefix+"/Documents/hello.txt")
+	assert.Contains(t, string(body), "<D:getcontentlength>12</D:getcontentlength>")
+	assert.Contains(t, string(body), "<D:getcontenttype>text/plain</D:getcontenttype>")
+}
+
+func TestMoveAndCopy(t *testing.T) {
+	res := doRequest(t, "MOVE", "/Documents/hello.txt", "", map[string]string{
+		"Destination": ts.URL + FilesPrefix + "/Documents/bonjour.txt",
+	})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	_, err := inst.VFS().FileByPath("/Documents/hello.txt")
+	assert.True(t, os.IsNotExist(err))
+	moved, err := inst.VFS().FileByPath("/Documents/bonjour.txt")
+	assert.NoError(t, err)
+
+	res = doRequest(t, "COPY", "/Documents/bonjour.txt", "", map[string]string{
+		"Destination": ts.URL + FilesPrefix + "/copy.txt",
+	})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	copied, err := inst.VFS().FileByPath("/copy.txt")
+	assert.NoError(t, err)
+	assert.NotEqual(t, moved.ID(), copied.ID())
+	assert.Equal(t, moved.MD5Sum, copied.MD5Sum)
+}
+
+func TestLockAndUnlock(t *testing.T) {
+	lockBody := `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner>test</D:owner>
+</D:lockinfo>`
+	res := doRequest(t, "LOCK", "/copy.txt", lockBody, map[string]string{
+		"Timeout": "Second-60",
+	})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	lockToken := res.Header.Get("Lock-Token")
+	assert.NotEmpty(t, lockToken)
+
+	res = doRequest(t, "PUT", "/copy.txt", "locked", nil)
+	assert.Equal(t, http.StatusLocked, res.StatusCode)
+
+	res = doRequest(t, "PUT", "/copy.txt", "unlocked", map[string]string{
+		"If": "(" + lockToken + ")",
+	})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res = doRequest(t, "UNLOCK", "/copy.txt", "", map[string]string{
+		"Lock-Token": lockToken,
+	})
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestFileDropToken(t *testing.T) {
+	dir, err := vfs.NewDirDoc(inst.VFS(), "dropzone", consts.RootDirID, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, inst.VFS().CreateDir(dir))
+
+	code, err := inst.CreateShareCode("dropper")
+	assert.NoError(t, err)
+	pdoc := &permission.Permission{
+		Type:     permission.TypeShareDrop,
+		SourceID: consts.Apps + "/drive",
+		Permissions: permission.Set{
+			permission.Rule{
+				Type:   consts.Files,
+				Verbs:  permission.Verbs(permission.POST),
+				Values: []string{dir.ID()},
+			},
+		},
+		Codes: map[string]string{"dropper": code},
+		Drop:  &permission.DropOptions{MaxFiles: 1},
+	}
+	assert.NoError(t, couchdb.CreateDoc(inst, pdoc))
+
+	// The limits of a file drop can't be bypassed with WebDAV
+	req, _ := http.NewRequest("PUT", ts.URL+FilesPrefix+"/dropzone/dropped.txt", strings.NewReader("foo"))
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+code)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	req, _ = http.NewRequest("MKCOL", ts.URL+FilesPrefix+"/dropzone/subdir", nil)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+code)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	_, err = inst.VFS().FileByPath("/dropzone/dropped.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDelete(t *testing.T) {
+	res := doRequest(t, "DELETE", "/Documents", "", nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, err := inst.VFS().DirByPath("/Documents")
+	assert.True(t, os.IsNotExist(err))
+	trashed, err := inst.VFS().DirByPath(vfs.TrashDirName + "/Documents")
+	assert.NoError(t, err)
+	assert.Equal(t, "/", trashed.RestorePath)
+
+	res = doRequest(t, "DELETE", vfs.TrashDirName+"/Documents", "", nil)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "webdav_test")
+	inst = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.Files)
+
+	ts = setup.GetTestServer("/files", func(*echo.Group) {}, func(r *echo.Echo) *echo.Echo {
+		r.HTTPErrorHandler = weberrors.ErrorHandler
+		Routes(r, func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set("instance", inst)
+				return next(c)
+			}
+		})
+		return r
+	})
+	os.Exit(setup.Run())
+}
@@ -7,6 +7,16 @@ import (
 	"github.com/cozy/cozy-stack/model/job"
 )
 
+// progressFunc is called by the archive functions to report the number of
+// files processed.
+type progressFunc func(done, total int64)
+
+func (fn progressFunc) report(done, total int) {
+	if fn != nil {
+		fn(int64(done), int64(total))
+	}
+}
+
 func init() {
 	job.AddWorker(&job.WorkerConfig{
 		WorkerType:   "zip",
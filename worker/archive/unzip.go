@@ -25,10 +25,12 @@ func WorkerUnzip(ctx *job.WorkerContext) error {
 		return err
 	}
 	fs := ctx.Instance.VFS()
-	return unzip(fs, msg.Zip, msg.Destination)
+	return unzip(fs, msg.Zip, msg.Destination, func(done, total int64) {
+		ctx.ReportProgress(done, total, "")
+	})
 }
 
-func unzip(fs vfs.VFS, zipID, destination string) error {
+func unzip(fs vfs.VFS, zipID, destination string, progress progressFunc) error {
 	zipDoc, err := fs.FileByID(zipID)
 	if err != nil {
 		return err
@@ -49,7 +51,8 @@ func unzip(fs vfs.VFS, zipID, destination string) error {
 	}
 
 	dirs := make(map[string]*vfs.DirDoc)
-	for _, f := range r.File {
+	for i, f := range r.File {
+		progress.report(i, len(r.File))
 		f.Name = utils.CleanUTF8(f.Name)
 		name := path.Base(f.Name)
 		dirname := path.Dir(f.Name)
@@ -110,5 +113,6 @@ func unzip(fs vfs.VFS, zipID, destination string) error {
 			return cerr
 		}
 	}
+	progress.report(len(r.File), len(r.File))
 	return nil
 }
@@ -22,10 +22,12 @@ func WorkerZip(ctx *job.WorkerContext) error {
 		return err
 	}
 	fs := ctx.Instance.VFS()
-	return createZip(fs, msg.Files, msg.DirID, msg.Filename)
+	return createZip(fs, msg.Files, msg.DirID, msg.Filename, func(done, total int64) {
+		ctx.ReportProgress(done, total, "")
+	})
 }
 
-func createZip(fs vfs.VFS, files map[string]string, dirID, filename string) error {
+func createZip(fs vfs.VFS, files map[string]string, dirID, filename string, progress progressFunc) error {
 	now := time.Now()
 	zipDoc, err := vfs.NewFileDoc(filename, dirID, -1, nil, "application/zip", "zip", now, false, false, nil)
 	if err != nil {
@@ -38,11 +40,17 @@ func createZip(fs vfs.VFS, files map[string]string, dirID, filename string) erro
 		return err
 	}
 	w := zip.NewWriter(z)
+	done := 0
 	for filePath, fileID := range files {
+		progress.report(done, len(files))
 		err = addFileToZip(fs, w, fileID, filePath)
 		if err != nil {
 			break
 		}
+		done++
+	}
+	if err == nil {
+		progress.report(done, len(files))
 	}
 	werr := w.Close()
 	zerr := z.Close()
@@ -0,0 +1,101 @@
+package copy
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// progressInterval is the minimal duration between two realtime events for
+// the progress of a copy.
+const progressInterval = time.Second
+
+func init() {
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "copy",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Reserved:     true,
+		Timeout:      2 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// progress is used to send the progress of the copy of a directory via the
+// realtime, with the io.cozy.files.copies doctype. The identifier is the one
+// of the new directory.
+type progress struct {
+	inst       *instance.Instance
+	msg        *vfs.CopyDirMessage
+	filesTotal int
+	bytesTotal int64
+	lastSent   time.Time
+}
+
+func (p *progress) publish(state string, files int, bytes int64, err error) {
+	doc := couchdb.JSONDoc{
+		Type: consts.FilesCopies,
+		M: map[string]interface{}{
+			"_id":          p.msg.DirID,
+			"source_id":    p.msg.SourceID,
+			"state":        state,
+			"files_copied": files,
+			"files_total":  p.filesTotal,
+			"bytes_copied": bytes,
+			"bytes_total":  p.bytesTotal,
+		},
+	}
+	if err != nil {
+		doc.M["error"] = err.Error()
+	}
+	p.lastSent = time.Now()
+	realtime.GetHub().Publish(p.inst, realtime.EventUpdate, &doc, nil)
+}
+
+// Worker is a worker that copies the files and sub-directories of a directory
+// in a new directory.
+func Worker(ctx *job.WorkerContext) error {
+	var msg vfs.CopyDirMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	fs := ctx.Instance.VFS()
+	src, err := fs.DirByID(msg.SourceID)
+	if err != nil {
+		return err
+	}
+	dst, err := fs.DirByID(msg.DirID)
+	if err != nil {
+		return err
+	}
+
+	p := &progress{inst: ctx.Instance, msg: &msg}
+	p.filesTotal, p.bytesTotal, err = vfs.DirSize(fs, src)
+	if err != nil {
+		return err
+	}
+	p.publish("running", 0, 0, nil)
+
+	var files int
+	var bytes int64
+	err = vfs.CopyDirContent(fs, src, dst, &msg.Options, func(count int, size int64) {
+		files, bytes = count, size
+		if time.Since(p.lastSent) >= progressInterval {
+			p.publish("running", count, size, nil)
+		}
+	})
+	if err != nil {
+		ctx.Logger().WithField("nspace", "copy").
+			Warnf("Cannot copy %s to %s: %s", msg.SourceID, msg.DirID, err)
+		p.publish("errored", files, bytes, err)
+		return err
+	}
+	p.publish("done", files, bytes, nil)
+	return nil
+}
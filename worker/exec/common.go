@@ -20,6 +20,10 @@ import (
 
 var defaultTimeout = 300 * time.Second
 
+// maxScanLineSize is the maximal size of a line printed on stdout by a
+// konnector or a service.
+const maxScanLineSize = 1024 * 1024
+
 func init() {
 	job.AddWorker(&job.WorkerConfig{
 		WorkerType: "konnector",
@@ -30,9 +34,12 @@ func init() {
 		ErrorHook:    jobHookErrorCheckerKonnector,
 		WorkerFunc:   worker,
 		WorkerCommit: commit,
-		Concurrency:  runtime.NumCPU() * 2,
-		MaxExecCount: 2,
-		Timeout:      defaultTimeout,
+		// The errors of the konnectors are mostly login errors or errors of
+		// the vendors, and the jobs are pushed again by their triggers
+		NoDeadLetters: true,
+		Concurrency:   runtime.NumCPU() * 2,
+		MaxExecCount:  2,
+		Timeout:       defaultTimeout,
 	})
 
 	job.AddWorker(&job.WorkerConfig{
@@ -40,11 +47,12 @@ func init() {
 		WorkerStart: func(ctx *job.WorkerContext) (*job.WorkerContext, error) {
 			return ctx.WithCookie(&serviceWorker{}), nil
 		},
-		WorkerFunc:   worker,
-		WorkerCommit: commit,
-		Concurrency:  runtime.NumCPU() * 2,
-		MaxExecCount: 2,
-		Timeout:      defaultTimeout,
+		WorkerFunc:    worker,
+		WorkerCommit:  commit,
+		NoDeadLetters: true,
+		Concurrency:   runtime.NumCPU() * 2,
+		MaxExecCount:  2,
+		Timeout:       defaultTimeout,
 	})
 }
 
@@ -98,9 +106,10 @@ func worker(ctx *job.WorkerContext) (err error) {
 	if err != nil {
 		return err
 	}
+	// The lines can be large for the result of the job
 	scanBuf := make([]byte, 16*1024)
 	scanOut := bufio.NewScanner(cmdOut)
-	scanOut.Buffer(scanBuf, 64*1024)
+	scanOut.Buffer(scanBuf, maxScanLineSize)
 
 	timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
 		var result string
@@ -49,6 +49,8 @@ const (
 	konnectorMsgTypeWarning  = "warning"
 	konnectorMsgTypeError    = "error"
 	konnectorMsgTypeCritical = "critical"
+	konnectorMsgTypeProgress = "progress"
+	konnectorMsgTypeResult   = "result"
 )
 
 // KonnectorMessage is the message structure sent to the konnector worker.
@@ -508,14 +510,27 @@ func (w *konnectorWorker) Logger(ctx *job.WorkerContext) *logrus.Entry {
 
 func (w *konnectorWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instance, line []byte) error {
 	var msg struct {
-		Type    string `json:"type"`
-		Message string `json:"message"`
-		NoRetry bool   `json:"no_retry"`
+		Type    string          `json:"type"`
+		Message string          `json:"message"`
+		NoRetry bool            `json:"no_retry"`
+		Done    int64           `json:"done"`
+		Total   int64           `json:"total"`
+		Result  json.RawMessage `json:"result"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
 	}
 
+	// The progress and the result are published with the updates of the job
+	// document
+	switch msg.Type {
+	case konnectorMsgTypeProgress:
+		ctx.ReportProgress(msg.Done, msg.Total, msg.Message)
+		return nil
+	case konnectorMsgTypeResult:
+		return ctx.SetResult(msg.Result)
+	}
+
 	log := w.Logger(ctx)
 	switch msg.Type {
 	case konnectorMsgTypeDebug, konnectorMsgTypeInfo:
@@ -178,14 +178,21 @@ func (w *serviceWorker) Logger(ctx *job.WorkerContext) *logrus.Entry {
 
 func (w *serviceWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instance, line []byte) error {
 	var msg struct {
-		Type    string `json:"type"`
-		Message string `json:"message"`
+		Type    string          `json:"type"`
+		Message string          `json:"message"`
+		Done    int64           `json:"done"`
+		Total   int64           `json:"total"`
+		Result  json.RawMessage `json:"result"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
 	}
 	log := w.Logger(ctx)
 	switch msg.Type {
+	case konnectorMsgTypeProgress:
+		ctx.ReportProgress(msg.Done, msg.Total, msg.Message)
+	case konnectorMsgTypeResult:
+		return ctx.SetResult(msg.Result)
 	case konnectorMsgTypeDebug, konnectorMsgTypeInfo:
 		log.Debug(msg.Message)
 	case konnectorMsgTypeWarning, "warn":
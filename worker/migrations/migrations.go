@@ -13,9 +13,12 @@ import (
 	"github.com/cozy/cozy-stack/model/bitwarden"
 	"github.com/cozy/cozy-stack/model/bitwarden/settings"
 	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/model/note"
+	"github.com/cozy/cozy-stack/model/search"
 	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -33,15 +36,20 @@ import (
 const (
 	swiftV1ToV2 = "swift-v1-to-v2"
 	toSwiftV3   = "to-swift-v3"
+	toDedup     = "to-dedup"
 
 	swiftV1ContainerPrefixCozy = "cozy-"
 	swiftV1ContainerPrefixData = "data-"
 	swiftV2ContainerPrefixCozy = "cozy-v2-"
 	swiftV2ContainerPrefixData = "data-v2-"
 	swiftV3ContainerPrefix     = "cozy-v3-"
+	swiftV4ContainerPrefix     = "cozy-v4-"
 
 	accountsToOrganization = "accounts-to-organization"
 	notesMimeType          = "notes-mime-type"
+	searchIndex            = "search-index"
+	trashExpiration        = "trash-expiration"
+	rotateFsKey            = "rotate-fs-key"
 )
 
 // maxSimultaneousCalls is the maximal number of simultaneous calls to Swift
@@ -76,12 +84,20 @@ func worker(ctx *job.WorkerContext) error {
 	switch msg.Type {
 	case toSwiftV3:
 		return migrateToSwiftV3(ctx.Instance.Domain)
+	case toDedup:
+		return migrateToDedup(ctx.Instance.Domain)
 	case swiftV1ToV2:
 		return fmt.Errorf("this migration type is no longer supported")
 	case accountsToOrganization:
 		return migrateAccountsToOrganization(ctx.Instance.Domain)
 	case notesMimeType:
 		return migrateNotesMimeType(ctx.Instance.Domain)
+	case searchIndex:
+		return migrateSearchIndex(ctx.Instance.Domain)
+	case trashExpiration:
+		return migrateTrashExpiration(ctx.Instance.Domain)
+	case rotateFsKey:
+		return migrateRotateFsKey(ctx.Instance.Domain)
 	default:
 		return fmt.Errorf("unknown migration type %q", msg.Type)
 	}
@@ -131,6 +147,62 @@ func migrateNotesMimeType(domain string) error {
 	return nil
 }
 
+// Add the trigger that keeps the search index up-to-date, and build the
+// index for the existing files.
+func migrateSearchIndex(domain string) error {
+	inst, err := instance.GetFromCouch(domain)
+	if err != nil {
+		return err
+	}
+	if err = addMissingTrigger(inst, "search-index"); err != nil {
+		return err
+	}
+	return search.Reindex(inst)
+}
+
+// Add the trigger for the expiration of the trash. The files and directories
+// that were already in the trash have no trashed_at date: it is set to now, so
+// that they are not destroyed before the end of the retention period.
+func migrateTrashExpiration(domain string) error {
+	inst, err := instance.GetFromCouch(domain)
+	if err != nil {
+		return err
+	}
+	if _, err = vfs.SetMissingTrashedAt(inst.VFS()); err != nil {
+		return err
+	}
+	return addMissingTrigger(inst, "trash-expiration")
+}
+
+// addMissingTrigger adds the trigger for the given worker type from the list
+// of the triggers created with a new instance, if the instance doesn't have
+// one yet.
+func addMissingTrigger(inst *instance.Instance, workerType string) error {
+	sched := job.System()
+	triggers, err := sched.GetAllTriggers(inst)
+	if err != nil {
+		return err
+	}
+	for _, t := range triggers {
+		if t.Infos().WorkerType == workerType {
+			return nil
+		}
+	}
+	for _, infos := range lifecycle.Triggers(inst) {
+		if infos.WorkerType != workerType {
+			continue
+		}
+		t, err := job.NewTrigger(inst, infos, nil)
+		if err != nil {
+			return err
+		}
+		if err = sched.AddTrigger(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Migrate all the encrypted accounts to Bitwarden ciphers.
 // It decrypts each account, reencrypt the fields with the organization key,
 // and save it in the ciphers database.
@@ -539,3 +611,287 @@ func getThumbsDstNames(inst *instance.Instance, f *vfs.FileDoc) (string, string,
 	large := fmt.Sprintf("thumbs/%s-large", obj)
 	return small, medium, large
 }
+
+// migrateToDedup moves the files of an instance to a content-addressed layout,
+// where the contents shared by several files and versions are stored only
+// once: the afero one for the file and mem schemes, and the layout v4 for
+// Swift.
+func migrateToDedup(domain string) error {
+	switch config.FsURL().Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		return migrateAferoToDedup(domain)
+	case config.SchemeSwift, config.SchemeSwiftSecure:
+		return migrateToSwiftV4(domain)
+	default:
+		return fmt.Errorf("unknown storage provider %s", config.FsURL().Scheme)
+	}
+}
+
+func migrateAferoToDedup(domain string) error {
+	inst, err := instance.GetFromCouch(domain)
+	if err != nil {
+		return err
+	}
+	if inst.ContentAddressed {
+		return nil // Nothing to do!
+	}
+	log := inst.Logger().WithField("nspace", "migration")
+	log.Infof("Migrating to the content-addressed layout")
+
+	mutex := lock.LongOperation(inst, "vfs")
+	if err = mutex.Lock(); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+
+	fs := inst.VFS()
+	if err = vfsafero.MigrateToContentAddressed(fs); err != nil {
+		if errd := couchdb.DeleteDB(inst, consts.FilesBlobs); errd != nil && !couchdb.IsNotFoundError(errd) {
+			log.Errorf("Failed to delete the blobs database: %s", errd)
+		}
+		return err
+	}
+
+	if in, err := instance.GetFromCouch(domain); err == nil {
+		inst = in
+	}
+	inst.ContentAddressed = true
+	if err = couchdb.UpdateDoc(couchdb.GlobalDB, inst); err != nil {
+		return err
+	}
+
+	if err := vfsafero.CleanPathLayout(fs); err != nil {
+		log.Errorf("Failed to clean the old layout: %s", err)
+	}
+	return nil
+}
+
+func migrateRotateFsKey(domain string) error {
+	master := config.GetVault().FsEncryptionKey()
+	if master == nil {
+		return instance.ErrMissingFsEncryptionKey
+	}
+	switch config.FsURL().Scheme {
+	case config.SchemeFile, config.SchemeMem:
+	default:
+		return fmt.Errorf("the files can be encrypted only on the local file system")
+	}
+	inst, err := instance.GetFromCouch(domain)
+	if err != nil {
+		return err
+	}
+	log := inst.Logger().WithField("nspace", "migration")
+	log.Infof("Rotating the encryption key of the files")
+
+	mutex := lock.LongOperation(inst, "vfs")
+	if err = mutex.Lock(); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+
+	// The old keys are kept while the files are encrypted again, to be able
+	// to read them.
+	key := crypto.GenerateRandomBytes(instance.FsKeyLen)
+	inst.FsKeys = append([][]byte{master.Seal(key)}, inst.FsKeys...)
+	if err = couchdb.UpdateDoc(couchdb.GlobalDB, inst); err != nil {
+		return err
+	}
+
+	inst, err = instance.GetFromCouch(domain)
+	if err != nil {
+		return err
+	}
+	if err = vfsafero.Reencrypt(inst.VFS()); err != nil {
+		return err
+	}
+
+	inst.FsKeys = inst.FsKeys[:1]
+	return couchdb.UpdateDoc(couchdb.GlobalDB, inst)
+}
+
+func migrateToSwiftV4(domain string) error {
+	c := config.GetSwiftConnection()
+	inst, err := instance.GetFromCouch(domain)
+	if err != nil {
+		return err
+	}
+	switch inst.SwiftLayout {
+	case 0, 1:
+		// The layout v4 is built from the layout v3, where each content has
+		// its own object.
+		if err = migrateToSwiftV3(domain); err != nil {
+			return err
+		}
+		if inst, err = instance.GetFromCouch(domain); err != nil {
+			return err
+		}
+	case 2:
+		// OK
+	case 3:
+		return nil // Nothing to do!
+	default:
+		return instance.ErrInvalidSwiftLayout
+	}
+	log := inst.Logger().WithField("nspace", "migration")
+	log.Infof("Migrating from swift layout v3 to swift layout v4")
+
+	fs := inst.VFS()
+	root, err := fs.DirByID(consts.RootDirID)
+	if err != nil {
+		return err
+	}
+
+	mutex := lock.LongOperation(inst, "vfs")
+	if err = mutex.Lock(); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+
+	srcContainer := swiftV3ContainerPrefix + inst.DBPrefix()
+	dstContainer := swiftV4ContainerPrefix + inst.DBPrefix()
+	if _, _, err = c.Container(dstContainer); err != swift.ContainerNotFound {
+		log.Errorf("Destination container %s already exists or something went wrong. Migration canceled.", dstContainer)
+		return errors.New("Destination container busy")
+	}
+	if err = c.ContainerCreate(dstContainer, nil); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := vfsswift.DeleteContainer(c, dstContainer); err != nil {
+				log.Errorf("Failed to delete v4 container %s: %s", dstContainer, err)
+			}
+			if err := couchdb.DeleteDB(inst, consts.FilesBlobs); err != nil && !couchdb.IsNotFoundError(err) {
+				log.Errorf("Failed to delete the blobs database: %s", err)
+			}
+		}
+	}()
+
+	if err = copyTheFilesToSwiftV4(inst, c, root, srcContainer, dstContainer); err != nil {
+		return err
+	}
+
+	meta := &swift.Metadata{"cozy-migrated-from": "v3"}
+	_ = c.ContainerUpdate(dstContainer, meta.ContainerHeaders())
+	if in, err := instance.GetFromCouch(domain); err == nil {
+		inst = in
+	}
+	inst.SwiftLayout = 3
+	if err = couchdb.UpdateDoc(couchdb.GlobalDB, inst); err != nil {
+		return err
+	}
+
+	// Migration done. Now clean-up oldies.
+
+	// WARNING: Don't call `err` any error below in this function or the defer func
+	//          will delete the new container even if the migration was successful
+
+	if deleteErr := fs.Delete(); deleteErr != nil {
+		log.Errorf("Failed to delete old v3 container: %s", deleteErr)
+	}
+	return nil
+}
+
+func copyTheFilesToSwiftV4(inst *instance.Instance, c *swift.Connection, root *vfs.DirDoc, src, dst string) error {
+	log := logger.WithDomain(inst.Domain).
+		WithField("nspace", "migration")
+
+	// The first file or version with a given checksum gives the content of
+	// the blob, the others only add a reference to it.
+	type copyOp struct{ srcName, dstName string }
+	var ops []copyOp
+	blobs := make(map[string]*vfs.Blob)
+	addBlob := func(md5sum []byte, size int64, srcName string) {
+		id := vfs.BlobID(md5sum)
+		if blob, ok := blobs[id]; ok {
+			blob.Refs++
+			return
+		}
+		blobs[id] = &vfs.Blob{DocID: id, ByteSize: size, Refs: 1}
+		ops = append(ops, copyOp{srcName, vfsswift.MakeBlobName(md5sum)})
+	}
+
+	fs := inst.VFS()
+	err := vfs.WalkAlreadyLocked(fs, root, func(_ string, d *vfs.DirDoc, f *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			return nil
+		}
+		addBlob(f.MD5Sum, f.ByteSize, vfsswift.MakeObjectNameV3(f.DocID, f.InternalID))
+		versions, err := vfs.VersionsFor(inst, f.DocID)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+		for _, v := range versions {
+			parts := strings.SplitN(v.DocID, "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			addBlob(v.MD5Sum, v.ByteSize, vfsswift.MakeObjectNameV3(parts[0], parts[1]))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The thumbnails are still stored by file, and are copied as is.
+	opts := &swift.ObjectsOpts{Prefix: "thumbs/"}
+	err = c.ObjectsWalk(src, opts, func(opts *swift.ObjectsOpts) (interface{}, error) {
+		names, err := c.ObjectNames(src, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			ops = append(ops, copyOp{name, name})
+		}
+		return names, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Use a system of tokens to limit the number of simultaneous calls to
+	// Swift: only a goroutine that has a token can make a call.
+	tokens := make(chan int, maxSimultaneousCalls)
+	for k := 0; k < maxSimultaneousCalls; k++ {
+		tokens <- k
+	}
+	ch := make(chan error)
+	for _, op := range ops {
+		go func(op copyOp) {
+			k := <-tokens
+			err := utils.RetryWithExpBackoff(3, 200*time.Millisecond, func() error {
+				_, err := c.ObjectCopy(src, op.srcName, dst, op.dstName, nil)
+				return err
+			})
+			if err != nil {
+				log.Warningf("Cannot copy file from %s %s to %s %s: %s",
+					src, op.srcName, dst, op.dstName, err)
+			}
+			ch <- err
+			tokens <- k
+		}(op)
+	}
+	var errm error
+	for range ops {
+		if err := <-ch; err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	// Get back the tokens to ensure that each goroutine can finish.
+	for k := 0; k < maxSimultaneousCalls; k++ {
+		<-tokens
+	}
+	if errm != nil {
+		return errm
+	}
+
+	list := make([]*vfs.Blob, 0, len(blobs))
+	for _, blob := range blobs {
+		list = append(list, blob)
+	}
+	return vfs.CreateBlobs(inst, list)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/s3"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/ncw/swift"
 	"github.com/spf13/afero"
@@ -43,6 +44,8 @@ func SystemArchiver() Archiver {
 		return newAferoArchiver(fs)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return newSwiftArchiver()
+	case config.SchemeS3, config.SchemeS3Secure:
+		return newS3Archiver()
 	default:
 		panic(fmt.Errorf("exports: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -159,3 +162,49 @@ func (a *switfArchiver) RemoveArchives(exportDocs []*ExportDoc) error {
 	}
 	return nil
 }
+
+func newS3Archiver() Archiver {
+	return &s3Archiver{
+		c:      config.GetS3Client(),
+		bucket: config.GetS3Bucket(),
+		prefix: "exports/",
+	}
+}
+
+// s3Archiver stores the archives in the S3 bucket. There is no equivalent of
+// the X-Delete-At header of Swift, so the archives are only removed by
+// RemoveArchives.
+type s3Archiver struct {
+	c      *s3.Client
+	bucket string
+	prefix string
+}
+
+func (a *s3Archiver) key(exportDoc *ExportDoc) string {
+	return a.prefix + exportDoc.Domain + "/" + exportDoc.ID()
+}
+
+func (a *s3Archiver) OpenArchive(inst *instance.Instance, exportDoc *ExportDoc) (io.ReadCloser, int64, error) {
+	obj, err := a.c.OpenObject(a.bucket, a.key(exportDoc))
+	if err != nil {
+		return nil, 0, err
+	}
+	return obj, obj.Info.Size, nil
+}
+
+func (a *s3Archiver) CreateArchive(exportDoc *ExportDoc) (io.WriteCloser, error) {
+	return a.c.NewWriter(a.bucket, a.key(exportDoc), &s3.PutOptions{
+		ContentType: "application/tar+gzip",
+		Metadata: map[string]string{
+			"created-at": exportDoc.CreatedAt.Format(time.RFC3339),
+		},
+	}), nil
+}
+
+func (a *s3Archiver) RemoveArchives(exportDocs []*ExportDoc) error {
+	keys := make([]string, 0, len(exportDocs))
+	for _, e := range exportDocs {
+		keys = append(keys, a.key(e))
+	}
+	return a.c.DeleteObjects(a.bucket, keys)
+}
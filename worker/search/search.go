@@ -0,0 +1,97 @@
+package search
+
+import (
+	"bytes"
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/search"
+	"github.com/cozy/cozy-stack/model/vfs"
+)
+
+type filesEvent struct {
+	Verb   string            `json:"verb"`
+	Doc    vfs.DirOrFileDoc  `json:"doc"`
+	OldDoc *vfs.DirOrFileDoc `json:"old,omitempty"`
+}
+
+func init() {
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "search-index",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Reserved:     true,
+		Timeout:      1 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "search-reindex",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Reserved:     true,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   WorkerReindex,
+	})
+}
+
+// Worker is a worker that updates the search index when a file or a
+// directory is created, modified or deleted.
+func Worker(ctx *job.WorkerContext) error {
+	var event filesEvent
+	if err := ctx.UnmarshalEvent(&event); err != nil {
+		return err
+	}
+	if event.Doc.DirDoc == nil {
+		return nil
+	}
+	dir, file := event.Doc.Refine()
+	if dir != nil {
+		if event.Verb != "UPDATED" || event.OldDoc == nil || event.OldDoc.DirDoc == nil {
+			return nil
+		}
+		if dir.Fullpath == event.OldDoc.Fullpath {
+			return nil
+		}
+		doc, err := ctx.Instance.VFS().DirByID(dir.ID())
+		if err != nil {
+			return err
+		}
+		return search.UpdateDirectory(ctx.Instance, doc)
+	}
+
+	if event.Verb == "DELETED" {
+		return search.RemoveFile(ctx.Instance, file.ID())
+	}
+	if event.OldDoc != nil && event.OldDoc.DirDoc != nil {
+		if _, old := event.OldDoc.Refine(); old != nil && sameFile(file, old) {
+			return nil
+		}
+	}
+	ctx.Logger().WithField("nspace", "search").Debugf("%s %s", event.Verb, file.ID())
+	return search.IndexFile(ctx.Instance, file)
+}
+
+// sameFile returns true if the changes between the two revisions of a file
+// have no effect on the search index.
+func sameFile(doc, old *vfs.FileDoc) bool {
+	if doc.Trashed != old.Trashed || doc.DocName != old.DocName || doc.DirID != old.DirID {
+		return false
+	}
+	if len(doc.Tags) != len(old.Tags) {
+		return false
+	}
+	for i := range doc.Tags {
+		if doc.Tags[i] != old.Tags[i] {
+			return false
+		}
+	}
+	return bytes.Equal(doc.MD5Sum, old.MD5Sum)
+}
+
+// WorkerReindex is a worker that builds the search index for all the files
+// of an instance.
+func WorkerReindex(ctx *job.WorkerContext) error {
+	return search.Reindex(ctx.Instance)
+}
@@ -46,17 +46,20 @@ func init() {
 		Concurrency:  runtime.NumCPU(),
 		MaxExecCount: 2,
 		Reserved:     true,
-		Timeout:      30 * time.Second,
-		WorkerFunc:   Worker,
+		// A file that can't be converted to an image will fail again
+		NoDeadLetters: true,
+		Timeout:       30 * time.Second,
+		WorkerFunc:    Worker,
 	})
 
 	job.AddWorker(&job.WorkerConfig{
-		WorkerType:   "thumbnailck",
-		Concurrency:  runtime.NumCPU(),
-		MaxExecCount: 1,
-		Reserved:     true,
-		Timeout:      10 * time.Minute,
-		WorkerFunc:   WorkerCheck,
+		WorkerType:    "thumbnailck",
+		Concurrency:   runtime.NumCPU(),
+		MaxExecCount:  1,
+		Reserved:      true,
+		NoDeadLetters: true,
+		Timeout:       10 * time.Minute,
+		WorkerFunc:    WorkerCheck,
 	})
 }
 
@@ -1,11 +1,14 @@
 package trash
 
 import (
+	"os"
 	"runtime"
 	"time"
 
 	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/notification/center"
 	"github.com/cozy/cozy-stack/model/vfs"
+	multierror "github.com/hashicorp/go-multierror"
 )
 
 func init() {
@@ -17,6 +20,24 @@ func init() {
 		Timeout:      2 * time.Hour,
 		WorkerFunc:   WorkerTrashFiles,
 	})
+
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "trash-expiration",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Reserved:     true,
+		Timeout:      2 * time.Hour,
+		WorkerFunc:   WorkerTrashExpiration,
+	})
+
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "clean-upload",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Reserved:     true,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   WorkerCleanUpload,
+	})
 }
 
 // WorkerTrashFiles is a worker to remove files in Swift after they have been
@@ -35,3 +56,98 @@ func WorkerTrashFiles(ctx *job.WorkerContext) error {
 	}
 	return nil
 }
+
+// expirationNotice is how long before destroying the files in the trash the
+// user is warned.
+const expirationNotice = 3 * 24 * time.Hour
+
+// WorkerTrashExpiration is a worker to destroy the files and directories that
+// have been in the trash for longer than the retention period of the
+// instance. It also warns the user about the files that will be destroyed in
+// a few days. It is called every day by a @cron trigger.
+func WorkerTrashExpiration(ctx *job.WorkerContext) error {
+	inst := ctx.Instance
+	retention := inst.TrashRetention()
+	if retention <= 0 {
+		return nil
+	}
+	fs := inst.VFS()
+
+	dirs, files, err := vfs.ExpiredTrash(fs, retention)
+	if err != nil {
+		return err
+	}
+	var errm error
+	for _, dir := range dirs {
+		if err := fs.DestroyDirAndContent(dir, pushTrashJob(ctx)); err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	for _, file := range files {
+		if err := fs.DestroyFile(file); err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	if count := len(dirs) + len(files); count > 0 {
+		ctx.Logger().Infof("%d expired files and directories removed from the trash", count)
+	}
+
+	if retention > expirationNotice {
+		// The job runs once a day, so the user is warned only once for each
+		// file, when it enters the notice period.
+		to := time.Now().Add(expirationNotice - retention)
+		from := to.Add(-24 * time.Hour)
+		dirs, files, err = vfs.TrashedBetween(fs, from, to)
+		if err != nil {
+			return err
+		}
+		if count := len(dirs) + len(files); count > 0 {
+			days := int(expirationNotice / (24 * time.Hour))
+			if err := center.PushTrashExpiration(inst, count, days); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+	}
+	return errm
+}
+
+func pushTrashJob(ctx *job.WorkerContext) func(vfs.TrashJournal) error {
+	return func(journal vfs.TrashJournal) error {
+		msg, err := job.NewMessage(journal)
+		if err != nil {
+			return err
+		}
+		_, err = job.System().PushJob(ctx.Instance, &job.JobRequest{
+			WorkerType: "trash-files",
+			Message:    msg,
+		})
+		return err
+	}
+}
+
+// WorkerCleanUpload is a worker to remove the chunks of a resumable upload
+// that has expired before being finished.
+func WorkerCleanUpload(ctx *job.WorkerContext) error {
+	var msg vfs.CleanUploadMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	fs := ctx.Instance.VFS()
+	u, err := vfs.GetUploadSession(fs, msg.UploadID)
+	if os.IsNotExist(err) {
+		// The upload has been finished or aborted
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !u.Expired() {
+		return nil
+	}
+	ctx.Logger().Infof("Clean the expired upload %s", u.ID())
+	err = vfs.AbortUpload(fs, u.ID())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
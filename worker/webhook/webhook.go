@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/tlsclient"
+)
+
+const (
+	// EventHeader is the HTTP header with the verb of the event.
+	EventHeader = "X-Cozy-Event"
+	// DeliveryHeader is the HTTP header with the identifier of the delivery.
+	// It is the same for all the attempts, so that the receiver can ignore
+	// the duplicates.
+	DeliveryHeader = "X-Cozy-Delivery"
+
+	// requestTimeout is the maximal duration of a request to a webhook.
+	requestTimeout = 20 * time.Second
+	// maxResponseSize is the size of the response that is read (and ignored),
+	// so that the connection can be reused.
+	maxResponseSize = 64 * 1024
+)
+
+var client *http.Client
+
+func init() {
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   job.WebhookWorkerType,
+		Concurrency:  runtime.NumCPU() * 4,
+		MaxExecCount: 1,
+		Timeout:      30 * time.Second,
+		WorkerInit:   Init,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Init initializes the HTTP client used to call the webhooks.
+func Init() (err error) {
+	client, _, err = tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
+		Timeout:             requestTimeout,
+		MaxIdleConnsPerHost: 2,
+		PublicIPsOnly:       !config.GetConfig().Jobs.AllowPrivateWebhooks,
+	})
+	if err != nil {
+		return err
+	}
+	// The requests are signed for the registered URL only
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// event is the realtime event of the job, as it is given by the @event
+// trigger.
+type event struct {
+	ID      string          `json:"id"`
+	Verb    string          `json:"verb"`
+	DocType string          `json:"doctype"`
+	Doc     json.RawMessage `json:"doc"`
+	OldDoc  json.RawMessage `json:"old,omitempty"`
+}
+
+// Payload is the JSON body of the requests sent to the webhooks.
+type Payload struct {
+	TriggerID string          `json:"trigger_id"`
+	Domain    string          `json:"domain"`
+	EventID   string          `json:"event_id,omitempty"`
+	Verb      string          `json:"verb"`
+	DocType   string          `json:"doctype"`
+	Doc       json.RawMessage `json:"doc"`
+	OldDoc    json.RawMessage `json:"old,omitempty"`
+}
+
+// Worker is the worker that sends an event to an outgoing webhook. The
+// request is signed with the secret of the trigger, and the delivery is saved
+// in its log.
+func Worker(ctx *job.WorkerContext) error {
+	triggerID, ok := ctx.TriggerID()
+	if !ok {
+		return job.ErrBadTrigger{Err: errors.New("webhook: the job has no trigger")}
+	}
+	t, err := job.System().GetTrigger(ctx.Instance, triggerID)
+	if err != nil {
+		if err == job.ErrNotFoundTrigger {
+			return job.ErrBadTrigger{Err: err}
+		}
+		return err
+	}
+	infos := t.Infos()
+	if infos.Outgoing == nil {
+		return job.ErrBadTrigger{Err: job.ErrMalformedTrigger}
+	}
+	if infos.Disabled() {
+		ctx.Logger().Infof("The webhook of trigger %s is disabled", triggerID)
+		return nil
+	}
+
+	var msg job.WebhookMessage
+	if err = ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	var evt event
+	if err = ctx.UnmarshalEvent(&evt); err != nil {
+		return err
+	}
+	body, err := json.Marshal(Payload{
+		TriggerID: triggerID,
+		Domain:    ctx.Instance.Domain,
+		EventID:   evt.ID,
+		Verb:      evt.Verb,
+		DocType:   evt.DocType,
+		Doc:       evt.Doc,
+		OldDoc:    evt.OldDoc,
+	})
+	if err != nil {
+		return err
+	}
+
+	delivery := &job.WebhookDelivery{
+		JobID:   ctx.JobID(),
+		EventID: evt.ID,
+		Attempt: ctx.Retries() + 1,
+		At:      time.Now().UTC(),
+	}
+	status, errSend := send(ctx, msg.URL, infos.Outgoing.Secret, evt.Verb, ctx.JobID(), body)
+	delivery.Duration = time.Since(delivery.At).Milliseconds()
+	delivery.StatusCode = status
+
+	// A 410 Gone response means that the receiver doesn't want the events
+	// anymore, and the other client errors won't be fixed by a retry.
+	disable := status == http.StatusGone
+	if status >= 400 && status < 500 && status != http.StatusRequestTimeout &&
+		status != http.StatusTooManyRequests {
+		ctx.SetNoRetry()
+	}
+	if errSend != nil {
+		delivery.Error = errSend.Error()
+	}
+
+	disabled, err := job.RecordWebhookDelivery(ctx.Instance, triggerID, delivery, disable)
+	if err != nil {
+		ctx.Logger().Warnf("Cannot save the delivery of the webhook: %s", err)
+	}
+	if disabled {
+		ctx.Logger().Infof("The webhook of trigger %s has been disabled", triggerID)
+		ctx.SetNoRetry()
+	}
+	if err := ctx.SetResult(delivery); err != nil {
+		ctx.Logger().Warnf("Cannot set the result of the job: %s", err)
+	}
+	return errSend
+}
+
+// send makes the POST request to the webhook, and returns the status code of
+// the response. An error is returned if the request has failed or if the
+// status code is not 2xx.
+func send(ctx *job.WorkerContext, url, secret, verb, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(job.WebhookSignatureHeader, job.SignWebhookPayload(secret, body))
+	req.Header.Set(EventHeader, verb)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxResponseSize))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("webhook: unexpected status code %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
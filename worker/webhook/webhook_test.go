@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/tlsclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSend(t *testing.T) {
+	body := []byte(`{"verb":"CREATED","doctype":"io.cozy.files"}`)
+	status := http.StatusNoContent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "CREATED", r.Header.Get(EventHeader))
+		assert.Equal(t, "job-id", r.Header.Get(DeliveryHeader))
+		received, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, body, received)
+		signature := r.Header.Get(job.WebhookSignatureHeader)
+		assert.Equal(t, job.SignWebhookPayload("secret", received), signature)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	ctx := job.NewWorkerContext("0", &job.Job{JobID: "job-id", Domain: "cozy.example.net"}, nil)
+
+	// The test server listens on a loopback address
+	config.GetConfig().Jobs.AllowPrivateWebhooks = false
+	assert.NoError(t, Init())
+	code, err := send(ctx, ts.URL, "secret", "CREATED", "job-id", body)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), tlsclient.ErrPrivateIP.Error())
+	assert.Equal(t, 0, code)
+
+	config.GetConfig().Jobs.AllowPrivateWebhooks = true
+	assert.NoError(t, Init())
+	code, err = send(ctx, ts.URL, "secret", "CREATED", "job-id", body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	status = http.StatusGone
+	code, err = send(ctx, ts.URL, "secret", "CREATED", "job-id", body)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusGone, code)
+
+	ts.Close()
+	code, err = send(ctx, ts.URL, "secret", "CREATED", "job-id", body)
+	assert.Error(t, err)
+	assert.Equal(t, 0, code)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	os.Exit(m.Run())
+}